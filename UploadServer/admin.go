@@ -0,0 +1,374 @@
+/*! @file admin.go
+ * @brief Administration API for the upload server
+ *
+ * Operators manage the server through a JSON API under /admin/v1.  Each end-point requires a
+ * minimum role (see support/middleware.go): viewers can see the state of the fleet, operators
+ * can take routine actions on loggers and uploads, and admins can additionally manage credentials
+ * and delete data.  The role for each end-point is declared in adminRoutes() so that the access
+ * policy can be reviewed in one place.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Register the administration API end-points, along with the minimum role required for each.
+func (app *application) adminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /admin/v1/login",
+		support.RateLimit(app.state, "login", app.loginLimit, support.RemoteHost, app.login))
+	mux.HandleFunc("POST /admin/v1/logout", support.RequireLogin(app.admin, app.logout))
+	mux.HandleFunc("POST /admin/v1/password", support.RequireLogin(app.admin, app.changePassword))
+
+	mux.HandleFunc("GET /admin/v1/whoami", app.authorize(support.RoleViewer, app.whoami))
+	mux.HandleFunc("GET /admin/v1/loggers", app.authorize(support.RoleViewer, app.listLoggers))
+	mux.HandleFunc("GET /admin/v1/loggers/{id}", app.authorize(support.RoleViewer, app.getLogger))
+	mux.HandleFunc("PATCH /admin/v1/loggers/{id}", app.authorize(support.RoleOperator, app.updateLogger))
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/approve", app.authorize(support.RoleAdmin, app.approveLogger))
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/provision", app.authorize(support.RoleAdmin, app.provisionLogger))
+	mux.HandleFunc("GET /admin/v1/live", app.authorize(support.RoleViewer, app.liveEvents))
+	mux.HandleFunc("GET /admin/v1/live/{logger}", app.authorize(support.RoleViewer, app.liveEvents))
+	mux.HandleFunc("GET /admin/v1/loggers/{id}/requests", app.authorize(support.RoleAdmin, app.listCaptured))
+	mux.HandleFunc("DELETE /admin/v1/loggers/{id}/requests", app.authorize(support.RoleAdmin, app.clearCaptured))
+	mux.HandleFunc("GET /admin/v1/loggers/{id}/reconciliation", app.authorize(support.RoleViewer, app.getReconciliation))
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/resend", app.authorize(support.RoleOperator, app.requestResend))
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/upload", app.authorize(support.RoleOperator, app.requestUpload))
+	mux.HandleFunc("GET /admin/v1/loggers/{id}/commands", app.authorize(support.RoleViewer, app.listCommands))
+	mux.HandleFunc("DELETE /admin/v1/loggers/{id}/commands/{command}", app.authorize(support.RoleOperator, app.cancelCommand))
+
+	mux.HandleFunc("GET /admin/v1/vessels", app.authorize(support.RoleViewer, app.listVessels))
+	mux.HandleFunc("GET /admin/v1/vessels/{id}", app.authorize(support.RoleViewer, app.getVessel))
+	mux.HandleFunc("POST /admin/v1/vessels", app.authorize(support.RoleOperator, app.addVessel))
+	mux.HandleFunc("PUT /admin/v1/vessels/{id}", app.authorize(support.RoleOperator, app.replaceVessel))
+	mux.HandleFunc("DELETE /admin/v1/vessels/{id}", app.authorize(support.RoleAdmin, app.deleteVessel))
+
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/tags", app.authorize(support.RoleOperator, app.tagLogger))
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/notes", app.authorize(support.RoleOperator, app.noteLogger))
+	mux.HandleFunc("GET /admin/v1/loggers/{id}/maintenance", app.authorize(support.RoleViewer, app.listMaintenance))
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/maintenance", app.authorize(support.RoleOperator, app.addMaintenance))
+	mux.HandleFunc("PUT /admin/v1/loggers/{id}/maintenance/{entry}", app.authorize(support.RoleOperator, app.replaceMaintenance))
+	mux.HandleFunc("DELETE /admin/v1/loggers/{id}/maintenance/{entry}", app.authorize(support.RoleOperator, app.deleteMaintenance))
+	mux.HandleFunc("POST /admin/v1/files/{uuid}/tags", app.authorize(support.RoleOperator, app.tagUpload))
+	mux.HandleFunc("POST /admin/v1/files/{uuid}/notes", app.authorize(support.RoleOperator, app.noteUpload))
+	mux.HandleFunc("PUT /admin/v1/files/{uuid}/state", app.authorize(support.RoleOperator, app.setProcessingState))
+	mux.HandleFunc("GET /admin/v1/loggers/{id}/export", app.authorize(support.RoleOperator, app.exportLoggerFiles))
+	mux.HandleFunc("POST /admin/v1/loggers/{id}/purge", app.authorize(support.RoleAdmin, app.requestPurge))
+	mux.HandleFunc("DELETE /admin/v1/loggers/{id}/data", app.authorize(support.RoleAdmin, app.purgeLogger))
+	mux.HandleFunc("GET /admin/v1/holds", app.authorize(support.RoleViewer, app.listHolds))
+	mux.HandleFunc("PUT /admin/v1/holds/{kind}/{target}", app.authorize(support.RoleAdmin, app.placeHold))
+	mux.HandleFunc("DELETE /admin/v1/holds/{kind}/{target}", app.authorize(support.RoleAdmin, app.releaseHold))
+
+	mux.HandleFunc("GET /admin/v1/tokens", app.authorize(support.RoleAdmin, app.listTokens))
+	mux.HandleFunc("GET /admin/v1/logger-sessions", app.authorize(support.RoleViewer, app.listLoggerSessions))
+	mux.HandleFunc("GET /admin/v1/upload-sessions", app.authorize(support.RoleViewer, app.listUploadSessions))
+	mux.HandleFunc("POST /admin/v1/tokens", app.authorize(support.RoleAdmin, app.mintToken))
+	mux.HandleFunc("DELETE /admin/v1/tokens/{id}", app.authorize(support.RoleAdmin, app.revokeToken))
+	mux.HandleFunc("GET /admin/v1/enrolment-codes", app.authorize(support.RoleOperator, app.listEnrolmentCodes))
+	mux.HandleFunc("POST /admin/v1/enrolment-codes", app.authorize(support.RoleAdmin, app.mintEnrolmentCode))
+	mux.HandleFunc("DELETE /admin/v1/enrolment-codes/{id}", app.authorize(support.RoleOperator, app.revokeEnrolmentCode))
+	mux.HandleFunc("GET /admin/v1/users", app.authorize(support.RoleAdmin, app.listUsers))
+	mux.HandleFunc("POST /admin/v1/users", app.authorize(support.RoleAdmin, app.addUser))
+	mux.HandleFunc("DELETE /admin/v1/users/{name}", app.authorize(support.RoleAdmin, app.deleteUser))
+	mux.HandleFunc("POST /admin/v1/users/{name}/reset", app.authorize(support.RoleAdmin, app.resetPassword))
+
+	mux.HandleFunc("GET /admin/v1/stats", app.authorize(support.RoleViewer, app.fleetStats))
+	mux.HandleFunc("GET /admin/v1/fleet/firmware", app.authorize(support.RoleViewer, app.firmwareCompliance))
+	mux.HandleFunc("GET /admin/v1/fleet/status-warnings", app.authorize(support.RoleViewer, app.statusWarnings))
+	mux.HandleFunc("GET /admin/v1/fleet/positions", app.authorize(support.RoleViewer, app.fleetPositions))
+	mux.HandleFunc("GET /admin/v1/fleet/export", app.authorize(support.RoleViewer, app.exportFleet))
+	mux.HandleFunc("POST /admin/v1/fleet/import", app.authorize(support.RoleAdmin, app.importFleet))
+	mux.HandleFunc("GET /admin/v1/coverage", app.authorize(support.RoleViewer, app.coverageSummary))
+	mux.HandleFunc("GET /admin/v1/usage", app.authorize(support.RoleViewer, app.listUsage))
+	mux.HandleFunc("GET /admin/v1/alerts", app.authorize(support.RoleViewer, app.listAlerts))
+	mux.HandleFunc("GET /admin/v1/deadletters", app.authorize(support.RoleViewer, app.listDeadLetters))
+	mux.HandleFunc("POST /admin/v1/deadletters/{uuid}/redrive", app.authorize(support.RoleOperator, app.redriveDeadLetter))
+	mux.HandleFunc("DELETE /admin/v1/deadletters/{uuid}", app.authorize(support.RoleOperator, app.discardDeadLetter))
+	mux.HandleFunc("GET /admin/v1/quarantine", app.authorize(support.RoleViewer, app.listQuarantine))
+	mux.HandleFunc("GET /admin/v1/quarantine/{id}", app.authorize(support.RoleViewer, app.getQuarantined))
+	mux.HandleFunc("DELETE /admin/v1/quarantine/{id}", app.authorize(support.RoleOperator, app.discardQuarantined))
+	mux.HandleFunc("GET /admin/v1/jobs", app.authorize(support.RoleViewer, app.listJobs))
+	mux.HandleFunc("POST /admin/v1/jobs/{name}/run", app.authorize(support.RoleOperator, app.runJob))
+	mux.HandleFunc("GET /admin/v1/cluster", app.authorize(support.RoleViewer, app.clusterStatus))
+	mux.HandleFunc("GET /admin/v1/routes", app.authorize(support.RoleViewer, app.listRoutes))
+	mux.HandleFunc("GET /admin/v1/federation", app.authorize(support.RoleViewer, app.listDownstreams))
+	mux.HandleFunc("GET /admin/v1/features", app.authorize(support.RoleViewer, app.listFeatures))
+	mux.HandleFunc("GET /admin/v1/mock", app.authorize(support.RoleViewer, app.mockStatus))
+	mux.HandleFunc("GET /admin/v1/settings", app.authorize(support.RoleViewer, app.getSettings))
+	mux.HandleFunc("PATCH /admin/v1/settings", app.authorize(support.RoleAdmin, app.updateSettings))
+	mux.HandleFunc("GET /admin/v1/drain", app.authorize(support.RoleViewer, app.getDrain))
+	mux.HandleFunc("POST /admin/v1/drain", app.authorize(support.RoleOperator, app.startDrain))
+	mux.HandleFunc("DELETE /admin/v1/drain", app.authorize(support.RoleOperator, app.stopDrain))
+	mux.HandleFunc("GET /admin/v1/reports/usage", app.authorize(support.RoleOperator, app.usageReport))
+	mux.HandleFunc("GET /admin/v1/export/audit", app.authorize(support.RoleAdmin, app.exportAudit))
+	mux.HandleFunc("GET /admin/v1/export/uploads", app.authorize(support.RoleAdmin, app.exportUploads))
+}
+
+// Wrap an administration API handler so that it's only available to principals with at least
+// the role given.
+func (app *application) authorize(role support.Role, next http.HandlerFunc) http.HandlerFunc {
+	return support.RequireRole(app.admin, role, next)
+}
+
+// Report the experimental features that the server knows about, and which are enabled.
+func (app *application) listFeatures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.config.FeatureList())
+}
+
+// Report the principal that made the request, so that clients can check their credentials.
+func (app *application) whoami(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, support.CurrentPrincipal(r))
+}
+
+// A loggerView combines what a logger has reported about itself with what the registry holds.
+type loggerView struct {
+	support.LoggerStatus
+	Registry *support.LoggerRecord `json:"registry,omitempty"`
+	Usage    usageView             `json:"usage"`
+}
+
+func (app *application) loggerView(id string) (loggerView, bool) {
+	status, reported := app.fleet.Get(id)
+	status.LoggerID = id
+	view := loggerView{LoggerStatus: status, Usage: app.usageView(app.uploads.Usage(id))}
+	if record, ok := app.registry.Get(id); ok {
+		view.Registry = &record
+	}
+	return view, reported || view.Registry != nil
+}
+
+// Report the state of all loggers that have checked in or are in the registry.  The "tag" query
+// parameter restricts the list to loggers with that tag in the registry.
+func (app *application) listLoggers(w http.ResponseWriter, r *http.Request) {
+	ids := make(map[string]bool)
+	for _, status := range app.fleet.List() {
+		ids[status.LoggerID] = true
+	}
+	for _, record := range app.registry.List() {
+		ids[record.ID] = true
+	}
+	tag := r.URL.Query().Get("tag")
+	rtn := make([]loggerView, 0, len(ids))
+	for id := range ids {
+		view, _ := app.loggerView(id)
+		if len(tag) > 0 && (view.Registry == nil || !support.HasTag(view.Registry.Tags, tag)) {
+			continue
+		}
+		rtn = append(rtn, view)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].LoggerID < rtn[j].LoggerID })
+	writeJSON(w, http.StatusOK, rtn)
+}
+
+// Report the state of a single logger.
+func (app *application) getLogger(w http.ResponseWriter, r *http.Request) {
+	view, ok := app.loggerView(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "logger has not checked in and is not registered")
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// List the most recent raw requests from a logger, if request capture is enabled in the configuration
+// (see support/capture.go).  These can contain data from the logger, so are only available to admins.
+func (app *application) listCaptured(w http.ResponseWriter, r *http.Request) {
+	if !app.capture.Enabled() {
+		writeError(w, http.StatusNotFound, "request capture is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, app.capture.Get(r.PathValue("id")))
+}
+
+// Discard the raw requests captured from a logger.
+func (app *application) clearCaptured(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	app.capture.Clear(id)
+	app.recordAction(r, "logger.clear-requests", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Change the registry information for a logger, registering it if necessary.
+func (app *application) updateLogger(w http.ResponseWriter, r *http.Request) {
+	var request api.LoggerUpdate
+	if !readJSON(w, r, &request) {
+		return
+	}
+	id := r.PathValue("id")
+	var changes []string
+	record, err := app.registry.Update(id, func(l *support.LoggerRecord) error {
+		if request.Tenant != nil {
+			tenant := strings.TrimSpace(*request.Tenant)
+			if len(tenant) > 64 {
+				return errors.New("tenant must be no more than 64 characters")
+			}
+			l.Tenant = tenant
+			changes = append(changes, "tenant="+tenant)
+		}
+		if request.Vessel != nil {
+			if _, ok := app.vessels.Get(*request.Vessel); !ok && len(*request.Vessel) > 0 {
+				return errors.New("no such vessel")
+			}
+			l.Vessel = *request.Vessel
+			changes = append(changes, "vessel="+l.Vessel)
+		}
+		if request.Profile != nil {
+			if _, ok := app.config.Transfer.Profiles[*request.Profile]; !ok && len(*request.Profile) > 0 {
+				return errors.New("no such transfer profile")
+			}
+			l.Profile = *request.Profile
+			changes = append(changes, "profile="+l.Profile)
+		}
+		if hours := request.Hours; hours != nil {
+			if len(hours.Periods) == 0 {
+				l.Hours = nil
+				changes = append(changes, "upload-hours=any")
+			} else if err := support.ValidateUploadHours(hours); err != nil {
+				return err
+			} else {
+				l.Hours = hours
+				changes = append(changes, "upload-hours="+uploadHoursText(hours))
+			}
+		}
+		if request.Checkin != nil {
+			if *request.Checkin < 0 || *request.Checkin > maxCheckinMinutes {
+				return fmt.Errorf("checkin interval must be between 0 and %d minutes", maxCheckinMinutes)
+			}
+			l.Checkin = *request.Checkin
+			changes = append(changes, fmt.Sprintf("checkin-minutes=%d", l.Checkin))
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	app.recordAction(r, "logger.update", id, strings.Join(changes, " "))
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Report the upload tokens that the server accepts (hashes only).
+func (app *application) listTokens(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.tokens.List())
+}
+
+// Mint a new upload token, returning the plain-text token to the caller.
+func (app *application) mintToken(w http.ResponseWriter, r *http.Request) {
+	var request api.MintTokenRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if len(request.Logger) == 0 {
+		writeError(w, http.StatusBadRequest, "tokens must be minted for a logger")
+		return
+	}
+	token, record, err := app.tokens.Mint(request.Logger, request.Description)
+	if err != nil {
+		support.Errorf("ADMIN: failed to mint upload token: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to mint token")
+		return
+	}
+	app.recordAction(r, "token.mint", record.ID, record.Description)
+	writeJSON(w, http.StatusCreated, api.MintTokenResponse{
+		ID:          record.ID,
+		Token:       token,
+		Logger:      record.Logger,
+		Description: record.Description,
+		Created:     record.Created,
+		Expires:     record.Expires,
+	})
+}
+
+// Revoke an upload token, so that loggers using it can no longer connect.
+func (app *application) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := app.tokens.Revoke(id); err != nil {
+		if errors.Is(err, support.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "no such token")
+		} else {
+			support.Errorf("ADMIN: failed to revoke upload token %s: %s\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed to revoke token")
+		}
+		return
+	}
+	app.recordAction(r, "token.revoke", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Record an administrative action in the audit trail, attributed to the principal that made
+// the request.
+func (app *application) recordAction(r *http.Request, action, target, detail string) {
+	principal := support.CurrentPrincipal(r)
+	support.Infof("ADMIN: %s: %s %s %s\n", principal.Name, action, target, detail)
+	app.audit.Record(principal.Name, r.RemoteAddr, action, target, detail)
+}
+
+// Encode the value given as JSON in the response, with the status code given.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		support.Errorf("API: failed to encode JSON response: %s\n", err)
+	}
+}
+
+// Generate a JSON-encoded error response with the status code given.
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, api.ErrorResponse{Error: message})
+}
+
+// Decode the JSON body of a request into the value given.  On failure, an error response is
+// written and false is returned, so that the handler can simply return.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// Report the alerts raised in the time range given by the "from" and "to" query parameters.
+func (app *application) listAlerts(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	rtn := make([]support.Alert, 0)
+	err := app.alerts.Scan(from, to, func(alert support.Alert) error {
+		rtn = append(rtn, alert)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read alerts")
+		return
+	}
+	writeJSON(w, http.StatusOK, rtn)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The administration API keys that the test application accepts, by role.
+const (
+	viewerToken   = "viewer-token"
+	operatorToken = "operator-token"
+	adminToken    = "admin-token"
+	tenantToken   = "tenant-token" // A viewer restricted to the "survey" tenant
+)
+
+// Generate an application with in-memory storage and its state in a temporary directory, along
+// with a key for each role.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	config := support.NewDefaultConfig()
+	config.State.Directory = t.TempDir()
+	config.Mock = true
+	config.Admin.Keys = []support.AdminKey{
+		{Name: "viewer", Token: viewerToken, Role: "viewer"},
+		{Name: "operator", Token: operatorToken, Role: "operator"},
+		{Name: "admin", Token: adminToken, Role: "admin"},
+		{Name: "tenant", Token: tenantToken, Role: "viewer", Tenant: "survey"},
+	}
+	app, err := newApplication(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.stop)
+	return app
+}
+
+// Send a request to the application's handler, returning the response.
+func serve(app *application, method, target, authorization, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(authorization) > 0 {
+		r.Header.Set("Authorization", authorization)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	app := newTestApplication(t)
+	tests := []struct {
+		method, target string
+		required       support.Role
+	}{
+		{"GET", "/admin/v1/whoami", support.RoleViewer},
+		{"GET", "/admin/v1/loggers", support.RoleViewer},
+		{"GET", "/admin/v1/usage", support.RoleViewer},
+		{"PATCH", "/admin/v1/loggers/L1", support.RoleOperator},
+		{"POST", "/admin/v1/loggers/L1/tags", support.RoleOperator},
+		{"GET", "/admin/v1/enrolment-codes", support.RoleOperator},
+		{"GET", "/admin/v1/reports/usage", support.RoleOperator},
+		{"POST", "/admin/v1/enrolment-codes", support.RoleAdmin},
+		{"POST", "/admin/v1/loggers/L1/approve", support.RoleAdmin},
+		{"POST", "/admin/v1/loggers/L1/provision", support.RoleAdmin},
+		{"POST", "/admin/v1/loggers/L1/purge", support.RoleAdmin},
+		{"DELETE", "/admin/v1/loggers/L1/data", support.RoleAdmin},
+		{"GET", "/admin/v1/tokens", support.RoleAdmin},
+		{"POST", "/admin/v1/tokens", support.RoleAdmin},
+		{"GET", "/admin/v1/users", support.RoleAdmin},
+		{"PATCH", "/admin/v1/settings", support.RoleAdmin},
+		{"GET", "/admin/v1/export/audit", support.RoleAdmin},
+	}
+	principals := []struct {
+		token string
+		role  support.Role
+	}{
+		{viewerToken, support.RoleViewer},
+		{operatorToken, support.RoleOperator},
+		{adminToken, support.RoleAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			if w := serve(app, tt.method, tt.target, "", "{}"); w.Code != http.StatusUnauthorized {
+				t.Errorf("without credentials: status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if w := serve(app, tt.method, tt.target, "Bearer no-such-token", "{}"); w.Code != http.StatusUnauthorized {
+				t.Errorf("with an unknown token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			for _, p := range principals {
+				w := serve(app, tt.method, tt.target, "Bearer "+p.token, "{}")
+				denied := w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden
+				if allowed := p.role >= tt.required; allowed == denied {
+					t.Errorf("as %s: status = %d, want allowed = %v", p.role, w.Code, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestFileAuthorization(t *testing.T) {
+	app := newTestApplication(t)
+	own, _, err := app.tokens.Mint("L1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := app.tokens.Mint("L2", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.registry.Update("L1", func(l *support.LoggerRecord) error {
+		l.Tenant = "survey"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []support.UploadRecord{
+		{UUID: "u1", Logger: "L1", Status: support.UploadAccepted},
+		{UUID: "u2", Logger: "L2", Status: support.UploadAccepted},
+	} {
+		if err := app.uploads.Put(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	basic := func(logger, token string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(logger, token)
+		return r.Header.Get("Authorization")
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		files         []string // Files listed, or nil if the listing is refused
+	}{
+		{"no credentials", "", http.StatusUnauthorized, nil},
+		{"unknown bearer token", "Bearer no-such-token", http.StatusUnauthorized, nil},
+		{"viewer", "Bearer " + viewerToken, http.StatusOK, []string{"u1", "u2"}},
+		{"viewer in tenant", "Bearer " + tenantToken, http.StatusOK, []string{"u1"}},
+		{"logger", basic("L1", own), http.StatusOK, []string{"u1"}},
+		{"logger with another's token", basic("L2", own), http.StatusUnauthorized, nil},
+		{"logger with a bad token", basic("L1", "nope"), http.StatusUnauthorized, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(app, "GET", "/v1/files", tt.authorization, "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			for _, uuid := range []string{"u1", "u2"} {
+				listed := strings.Contains(w.Body.String(), `"`+uuid+`"`)
+				if want := slices.Contains(tt.files, uuid); listed != want {
+					t.Errorf("%s listed = %v, want %v", uuid, listed, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+/*! @file annotate.go
+ * @brief Tags and notes on uploads and loggers
+ *
+ * Operators often know things about the data that the server can't (e.g., "bad depth offset", or
+ * "calibration run"), and that need to travel with it.  These end-points allow tags and free-text
+ * notes to be attached to uploads and to loggers; they persist with the records, and so appear in
+ * listings and exports.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Add and remove tags on an upload.
+func (app *application) tagUpload(w http.ResponseWriter, r *http.Request) {
+	var request api.TagUpdate
+	if !readJSON(w, r, &request) {
+		return
+	}
+	uuid := r.PathValue("uuid")
+	record, err := app.uploads.Update(uuid, func(u *support.UploadRecord) (err error) {
+		if u.Tags, err = support.UpdateTags(u.Tags, request.Add, request.Remove); err != nil {
+			err = annotationError{err}
+		}
+		return
+	})
+	if !app.annotationResult(w, err, "file", uuid) {
+		return
+	}
+	app.recordAction(r, "file.tag", uuid, tagDetail(request))
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Add a note to an upload.
+func (app *application) noteUpload(w http.ResponseWriter, r *http.Request) {
+	var request api.NoteRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	uuid := r.PathValue("uuid")
+	note, err := support.NewNote(support.CurrentPrincipal(r).Name, request.Text)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	record, err := app.uploads.Update(uuid, func(u *support.UploadRecord) error {
+		u.Notes = append(u.Notes, note)
+		return nil
+	})
+	if !app.annotationResult(w, err, "file", uuid) {
+		return
+	}
+	app.recordAction(r, "file.note", uuid, "")
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Add and remove tags on a logger.
+func (app *application) tagLogger(w http.ResponseWriter, r *http.Request) {
+	var request api.TagUpdate
+	if !readJSON(w, r, &request) {
+		return
+	}
+	id := r.PathValue("id")
+	if !app.annotationLogger(w, id) {
+		return
+	}
+	record, err := app.registry.Update(id, func(l *support.LoggerRecord) (err error) {
+		if l.Tags, err = support.UpdateTags(l.Tags, request.Add, request.Remove); err != nil {
+			err = annotationError{err}
+		}
+		return
+	})
+	if !app.annotationResult(w, err, "logger", id) {
+		return
+	}
+	app.recordAction(r, "logger.tag", id, tagDetail(request))
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Add a note to a logger.
+func (app *application) noteLogger(w http.ResponseWriter, r *http.Request) {
+	var request api.NoteRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	id := r.PathValue("id")
+	if !app.annotationLogger(w, id) {
+		return
+	}
+	note, err := support.NewNote(support.CurrentPrincipal(r).Name, request.Text)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	record, err := app.registry.Update(id, func(l *support.LoggerRecord) error {
+		l.Notes = append(l.Notes, note)
+		return nil
+	})
+	if !app.annotationResult(w, err, "logger", id) {
+		return
+	}
+	app.recordAction(r, "logger.note", id, "")
+	writeJSON(w, http.StatusOK, record)
+}
+
+// An annotationError marks a change that was refused because of what was asked for (e.g., a tag
+// that's too long), rather than because it couldn't be saved.
+type annotationError struct {
+	error
+}
+
+// Check that the logger given is registered before annotating it (since Registry.Update() would
+// otherwise create it), returning true if it is.
+func (app *application) annotationLogger(w http.ResponseWriter, id string) bool {
+	if _, ok := app.registry.Get(id); !ok {
+		writeError(w, http.StatusNotFound, "no such logger")
+		return false
+	}
+	return true
+}
+
+// Write an error response for a failed annotation of the file or logger given, returning true if
+// there was no error.
+func (app *application) annotationResult(w http.ResponseWriter, err error, kind, id string) bool {
+	var refused annotationError
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such "+kind)
+	case errors.As(err, &refused):
+		writeError(w, http.StatusBadRequest, refused.Error())
+	default:
+		support.Errorf("ADMIN: failed to save annotation for %s %s: %s\n", kind, id, err)
+		writeError(w, http.StatusInternalServerError, "failed to save annotation")
+	}
+	return false
+}
+
+func tagDetail(request api.TagUpdate) string {
+	var parts []string
+	if len(request.Add) > 0 {
+		parts = append(parts, "+"+strings.Join(request.Add, ",+"))
+	}
+	if len(request.Remove) > 0 {
+		parts = append(parts, "-"+strings.Join(request.Remove, ",-"))
+	}
+	return strings.Join(parts, " ")
+}
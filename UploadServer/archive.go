@@ -0,0 +1,119 @@
+/*! @file archive.go
+ * @brief Confirmation of processing, and archiving of processed files
+ *
+ * Raw files are rarely needed once the processing chain has dealt with them, so they don't need to
+ * stay in hot storage.  The processing chain confirms that it has processed a file by setting the
+ * upload's processing state, and the archive job then moves files that were processed long enough
+ * ago to the archive storage class in the configuration (e.g., GLACIER), where the backend supports
+ * storage classes (i.e., S3).  Archived files can't be read back (for downloads or integrity checks)
+ * until they're restored by other means.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Set the processing state of an upload.  The only change that can be made is to "processed", for
+// files that are stored (and not damaged), including those that the processing chain failed on.
+func (app *application) setProcessingState(w http.ResponseWriter, r *http.Request) {
+	var request api.StateUpdate
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.State != support.StateProcessed {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("state can only be set to %q", support.StateProcessed))
+		return
+	}
+	uuid := r.PathValue("uuid")
+	errNotStored := errors.New("file is not stored, or is damaged")
+	record, err := app.uploads.Update(uuid, func(u *support.UploadRecord) error {
+		switch u.State {
+		case support.StateProcessed:
+			return nil
+		case support.StateStored, support.StateQueued, support.StateFailed:
+			now := time.Now().UTC()
+			u.State, u.Processed = support.StateProcessed, &now
+			return nil
+		}
+		return errNotStored
+	})
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such file")
+		return
+	case errors.Is(err, errNotStored):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to set processing state of %s: %s\n", uuid, err)
+		writeError(w, http.StatusInternalServerError, "failed to update file")
+		return
+	}
+	app.recordAction(r, "file.processed", uuid, "")
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Move files that were processed more than the configured number of days ago to the archive storage
+// class.
+func (app *application) archiveJob(ctx context.Context) (string, error) {
+	archive := app.config.Storage.Archive
+	if len(archive.Class) == 0 {
+		return "archiving is not configured", nil
+	}
+	cutoff := time.Now().Add(-time.Duration(archive.AfterDays) * 24 * time.Hour)
+	due := app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.State == support.StateProcessed && u.Archived == nil && u.Processed != nil && u.Processed.Before(cutoff)
+	})
+	var archived, failed int
+	for _, u := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := storage.SetClass(ctx, app.storage, u.Key, archive.Class); err != nil {
+			support.Errorf("ARCHIVE: failed to move %s to %s: %s\n", u.Key, archive.Class, err)
+			failed++
+			if errors.Is(err, storage.ErrUnsupported) {
+				break
+			}
+			continue
+		}
+		_, err := app.uploads.Update(u.UUID, func(u *support.UploadRecord) error {
+			now := time.Now().UTC()
+			u.Archived = &now
+			return nil
+		})
+		if err != nil {
+			support.Errorf("ARCHIVE: failed to record archiving of %s: %s\n", u.UUID, err)
+		}
+		archived++
+	}
+	return fmt.Sprintf("archived %d files to %s (%d failures)", archived, archive.Class, failed), ctx.Err()
+}
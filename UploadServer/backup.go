@@ -0,0 +1,294 @@
+/*! @file backup.go
+ * @brief Backing up and restoring the server's state
+ *
+ * A shore-station box that fails takes the registry, upload history, tokens, and keys with it.  The
+ * "backup" command writes an archive of the state directory and the configuration (see
+ * support/backup.go) to a file, or to the storage backend under the backup prefix; if the prefix is
+ * configured, the "backup" job does the same on a schedule, keeping only the most recent backups
+ * (each instance of a cluster backs up its own state directory, named for its host).  Backups hold
+ * the server's secrets, and the storage backend is shared with the processing chain, so backups are
+ * only stored there encrypted (as for the local backend's objects; see storage/encrypt.go), with
+ * the backup key or else the storage backend's key, which has to be kept somewhere other than the
+ * state directory.  The admin API keys are left out of the configuration in a backup.  The
+ * "restore" command unpacks an archive (from a file, or from the storage backend, decrypting it if
+ * need be) in place of the state directory, which has to be empty unless -force is given, and can
+ * write out the configuration it holds, so that a replacement box can take over where the old one
+ * stopped.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Backups stored by the server are named for the time they were made, so that they sort in order.
+const (
+	backupName   = "wibl-backup-"
+	backupSuffix = ".tar.gz"
+)
+
+// Generate the archive of the state directory and configuration.  The admin API keys are left out of
+// the configuration, so that a backup can't be used to administer the server.
+func makeBackup(config *support.Config) ([]byte, support.BackupManifest, error) {
+	snapshot := *config
+	snapshot.Admin.Keys = nil
+	settings, err := json.MarshalIndent(&snapshot, "", "    ")
+	if err != nil {
+		return nil, support.BackupManifest{}, err
+	}
+	var buffer bytes.Buffer
+	manifest, err := support.WriteBackup(&buffer, config.State.Directory, version, settings)
+	return buffer.Bytes(), manifest, err
+}
+
+// Generate the source of the key with which backups stored in the storage backend are encrypted: the
+// one given for backups, or else that of the storage backend.  The result is nil if neither is given.
+func backupKeys(config *support.Config) (storage.KeySource, error) {
+	param := config.Backup.Encryption
+	if len(param.KeyFile) == 0 && len(param.KMSKey) == 0 {
+		param = config.Storage.Encryption
+	}
+	return storage.NewKeySource(param, config.AWS)
+}
+
+// Encrypt a backup to be stored in the storage backend, which is refused if there's no key for it.
+func sealBackup(ctx context.Context, config *support.Config, data []byte) ([]byte, error) {
+	keys, err := backupKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, errors.New("backups are only stored in the storage backend encrypted, and no encryption key is configured")
+	}
+	return storage.Encrypt(ctx, keys, data)
+}
+
+// Find the start of the keys of the backups that this instance stores: under the backup prefix, with
+// the instance's name in a cluster (see clusterName()).
+func storedBackupName(config *support.Config) string {
+	name := path.Join(config.Backup.Prefix, backupName)
+	if host := clusterName(config); len(host) > 0 {
+		name += host + "-"
+	}
+	return name
+}
+
+// Store a backup in the storage backend, with a key starting with the prefix given (see
+// storedBackupName()), and drop all but the most recent keep backups there.  The key of the new
+// backup is returned.
+func storeBackup(ctx context.Context, backend storage.Backend, prefix string, keep int, data []byte,
+	manifest support.BackupManifest) (string, error) {
+	key := prefix + manifest.Created.Format("20060102T150405Z") + backupSuffix
+	metadata := map[string]string{"server": manifest.Server, "state-version": strconv.Itoa(manifest.StateVersion)}
+	if err := backend.Put(ctx, key, data, metadata); err != nil {
+		return "", err
+	}
+	var keys []string
+	err := backend.List(ctx, prefix, func(info storage.ObjectInfo) error {
+		if strings.HasSuffix(info.Key, backupSuffix) {
+			keys = append(keys, info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return key, fmt.Errorf("listing backups: %w", err)
+	}
+	slices.Sort(keys)
+	for len(keys) > max(keep, 1) {
+		if err := backend.Delete(ctx, keys[0]); err != nil {
+			return key, fmt.Errorf("dropping backup %s: %w", keys[0], err)
+		}
+		keys = keys[1:]
+	}
+	return key, nil
+}
+
+// Back up the state directory and configuration to the storage backend, if a backup prefix is
+// configured.
+func (app *application) backupJob(ctx context.Context) (string, error) {
+	param := app.config.Backup
+	if len(param.Prefix) == 0 {
+		return "backups are not configured", nil
+	}
+	data, manifest, err := makeBackup(app.config)
+	if err != nil {
+		return "", fmt.Errorf("making backup: %w", err)
+	}
+	if data, err = sealBackup(ctx, app.config, data); err != nil {
+		return "", err
+	}
+	key, err := storeBackup(ctx, app.storage, storedBackupName(app.config), param.Keep, data, manifest)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("backed up %d state files (%d bytes) to %s", len(manifest.Files), len(data), key), nil
+}
+
+// Write a backup of the state directory and configuration to a file, or to the storage backend.
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	output := fs.String("o", "", "Filename to write the backup to, which mustn't exist (default wibl-backup-<time>.tar.gz)")
+	stored := fs.Bool("storage", false, "Store the backup in the storage backend, under the configured backup prefix")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	data, manifest, err := makeBackup(config)
+	if err != nil {
+		return err
+	}
+	if *stored {
+		if len(config.Backup.Prefix) == 0 {
+			return errors.New("no backup prefix is configured")
+		}
+		backend, err := storage.New(config.Storage, config.AWS)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if data, err = sealBackup(ctx, config, data); err != nil {
+			return err
+		}
+		key, err := storeBackup(ctx, backend, storedBackupName(config), config.Backup.Keep, data, manifest)
+		if err != nil {
+			return err
+		}
+		support.Infof("backed up %d state files to %s in %s.\n", len(manifest.Files), key, backend.Location())
+		return nil
+	}
+	filename := *output
+	if len(filename) == 0 {
+		filename = backupName + manifest.Created.Format("20060102T150405Z") + backupSuffix
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	support.Infof("backed up %d state files to %s.\n", len(manifest.Files), filename)
+	return nil
+}
+
+// Restore a backup into the (empty) state directory, from a file or from the storage backend.
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	stored := fs.Bool("storage", false, "Read the backup from the storage backend (by key, or the latest that this host stored if none is given)")
+	writeConfig := fs.String("write-config", "", "Filename to write the configuration held in the backup to")
+	force := fs.Bool("force", false, "Restore into a state directory that isn't empty, replacing the files in the backup")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 || fs.NArg() == 0 && !*stored {
+		return errors.New("usage: restore [-config filename]... [-write-config filename] [-force] (<backup> | -storage [<key>])")
+	}
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	var source io.Reader
+	name := fs.Arg(0)
+	if *stored {
+		backend, err := storage.New(config.Storage, config.AWS)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if len(name) == 0 {
+			err := backend.List(ctx, storedBackupName(config), func(info storage.ObjectInfo) error {
+				if strings.HasSuffix(info.Key, backupSuffix) && info.Key > name {
+					name = info.Key
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(name) == 0 {
+				return fmt.Errorf("no backups under %q in %s", config.Backup.Prefix, backend.Location())
+			}
+		}
+		object, _, err := backend.Get(ctx, name)
+		if err != nil {
+			return fmt.Errorf("reading backup %s: %w", name, err)
+		}
+		defer object.Close()
+		source = object
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		source = f
+	}
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return fmt.Errorf("reading backup %s: %w", name, err)
+	}
+	keys, err := backupKeys(config)
+	if err != nil {
+		return err
+	}
+	if data, err = storage.Decrypt(context.Background(), keys, data); err != nil {
+		return fmt.Errorf("decrypting backup %s: %w", name, err)
+	}
+	manifest, err := support.RestoreBackup(bytes.NewReader(data), config.State.Directory, *writeConfig, *force)
+	if err != nil {
+		return err
+	}
+	support.Infof("restored %d state files from %s (made %s by server %s, state version %d) to %s.\n", len(manifest.Files),
+		name, manifest.Created.Format(time.RFC3339), manifest.Server, manifest.StateVersion, config.State.Directory)
+	if len(*writeConfig) > 0 {
+		support.Infof("wrote the backed-up configuration to %s.\n", *writeConfig)
+	}
+	return nil
+}
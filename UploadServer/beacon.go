@@ -0,0 +1,146 @@
+/*! @file beacon.go
+ * @brief Fixed-format binary status beacons, for the narrowest reporting paths
+ *
+ * On some links (satellite modems billed by the byte, heavily duty-cycled radios), even a compact CBOR
+ * status is more than a logger can afford to send often.  A beacon is a fixed-format binary message
+ * with just the essentials, POSTed to /beacon with the logger's usual credentials:
+ *
+ *	offset  size  field
+ *	0       1     format version (1)
+ *	1       1     length of the logger's identifier, n (1-64)
+ *	2       n     logger's identifier (ASCII)
+ *	2+n     4     uptime, seconds (unsigned)
+ *	6+n     4     number of files on the logger (unsigned)
+ *	10+n    4     latitude, 1e-7 degrees (signed)
+ *	14+n    4     longitude, 1e-7 degrees (signed)
+ *
+ * with all numbers big-endian.  A logger without a position sends 0x7FFFFFFF for both coordinates.  The
+ * beacon updates the logger's status in the fleet as a checkin would, keeping the last reported values
+ * of everything that it doesn't carry; the position, if given, is taken to be from the time of receipt.
+ * The response is a single byte giving the number of commands waiting for the logger (up to 255),
+ * which it has to check in over HTTP to collect.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+const (
+	beaconFormat     = 1
+	beaconNoPosition = math.MaxInt32
+	maxBeaconLogger  = 64
+)
+
+// A binaryBeacon is a decoded beacon; the position is nil if the logger didn't have one.
+type binaryBeacon struct {
+	Logger   string
+	Uptime   uint32
+	Files    uint32
+	Position *api.Position
+}
+
+// Decode a beacon in the format given at the top of the file.
+func decodeBinaryBeacon(data []byte) (binaryBeacon, error) {
+	var rtn binaryBeacon
+	if len(data) < 2 {
+		return rtn, errors.New("beacon too short")
+	}
+	if data[0] != beaconFormat {
+		return rtn, fmt.Errorf("unknown beacon format %d", data[0])
+	}
+	n := int(data[1])
+	if n == 0 || n > maxBeaconLogger {
+		return rtn, fmt.Errorf("logger identifier length %d out of range", n)
+	}
+	if len(data) != 2+n+16 {
+		return rtn, fmt.Errorf("beacon is %d bytes, expected %d", len(data), 2+n+16)
+	}
+	rtn.Logger = string(data[2 : 2+n])
+	fields := data[2+n:]
+	rtn.Uptime = binary.BigEndian.Uint32(fields[0:])
+	rtn.Files = binary.BigEndian.Uint32(fields[4:])
+	lat, lon := int32(binary.BigEndian.Uint32(fields[8:])), int32(binary.BigEndian.Uint32(fields[12:]))
+	if lat != beaconNoPosition || lon != beaconNoPosition {
+		rtn.Position = &api.Position{Latitude: float64(lat) / 1e7, Longitude: float64(lon) / 1e7}
+		if math.Abs(rtn.Position.Latitude) > 90 || math.Abs(rtn.Position.Longitude) > 180 {
+			return rtn, errors.New("position out of range")
+		}
+	}
+	return rtn, nil
+}
+
+// Accept a binary status beacon from a logger.
+func (app *application) beaconUpdate(w http.ResponseWriter, r *http.Request) {
+	received := time.Now().UTC()
+	logger := support.LoggerID(r)
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 2+maxBeaconLogger+16))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read beacon")
+		return
+	}
+	beacon, err := decodeBinaryBeacon(data)
+	if err != nil {
+		support.Warnf("API: malformed beacon from logger %s: %s\n", logger, err)
+		app.quarantineCheckin(r, data, err.Error())
+		writeError(w, http.StatusBadRequest, "malformed beacon")
+		return
+	}
+	if beacon.Logger != logger {
+		app.impersonation(logger, beacon.Logger, "a beacon")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var status api.Status
+	if previous, ok := app.fleet.Get(logger); ok {
+		status = previous.Status
+	}
+	status.Logger = logger
+	status.Timestamp = nil
+	status.Elapsed = beacon.Uptime
+	status.Files.Count = uint(beacon.Files)
+	if beacon.Position != nil {
+		status.Position = beacon.Position
+		status.Position.Time = &received
+	}
+	app.fleet.Update(logger, r.RemoteAddr, status, nil)
+	app.queueCheckin(logger, r.RemoteAddr, received, status)
+	support.Infof("API: beacon from logger %s on IP %s, uptime %ds, total %d files.\n", logger, r.RemoteAddr,
+		beacon.Uptime, beacon.Files)
+
+	pending, err := app.commands.Pending(logger)
+	if err != nil && !errors.Is(err, support.ErrNotFound) {
+		support.Errorf("API: failed to count commands for logger %s: %s\n", logger, err)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte{byte(min(len(pending), math.MaxUint8))})
+}
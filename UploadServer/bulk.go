@@ -0,0 +1,116 @@
+/*! @file bulk.go
+ * @brief Bulk export of the files stored for a logger
+ *
+ * Researchers working with a particular vessel's data need everything that its logger has
+ * contributed, but shouldn't need credentials for the storage backend to get it.  This end-point
+ * assembles all of the files stored for a logger in a time range into a ZIP archive, streamed as it
+ * is built so that the server never holds the whole archive, along with a manifest of the upload
+ * records for the files.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Stream a ZIP archive of the files stored for a logger in the requested time range.
+func (app *application) exportLoggerFiles(w http.ResponseWriter, r *http.Request) {
+	logger := r.PathValue("id")
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	records := app.uploads.Select(from, to, func(u *support.UploadRecord) bool {
+		return u.Logger == logger && len(u.Key) > 0
+	})
+	if len(records) == 0 {
+		writeError(w, http.StatusNotFound, "no stored files for logger in time range")
+		return
+	}
+	app.recordAction(r, "logger.export", logger, fmt.Sprintf("%d files, %s", len(records), r.URL.RawQuery))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", logger+".zip"))
+	archive := zip.NewWriter(streamResponse(w))
+	rc := http.NewResponseController(w)
+
+	// Once the archive has started, errors can't be reported in the status code, so files that
+	// fail are listed in the manifest instead, and the client can retry them individually.
+	manifest := struct {
+		Logger  string                 `json:"logger"`
+		Created time.Time              `json:"created"`
+		Files   []support.UploadRecord `json:"files"`
+		Failed  []string               `json:"failed,omitempty"`
+	}{Logger: logger, Created: time.Now().UTC()}
+	for _, record := range records {
+		if err := app.addToArchive(r.Context(), archive, record); err != nil {
+			if r.Context().Err() != nil {
+				support.Errorf("ADMIN: export for %s abandoned by client: %s\n", logger, r.Context().Err())
+				return
+			}
+			support.Errorf("ADMIN: failed to add %s to export for %s: %s\n", record.Key, logger, err)
+			manifest.Failed = append(manifest.Failed, record.Key)
+			continue
+		}
+		manifest.Files = append(manifest.Files, record)
+		if err := rc.Flush(); err != nil {
+			support.Errorf("ADMIN: export for %s abandoned by client: %s\n", logger, err)
+			return
+		}
+	}
+	header := &zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.Created}
+	if f, err := archive.CreateHeader(header); err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "    ")
+		enc.Encode(manifest)
+	}
+	if err := archive.Close(); err != nil {
+		support.Errorf("ADMIN: failed to complete export for %s: %s\n", logger, err)
+	}
+}
+
+// Copy a stored file into the archive.
+func (app *application) addToArchive(ctx context.Context, archive *zip.Writer, record support.UploadRecord) error {
+	obj, _, err := app.storage.Get(ctx, record.Key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	f, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     record.Key,
+		Method:   zip.Deflate,
+		Modified: record.Received,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, obj)
+	return err
+}
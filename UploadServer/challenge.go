@@ -0,0 +1,138 @@
+/*! @file challenge.go
+ * @brief Challenge-response authentication for loggers
+ *
+ * BasicAuth sends the logger's upload token with every request, so anyone who can read the traffic
+ * (e.g., at a TLS-terminating proxy) has the token.  Firmware that speaks protocol version 2 can
+ * instead ask for a nonce, sign it with a key derived from its token (see support/tokens.go), and
+ * get a session token (see support/sessions.go) for its checkins and uploads in return, so that the
+ * upload token itself never goes over the wire.  The server advertises the methods it accepts in
+ * the "auth" list of its server information, and only offers challenge-response if the
+ * "challenge-auth" feature is enabled and sessions are issued.  Nonces are held in the shared
+ * state, so that any instance can check a response, and can only be used once.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The authentication methods that loggers may use.
+const (
+	authBasic     = "basic"     // Upload token sent in the BasicAuth header
+	authChallenge = "challenge" // Challenge-response, for a session token
+)
+
+// The lowest protocol version that supports challenge-response authentication.
+const challengeProtocol = 2
+
+// How long a logger has to respond to a challenge.
+const challengeTTL = 2 * time.Minute
+
+// Determine whether loggers may authenticate by challenge-response.
+func (app *application) challengeAuth() bool {
+	return app.config.FeatureEnabled("challenge-auth") && app.grants != nil
+}
+
+// Generate the message that a logger signs in response to a challenge.
+func challengeMessage(logger, nonce string) []byte {
+	return []byte(fmt.Sprintf("wibl-auth/1\n%s\n%s", logger, nonce))
+}
+
+// Give a logger a nonce to sign, if it speaks a protocol version with challenge-response.
+func (app *application) issueChallenge(w http.ResponseWriter, r *http.Request) {
+	if !app.challengeAuth() {
+		http.NotFound(w, r)
+		return
+	}
+	var request api.ChallengeRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if len(request.Logger) == 0 {
+		writeError(w, http.StatusBadRequest, "logger is required")
+		return
+	}
+	if request.Protocol < challengeProtocol {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("challenge-response needs protocol version %d", challengeProtocol))
+		return
+	}
+	nonce, err := support.RandomToken(32)
+	if err != nil {
+		support.Errorf("API: failed to generate challenge: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to generate challenge")
+		return
+	}
+	if err := app.state.Set("challenge:"+nonce, []byte(request.Logger), challengeTTL); err != nil {
+		support.Errorf("API: failed to record challenge for logger %s: %s\n", request.Logger, err)
+		writeError(w, http.StatusServiceUnavailable, "shared state unavailable")
+		return
+	}
+	writeJSON(w, http.StatusOK, api.Challenge{Nonce: nonce, Expires: time.Now().UTC().Add(challengeTTL)})
+}
+
+// Check a logger's response to a challenge, giving it a session token if it's good.
+func (app *application) checkChallenge(w http.ResponseWriter, r *http.Request) {
+	if !app.challengeAuth() {
+		http.NotFound(w, r)
+		return
+	}
+	var response api.ChallengeResponse
+	if !readJSON(w, r, &response) {
+		return
+	}
+	logger, err := app.state.Take("challenge:" + response.Nonce)
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusUnauthorized, "unknown or expired challenge")
+		return
+	case err != nil:
+		support.Errorf("API: failed to look up challenge: %s\n", err)
+		writeError(w, http.StatusServiceUnavailable, "shared state unavailable")
+		return
+	}
+	signature, err := hex.DecodeString(response.Signature)
+	if string(logger) != response.Logger || err != nil {
+		writeError(w, http.StatusUnauthorized, "challenge failed")
+		return
+	}
+	token, ok := app.tokens.VerifySignature(response.Logger, challengeMessage(response.Logger, response.Nonce), signature)
+	if !ok {
+		support.Warnf("API: challenge response from %s for logger %s failed.\n", r.RemoteAddr, response.Logger)
+		writeError(w, http.StatusUnauthorized, "challenge failed")
+		return
+	}
+	session, grant, err := app.grants.Issue(response.Logger, token.ID)
+	if err != nil {
+		support.Errorf("API: failed to issue session to logger %s: %s\n", response.Logger, err)
+		writeError(w, http.StatusInternalServerError, "failed to issue session")
+		return
+	}
+	support.Infof("API: logger %s authenticated by challenge-response.\n", response.Logger)
+	writeJSON(w, http.StatusOK, api.SessionGrant{Token: session, Expires: grant.Expires})
+}
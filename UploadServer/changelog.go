@@ -0,0 +1,68 @@
+/*! @file changelog.go
+ * @brief Summary of uploads since a logger's last checkin
+ *
+ * A logger can't always tell whether an upload succeeded (e.g., if the connection drops before the
+ * response arrives), so each checkin response lists what the server has received from the logger
+ * since its previous checkin: the files accepted, and the files rejected with the reason.  Files are
+ * identified by MD5 digest, which the logger also reports in its status message, so that the
+ * firmware can reconcile its own records.  The time of the previous checkin is only known while the
+ * server is running; after a restart, the summary covers a fixed window instead.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+const (
+	changelogWindow = 24 * time.Hour // Period covered if the previous checkin isn't known
+	changelogLimit  = 100            // Maximum number of uploads listed (the most recent are kept)
+)
+
+// Generate the summary of the uploads received from the logger since the time given (or within the
+// changelog window, if the time is zero), or nil if there were none.
+func (app *application) uploadChangelog(logger string, since time.Time) *api.UploadChangelog {
+	if since.IsZero() {
+		since = time.Now().UTC().Add(-changelogWindow)
+	}
+	records := app.uploads.SelectLogger(logger, since, time.Time{}, nil)
+	if len(records) == 0 {
+		return nil
+	}
+	rtn := &api.UploadChangelog{Since: since}
+	if len(records) > changelogLimit {
+		records = records[len(records)-changelogLimit:]
+		rtn.Truncated = true
+	}
+	for _, record := range records {
+		change := api.UploadChange{MD5: record.MD5, Size: record.Size, Received: record.Received, Reason: record.Reason}
+		if record.Status == support.UploadAccepted {
+			rtn.Accepted = append(rtn.Accepted, change)
+		} else {
+			rtn.Rejected = append(rtn.Rejected, change)
+		}
+	}
+	return rtn
+}
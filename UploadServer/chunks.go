@@ -0,0 +1,366 @@
+/*! @file chunks.go
+ * @brief Uploads of large files in chunks, sent in parallel
+ *
+ * Over a high-latency satellite link, a large file takes much longer to send in a single request
+ * than the link's bandwidth would suggest, and a dropped connection means starting again.  With the
+ * "resumable-uploads" feature enabled, a logger can instead split the file into chunks, send them
+ * in parallel (each with its own digest) under an upload identifier of its choice, and then ask the
+ * server to assemble them, giving the digest of the whole file.  Chunks that didn't arrive can be
+ * found, and sent again, before assembly.  The assembled file is then handled exactly as if it had
+ * been uploaded in one piece.
+ *
+ * Chunks are held in the storage backend (under "chunks/"), so that they can be sent to different
+ * instances of the server; chunks that are never assembled are removed by the chunk-cleanup job.
+ * The chunks that a logger has sent count towards its quota until they're assembled, and files are
+ * only assembled up to the upload size limit (or 1GB, if there's no limit).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+const (
+	chunkPrefix = "chunks/"
+	maxChunks   = 10000          // Largest number of chunks in an upload
+	chunkTTL    = 24 * time.Hour // How long chunks are kept if they aren't assembled
+	maxAssembly = 1 << 30        // Largest file assembled, if there's no limit on the size of uploads
+)
+
+// Upload identifiers are chosen by the logger, but have to be safe to use in a storage key.
+var chunkUploadID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Generate the storage key prefix for the chunks of all uploads from a logger.
+func chunkLoggerPrefix(logger string) string {
+	return chunkPrefix + url.PathEscape(logger) + "/"
+}
+
+// Generate the storage key prefix for the chunks of an upload from a logger.
+func chunkUploadPrefix(logger, id string) string {
+	return chunkLoggerPrefix(logger) + id + "/"
+}
+
+// Check the upload identifier (and chunk index, if there is one) in the request path, returning the
+// storage key prefix for the upload's chunks, and the index.
+func chunkPath(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	id := r.PathValue("id")
+	if !chunkUploadID.MatchString(id) {
+		writeError(w, http.StatusBadRequest, "upload identifier must be 1-64 letters, digits, '-', or '_'")
+		return "", 0, false
+	}
+	index := 0
+	if s := r.PathValue("index"); len(s) > 0 {
+		var err error
+		if index, err = strconv.Atoi(s); err != nil || index < 0 || index >= maxChunks {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("chunk index must be between 0 and %d", maxChunks-1))
+			return "", 0, false
+		}
+	}
+	return chunkUploadPrefix(support.LoggerID(r), id), index, true
+}
+
+// Only serve requests to the handler if the feature named is enabled.
+func (app *application) requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.FeatureEnabled(name) {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Accept one chunk of an upload.  The Digest header gives the digest of the chunk, as for a complete
+// file; the response is the same as for a file transfer.  Sending a chunk again replaces it.
+func (app *application) putChunk(w http.ResponseWriter, r *http.Request) {
+	prefix, index, ok := chunkPath(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if app.tooLarge(w, r, err) {
+			return
+		}
+		support.Errorf("API: failed to read chunk body: %s.\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, err := support.CheckDigest(r.Header.Get("Digest"), body); err != nil {
+		support.Errorf("API: chunk %d of %s doesn't check against its digest (%s).\n", index, prefix, err)
+		app.writeTransferResult(w, api.TransferResult{Status: "failure"})
+		return
+	}
+	md5hash := fmt.Sprintf("%X", md5.Sum(body))
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	key := fmt.Sprintf("%s%05d", prefix, index)
+	release, ok, err := app.reserveChunk(ctx, support.LoggerID(r), key, int64(len(body)))
+	if err != nil {
+		support.Errorf("API: failed to find the chunks held for logger %s: %s\n", support.LoggerID(r), err)
+		app.writeTransferResult(w, api.TransferResult{Status: "failure"})
+		return
+	} else if !ok {
+		app.writeTransferResult(w, api.TransferResult{Status: "failure", Reason: "quota exceeded"})
+		return
+	}
+	defer release()
+	if err := app.putObject(ctx, key, body, map[string]string{"md5": md5hash}); err != nil {
+		support.Errorf("API: failed to store chunk %s: %s\n", key, err)
+		app.writeTransferResult(w, api.TransferResult{Status: "failure"})
+		return
+	}
+	app.writeTransferResult(w, api.TransferResult{Status: "success"})
+}
+
+// List the chunks of the upload that have been received, so that the logger can send any that are
+// missing.
+func (app *application) listChunks(w http.ResponseWriter, r *http.Request) {
+	prefix, _, ok := chunkPath(w, r)
+	if !ok {
+		return
+	}
+	chunks, err := app.uploadChunks(r.Context(), prefix)
+	if err != nil {
+		support.Errorf("API: failed to list chunks of %s: %s\n", prefix, err)
+		writeError(w, http.StatusInternalServerError, "failed to list chunks")
+		return
+	}
+	writeJSON(w, http.StatusOK, api.ChunkList{ID: r.PathValue("id"), Chunks: chunks})
+}
+
+// Reserve space for a chunk of the size given, stored under the key given, against the logger's
+// quota (see reserveQuota()), counting the chunks that it has sent but not yet had assembled along
+// with its stored files.
+func (app *application) reserveChunk(ctx context.Context, logger, key string, size int64) (func(), bool, error) {
+	if app.settings.Get().Quota.Limit(logger) <= 0 {
+		return func() {}, true, nil
+	}
+	var staged int64
+	err := app.storage.List(ctx, chunkLoggerPrefix(logger), func(info storage.ObjectInfo) error {
+		if info.Key != key { // A chunk sent again replaces the one stored
+			staged += info.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	release, ok := app.reserveQuota(logger, staged, size)
+	return release, ok, nil
+}
+
+func (app *application) uploadChunks(ctx context.Context, prefix string) ([]api.ChunkInfo, error) {
+	chunks := make([]api.ChunkInfo, 0)
+	err := app.storage.List(ctx, prefix, func(info storage.ObjectInfo) error {
+		if index, err := strconv.Atoi(strings.TrimPrefix(info.Key, prefix)); err == nil {
+			chunks = append(chunks, api.ChunkInfo{Index: index, Size: info.Size})
+		}
+		return nil
+	})
+	return chunks, err
+}
+
+// Assemble the chunks of an upload into the complete file, and handle it as for a file transfer.  The
+// Digest header gives the digest of the complete file (and X-Payload-Type its type, if it isn't WIBL
+// data), and the body the number of chunks.  If any
+// chunks are missing, the response lists them; otherwise, the chunks are removed once the file has
+// been accepted.
+func (app *application) assembleChunks(w http.ResponseWriter, r *http.Request) {
+	prefix, _, ok := chunkPath(w, r)
+	if !ok {
+		return
+	}
+	payload, known := app.payloadType(r)
+	if !known {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unknown payload type %q", r.Header.Get(payloadHeader)))
+		return
+	}
+	key, known := app.encryptionKey(r)
+	if !known {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unknown encryption key %q", r.Header.Get(encryptionHeader)))
+		return
+	}
+	var request api.AssembleRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.Count < 1 || request.Count > maxChunks {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("chunk count must be between 1 and %d", maxChunks))
+		return
+	}
+	received, err := app.uploadChunks(r.Context(), prefix)
+	if err != nil {
+		support.Errorf("API: failed to list chunks of %s: %s\n", prefix, err)
+		app.writeTransferResult(w, api.TransferResult{Status: "failure"})
+		return
+	}
+	present := make(map[int]bool)
+	var size int64
+	for _, c := range received {
+		if c.Index < request.Count {
+			present[c.Index] = true
+			size += c.Size
+		}
+	}
+	result := api.TransferResult{Status: "failure"}
+	limit := app.payloadLimit(payload)
+	if limit <= 0 {
+		limit = maxAssembly
+	}
+	if size > limit {
+		support.Warnf("TRANS: refusing to assemble %s (%d bytes, limit %d).\n", prefix, size, limit)
+		app.refuseUpload(r, size, "file too large")
+		app.writeTransferResult(w, result)
+		return
+	}
+	for i := 0; i < request.Count; i++ {
+		if !present[i] {
+			result.Missing = append(result.Missing, i)
+		}
+	}
+	if len(result.Missing) > 0 {
+		app.writeTransferResult(w, result)
+		return
+	}
+
+	var body []byte
+	for i := 0; i < request.Count; i++ {
+		if body, err = app.appendChunk(r.Context(), body, fmt.Sprintf("%s%05d", prefix, i)); err != nil {
+			support.Errorf("API: failed to read chunk %d of %s: %s\n", i, prefix, err)
+			if errors.Is(err, storage.ErrNotFound) {
+				result.Missing = append(result.Missing, i)
+			}
+			app.writeTransferResult(w, result)
+			return
+		}
+		if int64(len(body)) > limit { // A chunk was replaced by a larger one since they were listed
+			app.refuseUpload(r, int64(len(body)), "file too large")
+			app.writeTransferResult(w, result)
+			return
+		}
+	}
+	record := support.UploadRecord{
+		UUID:     support.NewUUID(),
+		Logger:   support.LoggerID(r),
+		Received: time.Now().UTC(),
+		Remote:   r.RemoteAddr,
+		Size:     int64(len(body)),
+		MD5:      fmt.Sprintf("%X", md5.Sum(body)),
+	}
+	record.Type = payload
+	record.KeyID = key
+	record.Trace, record.Correlation = newTraceID(), requestCorrelation(r)
+	record.FileID = app.reportedFileID(r, record.Logger, record.MD5)
+	algorithm, err := support.CheckDigest(r.Header.Get("Digest"), body)
+	if algorithm != "md5" {
+		record.Digest = algorithm
+	}
+	if err != nil {
+		support.Errorf("API: assembled file from %s doesn't check against its digest (%s).\n", prefix, err)
+		app.recordUpload(record, support.UploadRejected, err.Error())
+		app.quarantineUpload(record, body, err.Error())
+		if errors.Is(err, support.ErrDigestMismatch) {
+			app.resendFailed(record.Logger, support.ClaimedMD5(r.Header.Get("Digest")), "upload did not match its digest")
+		}
+		result.Trace = record.Trace
+		app.writeTransferResult(w, result)
+		return
+	}
+	status, receipt, accepted := app.acceptUpload(r.Context(), record, body)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	if accepted {
+		result.Status = "success"
+		result.Receipt = receipt
+		app.deleteChunks(r.Context(), prefix)
+	}
+	result.Trace = app.uploadTrace(record)
+	app.writeTransferResult(w, result)
+}
+
+func (app *application) appendChunk(ctx context.Context, body []byte, key string) ([]byte, error) {
+	obj, _, err := app.storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, err
+	}
+	return append(body, data...), nil
+}
+
+// Remove the chunks with the prefix given.
+func (app *application) deleteChunks(ctx context.Context, prefix string) {
+	var keys []string
+	err := app.storage.List(ctx, prefix, func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		support.Errorf("failed to list chunks under %s for removal: %s\n", prefix, err)
+	}
+	for _, key := range keys {
+		if err := app.storage.Delete(ctx, key); err != nil {
+			support.Errorf("failed to remove chunk %s: %s\n", key, err)
+		}
+	}
+}
+
+// Remove chunks of uploads that were never assembled.
+func (app *application) chunkCleanupJob(ctx context.Context) (string, error) {
+	cutoff := time.Now().Add(-chunkTTL)
+	var keys []string
+	err := app.storage.List(ctx, chunkPrefix, func(info storage.ObjectInfo) error {
+		if info.Modified.Before(cutoff) {
+			keys = append(keys, info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if err := app.storage.Delete(ctx, key); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("removed %d abandoned chunks", len(keys)), nil
+}
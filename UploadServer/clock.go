@@ -0,0 +1,63 @@
+/*! @file clock.go
+ * @brief Detection of loggers with inaccurate clocks
+ *
+ * Loggers timestamp their data with their own clock, so a logger whose clock has drifted quietly
+ * corrupts the timestamps of everything downstream.  Loggers can report their time at checkin; the
+ * difference from the server's time (ignoring network delay, which is small in comparison with the
+ * drift of concern) is kept with the logger's status, returned in the checkin response so that the
+ * firmware can correct itself, and an alert is raised when it exceeds the configured limit.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Compute the offset of the logger's clock from the server's, in seconds (positive if the logger is
+// ahead), from the time that the logger reported at the time the report was received.  An alert is
+// raised the first time that the offset exceeds the limit, and again if it recovers and then drifts
+// once more.
+func (app *application) checkClock(logger string, reported, received time.Time) float64 {
+	offset := reported.Sub(received).Seconds()
+	limit := app.config.Clock.MaxDriftSeconds
+	if limit <= 0 {
+		return offset
+	}
+	var err error
+	if math.Abs(offset) > limit {
+		var set bool
+		if set, err = app.state.SetNX("clock-drift:"+logger, []byte(received.Format(time.RFC3339)), 0); set {
+			app.alerts.Raise("clock", logger, fmt.Sprintf("logger clock is %.1f s from server time (limit %.0f s)", offset, limit))
+		}
+	} else if _, err = app.state.Take("clock-drift:" + logger); errors.Is(err, support.ErrNotFound) {
+		err = nil
+	}
+	if err != nil {
+		support.Errorf("failed to update clock drift state for %s: %s\n", logger, err)
+	}
+	return offset
+}
@@ -0,0 +1,139 @@
+/*! @file coap.go
+ * @brief CoAP ingest adapter for compact checkin telemetry
+ *
+ * Some loggers have no HTTP connectivity at all, and report through extremely constrained relays
+ * (e.g., over a satellite short-burst link).  With the "coap-listener" feature enabled, the server
+ * accepts a compact subset of the checkin status (api.CompactStatus, as CBOR) by CoAP POST to
+ * "checkin" on the UDP port in the configuration, and records it in the fleet status as for an HTTP
+ * checkin, so that these loggers still appear in fleet monitoring.  The parts of the status that
+ * the compact form doesn't carry (e.g., the file inventory) keep their last reported values.
+ *
+ * There's no TLS here, so the upload token isn't sent: the request carries the HMAC-SHA256 of
+ * "wibl-coap/1\n" and the payload, keyed with the signing key derived from the logger's upload token
+ * (as for challenge-response; see challenge.go), hex-encoded in the Uri-Query option "mac=...".  The
+ * status has to give the logger's time, which has to be within the replay window of the server's.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/coap"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// How far a compact status's time can be from the server's before it's refused as a replay.
+const coapReplayWindow = 10 * time.Minute
+
+// Start the CoAP listener, if the feature is enabled.
+func (app *application) startCoAP() error {
+	if !app.config.FeatureEnabled("coap-listener") {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", app.config.API.CoAPPort))
+	if err != nil {
+		return err
+	}
+	support.Infof("COAP: listening for compact telemetry on %s (UDP).\n", conn.LocalAddr())
+	app.background.Add(1)
+	go func() {
+		defer app.background.Done()
+		if err := coap.Serve(app.ctx, conn, app.coapRequest); err != nil {
+			support.Errorf("COAP: listener failed: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// Handle a CoAP request.
+func (app *application) coapRequest(request *coap.Message, remote net.Addr) (int, []byte) {
+	if request.Path() != "checkin" {
+		return coap.NotFound, nil
+	}
+	if request.Code != coap.POST {
+		return coap.NotAllowed, nil
+	}
+	var status api.CompactStatus
+	if err := cbor.Unmarshal(request.Payload, &status); err != nil || len(status.Logger) == 0 {
+		support.Warnf("COAP: malformed status from %s.\n", remote)
+		return coap.BadRequest, nil
+	}
+	mac, err := hex.DecodeString(request.Query("mac"))
+	message := append([]byte("wibl-coap/1\n"), request.Payload...)
+	if err != nil {
+		return coap.Unauthorized, nil
+	}
+	if _, ok := app.tokens.VerifySignature(status.Logger, message, mac); !ok {
+		support.Warnf("COAP: status from %s for logger %s failed authentication.\n", remote, status.Logger)
+		return coap.Unauthorized, nil
+	}
+	received := time.Now().UTC()
+	reported := time.Unix(status.Time, 0).UTC()
+	if math.Abs(received.Sub(reported).Seconds()) > coapReplayWindow.Seconds() {
+		support.Warnf("COAP: refusing status from %s for logger %s with time %s.\n", remote, status.Logger, reported.Format(time.RFC3339))
+		return coap.Forbidden, nil
+	}
+	update := app.compactCheckin(status, remote.String(), reported, received)
+	support.Infof("COAP: status update from logger %s via %s, firmware %s, total %d files.\n",
+		status.Logger, remote, update.Versions.Firmware, update.Files.Count)
+	pending, err := app.commands.Pending(status.Logger)
+	if err != nil && !errors.Is(err, support.ErrNotFound) {
+		support.Errorf("COAP: failed to count commands for logger %s: %s\n", status.Logger, err)
+	}
+	result, err := cbor.Marshal(api.CompactResult{Commands: len(pending)})
+	if err != nil {
+		return coap.ServerError, nil
+	}
+	return coap.Changed, result
+}
+
+// Record a compact status in the fleet status, keeping the last reported values of what it doesn't
+// carry.  The full status recorded is returned.
+func (app *application) compactCheckin(compact api.CompactStatus, remote string, reported, received time.Time) api.Status {
+	var status api.Status
+	if previous, ok := app.fleet.Get(compact.Logger); ok {
+		status = previous.Status
+	}
+	status.Logger = compact.Logger
+	status.Timestamp = &reported
+	status.Elapsed = compact.Elapsed
+	status.Files.Count = compact.Files
+	if len(compact.Firmware) > 0 {
+		status.Versions.Firmware = compact.Firmware
+	}
+	if len(compact.Current) > 0 {
+		status.Server.CurrentStatus = compact.Current
+	}
+	offset := app.checkClock(compact.Logger, reported, received)
+	app.fleet.Update(compact.Logger, remote, status, &offset)
+	app.checkFirmware(compact.Logger, status.Versions.Firmware)
+	app.queueCheckin(compact.Logger, remote, received, status)
+	return status
+}
@@ -0,0 +1,248 @@
+/*! @file commands.go
+ * @brief Maintenance commands that run in place of the server
+ *
+ * Some tasks (e.g., creating the first admin account) have to happen before the server is
+ * running, or are more conveniently done from the command line on the server host.  These are
+ * provided as commands, invoked as "wibl-monitor <command> [flags]".
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The commands, indexed by the name used on the command line.  Each is given the arguments
+// following the command name.
+var commands = map[string]func(args []string) error{
+	"adduser":         addUserCommand,
+	"audit":           auditCommand,
+	"backup":          backupCommand,
+	"config":          configCommand,
+	"fleet":           fleetCommand,
+	"migrate":         migrateCommand,
+	"migrate-storage": migrateStorageCommand,
+	"provision":       provisionCommand,
+	"replay":          replayCommand,
+	"restore":         restoreCommand,
+}
+
+// Add an account for the administration API directly to the user store.  This is primarily for
+// creating the first admin user, after which accounts can be managed through the API.  The password
+// is read from standard input so that it doesn't appear in the process list or shell history.
+func addUserCommand(args []string) error {
+	fs := flag.NewFlagSet("adduser", flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	name := fs.String("name", "", "Name of the user to add")
+	role := fs.String("role", "admin", "Role for the user (viewer, operator, admin)")
+	tenant := fs.String("tenant", "", "Tenant whose files the user is restricted to (none, if empty)")
+	temporary := fs.Bool("temporary", false, "Require the user to change the password on first login")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*name) == 0 {
+		return errors.New("a user name is required (-name)")
+	}
+	r, err := support.ParseRole(*role)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.State.Directory, 0700); err != nil {
+		return err
+	}
+	users, err := openUserStore(config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", *name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(password) == 0 {
+		return fmt.Errorf("failed to read password (%v)", err)
+	}
+	if _, err := users.Add(*name, r, *tenant, strings.TrimRight(password, "\r\n"), *temporary); err != nil {
+		return err
+	}
+	support.Infof("added user %s with role %s.\n", *name, r)
+	return nil
+}
+
+// Carry out an audit task: "verify" checks the hash chain of the audit trail in the state directory
+// (or the file given with -file), reporting the number of entries checked and the hash at the head of
+// the chain, or where the chain is broken.
+func auditCommand(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errors.New("usage: audit verify [-config filename]... [-file filename]")
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	file := fs.String("file", "", "Audit trail to check (default audit.jsonl in the state directory)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	filename := *file
+	if len(filename) == 0 {
+		config, err := loadConfig(configFiles)
+		if err != nil {
+			return err
+		}
+		filename = filepath.Join(config.State.Directory, "audit.jsonl")
+	}
+	result, err := support.VerifyAudit(filename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d entries in the chain, head %s", filename, result.Chained, result.Head)
+	if result.Unchained > 0 {
+		fmt.Printf(" (%d earlier entries not chained)", result.Unchained)
+	}
+	fmt.Println()
+	return nil
+}
+
+// Apply the migrations that the state directory is waiting for (see support/migrations.go), or with
+// -status, report its version and the migrations pending without applying them.
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	status := fs.Bool("status", false, "Report the state version and pending migrations without applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	dir := config.State.Directory
+	if *status {
+		version, err := support.ReadStateVersion(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: state version %d\n", dir, version.Version)
+		pending, err := support.PendingMigrations(dir)
+		for _, m := range pending {
+			fmt.Printf("pending: %d (%s)\n", m.Version, m.Description)
+		}
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return migrateState(dir)
+}
+
+// Apply the migrations that the state directory is waiting for, logging each one.
+func migrateState(dir string) error {
+	applied, err := support.MigrateState(dir)
+	for _, m := range applied {
+		support.Infof("MIGRATE: applied state migration %d (%s) to %s.\n", m.Version, m.Description, dir)
+	}
+	return err
+}
+
+// Carry out a configuration task: "init" writes out the default configuration, with every parameter
+// present and described, to standard output or the file given with -o (which isn't overwritten
+// unless -force is given); "show" writes out the configuration in effect, with the settings changed
+// at run-time (see support/settings.go) in place of those in the configuration files, and lists them.
+func configCommand(args []string) error {
+	if len(args) > 0 && args[0] == "show" {
+		return showConfig(args[1:])
+	}
+	if len(args) == 0 || args[0] != "init" {
+		return errors.New("usage: config init [-o filename] [-force] | config show [-config filename]...")
+	}
+	fs := flag.NewFlagSet("config init", flag.ExitOnError)
+	output := fs.String("o", "", "Filename to write the configuration to (default standard output)")
+	force := fs.Bool("force", false, "Overwrite the output file if it exists")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	config := support.NewDefaultConfig()
+	config.Jobs = jobDefaults
+	config.Features = make(map[string]bool)
+	for _, f := range config.FeatureList() {
+		config.Features[f.Name] = false
+	}
+	var w io.Writer = os.Stdout
+	if len(*output) > 0 {
+		mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if *force {
+			mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(*output, mode, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return support.WriteDocumentedConfig(w, config)
+}
+
+// Write out the configuration in effect, as JSON, listing under "//overrides" the settings kept in
+// the state directory that take precedence over the configuration files.
+func showConfig(args []string) error {
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	settings, err := support.NewSettingsStore(settingsFile(config), support.ConfigSettings(config))
+	if err != nil {
+		return err
+	}
+	config.ApplySettings(settings.Get())
+	var overrides []string
+	for _, o := range settings.Overrides() {
+		overrides = append(overrides, o.String())
+	}
+	data, err := json.MarshalIndent(struct {
+		Overrides []string `json:"//overrides,omitempty"`
+		*support.Config
+	}{overrides, config}, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,229 @@
+/*! @file coverage.go
+ * @brief Summaries of where the fleet has collected data, for survey coordinators
+ *
+ * Survey coordinators need to see where the crowdsourced fleet has (and hasn't) been, without pulling
+ * every file's metadata.  This end-point aggregates the bounds extracted from accepted files (see
+ * src/wibl) over a region: the totals for files intersecting the region, and a grid of cells of the
+ * size requested, aligned to multiples of the cell size from 0,0, with the count of files, loggers,
+ * and bytes, and the time range of the data, for each cell that any file intersects.  Since only the
+ * bounds of each file are kept, a file is counted in every cell that its bounds intersect, so the
+ * coverage of a long diagonal track is overstated; cells with no files are certainly empty, though.
+ * The grid can be had as GeoJSON polygons, for display on a web map alongside the fleet positions
+ * (see positions.go).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+	"ccom.unh.edu/wibl-monitor/src/wibl"
+)
+
+// The default cell size (degrees), the range allowed, and the largest grid that will be computed.
+const (
+	defaultCoverageCell = 1.0
+	minCoverageCell     = 0.01
+	maxCoverageCell     = 90.0
+	maxCoverageCells    = 1 << 16
+)
+
+// A coverageCell summarises the files that intersect one cell of the grid.
+type coverageCell struct {
+	wibl.BoundingBox
+	Files   int       `json:"files"`
+	Loggers int       `json:"loggers"`
+	Bytes   int64     `json:"bytes"`
+	First   time.Time `json:"first"` // Earliest data in the files
+	Last    time.Time `json:"last"`  // Latest data in the files
+}
+
+type coverageSummary struct {
+	Generated time.Time        `json:"generated"`
+	Region    wibl.BoundingBox `json:"region"`
+	CellSize  float64          `json:"cell_degrees"`
+	Files     int              `json:"files"` // Files intersecting the region
+	Loggers   int              `json:"loggers"`
+	Bytes     int64            `json:"bytes"`
+	Cells     int              `json:"cells"`            // Cells in the grid
+	Covered   int              `json:"covered"`          // Cells that at least one file intersects
+	Detail    []coverageCell   `json:"detail,omitempty"` // Covered cells, west to east, then south to north
+}
+
+type polygonGeometry struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+}
+
+type coverageFeature struct {
+	Type       string          `json:"type"`
+	Geometry   polygonGeometry `json:"geometry"`
+	Properties coverageCell    `json:"properties"`
+}
+
+type coverageCollection struct {
+	Type     string            `json:"type"`
+	Summary  coverageSummary   `json:"summary"` // With the cells as features, rather than in detail
+	Features []coverageFeature `json:"features"`
+}
+
+// A coverageTally accumulates the summary for the files in one cell (or the whole region).
+type coverageTally struct {
+	cell    coverageCell
+	loggers map[string]bool
+}
+
+func (t *coverageTally) add(u *support.UploadRecord) {
+	if t.loggers == nil {
+		t.loggers = make(map[string]bool)
+	}
+	t.cell.Files++
+	t.cell.Bytes += u.Size
+	t.loggers[u.Logger] = true
+	t.cell.Loggers = len(t.loggers)
+	if m := u.Metadata; m.Start != nil && m.End != nil {
+		if t.cell.First.IsZero() || m.Start.Before(t.cell.First) {
+			t.cell.First = *m.Start
+		}
+		if m.End.After(t.cell.Last) {
+			t.cell.Last = *m.End
+		}
+	}
+}
+
+// Summarise the coverage of the accepted files over a region, subject to the query parameters:
+//
+//	bbox          the region (west,south,east,north in degrees; default the whole world)
+//	cell          the size of the grid cells (degrees, default 1)
+//	start, end    only files with data in this time range (see queryTime())
+//	logger        only files from this logger
+//	format        "geojson" for the covered cells as a GeoJSON FeatureCollection of polygons
+func (app *application) coverageSummary(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	region := wibl.BoundingBox{West: -180, South: -90, East: 180, North: 90}
+	if value := query.Get("bbox"); len(value) > 0 {
+		// Written so that NaN fails every comparison, and so is refused along with values out of range.
+		if n, err := fmt.Sscanf(value, "%g,%g,%g,%g", &region.West, &region.South, &region.East, &region.North); err != nil || n != 4 ||
+			!(region.West >= -180 && region.West < region.East && region.East <= 180) ||
+			!(region.South >= -90 && region.South < region.North && region.North <= 90) {
+			writeError(w, http.StatusBadRequest, "bbox must be west,south,east,north, with longitudes in [-180,180] and latitudes in [-90,90]")
+			return
+		}
+	}
+	size := defaultCoverageCell
+	if value := query.Get("cell"); len(value) > 0 {
+		var err error
+		if size, err = strconv.ParseFloat(value, 64); err != nil || !(size >= minCoverageCell && size <= maxCoverageCell) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("cell must be between %g and %g degrees", minCoverageCell, maxCoverageCell))
+			return
+		}
+	}
+	col0, row0 := math.Floor(region.West/size), math.Floor(region.South/size)
+	cols, rows := int(math.Ceil(region.East/size)-col0), int(math.Ceil(region.North/size)-row0)
+	if cols*rows > maxCoverageCells {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("grid of %d cells exceeds %d; use larger cells or a smaller region", cols*rows, maxCoverageCells))
+		return
+	}
+	start, ok := queryTime(w, r, "start")
+	if !ok {
+		return
+	}
+	end, ok := queryTime(w, r, "end")
+	if !ok {
+		return
+	}
+	logger := query.Get("logger")
+
+	files := app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		m := u.Metadata
+		if u.Status != support.UploadAccepted || m == nil || m.Bounds == nil || !m.Bounds.Intersects(region) {
+			return false
+		}
+		if (!start.IsZero() || !end.IsZero()) && !m.Overlaps(start, end) {
+			return false
+		}
+		return len(logger) == 0 || u.Logger == logger
+	})
+	var total coverageTally
+	cells := make(map[[2]int]*coverageTally)
+	index := func(value, origin float64, n int) int {
+		return min(max(int(math.Floor(value/size)-origin), 0), n-1)
+	}
+	for i := range files {
+		u := &files[i]
+		total.add(u)
+		b := u.Metadata.Bounds
+		for col := index(b.West, col0, cols); col <= index(b.East, col0, cols); col++ {
+			for row := index(b.South, row0, rows); row <= index(b.North, row0, rows); row++ {
+				tally, ok := cells[[2]int{col, row}]
+				if !ok {
+					tally = &coverageTally{cell: coverageCell{BoundingBox: wibl.BoundingBox{
+						West: (col0 + float64(col)) * size, South: (row0 + float64(row)) * size,
+						East: (col0 + float64(col+1)) * size, North: (row0 + float64(row+1)) * size,
+					}}}
+					cells[[2]int{col, row}] = tally
+				}
+				tally.add(u)
+			}
+		}
+	}
+
+	rtn := coverageSummary{
+		Generated: time.Now().UTC(), Region: region, CellSize: size,
+		Files: total.cell.Files, Loggers: total.cell.Loggers, Bytes: total.cell.Bytes,
+		Cells: cols * rows, Covered: len(cells), Detail: make([]coverageCell, 0, len(cells)),
+	}
+	for _, tally := range cells {
+		rtn.Detail = append(rtn.Detail, tally.cell)
+	}
+	sort.Slice(rtn.Detail, func(i, j int) bool {
+		a, b := rtn.Detail[i], rtn.Detail[j]
+		return a.West < b.West || (a.West == b.West && a.South < b.South)
+	})
+	if query.Get("format") != "geojson" {
+		writeJSON(w, http.StatusOK, rtn)
+		return
+	}
+	collection := coverageCollection{Type: "FeatureCollection", Features: make([]coverageFeature, 0, len(rtn.Detail))}
+	for _, cell := range rtn.Detail {
+		ring := [][]float64{
+			{cell.West, cell.South}, {cell.East, cell.South}, {cell.East, cell.North},
+			{cell.West, cell.North}, {cell.West, cell.South},
+		}
+		collection.Features = append(collection.Features, coverageFeature{
+			Type: "Feature", Geometry: polygonGeometry{Type: "Polygon", Coordinates: [][][]float64{ring}}, Properties: cell,
+		})
+	}
+	rtn.Detail = nil
+	collection.Summary = rtn
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(collection); err != nil {
+		support.Errorf("API: failed to encode coverage: %s\n", err)
+	}
+}
@@ -0,0 +1,79 @@
+/*! @file deadletter.go
+ * @brief Administration of accepted files that never reached the processing chain
+ *
+ * Files whose notification ultimately failed are held in the dead-letter store (see
+ * support/deadletter.go).  Operators can list them, re-drive each (which repeats the notification,
+ * removing the entry if it succeeds), or discard an entry once the file has been dealt with some other
+ * way.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// List the files that couldn't be passed on for processing.
+func (app *application) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.dead.List())
+}
+
+// Repeat the notification for a dead-lettered file, reporting the entry's state afterwards: HTTP
+// 200 with no entry if the notification succeeded, or HTTP 502 (Bad Gateway) with the updated entry
+// if it failed again.
+func (app *application) redriveDeadLetter(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	if _, ok := app.dead.Get(uuid); !ok {
+		writeError(w, http.StatusNotFound, "no such dead letter")
+		return
+	}
+	record, ok := app.uploads.Get(uuid)
+	if !ok || len(record.Key) == 0 {
+		writeError(w, http.StatusConflict, "upload is no longer stored; discard the entry instead")
+		return
+	}
+	app.recordAction(r, "deadletter.redrive", uuid, "")
+	if err := app.notifyStored(record); err != nil {
+		letter, _ := app.dead.Get(uuid)
+		writeJSON(w, http.StatusBadGateway, letter)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"uuid": uuid, "status": "redriven"})
+}
+
+// Discard the dead-letter entry for a file, without notifying anything.
+func (app *application) discardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	switch err := app.dead.Remove(uuid); {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such dead letter")
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to discard dead letter %s: %s\n", uuid, err)
+		writeError(w, http.StatusInternalServerError, "failed to discard dead letter")
+		return
+	}
+	app.recordAction(r, "deadletter.discard", uuid, "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,225 @@
+/*! @file delta.go
+ * @brief Re-sending files that the server partially has, by sending only the blocks that differ
+ *
+ * When a logger is asked to re-send a file (e.g., because the stored copy failed its integrity
+ * check), the server usually has most of it already, and sending all of it again is expensive over
+ * a satellite link paid for by the megabyte.  With the "delta-transfer" feature enabled, the logger
+ * can instead ask for the block digests of the server's copy of the file (by the file's ID on the
+ * logger), find which of its own blocks the server already has (as rsync does), and send a delta:
+ * instructions to copy ranges of the server's copy, interleaved with literal data for the rest.  The
+ * server rebuilds the file from the delta and handles it exactly as if it had been uploaded whole,
+ * with the Digest header giving the digest of the rebuilt file.
+ *
+ * A delta is a sequence of instructions, each a byte giving the kind followed by its arguments, with
+ * integers big-endian:
+ *
+ *	'C' offset (uint64) length (uint32)	copy length bytes of the server's copy, from offset
+ *	'L' length (uint32) data		append the length bytes of data that follow
+ *
+ * Only stored copies that are byte-for-byte what the logger sent can be worked from, so files that
+ * the server rewrote when storing them (to add platform metadata) and archived files can't.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The block sizes for signatures: the default, and the range that a logger may ask for.
+const (
+	defaultDeltaBlock = 4096
+	minDeltaBlock     = 256
+	maxDeltaBlock     = 1 << 20
+)
+
+// The kinds of delta instruction.
+const (
+	deltaCopy    = 'C'
+	deltaLiteral = 'L'
+)
+
+// A file rebuilt from a delta can be at most this many times the size of the server's copy, plus the
+// size of the delta itself (i.e., the literal data), whatever the configured upload limit; otherwise a
+// few bytes of copy instructions could have the server build a file of any size in memory.
+const maxDeltaGrowth = 2
+
+// An ErrDeltaMalformed is returned for deltas that can't be applied.
+var ErrDeltaMalformed = errors.New("malformed delta")
+
+// Find the most recent stored copy from the logger of the file with the ID given that a delta can
+// be worked from.
+func (app *application) deltaBasis(logger string, fileID uint) (support.UploadRecord, bool) {
+	copies := app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.Logger == logger && u.FileID != nil && *u.FileID == fileID && usableBasis(u)
+	})
+	if len(copies) == 0 {
+		return support.UploadRecord{}, false
+	}
+	return copies[len(copies)-1], true
+}
+
+// Determine whether a delta can be worked from the stored copy of an upload.
+func usableBasis(u *support.UploadRecord) bool {
+	return u.Status == support.UploadAccepted && len(u.Key) > 0 && len(u.Stored) == 0 && u.Archived == nil
+}
+
+// Read the stored copy of an upload.
+func (app *application) readBasis(ctx context.Context, record support.UploadRecord) ([]byte, error) {
+	obj, _, err := app.storage.Get(ctx, record.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+// Compute the block digests of a file.
+func blockSignature(basis string, data []byte, blockSize int) api.BlockSignature {
+	rtn := api.BlockSignature{Basis: basis, Size: int64(len(data)), BlockSize: blockSize, Blocks: make([]api.BlockHash, 0)}
+	for start := 0; start < len(data); start += blockSize {
+		block := data[start:min(start+blockSize, len(data))]
+		rtn.Blocks = append(rtn.Blocks, api.BlockHash{Weak: adler32.Checksum(block), Strong: fmt.Sprintf("%x", md5.Sum(block))})
+	}
+	return rtn
+}
+
+// Rebuild a file from the server's copy and a delta, refusing to build more than the limit given
+// (zero for no limit other than maxDeltaGrowth).
+func applyDelta(basis, delta []byte, limit int64) ([]byte, error) {
+	if growth := int64(maxDeltaGrowth*len(basis) + len(delta)); limit <= 0 || limit > growth {
+		limit = growth
+	}
+	var rtn []byte
+	for len(delta) > 0 {
+		var data []byte
+		switch delta[0] {
+		case deltaCopy:
+			if len(delta) < 13 {
+				return nil, ErrDeltaMalformed
+			}
+			offset, length := binary.BigEndian.Uint64(delta[1:9]), uint64(binary.BigEndian.Uint32(delta[9:13]))
+			if offset > uint64(len(basis)) || length > uint64(len(basis))-offset {
+				return nil, fmt.Errorf("%w: copy of %d bytes at %d is outside the file", ErrDeltaMalformed, length, offset)
+			}
+			data, delta = basis[offset:offset+length], delta[13:]
+		case deltaLiteral:
+			if len(delta) < 5 {
+				return nil, ErrDeltaMalformed
+			}
+			length := uint64(binary.BigEndian.Uint32(delta[1:5]))
+			if length > uint64(len(delta)-5) {
+				return nil, fmt.Errorf("%w: literal of %d bytes is truncated", ErrDeltaMalformed, length)
+			}
+			data, delta = delta[5:5+length], delta[5+length:]
+		default:
+			return nil, fmt.Errorf("%w: unknown instruction %q", ErrDeltaMalformed, delta[0])
+		}
+		if int64(len(rtn)+len(data)) > limit {
+			return nil, fmt.Errorf("rebuilt file exceeds %d bytes", limit)
+		}
+		rtn = append(rtn, data...)
+	}
+	return rtn, nil
+}
+
+// Give the logger the block digests of the server's copy of one of its files, by the file's ID.  The
+// block size can be given in the block_size query parameter.
+func (app *application) deltaSignature(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "malformed file ID")
+		return
+	}
+	blockSize := defaultDeltaBlock
+	if s := r.URL.Query().Get("block_size"); len(s) > 0 {
+		if blockSize, err = strconv.Atoi(s); err != nil || blockSize < minDeltaBlock || blockSize > maxDeltaBlock {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("block size must be between %d and %d", minDeltaBlock, maxDeltaBlock))
+			return
+		}
+	}
+	logger := support.LoggerID(r)
+	record, ok := app.deltaBasis(logger, uint(id))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no usable copy of the file")
+		return
+	}
+	data, err := app.readBasis(r.Context(), record)
+	if err != nil {
+		support.Errorf("API: failed to read %s as basis for a delta: %s\n", record.Key, err)
+		writeError(w, http.StatusInternalServerError, "failed to read file from storage")
+		return
+	}
+	writeJSON(w, http.StatusOK, blockSignature(record.UUID, data, blockSize))
+}
+
+// Accept a file as a delta from the server's copy of a previous upload (by UUID in the path), which
+// is handled as a file transfer once the file has been rebuilt.
+func (app *application) deltaTransfer(w http.ResponseWriter, r *http.Request) {
+	logger := support.LoggerID(r)
+	record, ok := app.uploads.Get(r.PathValue("basis"))
+	if !ok || record.Logger != logger || !usableBasis(&record) {
+		writeError(w, http.StatusNotFound, "no usable copy of the file")
+		return
+	}
+	delta, err := io.ReadAll(r.Body)
+	if err != nil {
+		if app.tooLarge(w, r, err) {
+			return
+		}
+		support.Errorf("API: failed to read delta body: %s.\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+	basis, err := app.readBasis(r.Context(), record)
+	if err != nil {
+		support.Errorf("API: failed to read %s as basis for a delta: %s\n", record.Key, err)
+		writeError(w, http.StatusInternalServerError, "failed to read file from storage")
+		return
+	}
+	payload, _ := app.payloadType(r)
+	body, err := applyDelta(basis, delta, app.payloadLimit(payload))
+	if err != nil {
+		support.Warnf("TRANS: refusing delta from logger %s against %s: %s\n", logger, record.UUID, err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	support.Infof("TRANS: rebuilt %d bytes from a delta of %d bytes against %s.\n", len(body), len(delta), record.UUID)
+	if len(r.Header.Get(fileIDHeader)) == 0 && record.FileID != nil {
+		r.Header.Set(fileIDHeader, strconv.FormatUint(uint64(*record.FileID), 10))
+	}
+	r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	app.file_transfer(w, r)
+}
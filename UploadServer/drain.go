@@ -0,0 +1,153 @@
+/*! @file drain.go
+ * @brief Health checks, and draining the server before a restart
+ *
+ * Behind a load balancer, the server reports whether it's alive at /healthz and whether it should
+ * be sent new requests at /readyz (which also checks its dependencies; see readiness.go).  To
+ * restart an instance without dropping uploads, the operator drains it first (through the
+ * administration API, or by sending the process SIGUSR1): /readyz then reports that the instance
+ * isn't ready, so the load balancer stops sending it new requests, while requests already in
+ * progress (or still arriving during the load balancer's check interval) are handled as
+ * normal.  Connections are closed after each response while draining, so that clients reconnect
+ * through the load balancer.  Once the drain status shows no uploads in flight, the instance can be
+ * stopped.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The drainState tracks whether the server is draining, and how many uploads are in progress.
+type drainState struct {
+	mu       sync.Mutex
+	since    *time.Time // When draining started, or nil if not draining
+	inFlight atomic.Int64
+}
+
+// The drainStatus reports the drain state through the administration API.
+type drainStatus struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+	InFlight int64      `json:"uploads_in_flight"`
+}
+
+func (d *drainState) status() drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return drainStatus{Draining: d.since != nil, Since: d.since, InFlight: d.inFlight.Load()}
+}
+
+// Start draining, if not already doing so, returning true if the state changed.
+func (d *drainState) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since != nil {
+		return false
+	}
+	now := time.Now().UTC()
+	d.since = &now
+	return true
+}
+
+// Stop draining (e.g., if the restart was called off), returning true if the state changed.
+func (d *drainState) stop() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := d.since != nil
+	d.since = nil
+	return changed
+}
+
+func (d *drainState) draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.since != nil
+}
+
+// Count the requests to the handler given as uploads in flight, timing them for the ingest metrics.
+func (app *application) countUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app.drain.inFlight.Add(1)
+		defer app.drain.inFlight.Add(-1)
+		start := time.Now()
+		next(w, r)
+		app.ingest.Latency(time.Since(start))
+	}
+}
+
+// Ask clients to close their connections after each response while draining.
+func (app *application) closeWhenDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.drain.draining() {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Report that the server is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// The readyStatus reports the drain state and the state of each dependency (see readiness.go).
+type readyStatus struct {
+	drainStatus
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+// Report whether the server should be sent new requests: HTTP 200 if so, or HTTP 503 (Service
+// Unavailable) while draining or if any of its dependencies can't be used.
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	status := readyStatus{drainStatus: app.drain.status()}
+	dependencies, ok := app.checkDependencies(app.ctx)
+	status.Dependencies = dependencies
+	if status.Draining || !ok {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Report the drain state, and the number of uploads in flight.
+func (app *application) getDrain(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.drain.status())
+}
+
+// Start draining the server.
+func (app *application) startDrain(w http.ResponseWriter, r *http.Request) {
+	if app.drain.start() {
+		app.recordAction(r, "server.drain", app.instance, "")
+	}
+	writeJSON(w, http.StatusAccepted, app.drain.status())
+}
+
+// Stop draining the server, so that it's reported ready again.
+func (app *application) stopDrain(w http.ResponseWriter, r *http.Request) {
+	if app.drain.stop() {
+		app.recordAction(r, "server.undrain", app.instance, "")
+	}
+	writeJSON(w, http.StatusOK, app.drain.status())
+}
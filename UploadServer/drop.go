@@ -0,0 +1,142 @@
+/*! @file drop.go
+ * @brief Ingestion of files from a drop directory fed by SFTP
+ *
+ * Some partner institutions can only push data from their networks by SFTP.  Rather than embed an
+ * SFTP server, the server collects from a drop directory that an ordinary SFTP server writes to, with
+ * each partner's account confined to its own subdirectory.  The "drop" job handles each file in the
+ * subdirectories listed in the configuration as an upload from the logger given for the
+ * subdirectory, so the usual checks, de-duplication, storage, and notification apply; the SFTP
+ * server's accounts take the place of upload tokens.  A file is only collected once it has gone
+ * unmodified for the settling time, so that files still being written are left alone, and hidden
+ * files (which SFTP clients often write before renaming) are ignored.  Accepted files (and repeats
+ * of files already accepted) are removed; rejected files are moved to .rejected in the drop
+ * directory (with a suffix if a file of the same name was rejected before), so that the operator
+ * can see what failed.  Files that fail for reasons that may pass (e.g., storage failing, or the
+ * logger awaiting approval) are left in place for the next run, and a file that can't be read or
+ * moved is reported and skipped, so that one bad file doesn't hold up the rest.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The subdirectory of the drop directory to which rejected files are moved.
+const dropRejected = ".rejected"
+
+// Collect the files in the drop directory that have settled.
+func (app *application) dropJob(ctx context.Context) (string, error) {
+	param := app.config.Drop
+	if len(param.Directory) == 0 {
+		return "no drop directory configured", nil
+	}
+	settle := time.Duration(param.SettleSeconds) * time.Second
+	var accepted, rejected, retrying, failed, waiting int
+	for subdir, logger := range param.Loggers {
+		entries, err := os.ReadDir(filepath.Join(param.Directory, subdir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			support.Errorf("DROP: failed to read drop directory for logger %s: %s\n", logger, err)
+			failed++
+			continue
+		}
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				break
+			}
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if time.Since(info.ModTime()) < settle {
+				waiting++
+				continue
+			}
+			path := filepath.Join(param.Directory, subdir, entry.Name())
+			outcome, err := app.collectDropped(ctx, subdir, logger, path)
+			if err != nil {
+				support.Errorf("DROP: failed to collect %s for logger %s: %s\n", path, logger, err)
+				failed++
+				continue
+			}
+			switch outcome {
+			case dropAccepted:
+				accepted++
+			case dropRefused:
+				rejected++
+			default:
+				retrying++
+			}
+		}
+	}
+	return fmt.Sprintf("%d files accepted, %d rejected, %d left to retry, %d failed, %d still settling", accepted,
+		rejected, retrying, failed, waiting), nil
+}
+
+// The outcomes of collecting a file from the drop directory.
+const (
+	dropAccepted = iota
+	dropRefused
+	dropRetry
+)
+
+// Handle one file from the drop directory as an upload from the logger given, removing it if it's
+// accepted, leaving it in place if it might be accepted later, and moving it aside if not.
+func (app *application) collectDropped(ctx context.Context, subdir, logger, path string) (int, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return dropRetry, err
+	}
+	ok, retry := app.acceptFile(ctx, logger, "drop:"+subdir, filepath.Base(path), body)
+	switch {
+	case ok:
+		support.Infof("DROP: accepted %s for logger %s.\n", path, logger)
+		return dropAccepted, os.Remove(path)
+	case retry:
+		support.Warnf("DROP: failed to collect %s for logger %s; leaving it for the next run.\n", path, logger)
+		return dropRetry, nil
+	}
+	dir := filepath.Join(app.config.Drop.Directory, dropRejected, subdir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return dropRetry, err
+	}
+	target := filepath.Join(dir, filepath.Base(path))
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s.%d", filepath.Base(path), n))
+	}
+	support.Warnf("DROP: rejected %s for logger %s; moving it to %s.\n", path, logger, target)
+	return dropRefused, os.Rename(path, target)
+}
@@ -0,0 +1,264 @@
+/*! @file email.go
+ * @brief Ingestion of WIBL files sent as email attachments
+ *
+ * Some vessels only have email over satellite (through shipboard systems that batch messages for
+ * transmission), so their crews send WIBL files as attachments.  The "email" job collects unseen
+ * messages from the IMAP mailbox in the configuration, and an inbound mail relay can instead POST
+ * each message (as RFC 5322 text) to the email gateway end-point, with the gateway secret (see
+ * gateway.go).  Either way, a message is only accepted from an allowed sender, which gives the
+ * logger it sends for, and only if it carries that logger's upload token (in an X-WIBL-Token header,
+ * or on a "WIBL-Token: {token}" line in its text, since crews can't always set headers).  Each
+ * attachment is then handled as an upload from the logger, so the usual checks, de-duplication,
+ * storage, and notification apply.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/imap"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The header in which a message may carry the logger's upload token.
+const emailTokenHeader = "X-WIBL-Token"
+
+// The line in a message's text that may carry the logger's upload token instead.
+var emailTokenLine = regexp.MustCompile(`(?im)^\s*WIBL-Token:\s*(\S+)\s*$`)
+
+// The largest message accepted, and the deepest nesting of multipart sections followed.
+const (
+	maxMessage      = 64 << 20
+	maxMessageDepth = 5
+)
+
+// How long to wait to connect to the IMAP server.
+const imapTimeout = 30 * time.Second
+
+// Errors for messages that aren't accepted.
+var (
+	ErrEmailSender = errors.New("sender not allowed")
+	ErrEmailToken  = errors.New("missing or invalid upload token")
+)
+
+// An emailPart is one leaf section of a message: its content type, the name of the file if it's an
+// attachment, and its decoded content.
+type emailPart struct {
+	mediaType string
+	filename  string
+	content   []byte
+}
+
+// Determine which logger a sender sends for, if it's allowed.  Addresses aren't case-sensitive.
+func (app *application) emailSender(address string) (string, bool) {
+	for sender, logger := range app.config.Inbound.Senders {
+		if strings.EqualFold(sender, address) {
+			return logger, true
+		}
+	}
+	return "", false
+}
+
+// Handle one message, accepting its attachments as uploads from the logger that its sender sends
+// for, if the sender is allowed and the message carries the logger's upload token.  The number of
+// attachments accepted and rejected are given.
+func (app *application) ingestMessage(ctx context.Context, raw []byte) (int, int, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed message: %w", err)
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed sender: %w", err)
+	}
+	logger, ok := app.emailSender(from.Address)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %s", ErrEmailSender, from.Address)
+	}
+	parts, err := messageParts(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed message from %s: %w", from.Address, err)
+	}
+	token := strings.TrimSpace(msg.Header.Get(emailTokenHeader))
+	var attachments []emailPart
+	for _, p := range parts {
+		if len(p.filename) > 0 {
+			attachments = append(attachments, p)
+		} else if match := emailTokenLine.FindSubmatch(p.content); len(token) == 0 && match != nil && strings.HasPrefix(p.mediaType, "text/") {
+			token = string(match[1])
+		}
+	}
+	if _, ok := app.tokens.Authenticate(logger, token); !ok {
+		return 0, 0, fmt.Errorf("%w from %s for logger %s", ErrEmailToken, from.Address, logger)
+	}
+	remote := "email:" + from.Address
+	var accepted, rejected int
+	for _, a := range attachments {
+		if ok, _ := app.acceptFile(ctx, logger, remote, a.filename, a.content); ok {
+			support.Infof("EMAIL: accepted attachment %q from %s for logger %s.\n", a.filename, from.Address, logger)
+			accepted++
+		} else {
+			rejected++
+		}
+	}
+	return accepted, rejected, nil
+}
+
+// Decode a section of a message with the content type and transfer encoding given, returning its
+// leaf sections.
+func messageParts(contentType, encoding string, body io.Reader, depth int) ([]emailPart, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMessageDepth {
+			return nil, errors.New("multipart sections nested too deeply")
+		}
+		var rtn []emailPart
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return rtn, nil
+			} else if err != nil {
+				return nil, err
+			}
+			parts, err := messageParts(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if filename := part.FileName(); len(parts) == 1 && len(filename) > 0 {
+				parts[0].filename = filename
+			}
+			rtn = append(rtn, parts...)
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return []emailPart{{mediaType: mediaType, filename: params["name"], content: content}}, nil
+}
+
+// Collect unseen messages from the IMAP mailbox in the configuration.  Each message is marked seen
+// once handled, whether or not it was accepted, so that it isn't collected again.
+func (app *application) emailJob(ctx context.Context) (string, error) {
+	param := app.config.Inbound
+	if len(param.Server) == 0 {
+		return "no inbound mail server configured", nil
+	}
+	host, _, err := net.SplitHostPort(param.Server)
+	if err != nil {
+		return "", err
+	}
+	client, err := imap.Dial(param.Server, &tls.Config{ServerName: host}, imapTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer client.Logout()
+	if err := client.Login(param.Username, param.Password); err != nil {
+		return "", err
+	}
+	if err := client.Select(param.Mailbox); err != nil {
+		return "", err
+	}
+	uids, err := client.Unseen()
+	if err != nil {
+		return "", err
+	}
+	var messages, accepted, rejected, refused int
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			break
+		}
+		raw, err := client.Fetch(uid)
+		if err != nil {
+			return "", err
+		}
+		if len(raw) > maxMessage {
+			support.Warnf("EMAIL: ignoring message %d of %d bytes (limit %d).\n", uid, len(raw), maxMessage)
+			refused++
+		} else if a, r, err := app.ingestMessage(ctx, raw); err != nil {
+			support.Warnf("EMAIL: refusing message %d: %s\n", uid, err)
+			refused++
+		} else {
+			accepted += a
+			rejected += r
+		}
+		messages++
+		if err := client.MarkSeen(uid); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d messages (%d refused), %d files accepted, %d rejected", messages, refused, accepted, rejected), nil
+}
+
+// Accept a message POSTed by an inbound mail relay, as RFC 5322 text.
+func (app *application) emailDelivery(w http.ResponseWriter, r *http.Request) {
+	if len(app.config.Gateway.Secret) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if !app.gatewayAuthorized(r) {
+		support.Warnf("GATEWAY: email delivery from %s failed authentication.\n", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessage))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "message too large")
+		return
+	}
+	accepted, rejected, err := app.ingestMessage(r.Context(), raw)
+	switch {
+	case errors.Is(err, ErrEmailSender), errors.Is(err, ErrEmailToken):
+		support.Warnf("EMAIL: refusing message relayed by %s: %s\n", r.RemoteAddr, err)
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"accepted": accepted, "rejected": rejected})
+}
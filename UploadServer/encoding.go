@@ -0,0 +1,130 @@
+/*! @file encoding.go
+ * @brief Negotiating the encoding of checkin requests and responses
+ *
+ * Checkins are JSON by default, but encoding (and decoding) a large file inventory as JSON is a
+ * real cost on an ESP32-class logger, so a logger can send its status as CBOR instead, by setting
+ * the Content-Type to "application/cbor", and ask for the response as CBOR with the Accept
+ * header.  CBOR messages use the same keys as the JSON ones, but times in a CBOR response are Unix
+ * seconds.  A CBOR status is converted to JSON before it's decoded, so that it's checked for fields
+ * that the server doesn't understand (see support/lenient.go) in exactly the same way.  Unless the
+ * Accept header names one or the other, the response is in the encoding of the request.  The server
+ * lists the encodings that it accepts in its build information (see version.go), so that a logger
+ * can check before switching.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+const (
+	contentJSON = "application/json"
+	contentCBOR = "application/cbor"
+)
+
+// The content types accepted for checkins, as advertised to loggers.
+var checkinEncodings = []string{contentJSON, contentCBOR}
+
+// CBOR is decoded into generic values with string keys so that it can be re-encoded as JSON; times
+// (tags 0 and 1) become RFC 3339 strings on the way.
+var cborGeneric = func() cbor.DecMode {
+	mode, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any{})}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// Determine whether the content type given is CBOR.
+func isCBOR(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == contentCBOR
+}
+
+// Decode a checkin's status from the body of the request, in the encoding given by its Content-Type,
+// returning the warnings for the parts that the server doesn't understand.
+func decodeStatus(r *http.Request, body []byte, v any) ([]string, error) {
+	if !isCBOR(r.Header.Get("Content-Type")) {
+		return support.DecodeLenient(body, v)
+	}
+	var generic any
+	if err := cborGeneric.Unmarshal(body, &generic); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return nil, fmt.Errorf("CBOR status can't be represented as JSON: %w", err)
+	}
+	return support.DecodeLenient(data, v)
+}
+
+// Choose the encoding of the response to a request, returning its content type and the function
+// to marshal it: CBOR if the Accept header prefers it to JSON, or (if the Accept header names
+// neither) if the request was CBOR, and JSON otherwise.
+func responseEncoding(r *http.Request) (string, func(any) ([]byte, error)) {
+	cborQ, jsonQ, anyQ := -1.0, -1.0, 0.0
+	for _, item := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case contentCBOR:
+			cborQ = max(cborQ, q)
+		case contentJSON:
+			jsonQ = max(jsonQ, q)
+		case "application/*", "*/*":
+			anyQ = max(anyQ, q)
+		}
+	}
+	switch {
+	case cborQ < 0 && jsonQ < 0:
+		cborQ, jsonQ = 0, 0
+		if isCBOR(r.Header.Get("Content-Type")) {
+			cborQ = 1
+		}
+	case cborQ < 0:
+		cborQ = anyQ
+	case jsonQ < 0:
+		jsonQ = anyQ
+	}
+	if cborQ > jsonQ {
+		return contentCBOR, cbor.Marshal
+	}
+	return contentJSON, json.Marshal
+}
@@ -0,0 +1,207 @@
+/*! @file enrolcodes.go
+ * @brief Self-service enrolment of new loggers with one-time codes
+ *
+ * Rather than mint a token for each new logger and type it into the logger's configuration, an
+ * administrator mints a one-time enrolment code (see support/enrolcodes.go), which is entered into
+ * the logger on the bench.  The logger presents the code to /v1/register, and gets back the unique
+ * identifier that the server assigns it and an upload token bound to that identifier.  The logger
+ * appears in the registry with the tenant, vessel, and transfer profile given with the code, and a
+ * note of its serial number and firmware, but is pending: it can check in, but its uploads (by any
+ * route: whole files, chunks, upload sessions, and deltas), live streams, and beacons are refused
+ * with HTTP 403 until an administrator approves it, so that a leaked code can't be used to inject
+ * data.  Since a code is as good as an upload token, minting codes and approving loggers need the
+ * admin role, as minting tokens does.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The default and longest lifetime of an enrolment code, in hours.
+const (
+	defaultEnrolmentHours = 72
+	maxEnrolmentHours     = 30 * 24
+)
+
+// The longest serial number or firmware version that a logger can give when enrolling.
+const maxEnrolmentDetail = 128
+
+// Report the enrolment codes that have been minted (hashes only).
+func (app *application) listEnrolmentCodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.codes.List())
+}
+
+// Mint a new enrolment code, returning the plain-text code to the caller.
+func (app *application) mintEnrolmentCode(w http.ResponseWriter, r *http.Request) {
+	var request api.EnrolmentCodeRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	hours := request.Hours
+	if hours == 0 {
+		hours = defaultEnrolmentHours
+	}
+	if hours < 0 || hours > maxEnrolmentHours {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("hours must be between 1 and %d", maxEnrolmentHours))
+		return
+	}
+	if _, ok := app.vessels.Get(request.Vessel); len(request.Vessel) > 0 && !ok {
+		writeError(w, http.StatusBadRequest, "no such vessel")
+		return
+	}
+	if _, ok := app.config.Transfer.Profiles[request.Profile]; len(request.Profile) > 0 && !ok {
+		writeError(w, http.StatusBadRequest, "no such transfer profile")
+		return
+	}
+	code, record, err := app.codes.Mint(support.EnrolmentCode{
+		Description: request.Description,
+		Author:      support.CurrentPrincipal(r).Name,
+		Tenant:      request.Tenant,
+		Vessel:      request.Vessel,
+		Profile:     request.Profile,
+	}, time.Duration(hours)*time.Hour)
+	if err != nil {
+		support.Errorf("ADMIN: failed to mint enrolment code: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to mint enrolment code")
+		return
+	}
+	app.recordAction(r, "enrolment.mint", record.ID, record.Description)
+	writeJSON(w, http.StatusCreated, api.EnrolmentCodeResponse{ID: record.ID, Code: code, Expires: record.Expires})
+}
+
+// Revoke an enrolment code, so that it can't be used.
+func (app *application) revokeEnrolmentCode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := app.codes.Revoke(id); err != nil {
+		if errors.Is(err, support.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "no such enrolment code")
+		} else {
+			support.Errorf("ADMIN: failed to revoke enrolment code %s: %s\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed to revoke enrolment code")
+		}
+		return
+	}
+	app.recordAction(r, "enrolment.revoke", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Approve a logger that enrolled itself, so that its uploads are accepted.
+func (app *application) approveLogger(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if existing, ok := app.registry.Get(id); !ok || !existing.Pending {
+		writeError(w, http.StatusNotFound, "logger is not awaiting approval")
+		return
+	}
+	record, err := app.registry.Update(id, func(l *support.LoggerRecord) error {
+		l.Pending = false
+		return nil
+	})
+	if err != nil {
+		support.Errorf("ADMIN: failed to approve logger %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to approve logger")
+		return
+	}
+	app.recordAction(r, "logger.approve", id, "")
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Refuse requests from loggers that are awaiting approval, with HTTP 403 (Forbidden).
+func (app *application) requireApproved(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := support.LoggerID(r)
+		if entry, ok := app.registry.Get(logger); ok && entry.Pending {
+			support.Warnf("TRANS: refusing %s %s from logger %s, which is awaiting approval.\n", r.Method, r.URL.Path, logger)
+			writeError(w, http.StatusForbidden, "logger awaiting approval")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Enrol a new logger with a one-time code, assigning it an identifier and upload token.
+func (app *application) registerLogger(w http.ResponseWriter, r *http.Request) {
+	var request api.EnrolmentRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if len(request.Code) == 0 {
+		writeError(w, http.StatusBadRequest, "enrolment code is required")
+		return
+	}
+	if len(request.Serial) > maxEnrolmentDetail || len(request.Firmware) > maxEnrolmentDetail {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("serial number and firmware version must be at most %d characters", maxEnrolmentDetail))
+		return
+	}
+	logger := support.NewUUID()
+	code, err := app.codes.Redeem(request.Code, logger)
+	switch {
+	case errors.Is(err, support.ErrEnrolmentCode):
+		support.Warnf("API: refused enrolment from %s with an invalid code.\n", r.RemoteAddr)
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	case err != nil:
+		support.Errorf("API: failed to redeem enrolment code: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to enrol logger")
+		return
+	}
+	token, record, err := app.tokens.Mint(logger, "enrolled with code "+code.ID)
+	if err != nil {
+		support.Errorf("API: failed to mint upload token for enrolling logger %s: %s\n", logger, err)
+		app.abandonEnrolment(code.ID, "")
+		writeError(w, http.StatusInternalServerError, "failed to enrol logger")
+		return
+	}
+	if _, err := app.registry.Update(logger, func(l *support.LoggerRecord) error {
+		l.Tenant, l.Vessel, l.Profile, l.Pending = code.Tenant, code.Vessel, code.Profile, true
+		note, err := support.NewNote("enrolment", fmt.Sprintf("Enrolled with code %s (%s) from %s; serial %q, firmware %q.",
+			code.ID, code.Description, r.RemoteAddr, request.Serial, request.Firmware))
+		l.Notes = append(l.Notes, note)
+		return err
+	}); err != nil {
+		support.Errorf("API: failed to add enrolling logger %s to the registry: %s\n", logger, err)
+		app.abandonEnrolment(code.ID, record.ID)
+		writeError(w, http.StatusInternalServerError, "failed to enrol logger")
+		return
+	}
+	support.Infof("API: logger %s enrolled from %s with code %s; awaiting approval.\n", logger, r.RemoteAddr, code.ID)
+	app.audit.Record(logger, r.RemoteAddr, "logger.enrol", logger, "code "+code.ID)
+	writeJSON(w, http.StatusCreated, api.Enrolment{Logger: logger, Token: token, Expires: record.Expires, Pending: true})
+}
+
+// Undo the parts of an enrolment that succeeded, so that the code can be used again.
+func (app *application) abandonEnrolment(codeID, tokenID string) {
+	if len(tokenID) > 0 {
+		if err := app.tokens.Revoke(tokenID); err != nil {
+			support.Errorf("API: failed to revoke upload token %s of abandoned enrolment: %s\n", tokenID, err)
+		}
+	}
+	if err := app.codes.Release(codeID); err != nil {
+		support.Errorf("API: failed to release enrolment code %s: %s\n", codeID, err)
+	}
+}
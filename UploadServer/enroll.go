@@ -0,0 +1,104 @@
+/*! @file enroll.go
+ * @brief Enrolment of loggers for client certificates
+ *
+ * A simple enrolment flow, after EST (RFC 7030): a logger that has authenticated (with its upload
+ * token, a session, or a certificate it enrolled for before) posts a certificate signing request to
+ * /v1/enroll, and gets back a client certificate signed by the server's logger CA (see
+ * support/enroll.go), followed by the CA certificate.  The request may be PEM, DER, or base64 DER
+ * (as in EST).  The logger then presents the certificate on later connections, and doesn't need to
+ * send its token; it enrols again before the certificate expires.  The CA certificate is available
+ * from /v1/enroll/ca for anyone who needs to check the certificates.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The largest certificate signing request accepted.
+const maxCSRBytes = 16 * 1024
+
+// Decode a certificate signing request, which may be PEM, DER, or base64-encoded DER.
+func parseCSR(body []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(body))); err == nil {
+		body = decoded
+	}
+	return x509.ParseCertificateRequest(body)
+}
+
+// Sign a client certificate for the logger making the request.
+func (app *application) enroll(w http.ResponseWriter, r *http.Request) {
+	if app.ca == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSRBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read certificate signing request")
+		return
+	}
+	csr, err := parseCSR(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "malformed certificate signing request")
+		return
+	}
+	logger, id := support.LoggerID(r), support.TokenID(r)
+	token, ok := app.tokens.Get(id)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "token has been revoked")
+		return
+	}
+	notAfter := time.Now().UTC().AddDate(0, 0, app.config.Enrollment.ValidityDays)
+	if token.Expires != nil && token.Expires.Before(notAfter) {
+		notAfter = *token.Expires
+	}
+	cert, serial, err := app.ca.Sign(csr, logger, id, notAfter)
+	if err != nil {
+		support.Warnf("API: failed to sign certificate for logger %s: %s\n", logger, err)
+		writeError(w, http.StatusBadRequest, "certificate signing request refused")
+		return
+	}
+	support.Infof("API: enrolled logger %s for certificate %s, good until %s.\n", logger, serial, notAfter.Format(time.RFC3339))
+	app.audit.Record(logger, r.RemoteAddr, "cert.enroll", serial, "token "+id)
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(append(cert, app.ca.CertificatePEM()...))
+}
+
+// Provide the certificate of the CA that signs logger certificates.
+func (app *application) enrollCA(w http.ResponseWriter, r *http.Request) {
+	if app.ca == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(app.ca.CertificatePEM())
+}
@@ -0,0 +1,217 @@
+/*! @file export.go
+ * @brief Export of the audit trail and upload history for external review
+ *
+ * Institutions running the server need to feed its records into their own security and data
+ * management systems (e.g., a SIEM), and to produce them for data-handling reviews.  These
+ * end-points stream the audit trail or upload history for a time range as either CSV or JSON Lines,
+ * without buffering the whole export in memory.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A recordWriter writes records in the format that the caller requested.  Each record is provided
+// both as an object (for JSON) and as a list of fields matching the header (for CSV).
+type recordWriter interface {
+	Write(v any, fields []string) error
+	Flush() error
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+	rc  *http.ResponseController
+}
+
+func (j *jsonlWriter) Write(v any, fields []string) error { return j.enc.Encode(v) }
+func (j *jsonlWriter) Flush() error                       { return j.rc.Flush() }
+
+type csvWriter struct {
+	w  *csv.Writer
+	rc *http.ResponseController
+}
+
+func (c *csvWriter) Write(v any, fields []string) error { return c.w.Write(fields) }
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+// How long a streamed response (e.g., an archive of files, or a large download) may go without
+// writing anything before it's abandoned.  These outlast the server's write timeout, so the deadline
+// is pushed back on every write instead.
+const streamIdle = time.Minute
+
+// A streamWriter pushes back the connection's write deadline on every write, so that a long response
+// isn't cut off by the server's write timeout while the client is still reading it.
+type streamWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func streamResponse(w http.ResponseWriter) *streamWriter {
+	return &streamWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.rc.SetWriteDeadline(time.Now().Add(streamIdle))
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *streamWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// Set up the response for an export, based on the "format" query parameter ("csv" or "jsonl",
+// defaulting to the latter), and return a writer for the records.  The response is streamed (see
+// streamResponse), so that a long export isn't cut off by the server's write timeout.  On failure,
+// an error response is written and the writer is nil.
+func startExport(w http.ResponseWriter, r *http.Request, name string, header []string) recordWriter {
+	w = streamResponse(w)
+	rc := http.NewResponseController(w)
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "jsonl":
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".jsonl"))
+		return &jsonlWriter{enc: json.NewEncoder(w), rc: rc}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+		cw := &csvWriter{w: csv.NewWriter(w), rc: rc}
+		cw.w.Write(header)
+		return cw
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown export format %q", format))
+		return nil
+	}
+}
+
+// Parse the "from" and "to" query parameters that give the time range for a query.  Either can be
+// omitted (see queryTime()).  On failure, an error response is written and false is returned.
+func timeRange(w http.ResponseWriter, r *http.Request) (from, to time.Time, ok bool) {
+	if from, ok = queryTime(w, r, "from"); !ok {
+		return
+	}
+	to, ok = queryTime(w, r, "to")
+	return
+}
+
+// Parse a time from the named query parameter, which can be either an RFC 3339 time or a date
+// (YYYY-MM-DD, taken as midnight UTC).  A missing parameter results in the zero time.  On failure,
+// an error response is written and false is returned.
+func queryTime(w http.ResponseWriter, r *http.Request, name string) (time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if len(value) == 0 {
+		return time.Time{}, true
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	writeError(w, http.StatusBadRequest, fmt.Sprintf("cannot parse %q as a time for %q", value, name))
+	return time.Time{}, false
+}
+
+// The number of records written between flushes of the response.
+const exportFlushInterval = 500
+
+// Stream the audit trail for the requested time range.
+func (app *application) exportAudit(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	out := startExport(w, r, "audit", []string{"time", "actor", "remote", "action", "target", "detail"})
+	if out == nil {
+		return
+	}
+	app.recordAction(r, "export.audit", r.URL.RawQuery, "")
+	count := 0
+	err := app.audit.Scan(from, to, func(e support.AuditEntry) error {
+		fields := []string{e.Time.Format(time.RFC3339Nano), e.Actor, e.Remote, e.Action, e.Target, e.Detail}
+		if err := out.Write(e, fields); err != nil {
+			return err
+		}
+		if count++; count%exportFlushInterval == 0 {
+			return out.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		support.Errorf("ADMIN: audit export failed after %d records: %s\n", count, err)
+	}
+}
+
+// Stream the upload history for the requested time range.
+func (app *application) exportUploads(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	out := startExport(w, r, "uploads", []string{"uuid", "logger", "received", "remote", "size", "md5", "status", "reason",
+		"tags", "notes"})
+	if out == nil {
+		return
+	}
+	app.recordAction(r, "export.uploads", r.URL.RawQuery, "")
+	count := 0
+	err := app.uploads.Scan(from, to, func(u support.UploadRecord) error {
+		fields := []string{u.UUID, u.Logger, u.Received.Format(time.RFC3339Nano), u.Remote,
+			strconv.FormatInt(u.Size, 10), u.MD5, u.Status, u.Reason, strings.Join(u.Tags, ";"), joinNotes(u.Notes)}
+		if err := out.Write(u, fields); err != nil {
+			return err
+		}
+		if count++; count%exportFlushInterval == 0 {
+			return out.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		support.Errorf("ADMIN: upload history export failed after %d records: %s\n", count, err)
+	}
+}
+
+// Flatten notes into a single field for CSV export.
+func joinNotes(notes []support.Note) string {
+	parts := make([]string, 0, len(notes))
+	for _, n := range notes {
+		parts = append(parts, fmt.Sprintf("[%s %s] %s", n.Time.Format(time.RFC3339), n.Author, n.Text))
+	}
+	return strings.Join(parts, " | ")
+}
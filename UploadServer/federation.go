@@ -0,0 +1,451 @@
+/*! @file federation.go
+ * @brief Forwarding of uploads and checkins from a downstream server to an upstream one
+ *
+ * A server on a research vessel's LAN collects from the loggers aboard while the vessel is at sea,
+ * but the data is wanted ashore.  A downstream server configured with an upstream server (see
+ * FederationParam in support/config.go) keeps a journal of its loggers' checkins, and the "federate"
+ * job forwards its accepted uploads and the checkins to the upstream server whenever it can reach
+ * it, so the collector drains itself when the vessel gets shore connectivity.  Uploads go to the
+ * upstream server with the same protocol as from a logger (the same headers and digest, with the
+ * logger's identifier in the X-Federated-Logger header), so they're checked and stored as if the
+ * logger had sent them directly; repeats are acknowledged without being stored again.  Checkins go in
+ * batches, with the time they were made.
+ *
+ * The upstream server keeps a sync cursor for each downstream server (and each instance of a
+ * downstream cluster; see support/federation.go): how far it has forwarded each kind of record, by
+ * time of receipt.  The downstream server reads the cursor at the start of each run, forwards what
+ * it has received since, and moves the cursor on, so an interrupted run resumes where it stopped.
+ * Uploads that the upstream server refuses outright (e.g., as malformed) are logged and skipped, so
+ * that they don't block the rest; uploads it can't take yet (e.g., for a logger that isn't approved
+ * there) stop the run, and are tried again on the next.  A downstream server is trusted to say
+ * which logger each record is from, so its token should be treated like an admin credential.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The header in which a downstream server names the logger that a forwarded upload is from.
+const federatedLoggerHeader = "X-Federated-Logger"
+
+// The most checkins forwarded in one request, and the largest request of checkins accepted.
+const (
+	federationBatch      = 500
+	maxFederatedCheckins = 16 << 20
+)
+
+// An upstream is the server that this one forwards its uploads and checkins to.
+type upstream struct {
+	base   string // URL of the federation end-points, ending in '/'
+	token  string
+	client *http.Client
+}
+
+// Generate the client for the upstream server in the configuration, or nil if there isn't one.
+func newUpstream(param support.FederationParam) (*upstream, error) {
+	if len(param.UpstreamURL) == 0 {
+		return nil, nil
+	}
+	if len(param.Token) == 0 {
+		return nil, errors.New("a token is required for the upstream server")
+	}
+	u := &upstream{
+		base:   strings.TrimSuffix(param.UpstreamURL, "/") + "/v1/federation/",
+		token:  param.Token,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(param.CACert) > 0 {
+		pool, err := support.CertPool(param.CACert)
+		if err != nil {
+			return nil, err
+		}
+		u.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return u, nil
+}
+
+// Send a request to the upstream server, returning the response if it has a 2xx status.  Other
+// responses are closed, and reported as an upstreamError.
+func (u *upstream) do(request *http.Request) (*http.Response, error) {
+	request.Header.Set("Authorization", "Bearer "+u.token)
+	response, err := u.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		return response, &upstreamError{status: response.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+	return response, nil
+}
+
+// An upstreamError reports a response from the upstream server other than success.
+type upstreamError struct {
+	status  int
+	message string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream server responded %d %s: %s", e.status, http.StatusText(e.status), e.message)
+}
+
+// Determine whether the upstream server refused a request for what it held (so that retrying won't
+// help), rather than because of its own state (e.g., the same file being uploaded already, or the
+// logger awaiting approval there) or the downstream server's credentials.
+func refusedUpstream(err error) bool {
+	var e *upstreamError
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return true
+	case http.StatusForbidden:
+		return e.message == "logger identity mismatch"
+	}
+	return false
+}
+
+// Exchange JSON with the upstream server.  The response is decoded into rtn, if it isn't nil.
+func (u *upstream) exchange(ctx context.Context, method, path string, body, rtn any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, u.base+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := u.do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if rtn == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(rtn)
+}
+
+// Forward an upload to the upstream server, with the stored file given, returning the upstream
+// server's result.
+func (u *upstream) upload(ctx context.Context, record support.UploadRecord, data []byte, contentType string) (api.TransferResult, error) {
+	var result api.TransferResult
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.base+"update", bytes.NewReader(data))
+	if err != nil {
+		return result, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("Digest", fmt.Sprintf("md5=%x", md5.Sum(data)))
+	request.Header.Set(federatedLoggerHeader, record.Logger)
+	if len(record.Trace) > 0 {
+		request.Header.Set(traceHeader, record.Trace)
+	}
+	if len(record.Type) > 0 {
+		request.Header.Set(payloadHeader, record.Type)
+	}
+	if len(record.KeyID) > 0 {
+		request.Header.Set(encryptionHeader, record.KeyID)
+	}
+	if record.FileID != nil {
+		request.Header.Set(fileIDHeader, strconv.FormatUint(uint64(*record.FileID), 10))
+	}
+	response, err := u.do(request)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return result, err
+}
+
+// Add a checkin to the journal of those to forward upstream, if this server has an upstream server.
+func (app *application) queueCheckin(logger, remote string, at time.Time, status api.Status) {
+	if app.outbox == nil {
+		return
+	}
+	checkin := api.FederatedCheckin{Logger: logger, Time: at, Remote: remote, Status: status}
+	if err := app.outbox.Append(checkin); err != nil {
+		support.Errorf("FEDERATE: failed to queue checkin from logger %s for forwarding: %s\n", logger, err)
+	}
+}
+
+// Forward the uploads and checkins received since the last run to the upstream server.
+func (app *application) federateJob(ctx context.Context) (string, error) {
+	if app.upstream == nil {
+		return "federation is not configured", nil
+	}
+	// Each instance of a cluster forwards the uploads and checkins it received, so has its own cursor.
+	path := "cursor"
+	if name := clusterName(app.config); len(name) > 0 {
+		path += "?instance=" + url.QueryEscape(name)
+	}
+	var cursor api.SyncCursor
+	if err := app.upstream.exchange(ctx, http.MethodGet, path, nil, &cursor); err != nil {
+		return "upstream server unavailable", err
+	}
+	uploads, refused, err := app.forwardUploads(ctx, &cursor)
+	var checkins int
+	if err == nil {
+		checkins, err = app.forwardCheckins(ctx, &cursor)
+	}
+	if cerr := app.upstream.exchange(ctx, http.MethodPut, path, cursor, nil); cerr != nil && err == nil {
+		err = fmt.Errorf("moving sync cursor: %w", cerr)
+	}
+	if err == nil {
+		app.pruneCheckins(cursor.Checkins)
+	}
+	return fmt.Sprintf("forwarded %d uploads (%d refused upstream) and %d checkins", uploads, refused, checkins), err
+}
+
+// Forward the uploads accepted since the cursor, in order, moving the cursor on as each is done.  Uploads
+// that the upstream server refuses outright are skipped, but the run stops (without moving the cursor
+// past the upload) if the upstream server can't take the upload now, so that it's tried again on the
+// next run.
+func (app *application) forwardUploads(ctx context.Context, cursor *api.SyncCursor) (int, int, error) {
+	due := app.uploads.Select(cursor.Uploads, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.Status == support.UploadAccepted && len(u.Key) > 0 && u.Received.After(cursor.Uploads)
+	})
+	var forwarded, refused int
+	for _, u := range due {
+		if err := ctx.Err(); err != nil {
+			return forwarded, refused, err
+		}
+		data, err := app.readStored(ctx, u.Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			support.Warnf("FEDERATE: skipping %s from logger %s, which is no longer stored.\n", u.UUID, u.Logger)
+			cursor.Uploads = u.Received
+			continue
+		} else if err != nil {
+			return forwarded, refused, fmt.Errorf("reading %s: %w", u.Key, err)
+		}
+		result, err := app.upstream.upload(ctx, u, data, app.forwardedType(u.Type))
+		switch {
+		case refusedUpstream(err):
+			support.Warnf("FEDERATE: upstream server refused %s from logger %s: %s\n", u.UUID, u.Logger, err)
+			refused++
+		case err != nil:
+			return forwarded, refused, fmt.Errorf("forwarding %s: %w", u.UUID, err)
+		case result.Status != "success" && transientRefusals[result.Reason]:
+			return forwarded, refused, fmt.Errorf("forwarding %s: upstream server failed to take it (status %q, %q)", u.UUID,
+				result.Status, result.Reason)
+		case result.Status != "success":
+			support.Warnf("FEDERATE: upstream server refused %s from logger %s (status %q, %s).\n", u.UUID, u.Logger,
+				result.Status, result.Reason)
+			refused++
+		default:
+			forwarded++
+		}
+		cursor.Uploads = u.Received
+	}
+	return forwarded, refused, nil
+}
+
+// Read a stored object in full.
+func (app *application) readStored(ctx context.Context, key string) ([]byte, error) {
+	object, _, err := app.storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return io.ReadAll(object)
+}
+
+// Find the content type to forward an upload of the payload type given with: the first that the
+// type accepts, or generic binary data if it accepts anything.
+func (app *application) forwardedType(payload string) string {
+	types := app.config.Upload.ContentTypes
+	if len(payload) > 0 {
+		types = app.config.Upload.Types[payload].ContentTypes
+	}
+	if len(types) == 0 {
+		return "application/octet-stream"
+	}
+	return types[0]
+}
+
+// Forward the checkins made since the cursor, in batches, moving the cursor on as each is done.
+func (app *application) forwardCheckins(ctx context.Context, cursor *api.SyncCursor) (int, error) {
+	var due []api.FederatedCheckin
+	err := app.outbox.Scan(func(line []byte) error {
+		var checkin api.FederatedCheckin
+		if err := json.Unmarshal(line, &checkin); err != nil {
+			return err
+		}
+		if checkin.Time.After(cursor.Checkins) {
+			due = append(due, checkin)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var forwarded int
+	for start := 0; start < len(due); start += federationBatch {
+		batch := due[start:min(start+federationBatch, len(due))]
+		if err := app.upstream.exchange(ctx, http.MethodPost, "checkins", batch, nil); err != nil {
+			return forwarded, fmt.Errorf("forwarding checkins: %w", err)
+		}
+		forwarded += len(batch)
+		cursor.Checkins = batch[len(batch)-1].Time
+	}
+	return forwarded, nil
+}
+
+// Remove the checkins that the upstream server has from the journal.
+func (app *application) pruneCheckins(through time.Time) {
+	err := app.outbox.Rewrite(func(enc *json.Encoder) error {
+		return app.outbox.Scan(func(line []byte) error {
+			var checkin api.FederatedCheckin
+			if err := json.Unmarshal(line, &checkin); err != nil || !checkin.Time.After(through) {
+				return err
+			}
+			return enc.Encode(checkin)
+		})
+	})
+	if err != nil {
+		support.Errorf("FEDERATE: failed to prune forwarded checkins: %s\n", err)
+	}
+}
+
+// Check that a request comes from a known downstream server, writing an error response if not.
+func (app *application) checkDownstream(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if len(app.config.Federation.Downstreams) == 0 {
+		http.NotFound(w, r)
+		return "", false
+	}
+	name, ok := namedToken(r, app.config.Federation.Downstreams)
+	if !ok {
+		support.Warnf("FEDERATE: request from %s failed authentication.\n", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+	}
+	return name, ok
+}
+
+// Authenticate an upload forwarded by a downstream server, and attribute it to the logger named in
+// the request, as if the logger had sent it.
+func (app *application) downstreamAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := app.checkDownstream(w, r)
+		if !ok {
+			return
+		}
+		logger := strings.TrimSpace(r.Header.Get(federatedLoggerHeader))
+		if len(logger) == 0 {
+			writeError(w, http.StatusBadRequest, "no logger given for forwarded upload")
+			return
+		}
+		support.Infof("FEDERATE: upload from logger %s forwarded by %s.\n", logger, name)
+		next(w, support.ForLogger(r, logger))
+	}
+}
+
+// Accept a batch of checkins forwarded by a downstream server.
+func (app *application) federatedCheckins(w http.ResponseWriter, r *http.Request) {
+	name, ok := app.checkDownstream(w, r)
+	if !ok {
+		return
+	}
+	var checkins []api.FederatedCheckin
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFederatedCheckins))
+	if err := decoder.Decode(&checkins); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed checkins: "+err.Error())
+		return
+	}
+	var accepted int
+	for _, c := range checkins {
+		if len(c.Logger) == 0 || len(c.Status.Logger) > 0 && c.Status.Logger != c.Logger {
+			support.Warnf("FEDERATE: ignoring checkin for logger %q with status for %q from %s.\n", c.Logger, c.Status.Logger, name)
+			continue
+		}
+		app.fleet.Relay(c.Logger, c.Remote+" via "+name, c.Time, c.Status)
+		accepted++
+	}
+	support.Infof("FEDERATE: accepted %d of %d checkins forwarded by %s.\n", accepted, len(checkins), name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Report the sync cursor of the downstream server making the request.
+func (app *application) getSyncCursor(w http.ResponseWriter, r *http.Request) {
+	name, ok := app.cursorName(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, app.cursors.Get(name))
+}
+
+// Find the name under which the sync cursor of the downstream server making the request is kept: the
+// downstream server's name, with the instance given in the "instance" query parameter, if the
+// downstream server is a cluster.
+func (app *application) cursorName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name, ok := app.checkDownstream(w, r)
+	if instance := r.URL.Query().Get("instance"); ok && len(instance) > 0 {
+		name += "/" + instance
+	}
+	return name, ok
+}
+
+// Move the sync cursor of the downstream server making the request.
+func (app *application) setSyncCursor(w http.ResponseWriter, r *http.Request) {
+	name, ok := app.cursorName(w, r)
+	if !ok {
+		return
+	}
+	var cursor api.SyncCursor
+	if !readJSON(w, r, &cursor) {
+		return
+	}
+	if err := app.cursors.Set(name, cursor); err != nil {
+		support.Errorf("FEDERATE: failed to save sync cursor for %s: %s\n", name, err)
+		writeError(w, http.StatusInternalServerError, "failed to save sync cursor")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Report how far each downstream server has forwarded its records.
+func (app *application) listDownstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.cursors.List())
+}
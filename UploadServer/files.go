@@ -0,0 +1,322 @@
+/*! @file files.go
+ * @brief API end-points for the files that the server has received
+ *
+ * The processing team sometimes needs to pull a specific file that caused problems downstream, and
+ * it's more convenient to do that from the server than from the storage backend.  The listing
+ * end-point allows the files to be found by logger, time, size, and processing state, and the
+ * search end-point by the metadata extracted from the files (time and geographic coverage, NMEA0183
+ * data present).  These end-points (under /v1/files) are available either to users of the
+ * administration API, for all files or those of their tenant's loggers, or to a logger for the
+ * files that it uploaded itself.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+	"ccom.unh.edu/wibl-monitor/src/wibl"
+)
+
+// Wrap a handler so that it's available either to principals of the administration API with at
+// least the viewer role (using a bearer token), or to loggers with any of the credentials that they
+// can upload with (see support.LoggerAuth()).  A bearer token is tried against the administration
+// API first, since loggers' session tokens are also bearer tokens.  Handlers have to use canAccess()
+// to restrict loggers to their own files.
+func (app *application) fileAuth(next http.HandlerFunc) http.HandlerFunc {
+	admin := app.authorize(support.RoleViewer, next)
+	logger := support.LoggerAuth(app.tokens, app.grants, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := support.BearerToken(r); ok {
+			if _, ok := app.admin.Authenticate(token); ok {
+				admin(w, r)
+				return
+			}
+		}
+		logger(w, r)
+	}
+}
+
+// Determine whether the caller can access the files uploaded by the logger given: principals of
+// the administration API can see the files of loggers in their tenant (or everything, if they
+// aren't restricted to one), and loggers can see their own files.
+func (app *application) canAccess(r *http.Request, logger string) bool {
+	if principal := support.CurrentPrincipal(r); principal.Role >= support.RoleViewer {
+		if len(principal.Tenant) == 0 {
+			return true
+		}
+		record, ok := app.registry.Get(logger)
+		return ok && record.Tenant == principal.Tenant
+	}
+	id := support.LoggerID(r)
+	return len(id) > 0 && id == logger
+}
+
+// Stream a stored file back to the caller.  Range requests are supported so that large files can
+// be fetched in pieces, or resumed, and the write deadline is pushed back as the file is written (see
+// streamResponse) so that large files aren't cut off by the server's write timeout.
+func (app *application) downloadFile(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	record, ok := app.uploads.Get(uuid)
+	if !ok || !app.canAccess(r, record.Logger) {
+		// Loggers get the same response for files that aren't theirs as for files that don't
+		// exist, so that they can't probe for other loggers' files.
+		writeError(w, http.StatusNotFound, "no such file")
+		return
+	}
+	if len(record.Key) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("file was not stored (%s)", record.Reason))
+		return
+	}
+	if record.Archived != nil {
+		writeError(w, http.StatusConflict, "file has been archived, and has to be restored before it can be read")
+		return
+	}
+	obj, info, err := app.storage.Get(r.Context(), record.Key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "file is no longer in storage")
+		} else {
+			support.Errorf("API: failed to read %s from storage: %s\n", record.Key, err)
+			writeError(w, http.StatusInternalServerError, "failed to read file from storage")
+		}
+		return
+	}
+	defer obj.Close()
+	if principal := support.CurrentPrincipal(r); len(principal.Name) > 0 {
+		app.recordAction(r, "file.download", uuid, r.Header.Get("Range"))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", record.Key))
+	w.Header().Set("ETag", `"`+strings.ToLower(record.ObjectMD5())+`"`)
+	http.ServeContent(streamResponse(w), r, record.Key, info.Modified, obj)
+}
+
+// The default and maximum number of files returned in one page of a listing.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// A fileListing is a page of results from a query on the files the server has received.  If
+// there are more results, Next is the cursor to pass to get the next page.
+type fileListing struct {
+	Files []support.UploadRecord `json:"files"`
+	Next  string                 `json:"next,omitempty"`
+}
+
+// List the files that the server has received, subject to filters in the query parameters:
+//
+//	logger            only files from this logger
+//	from, to          only files received in this time range (see timeRange())
+//	min_size, max_size only files with size in this range (bytes, inclusive)
+//	status            only uploads with this status (accepted, rejected)
+//	state             only files in this processing state (e.g., stored)
+//	outcome           only files whose latest processing outcome is this (e.g., rejected)
+//	trace             only the file with this trace ID (or with this ID given by the logger)
+//	route             only files sent down this processing route ("production" for the rest)
+//	tag               only files with this tag
+//	limit             maximum number of files to return (default 100, maximum 1000)
+//	cursor            the "next" value from the previous page
+//
+// Loggers can only list their own files, and users restricted to a tenant that tenant's files.
+func (app *application) listFiles(w http.ResponseWriter, r *http.Request) {
+	app.queryFiles(w, r, nil)
+}
+
+// Search the files that the server has received by the metadata extracted from them, subject to
+// the filters in the query parameters (in addition to those for listFiles()):
+//
+//	start, end   only files with data in this time range (see queryTime())
+//	bbox         only files with positions in this box (west,south,east,north in degrees)
+//	talker       only files with NMEA0183 data from all of these talkers (comma-separated, e.g. GP,SD)
+//	sentence     only files with all of these NMEA0183 sentences (comma-separated, e.g. GGA,DBT)
+//	platform     only files from this platform (as recorded in the file)
+//
+// Files without extracted metadata (e.g., rejected uploads) never match a search.
+func (app *application) searchFiles(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	start, ok := queryTime(w, r, "start")
+	if !ok {
+		return
+	}
+	end, ok := queryTime(w, r, "end")
+	if !ok {
+		return
+	}
+	var bbox *wibl.BoundingBox
+	if value := query.Get("bbox"); len(value) > 0 {
+		var b wibl.BoundingBox
+		if n, err := fmt.Sscanf(value, "%g,%g,%g,%g", &b.West, &b.South, &b.East, &b.North); err != nil || n != 4 {
+			writeError(w, http.StatusBadRequest, "bbox must be west,south,east,north")
+			return
+		}
+		bbox = &b
+	}
+	talkers, sentences := splitList(query.Get("talker")), splitList(query.Get("sentence"))
+	platform := query.Get("platform")
+
+	app.queryFiles(w, r, func(u *support.UploadRecord) bool {
+		m := u.Metadata
+		if m == nil {
+			return false
+		}
+		if (!start.IsZero() || !end.IsZero()) && !m.Overlaps(start, end) {
+			return false
+		}
+		if bbox != nil && (m.Bounds == nil || !m.Bounds.Intersects(*bbox)) {
+			return false
+		}
+		for _, t := range talkers {
+			if !m.HasTalker(t) {
+				return false
+			}
+		}
+		for _, s := range sentences {
+			if !m.HasSentence(s) {
+				return false
+			}
+		}
+		return len(platform) == 0 || strings.EqualFold(m.Platform, platform)
+	})
+}
+
+// Split a comma-separated list, ignoring empty elements.
+func splitList(value string) []string {
+	var rtn []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			rtn = append(rtn, v)
+		}
+	}
+	return rtn
+}
+
+// Respond with a page of the files that match the common filters (see listFiles()) and the extra
+// filter given (if not nil).
+func (app *application) queryFiles(w http.ResponseWriter, r *http.Request, extra func(u *support.UploadRecord) bool) {
+	query := r.URL.Query()
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	logger := query.Get("logger")
+	if id := support.LoggerID(r); len(id) > 0 {
+		if len(logger) > 0 && logger != id {
+			writeJSON(w, http.StatusOK, fileListing{Files: []support.UploadRecord{}})
+			return
+		}
+		logger = id
+	}
+	var minSize, maxSize int64 = 0, -1
+	limit := defaultPageSize
+	for name, target := range map[string]*int64{"min_size": &minSize, "max_size": &maxSize} {
+		if value := query.Get(name); len(value) > 0 {
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || v < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid value for %s", name))
+				return
+			}
+			*target = v
+		}
+	}
+	if value := query.Get("limit"); len(value) > 0 {
+		v, err := strconv.Atoi(value)
+		if err != nil || v <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid value for limit")
+			return
+		}
+		limit = min(v, maxPageSize)
+	}
+	var after cursor
+	if value := query.Get("cursor"); len(value) > 0 {
+		var err error
+		if after, err = decodeCursor(value); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+	status, state, tag, outcome := query.Get("status"), query.Get("state"), query.Get("tag"), query.Get("outcome")
+	trace, route := query.Get("trace"), query.Get("route")
+
+	records := app.uploads.Select(from, to, func(u *support.UploadRecord) bool {
+		return (len(logger) == 0 || u.Logger == logger) &&
+			u.Size >= minSize && (maxSize < 0 || u.Size <= maxSize) &&
+			(len(status) == 0 || u.Status == status) &&
+			(len(state) == 0 || u.State == state) &&
+			(len(tag) == 0 || support.HasTag(u.Tags, tag)) &&
+			(len(outcome) == 0 || latestOutcome(u) == outcome) &&
+			(len(trace) == 0 || u.Trace == trace || u.Correlation == trace) &&
+			(len(route) == 0 || u.Route == route || (route == productionRoute && len(u.Route) == 0)) &&
+			after.before(u) && (extra == nil || extra(u)) && app.canAccess(r, u.Logger)
+	})
+	listing := fileListing{Files: records}
+	if len(records) > limit {
+		listing.Files = records[:limit]
+		last := listing.Files[limit-1]
+		listing.Next = cursor{received: last.Received, uuid: last.UUID}.encode()
+	}
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// A cursor marks a position in the list of uploads, which is ordered by time of receipt and
+// then UUID.  The zero cursor is before everything.
+type cursor struct {
+	received time.Time
+	uuid     string
+}
+
+// Determine whether the cursor is before the upload given.
+func (c cursor) before(u *support.UploadRecord) bool {
+	if c.received.IsZero() {
+		return true
+	}
+	return u.Received.After(c.received) || (u.Received.Equal(c.received) && u.UUID > c.uuid)
+}
+
+func (c cursor) encode() string {
+	raw := c.received.Format(time.RFC3339Nano) + "|" + c.uuid
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor{}, err
+	}
+	stamp, uuid, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return cursor{}, errors.New("malformed cursor")
+	}
+	received, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return cursor{}, err
+	}
+	return cursor{received: received, uuid: uuid}, nil
+}
@@ -0,0 +1,146 @@
+/*! @file firmware.go
+ * @brief Enforcement of the fleet's firmware policy
+ *
+ * Loggers running old firmware, or a version known to be broken, keep uploading data that looks fine
+ * but isn't.  Operators set a minimum firmware version, and versions that are blocked, in the run-time
+ * settings (see support/settings.go); each checkin's reported firmware is checked against the policy,
+ * an alert is raised the first time that a logger is found out of policy with a given version, and
+ * (if the policy says so) the logger is sent an "upgrade" command.  Operators can list the loggers
+ * whose most recent checkin was out of policy.  Loggers that don't report their firmware version
+ * aren't checked.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Compare two version strings component by component (components being separated by anything other
+// than letters and digits), numerically where both components are numbers, returning -1, 0, or +1 as
+// for strings.Compare.  A leading "v" is ignored, and missing components count as zero, so that "1.2"
+// is the same as "1.2.0".
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "v")
+		return strings.FieldsFunc(v, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	}
+	x, y := split(a), split(b)
+	for len(x) < len(y) {
+		x = append(x, "0")
+	}
+	for len(y) < len(x) {
+		y = append(y, "0")
+	}
+	return slices.CompareFunc(x, y, func(x, y string) int {
+		m, errX := strconv.ParseUint(x, 10, 64)
+		n, errY := strconv.ParseUint(y, 10, 64)
+		if errX == nil && errY == nil {
+			return cmp.Compare(m, n)
+		}
+		return strings.Compare(x, y)
+	})
+}
+
+// Determine why the firmware version given is out of the policy, or return "" if it isn't.
+func firmwareViolation(policy support.FirmwareParam, version string) string {
+	if len(version) == 0 {
+		return ""
+	}
+	if slices.ContainsFunc(policy.Blocked, func(v string) bool { return compareVersions(v, version) == 0 }) {
+		return fmt.Sprintf("firmware %s is blocked", version)
+	}
+	if len(policy.Minimum) > 0 && compareVersions(version, policy.Minimum) < 0 {
+		return fmt.Sprintf("firmware %s is older than the minimum %s", version, policy.Minimum)
+	}
+	return ""
+}
+
+// Check the firmware that a logger reported at checkin against the policy, raising an alert the first
+// time that it's found out of policy with the version, and queueing an upgrade command if the policy
+// asks for one.  A logger found back in policy is noted, so that it's alerted again if it regresses.
+func (app *application) checkFirmware(logger, version string) {
+	policy := app.settings.Get().Firmware
+	key := "firmware-policy:" + logger
+	reason := firmwareViolation(policy, version)
+	if len(reason) == 0 {
+		if previous, err := app.state.Take(key); err == nil {
+			support.Infof("CHECKIN: logger %s is back within the firmware policy (was %s).\n", logger, previous)
+		} else if !errors.Is(err, support.ErrNotFound) {
+			support.Errorf("failed to update firmware policy state for %s: %s\n", logger, err)
+		}
+		return
+	}
+	previous, err := app.state.Swap(key, []byte(version), 0)
+	if err != nil {
+		support.Errorf("failed to update firmware policy state for %s: %s\n", logger, err)
+	} else if string(previous) != version {
+		support.Warnf("CHECKIN: logger %s is out of the firmware policy (%s).\n", logger, reason)
+		app.alerts.Raise("firmware", logger, reason)
+	}
+	if !policy.UpgradeCommand {
+		return
+	}
+	command, queued, err := app.commands.Enqueue(logger, api.Command{Action: support.CommandUpgrade, Reason: reason})
+	if err != nil {
+		support.Errorf("CHECKIN: failed to queue upgrade command for logger %s: %s\n", logger, err)
+	} else if queued {
+		support.Infof("CHECKIN: queued upgrade command %s for logger %s.\n", command.ID, logger)
+	}
+}
+
+// The firmwareCompliance reports the firmware policy, and the loggers whose most recent checkin
+// reported firmware out of it.
+type firmwareCompliance struct {
+	Policy  support.FirmwareParam `json:"policy"`
+	Loggers []firmwareViolator    `json:"out_of_policy"`
+}
+
+type firmwareViolator struct {
+	Logger   string    `json:"logger"`
+	Firmware string    `json:"firmware"`
+	Reason   string    `json:"reason"`
+	Checkin  time.Time `json:"last_checkin"`
+}
+
+// List the loggers whose most recent checkin reported firmware out of the current policy.
+func (app *application) firmwareCompliance(w http.ResponseWriter, r *http.Request) {
+	rtn := firmwareCompliance{Policy: app.settings.Get().Firmware, Loggers: make([]firmwareViolator, 0)}
+	for _, status := range app.fleet.List() {
+		version := status.Status.Versions.Firmware
+		if reason := firmwareViolation(rtn.Policy, version); len(reason) > 0 {
+			rtn.Loggers = append(rtn.Loggers, firmwareViolator{Logger: status.LoggerID, Firmware: version,
+				Reason: reason, Checkin: status.LastCheckin})
+		}
+	}
+	writeJSON(w, http.StatusOK, rtn)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.5.6", "1.5.6", 0},
+		{"1.5.6", "1.5.7", -1},
+		{"1.5.10", "1.5.9", 1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.5", "1.5.0", 0},
+		{"1.5.0.0", "1.5", 0},
+		{"1.5", "1.5.1", -1},
+		{"1.6", "1.5.9", 1},
+		{"v1.5.6", "1.5.6", 0},
+		{" V1.5.6 ", "1.5.6", 0},
+		{"1.5.6-rc1", "1.5.6-rc2", -1},
+		{"1.5.6-beta", "1.5.6-alpha", 1},
+		{"1_5_6", "1.5.6", 0},
+		{"", "", 0},
+		{"", "1", -1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := compareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestFirmwareViolation(t *testing.T) {
+	policy := support.FirmwareParam{Minimum: "1.5", Blocked: []string{"1.6.2"}}
+	tests := []struct {
+		version  string
+		violates bool
+	}{
+		{"", false},
+		{"1.5", false},
+		{"1.5.0", false},
+		{"1.4.9", true},
+		{"1.6.1", false},
+		{"1.6.2", true},
+		{"v1.6.2.0", true},
+		{"2.0", false},
+	}
+	for _, tt := range tests {
+		if got := firmwareViolation(policy, tt.version); (len(got) > 0) != tt.violates {
+			t.Errorf("firmwareViolation(%q) = %q, want violation = %v", tt.version, got, tt.violates)
+		}
+	}
+}
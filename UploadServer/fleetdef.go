@@ -0,0 +1,515 @@
+/*! @file fleetdef.go
+ * @brief Bulk import and export of fleet definitions
+ *
+ * Programs that start using the server usually have their fleet in a spreadsheet, or on another
+ * server, and entering each logger and vessel through the administration API is tedious.  A fleet
+ * definition lists loggers with their registry information (tenant, transfer profile, tags), the
+ * vessel that each is installed on, and their upload tokens, as JSON (a list of api.FleetEntry) or
+ * CSV (with the columns in fleetColumns, in any order, and semicolons separating lists).  An import is
+ * checked in full before anything is changed, so that a bad row doesn't leave half a fleet behind.
+ * Fields that are empty are left as they are for loggers already in the registry.  Vessels are matched
+ * to existing records by MMSI, IMO number, or name, in that order, and added if there is no match;
+ * existing vessel records aren't changed.  Loggers can be given their existing tokens (in plain text,
+ * or as hashes exported from another server), or have new ones minted.
+ *
+ * The registry can be exported in the same formats, so that it can be edited in a spreadsheet and
+ * imported again, or moved to another server.  Token hashes are exported only if asked for, and only
+ * to admins, since a hash is as good as the token for challenge-response authentication.  Both
+ * directions are also available with the "fleet" command on the server host.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The largest fleet definition that can be imported through the administration API.
+const maxFleetBytes = 4 << 20
+
+// The columns of a fleet definition in CSV.
+var fleetColumns = []string{
+	"logger", "tenant", "profile", "tags", "vessel_name", "mmsi", "imo", "owner", "draft",
+	"token", "token_hashes", "mint_token",
+}
+
+// A fleetBook gathers the stores that a fleet definition touches, so that imports and exports work
+// the same through the API and on the command line.
+type fleetBook struct {
+	config   *support.Config
+	registry *support.Registry
+	vessels  *support.VesselStore
+	tokens   *support.TokenStore
+}
+
+func (app *application) fleetBook() *fleetBook {
+	return &fleetBook{config: app.config, registry: app.registry, vessels: app.vessels, tokens: app.tokens}
+}
+
+// Generate the fleet definition for all loggers in the registry or with upload tokens, ordered by
+// logger, with the hashes of their tokens if requested.
+func (f *fleetBook) export(withTokens bool) []api.FleetEntry {
+	entries := make(map[string]*api.FleetEntry)
+	for _, l := range f.registry.List() {
+		entry := &api.FleetEntry{Logger: l.ID, Tenant: l.Tenant, Profile: l.Profile, Tags: l.Tags}
+		if v, ok := f.vessels.Get(l.Vessel); ok {
+			entry.Vessel = &v.VesselInfo
+		}
+		entries[l.ID] = entry
+	}
+	for _, t := range f.tokens.List() {
+		if len(t.Logger) == 0 {
+			continue
+		}
+		entry, ok := entries[t.Logger]
+		if !ok {
+			entry = &api.FleetEntry{Logger: t.Logger}
+			entries[t.Logger] = entry
+		}
+		if withTokens {
+			entry.TokenHashes = append(entry.TokenHashes, t.Hash)
+		}
+	}
+	rtn := make([]api.FleetEntry, 0, len(entries))
+	for _, entry := range entries {
+		rtn = append(rtn, *entry)
+	}
+	slices.SortFunc(rtn, func(a, b api.FleetEntry) int { return strings.Compare(a.Logger, b.Logger) })
+	return rtn
+}
+
+// Check a fleet definition before import, normalising the entries in place, and report any entries
+// that can't be imported.
+func (f *fleetBook) check(entries []api.FleetEntry) []api.FleetImportError {
+	var errs []api.FleetImportError
+	holders := make(map[string]string)
+	for _, t := range f.tokens.List() {
+		holders[t.Hash] = t.Logger
+	}
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		if err := f.checkEntry(entry, seen, holders); err != nil {
+			errs = append(errs, api.FleetImportError{Row: i + 1, Logger: entry.Logger, Error: err.Error()})
+		}
+	}
+	return errs
+}
+
+func (f *fleetBook) checkEntry(entry *api.FleetEntry, seen map[string]bool, holders map[string]string) error {
+	entry.Logger, entry.Tenant = strings.TrimSpace(entry.Logger), strings.TrimSpace(entry.Tenant)
+	if len(entry.Logger) == 0 || len(entry.Logger) > 128 {
+		return errors.New("logger identifier must be between 1 and 128 characters")
+	}
+	if seen[entry.Logger] {
+		return errors.New("logger appears more than once")
+	}
+	seen[entry.Logger] = true
+	if len(entry.Tenant) > 64 {
+		return errors.New("tenant must be no more than 64 characters")
+	}
+	if _, ok := f.config.Transfer.Profiles[entry.Profile]; len(entry.Profile) > 0 && !ok {
+		return errors.New("no such transfer profile")
+	}
+	tags, err := support.UpdateTags(nil, entry.Tags, nil)
+	if err != nil {
+		return err
+	}
+	entry.Tags = tags
+	if entry.Vessel != nil {
+		if err := support.ValidateVessel(entry.Vessel); err != nil {
+			return err
+		}
+	}
+	hashes := entry.TokenHashes
+	if len(entry.Token) > 0 {
+		hashes = append(hashes, support.HashToken(entry.Token))
+	}
+	for i, hash := range hashes {
+		hash = strings.ToLower(strings.TrimSpace(hash))
+		if len(hash) != 64 || strings.Trim(hash, "0123456789abcdef") != "" {
+			return errors.New("token hashes must be SHA-256 digests in hex")
+		}
+		if holder, ok := holders[hash]; ok && holder != entry.Logger {
+			return errors.New("token is already issued to another logger")
+		}
+		holders[hash] = entry.Logger
+		if i < len(entry.TokenHashes) {
+			entry.TokenHashes[i] = hash
+		}
+	}
+	return nil
+}
+
+// Import a fleet definition that has passed check(), returning the results for each entry.  If an
+// entry fails, the results for the entries before it are returned with the error.
+func (f *fleetBook) apply(entries []api.FleetEntry, author string) ([]api.FleetImportResult, error) {
+	rtn := make([]api.FleetImportResult, 0, len(entries))
+	for _, entry := range entries {
+		result := api.FleetImportResult{Logger: entry.Logger}
+		if entry.Vessel != nil {
+			vessel, err := f.matchVessel(*entry.Vessel)
+			if err != nil {
+				return rtn, fmt.Errorf("adding vessel for logger %s: %w", entry.Logger, err)
+			}
+			result.Vessel = vessel
+		}
+		_, exists := f.registry.Get(entry.Logger)
+		result.Created = !exists
+		if _, err := f.registry.Update(entry.Logger, func(l *support.LoggerRecord) error {
+			if len(entry.Tenant) > 0 {
+				l.Tenant = entry.Tenant
+			}
+			if len(entry.Profile) > 0 {
+				l.Profile = entry.Profile
+			}
+			if len(result.Vessel) > 0 {
+				l.Vessel = result.Vessel
+			}
+			if len(entry.Tags) > 0 {
+				l.Tags = entry.Tags
+			}
+			return nil
+		}); err != nil {
+			return rtn, fmt.Errorf("updating registry for logger %s: %w", entry.Logger, err)
+		}
+		for _, hash := range entry.TokenHashes {
+			if _, err := f.tokens.Import(entry.Logger, "imported by "+author, hash); err != nil {
+				return rtn, fmt.Errorf("importing token for logger %s: %w", entry.Logger, err)
+			}
+			result.Tokens++
+		}
+		if len(entry.Token) > 0 {
+			if _, err := f.tokens.ImportToken(entry.Logger, "imported by "+author, entry.Token); err != nil {
+				return rtn, fmt.Errorf("importing token for logger %s: %w", entry.Logger, err)
+			}
+			result.Tokens++
+		}
+		if entry.MintToken {
+			token, _, err := f.tokens.Mint(entry.Logger, "minted on import by "+author)
+			if err != nil {
+				return rtn, fmt.Errorf("minting token for logger %s: %w", entry.Logger, err)
+			}
+			result.Token = token
+		}
+		rtn = append(rtn, result)
+	}
+	return rtn, nil
+}
+
+// Find the vessel record matching the information given, by MMSI, IMO number, or name, adding one if
+// there isn't one, and return its ID.
+func (f *fleetBook) matchVessel(info api.VesselInfo) (string, error) {
+	vessels := f.vessels.List()
+	matches := []func(v support.Vessel) bool{
+		func(v support.Vessel) bool { return len(info.MMSI) > 0 && v.MMSI == info.MMSI },
+		func(v support.Vessel) bool { return len(info.IMO) > 0 && v.IMO == info.IMO },
+		func(v support.Vessel) bool { return strings.EqualFold(v.Name, info.Name) },
+	}
+	for _, match := range matches {
+		if i := slices.IndexFunc(vessels, match); i >= 0 {
+			return vessels[i].ID, nil
+		}
+	}
+	vessel, err := f.vessels.Add(info)
+	if err != nil {
+		return "", err
+	}
+	return vessel.ID, nil
+}
+
+// Write a fleet definition as CSV, with a header.
+func writeFleetCSV(w io.Writer, entries []api.FleetEntry) error {
+	out := csv.NewWriter(w)
+	out.Write(fleetColumns)
+	for _, e := range entries {
+		var name, mmsi, imo, owner, draft string
+		if v := e.Vessel; v != nil {
+			name, mmsi, imo, owner = v.Name, v.MMSI, v.IMO, v.Owner
+			if v.Draft != nil {
+				draft = strconv.FormatFloat(*v.Draft, 'f', -1, 64)
+			}
+		}
+		out.Write([]string{
+			e.Logger, e.Tenant, e.Profile, strings.Join(e.Tags, ";"), name, mmsi, imo, owner, draft,
+			"", strings.Join(e.TokenHashes, ";"), "",
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Read a fleet definition from CSV, which must have a header naming the columns.  Columns that
+// aren't in fleetColumns are ignored.  Rows that can't be read are reported, numbered from one
+// after the header.
+func readFleetCSV(r io.Reader) ([]api.FleetEntry, []api.FleetImportError, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+	header, err := in.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["logger"]; !ok {
+		return nil, nil, errors.New("CSV header has no logger column")
+	}
+	var entries []api.FleetEntry
+	var errs []api.FleetImportError
+	for row := 1; ; row++ {
+		fields, err := in.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
+		}
+		entry, err := fleetEntryFromCSV(get)
+		if err != nil {
+			errs = append(errs, api.FleetImportError{Row: row, Logger: entry.Logger, Error: err.Error()})
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errs, nil
+}
+
+func fleetEntryFromCSV(get func(name string) string) (api.FleetEntry, error) {
+	entry := api.FleetEntry{
+		Logger: get("logger"), Tenant: get("tenant"), Profile: get("profile"),
+		Tags: splitCell(get("tags")), Token: get("token"), TokenHashes: splitCell(get("token_hashes")),
+	}
+	if mint := get("mint_token"); len(mint) > 0 {
+		b, err := strconv.ParseBool(mint)
+		if err != nil {
+			return entry, fmt.Errorf("mint_token %q is not true or false", mint)
+		}
+		entry.MintToken = b
+	}
+	vessel := api.VesselInfo{Name: get("vessel_name"), MMSI: get("mmsi"), IMO: get("imo"), Owner: get("owner")}
+	if draft := get("draft"); len(draft) > 0 {
+		d, err := strconv.ParseFloat(draft, 64)
+		if err != nil {
+			return entry, fmt.Errorf("draft %q is not a number", draft)
+		}
+		vessel.Draft = &d
+	}
+	if vessel != (api.VesselInfo{}) {
+		entry.Vessel = &vessel
+	}
+	return entry, nil
+}
+
+// Split a semicolon-separated list in a CSV field, ignoring empty elements.
+func splitCell(s string) []string {
+	var rtn []string
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			rtn = append(rtn, item)
+		}
+	}
+	return rtn
+}
+
+// Read a fleet definition in the format given ("json" or "csv"), reporting entries that can't be
+// read or imported.
+func readFleet(r io.Reader, format string, f *fleetBook) ([]api.FleetEntry, []api.FleetImportError, error) {
+	var entries []api.FleetEntry
+	var errs []api.FleetImportError
+	switch format {
+	case "", "json":
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, nil, err
+		}
+	case "csv":
+		var err error
+		if entries, errs, err = readFleetCSV(r); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, errors.New("format must be json or csv")
+	}
+	if len(entries) == 0 {
+		return nil, nil, errors.New("fleet definition has no loggers")
+	}
+	if len(errs) > 0 {
+		return entries, errs, nil
+	}
+	return entries, f.check(entries), nil
+}
+
+// Export the fleet definition as JSON or, if the "format" query parameter is "csv", as CSV.  Token
+// hashes are included if the "tokens" query parameter is true, for admins only.
+func (app *application) exportFleet(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) > 0 && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+	withTokens := r.URL.Query().Get("tokens") == "true"
+	if withTokens && support.CurrentPrincipal(r).Role < support.RoleAdmin {
+		writeError(w, http.StatusForbidden, "token hashes can only be exported by admins")
+		return
+	}
+	entries := app.fleetBook().export(withTokens)
+	if withTokens {
+		app.recordAction(r, "fleet.export", "", "with token hashes")
+	}
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="fleet.csv"`)
+	if err := writeFleetCSV(w, entries); err != nil {
+		support.Errorf("ADMIN: failed to write fleet export: %s\n", err)
+	}
+}
+
+// Import a fleet definition, as JSON or, if the "format" query parameter is "csv", as CSV.  If any
+// entry can't be imported, nothing is changed and the problems are reported.
+func (app *application) importFleet(w http.ResponseWriter, r *http.Request) {
+	book := app.fleetBook()
+	body := http.MaxBytesReader(w, r.Body, maxFleetBytes)
+	entries, errs, err := readFleet(body, r.URL.Query().Get("format"), book)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "malformed fleet definition: "+err.Error())
+		return
+	}
+	if len(errs) > 0 {
+		writeJSON(w, http.StatusBadRequest, errs)
+		return
+	}
+	results, err := book.apply(entries, support.CurrentPrincipal(r).Name)
+	if err != nil {
+		support.Errorf("ADMIN: fleet import failed after %d loggers: %s\n", len(results), err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("fleet import failed after %d loggers", len(results)))
+		return
+	}
+	app.recordAction(r, "fleet.import", "", fmt.Sprintf("%d loggers", len(results)))
+	writeJSON(w, http.StatusOK, results)
+}
+
+// Import or export a fleet definition on the server host: "fleet import [file]" reads the definition
+// from the file given (or standard input), and "fleet export" writes it to standard output.
+func fleetCommand(args []string) error {
+	if len(args) == 0 || args[0] != "import" && args[0] != "export" {
+		return errors.New("usage: fleet import|export [options]")
+	}
+	fs := flag.NewFlagSet("fleet "+args[0], flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	format := fs.String("format", "json", "Format of the fleet definition (json, csv)")
+	withTokens := fs.Bool("tokens", false, "Include upload token hashes in an export")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return errors.New("format must be json or csv")
+	}
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	book, err := openFleetBook(config)
+	if err != nil {
+		return err
+	}
+	if args[0] == "export" {
+		entries := book.export(*withTokens)
+		if *format == "csv" {
+			return writeFleetCSV(os.Stdout, entries)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(entries)
+	}
+	in := io.Reader(os.Stdin)
+	if fs.NArg() > 0 {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	entries, errs, err := readFleet(in, *format, book)
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		support.Errorf("row %d (%s): %s\n", e.Row, e.Logger, e.Error)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d rows can't be imported; nothing was changed", len(errs))
+	}
+	results, err := book.apply(entries, "fleet command")
+	for _, result := range results {
+		if len(result.Token) > 0 {
+			fmt.Printf("%s\t%s\n", result.Logger, result.Token)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	support.Infof("imported %d loggers.\n", len(results))
+	return nil
+}
+
+// Open the stores that a fleet definition touches, for use on the server host.
+func openFleetBook(config *support.Config) (*fleetBook, error) {
+	registry, err := support.NewRegistry(filepath.Join(config.State.Directory, "registry.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading logger registry: %w", err)
+	}
+	vessels, err := support.NewVesselStore(filepath.Join(config.State.Directory, "vessels.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading vessel records: %w", err)
+	}
+	tokens, err := openTokenStore(config)
+	if err != nil {
+		return nil, err
+	}
+	return &fleetBook{config: config, registry: registry, vessels: vessels, tokens: tokens}, nil
+}
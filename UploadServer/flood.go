@@ -0,0 +1,111 @@
+/*! @file flood.go
+ * @brief Detection of loggers checking in far more often than they should
+ *
+ * A logger that checks in many times more often than it's been told to (see ProvisionParam in
+ * support/config.go, or the logger's own interval in the registry) almost always has a firmware
+ * fault, and left alone it fills the fleet status, the upload history's changelog, and the logs
+ * with identical checkins.  Checkins are counted in windows of the logger's checkin interval; once
+ * a logger exceeds the configured multiple of the one expected in a window, the rest of its
+ * checkins in the window are refused with HTTP 429 (Too Many Requests) and not recorded, and an
+ * alert is raised.  The alert is raised once for each flood, which ends when the logger gets
+ * through a whole window within the limit (or without checking in at all).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The longest checkin interval that can be set for a logger (a week), in minutes.
+const maxCheckinMinutes = 7 * 24 * 60
+
+// Determine how often the logger should check in: its own interval in the registry, if it has one, or
+// the interval that loggers are provisioned with.
+func (app *application) checkinInterval(logger string) time.Duration {
+	if entry, ok := app.registry.Get(logger); ok && entry.Checkin > 0 {
+		return time.Duration(entry.Checkin) * time.Minute
+	}
+	return time.Duration(app.config.Provision.CheckinMinutes) * time.Minute
+}
+
+// Count a checkin from the logger received at the time given, returning true (with how long the
+// logger should wait before checking in again) if the logger is flooding the server with checkins,
+// and its checkin should be refused.  If the counters can't be reached, checkins are allowed.
+func (app *application) checkinFlood(logger string, received time.Time) (time.Duration, bool) {
+	factor := app.config.Flood.Factor
+	interval := app.checkinInterval(logger)
+	if factor <= 0 || interval <= 0 {
+		return 0, false
+	}
+	window := received.Truncate(interval)
+	count, err := app.state.Incr(floodKey(logger, window), 2*interval)
+	if err != nil {
+		support.Errorf("failed to count checkins from %s: %s\n", logger, err)
+		return 0, false
+	}
+	if count == 1 {
+		app.floodEnded(logger, window.Add(-interval), int64(factor))
+	}
+	if count <= int64(factor) {
+		return 0, false
+	}
+	if count == int64(factor)+1 {
+		support.Warnf("CHECKIN: logger %s checked in more than %d times in %s; refusing its checkins until %s.\n",
+			logger, factor, interval, window.Add(interval).Format(time.RFC3339))
+		set, err := app.state.SetNX("checkin-flood:"+logger, []byte(received.Format(time.RFC3339)), 0)
+		if err != nil {
+			support.Errorf("failed to update checkin flood state for %s: %s\n", logger, err)
+		} else if set {
+			app.alerts.Raise("checkin", logger, fmt.Sprintf("logger is checking in more than %d times every %s (expected once); checkins are being refused", factor, interval))
+		}
+	}
+	return window.Add(interval).Sub(received), true
+}
+
+// Note the end of a logger's checkin flood, if it had one and stayed within the limit in the window
+// that started at the time given.
+func (app *application) floodEnded(logger string, previous time.Time, factor int64) {
+	if data, err := app.state.Get(floodKey(logger, previous)); err == nil {
+		if count, err := strconv.ParseInt(string(data), 10, 64); err == nil && count > factor {
+			return
+		}
+	}
+	since, err := app.state.Take("checkin-flood:" + logger)
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+	case err != nil:
+		support.Errorf("failed to update checkin flood state for %s: %s\n", logger, err)
+	default:
+		support.Infof("CHECKIN: logger %s is no longer flooding the server with checkins (since %s).\n", logger, since)
+	}
+}
+
+// Generate the key under which checkins from the logger are counted in the window starting at the
+// time given.
+func floodKey(logger string, window time.Time) string {
+	return fmt.Sprintf("flood:%s:%d", logger, window.Unix())
+}
@@ -0,0 +1,193 @@
+/*! @file gateway.go
+ * @brief Status beacons relayed by store-and-forward gateways such as Iridium SBD
+ *
+ * Loggers on vessels offshore have no connectivity until they reach port, and would otherwise drop
+ * out of fleet monitoring for the length of a voyage.  Those with a satellite modem can send a short
+ * status beacon, which the satellite service delivers to the server by webhook.  The end-point here
+ * takes the form fields of the Iridium Short Burst Data delivery webhook (imei, momsn, transmit_time,
+ * iridium_latitude, iridium_longitude, iridium_cep, and the message as hex in data), which other
+ * store-and-forward services can also use.  The message is an api.CompactStatus as CBOR (as for
+ * CoAP; see coap.go), optionally compressed with zlib, and is recorded as a checkin for the logger
+ * that the configuration gives for the device, along with the position that the service estimated.
+ *
+ * The satellite network authenticates the modem, so the beacon itself isn't signed (there's little
+ * room in an SBD message for a MAC); instead, the gateway service has to present the secret in the
+ * configuration.  Services retry deliveries that aren't acknowledged, so duplicates are recognised
+ * by the device's message sequence number and acknowledged without being recorded again.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The header in which a gateway service presents its secret.
+const gatewayKeyHeader = "X-Gateway-Key"
+
+// The name recorded for beacons relayed through Iridium SBD.
+const sbdGateway = "iridium-sbd"
+
+// The format of the transmit_time field in an Iridium SBD delivery (UTC).
+const sbdTimeFormat = "06-01-02 15:04:05"
+
+// How long a delivery is remembered, so that retries of it are recognised.
+const beaconDedupTTL = 7 * 24 * time.Hour
+
+// Limits on the size of a delivery, and of the beacon once decompressed.
+const (
+	maxDelivery = 64 << 10
+	maxBeacon   = 4 << 10
+)
+
+// Check that a request comes from a gateway service that knows the secret in the configuration.
+func (app *application) gatewayAuthorized(r *http.Request) bool {
+	key := r.Header.Get(gatewayKeyHeader)
+	secret := app.config.Gateway.Secret
+	return len(secret) > 0 && subtle.ConstantTimeCompare([]byte(key), []byte(secret)) == 1
+}
+
+// Decode a beacon, decompressing it first if it's compressed.  A status is a CBOR map, which never
+// starts with a zlib header byte, so the two can be told apart.
+func decodeBeacon(payload []byte) (api.CompactStatus, error) {
+	var status api.CompactStatus
+	if len(payload) > 0 && payload[0] == 0x78 {
+		reader, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return status, err
+		}
+		defer reader.Close()
+		if payload, err = io.ReadAll(io.LimitReader(reader, maxBeacon+1)); err != nil {
+			return status, err
+		}
+		if len(payload) > maxBeacon {
+			return status, fmt.Errorf("beacon exceeds %d bytes when decompressed", maxBeacon)
+		}
+	}
+	err := cbor.Unmarshal(payload, &status)
+	return status, err
+}
+
+// Parse an optional floating-point form field, returning nil if it's missing or malformed.
+func formFloat(r *http.Request, name string) *float64 {
+	value, err := strconv.ParseFloat(r.PostForm.Get(name), 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+// Accept a status beacon delivered by Iridium SBD (or a service using the same fields).
+func (app *application) sbdDelivery(w http.ResponseWriter, r *http.Request) {
+	if len(app.config.Gateway.Secret) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if !app.gatewayAuthorized(r) {
+		support.Warnf("GATEWAY: delivery from %s failed authentication.\n", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxDelivery)
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed delivery: "+err.Error())
+		return
+	}
+	device := r.PostForm.Get("imei")
+	logger, ok := app.config.Gateway.Devices[device]
+	if !ok {
+		support.Warnf("GATEWAY: delivery from unknown device %q via %s.\n", device, r.RemoteAddr)
+		writeError(w, http.StatusForbidden, "unknown device")
+		return
+	}
+	sequence, err := strconv.ParseUint(r.PostForm.Get("momsn"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "malformed or missing momsn")
+		return
+	}
+	payload, err := hex.DecodeString(r.PostForm.Get("data"))
+	if err != nil || len(payload) == 0 {
+		writeError(w, http.StatusBadRequest, "malformed or missing data")
+		return
+	}
+	status, err := decodeBeacon(payload)
+	if err != nil {
+		support.Warnf("GATEWAY: malformed beacon from device %s (logger %s): %s\n", device, logger, err)
+		writeError(w, http.StatusBadRequest, "malformed beacon")
+		return
+	}
+	if len(status.Logger) > 0 && status.Logger != logger {
+		app.impersonation(logger, status.Logger, "a beacon")
+		writeError(w, http.StatusForbidden, "logger identity mismatch")
+		return
+	}
+	status.Logger = logger
+	first, err := app.state.SetNX(fmt.Sprintf("beacon:%s:%s:%d", sbdGateway, device, sequence), []byte(logger), beaconDedupTTL)
+	if err != nil {
+		support.Errorf("GATEWAY: failed to record delivery %d from device %s: %s\n", sequence, device, err)
+		writeError(w, http.StatusServiceUnavailable, "shared state unavailable")
+		return
+	}
+	if !first {
+		support.Infof("GATEWAY: ignoring repeated delivery %d from device %s (logger %s).\n", sequence, device, logger)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "duplicate"})
+		return
+	}
+	// Store-and-forward delays can be long, so the logger's clock is compared with the time the
+	// message left it, rather than the time it arrived here.
+	sent, err := time.Parse(sbdTimeFormat, r.PostForm.Get("transmit_time"))
+	if err != nil {
+		sent = time.Now().UTC()
+	}
+	reported := sent
+	if status.Time != 0 {
+		reported = time.Unix(status.Time, 0).UTC()
+	}
+	update := app.compactCheckin(status, sbdGateway+":"+device, reported, sent)
+	support.Infof("GATEWAY: status update from logger %s via device %s, firmware %s, total %d files.\n",
+		logger, device, update.Versions.Firmware, update.Files.Count)
+	beacon := support.Beacon{
+		Gateway:   sbdGateway,
+		Device:    device,
+		Sequence:  sequence,
+		Sent:      sent,
+		Latitude:  formFloat(r, "iridium_latitude"),
+		Longitude: formFloat(r, "iridium_longitude"),
+	}
+	if cep := formFloat(r, "iridium_cep"); cep != nil {
+		beacon.CEP = *cep
+	}
+	app.fleet.SetBeacon(logger, beacon)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "accepted"})
+}
@@ -0,0 +1,82 @@
+/*! @file hints.go
+ * @brief Upload scheduling hints for loggers
+ *
+ * Each checkin response tells the logger when it should upload (see support/window.go): not before
+ * the end of any quiet hours (and within the logger's own upload hours, if it has them; see
+ * uploadhours.go), and then at the logger's own offset within the configured spread, so that the fleet
+ * doesn't arrive all at once.  The logger is also staggered, and asked to upload one
+ * file at a time, if the server is already busy with uploads.  The hint also gives the number of files
+ * to upload at once and the bandwidth limit, so that the logger can pace itself rather than be
+ * throttled.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// Report whether the proportion of upload slots in use has reached the configured threshold.
+func (app *application) uploadsBusy() bool {
+	if app.slots == nil {
+		return false
+	}
+	return len(app.slots)*100 >= cap(app.slots)*app.config.Schedule.BusyPercent
+}
+
+// Generate the upload window for the logger.
+func (app *application) uploadWindow(logger string) *api.UploadWindow {
+	now := time.Now().UTC()
+	if app.uploadNow(logger) {
+		// An operator has asked for everything (see uploadnow.go), so the schedule doesn't apply.
+		return &api.UploadWindow{Earliest: now, MaxFiles: app.config.Schedule.MaxFiles, MaxKBps: app.config.Bandwidth.UploadKBps}
+	}
+	busy := app.uploadsBusy()
+	earliest := app.schedule.NextOpen(now)
+	var closes time.Time
+	if hours := app.loggerHours(logger); hours != nil {
+		earliest, closes = app.nextUploadHour(hours, earliest)
+	}
+	if earliest.After(now) || busy {
+		// The stagger mustn't push the logger out of its upload hours.
+		if staggered := earliest.Add(app.schedule.Stagger(logger)); closes.IsZero() || staggered.Before(closes) {
+			earliest = staggered
+		}
+	}
+	window := &api.UploadWindow{
+		Earliest: earliest,
+		MaxFiles: app.config.Schedule.MaxFiles,
+		MaxKBps:  app.config.Bandwidth.UploadKBps,
+	}
+	if busy {
+		window.MaxFiles = 1
+	}
+	latest := app.schedule.NextQuiet(earliest)
+	if !closes.IsZero() && (latest.IsZero() || closes.Before(latest)) {
+		latest = closes
+	}
+	if !latest.IsZero() {
+		window.Latest = &latest
+	}
+	return window
+}
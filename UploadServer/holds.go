@@ -0,0 +1,113 @@
+/*! @file holds.go
+ * @brief Administration of legal holds
+ *
+ * Admins place legal holds on uploads or loggers whose data is part of an incident investigation,
+ * and release them when the investigation is over (see support/holds.go).  Held data is left in
+ * place by purges.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A holdRequest gives the reason for a legal hold.
+type holdRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Find the kind of hold named in the request path ("files" for uploads, or "loggers").
+func holdKind(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch r.PathValue("kind") {
+	case "files":
+		return support.HoldUpload, true
+	case "loggers":
+		return support.HoldLogger, true
+	}
+	writeError(w, http.StatusNotFound, "holds can only be placed on files or loggers")
+	return "", false
+}
+
+// List the legal holds in place.
+func (app *application) listHolds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.holds.List())
+}
+
+// Place a legal hold on an upload or logger, replacing any hold already in place.
+func (app *application) placeHold(w http.ResponseWriter, r *http.Request) {
+	kind, ok := holdKind(w, r)
+	if !ok {
+		return
+	}
+	target := r.PathValue("target")
+	var request holdRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if len(strings.TrimSpace(request.Reason)) == 0 {
+		writeError(w, http.StatusBadRequest, "a reason is required")
+		return
+	}
+	if _, found := app.uploads.Get(target); kind == support.HoldUpload && !found {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	hold := support.Hold{
+		Kind:   kind,
+		Target: target,
+		Reason: request.Reason,
+		By:     support.CurrentPrincipal(r).Name,
+		Placed: time.Now().UTC(),
+	}
+	if err := app.holds.Place(hold); err != nil {
+		support.Errorf("ADMIN: failed to place hold on %s %s: %s\n", kind, target, err)
+		writeError(w, http.StatusInternalServerError, "failed to place hold")
+		return
+	}
+	app.recordAction(r, "hold.place", kind+":"+target, request.Reason)
+	writeJSON(w, http.StatusOK, hold)
+}
+
+// Release a legal hold.
+func (app *application) releaseHold(w http.ResponseWriter, r *http.Request) {
+	kind, ok := holdKind(w, r)
+	if !ok {
+		return
+	}
+	target := r.PathValue("target")
+	switch err := app.holds.Release(kind, target); {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such hold")
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to release hold on %s %s: %s\n", kind, target, err)
+		writeError(w, http.StatusInternalServerError, "failed to release hold")
+		return
+	}
+	app.recordAction(r, "hold.release", kind+":"+target, "")
+	w.WriteHeader(http.StatusNoContent)
+}
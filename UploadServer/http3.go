@@ -0,0 +1,82 @@
+/*! @file http3.go
+ * @brief Optional HTTP/3 (QUIC) listener
+ *
+ * On lossy cellular and satellite links, QUIC's loss recovery gets bulk uploads through much faster
+ * than TCP, and several gateway stacks already speak it.  With the "http3-listener" feature enabled,
+ * the server also listens for HTTP/3 on the UDP port with the same number as the HTTPS port, with
+ * the same certificate, client certificate checks, and handlers, and advertises it to HTTPS clients
+ * in the Alt-Svc header so that those that can switch do.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Start the HTTP/3 listener on the address given, if the feature is enabled, with the handler and
+// TLS configuration given, which holds the server's certificate.  The result is nil if there is no
+// listener.
+func (app *application) startHTTP3(address string, handler http.Handler, config *tls.Config) (*http3.Server, error) {
+	if !app.config.FeatureEnabled("http3-listener") {
+		return nil, nil
+	}
+	srv := &http3.Server{Addr: address, Handler: handler, TLSConfig: config.Clone(), IdleTimeout: time.Minute}
+	go func() {
+		log.Printf("starting HTTP/3 listener on %s (UDP)", address)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			support.Errorf("HTTP/3 listener failed: %s\n", err)
+		}
+	}()
+	return srv, nil
+}
+
+// Tell HTTPS clients that the server also speaks HTTP/3, if it does.
+func advertiseHTTP3(srv *http3.Server, next http.Handler) http.Handler {
+	if srv == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			srv.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stop the HTTP/3 listener, if there is one, giving requests in progress until the context is done.
+func stopHTTP3(ctx context.Context, srv *http3.Server) {
+	if srv == nil {
+		return
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("closing HTTP/3 connections still open: %v", err)
+	}
+}
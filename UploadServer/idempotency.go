@@ -0,0 +1,96 @@
+/*! @file idempotency.go
+ * @brief Recognition of repeated uploads of the same file
+ *
+ * A logger that doesn't see the response to an upload (e.g., because the connection dropped just
+ * after the server received the file) will send the file again, and if the server is one of several
+ * behind a load balancer, the repeat can arrive at a different instance, possibly while the first
+ * is still being stored.  Each upload is therefore identified by the logger and the MD5 digest of
+ * the file: while one instance is handling an upload, the same upload to any other instance is
+ * refused with HTTP 409 (Conflict) so that the logger tries again later, and once it's been
+ * accepted, repeats are acknowledged as successful without storing the file again.  The markers
+ * are held in the shared state (see support/shared.go).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+const (
+	uploadSessionTTL = 5 * time.Minute // Longest that an instance can spend handling an upload
+	uploadRepeatTTL  = 24 * time.Hour  // How long an accepted upload is remembered for repeats
+)
+
+var errUploadInProgress = errors.New("upload already in progress")
+
+// Start handling an upload of the file with the given digest from a logger, returning the UUID
+// of the earlier upload if the file has already been accepted.  If the same upload is being handled
+// elsewhere, errUploadInProgress is returned.  Otherwise, finishUpload() has to be called once the
+// upload has been handled.
+func (app *application) startUpload(logger, digest string) (string, error) {
+	previous, err := app.state.Get(uploadKey("uploaded", logger, digest))
+	if err == nil {
+		return string(previous), nil
+	}
+	if !errors.Is(err, support.ErrNotFound) {
+		// If the shared state isn't available, accepting a duplicate is better than refusing the file.
+		support.Errorf("TRANS: failed to check for repeated upload: %s\n", err)
+		return "", nil
+	}
+	started, err := app.state.SetNX(uploadKey("uploading", logger, digest), []byte(app.instance), uploadSessionTTL)
+	if err != nil {
+		support.Errorf("TRANS: failed to record start of upload: %s\n", err)
+		return "", nil
+	}
+	if !started {
+		return "", errUploadInProgress
+	}
+	return "", nil
+}
+
+// Finish handling an upload, remembering it if it was accepted so that repeats can be recognised.
+func (app *application) finishUpload(logger, digest string, record *support.UploadRecord) {
+	if len(record.Key) > 0 && record.State == support.StateStored {
+		if err := app.state.Set(uploadKey("uploaded", logger, digest), []byte(record.UUID), uploadRepeatTTL); err != nil {
+			support.Errorf("TRANS: failed to record completion of upload %s: %s\n", record.UUID, err)
+		}
+	}
+	if err := app.state.Delete(uploadKey("uploading", logger, digest)); err != nil {
+		support.Errorf("TRANS: failed to clear upload session for %s: %s\n", record.UUID, err)
+	}
+}
+
+// Forget that an upload was accepted (e.g., when the logger's data is purged), so that the file
+// is stored again if the logger sends it.
+func (app *application) forgetUpload(logger, digest string) {
+	if err := app.state.Delete(uploadKey("uploaded", logger, digest)); err != nil {
+		support.Errorf("failed to forget upload from %s with digest %s: %s\n", logger, digest, err)
+	}
+}
+
+func uploadKey(kind, logger, digest string) string {
+	return fmt.Sprintf("%s:%s:%s", kind, logger, digest)
+}
@@ -0,0 +1,78 @@
+/*! @file ingest.go
+ * @brief Publishing of ingest metrics to monitoring services
+ *
+ * The ingest metrics (see src/metrics) are collected as uploads are handled: outcomes and sizes as
+ * they're recorded in the upload history, failures where storage or notification fails, and latency
+ * as upload requests complete.  Each instance publishes its own metrics to the services configured,
+ * so dimensions should distinguish instances if that matters.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/cloud"
+	"ccom.unh.edu/wibl-monitor/src/metrics"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Generate the metrics publishers specified in the configuration.  CloudWatch isn't used in mock
+// mode, since nothing else in AWS is.
+func newPublishers(config *support.Config) ([]metrics.Publisher, error) {
+	var rtn []metrics.Publisher
+	if cw := config.Metrics.CloudWatch; cw.Enabled && !config.Mock {
+		cfg, err := cloud.AWSConfig(config.AWS)
+		if err != nil {
+			return nil, fmt.Errorf("AWS configuration: %w", err)
+		}
+		p, err := metrics.NewCloudWatch(cfg, cloud.Endpoint(config.AWS, "monitoring"), cw.Namespace, cw.Dimensions)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, p)
+	}
+	if sd := config.Metrics.StatsD; len(sd.Address) > 0 {
+		p, err := metrics.NewStatsD(sd.Address, sd.Prefix, sd.Tags)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, p)
+	}
+	return rtn, nil
+}
+
+// Start publishing the ingest metrics in the background, if any publishers are configured.
+func (app *application) publishMetrics() {
+	if len(app.publish) == 0 {
+		return
+	}
+	interval := time.Duration(app.config.Metrics.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	app.background.Add(1)
+	go func() {
+		defer app.background.Done()
+		metrics.Run(app.ctx, interval, app.ingest, app.publish)
+	}()
+}
@@ -0,0 +1,120 @@
+/*! @file integrity.go
+ * @brief Background verification of stored files against their upload digests
+ *
+ * Files on local disk can be silently corrupted (failing media, bad copies during a migration,
+ * someone "tidying up" the data directory).  Since the MD5 digest of each file is recorded when it's
+ * uploaded, the server can periodically re-read the stored files and check that they still match.
+ * Any that don't (or that have gone missing) are marked in the upload history and an alert is
+ * raised so that the operator can recover them from the logger or a backup.  Files that have been
+ * archived (see archive.go) can't be read, so they aren't checked.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// An integritySummary reports the results of a single integrity check.
+type integritySummary struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Checked  int       `json:"checked"`
+	Corrupt  int       `json:"corrupt"`
+	Missing  int       `json:"missing"`
+	Errors   int       `json:"errors"`
+}
+
+// Run the integrity check as a scheduled job.
+func (app *application) integrityJob(ctx context.Context) (string, error) {
+	summary := app.checkIntegrity(ctx, app.config.Integrity.SampleFraction)
+	return fmt.Sprintf("checked %d files (%d corrupt, %d missing, %d errors)",
+		summary.Checked, summary.Corrupt, summary.Missing, summary.Errors), ctx.Err()
+}
+
+// Re-read a random fraction of the stored files, comparing each against the digest recorded when
+// it was uploaded.  Files that fail are moved to the corrupt or missing state, so that they are
+// reported once rather than on every check.
+func (app *application) checkIntegrity(ctx context.Context, fraction float64) integritySummary {
+	summary := integritySummary{Started: time.Now().UTC()}
+	stored := app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return len(u.Key) > 0 && u.State != support.StateCorrupt && u.State != support.StateMissing && u.Archived == nil
+	})
+	for _, u := range stored {
+		if ctx.Err() != nil {
+			break
+		}
+		if fraction < 1.0 && rand.Float64() >= fraction {
+			continue
+		}
+		summary.Checked++
+		digest, err := app.digestObject(ctx, u.Key)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			summary.Missing++
+			app.markDamaged(u, support.StateMissing, "stored object not found")
+		case ctx.Err() != nil:
+			summary.Checked--
+		case err != nil:
+			summary.Errors++
+			support.Errorf("INTEGRITY: failed to read %s for %s: %s\n", u.Key, u.UUID, err)
+		case digest != u.ObjectMD5():
+			summary.Corrupt++
+			app.markDamaged(u, support.StateCorrupt, fmt.Sprintf("digest %s does not match %s recorded on upload", digest, u.ObjectMD5()))
+		}
+	}
+	summary.Finished = time.Now().UTC()
+	return summary
+}
+
+// Compute the MD5 digest of a stored object, in the same form as recorded on upload.
+func (app *application) digestObject(ctx context.Context, key string) (string, error) {
+	obj, _, err := app.storage.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, obj); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%X", hash.Sum(nil)), nil
+}
+
+func (app *application) markDamaged(u support.UploadRecord, state, message string) {
+	app.alerts.Raise("integrity", u.UUID, fmt.Sprintf("%s (logger %s, key %s)", message, u.Logger, u.Key))
+	_, err := app.uploads.Update(u.UUID, func(r *support.UploadRecord) error {
+		r.State = state
+		return nil
+	})
+	if err != nil {
+		support.Errorf("INTEGRITY: failed to update state of %s: %s\n", u.UUID, err)
+	}
+}
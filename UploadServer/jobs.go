@@ -0,0 +1,149 @@
+/*! @file jobs.go
+ * @brief Background jobs run by the server, and their administration end-points
+ *
+ * All of the periodic work that the server does is registered here with the scheduler (see
+ * support/scheduler.go), along with its default schedule, so that what runs when can be seen
+ * in one place.  The configuration can override the schedule for any job by name.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The default settings for each background job, used unless the configuration overrides them.
+var jobDefaults = map[string]support.JobParam{
+	"integrity":     {Enabled: true, IntervalMinutes: 24 * 60},
+	"usage-report":  {Enabled: true, IntervalMinutes: 24 * 60},
+	"chunk-cleanup": {Enabled: true, IntervalMinutes: 60},
+	"reconcile":     {Enabled: true, IntervalMinutes: 60},
+	"archive":       {Enabled: true, IntervalMinutes: 24 * 60},
+	"manifest":      {Enabled: true, IntervalMinutes: 60},
+	"email":         {Enabled: true, IntervalMinutes: 15},
+	"drop":          {Enabled: true, IntervalMinutes: 5},
+	"replicate":     {Enabled: true, IntervalMinutes: 5},
+	"federate":      {Enabled: true, IntervalMinutes: 5},
+	"stage-cleanup": {Enabled: true, IntervalMinutes: 60},
+	"quarantine":    {Enabled: true, IntervalMinutes: 24 * 60},
+	"backup":        {Enabled: true, IntervalMinutes: 24 * 60},
+}
+
+// Register all background jobs with the scheduler, with their default settings.  Jobs that work
+// through this instance's own state (e.g., its upload history) run on every instance, writing
+// anything they share under a name for the instance (see clusterName()); the rest only run on the
+// leader.
+func (app *application) registerJobs() {
+	app.jobs.Register("integrity", jobDefaults["integrity"], app.integrityJob)
+	app.jobs.Register("usage-report", jobDefaults["usage-report"], app.reportJob)
+	app.jobs.Register("chunk-cleanup", jobDefaults["chunk-cleanup"], app.chunkCleanupJob)
+	app.jobs.Register("reconcile", jobDefaults["reconcile"], app.reconcileJob)
+	app.jobs.Register("archive", jobDefaults["archive"], app.archiveJob)
+	app.jobs.Register("manifest", jobDefaults["manifest"], app.manifestJob)
+	app.jobs.RegisterGlobal("email", jobDefaults["email"], app.emailJob)
+	app.jobs.RegisterGlobal("drop", jobDefaults["drop"], app.dropJob)
+	app.jobs.Register("replicate", jobDefaults["replicate"], app.replicateJob)
+	app.jobs.Register("federate", jobDefaults["federate"], app.federateJob)
+	app.jobs.Register("stage-cleanup", jobDefaults["stage-cleanup"], app.sessionCleanupJob)
+	app.jobs.Register("quarantine", jobDefaults["quarantine"], app.quarantineJob)
+	app.jobs.Register("backup", jobDefaults["backup"], app.backupJob)
+}
+
+// Give the name under which this instance writes what its jobs share with the other instances in a
+// cluster (e.g., manifests and backups, in storage): empty for a single instance, so that names don't
+// change, or otherwise the host name, which (unlike the instance ID) lasts across restarts.
+func clusterName(config *support.Config) string {
+	if config.Shared.Backend == "" || config.Shared.Backend == "memory" {
+		return ""
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "wibl-monitor"
+	}
+	return host
+}
+
+// Add this instance's cluster name (see clusterName()) to a name, with the separator given, if it has
+// one.
+func clusterSuffix(config *support.Config, separator string) string {
+	if name := clusterName(config); len(name) > 0 {
+		return separator + name
+	}
+	return ""
+}
+
+// Report the status of all background jobs.
+func (app *application) listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.jobs.List())
+}
+
+// Start a background job immediately.  The job runs asynchronously; its outcome is available
+// from the job list once it finishes.
+func (app *application) runJob(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch err := app.jobs.RunNow(name); {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	case errors.Is(err, support.ErrJobRunning):
+		writeError(w, http.StatusConflict, "job is already running")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	app.recordAction(r, "job.run", name, "")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// The clusterStatus reports which instance of the server is handling a request, and which is
+// running the scheduled jobs.
+type clusterStatus struct {
+	Instance    string     `json:"instance"`
+	Shared      string     `json:"shared_state"`
+	Leader      string     `json:"leader,omitempty"`
+	IsLeader    bool       `json:"is_leader"`
+	LeaderSince *time.Time `json:"leader_since,omitempty"`
+}
+
+// Report the state of the leader election for scheduled jobs.
+func (app *application) clusterStatus(w http.ResponseWriter, r *http.Request) {
+	holder, since, err := app.leader.Holder()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "shared state unavailable")
+		return
+	}
+	status := clusterStatus{
+		Instance: app.instance,
+		Shared:   app.config.Shared.Backend,
+		Leader:   holder,
+		IsLeader: app.leader.IsLeader(),
+	}
+	if !since.IsZero() {
+		status.LeaderSince = &since
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,175 @@
+/*! @file lambda.go
+ * @brief Adapter to run the server's handlers as an AWS Lambda behind API Gateway
+ *
+ * Small programs may not want to run a server continuously just to accept occasional uploads.  When
+ * the binary is started by the Lambda runtime (as a custom runtime "bootstrap"), it serves requests
+ * from API Gateway (REST or HTTP API proxy integrations, or a function URL) through the same handlers
+ * as the standalone server, by converting each event to an http.Request and the response back again.
+ * TLS is terminated by API Gateway, and the scheduled jobs are not run.  Note that the state
+ * directory has to be on storage that persists between invocations (e.g., EFS) for tokens and upload
+ * history to be retained.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Determine whether the binary has been started by the AWS Lambda runtime.
+func inLambda() bool {
+	return len(os.Getenv("AWS_LAMBDA_RUNTIME_API")) > 0
+}
+
+// Serve API Gateway events through the handler given until the runtime shuts down the function.
+func serveLambda(handler http.Handler) {
+	lambda.Start(func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var probe struct {
+			Version string `json:"version"`
+		}
+		json.Unmarshal(raw, &probe)
+		if probe.Version == "2.0" {
+			var event events.APIGatewayV2HTTPRequest
+			if err := json.Unmarshal(raw, &event); err != nil {
+				return nil, err
+			}
+			return serveV2(ctx, handler, event)
+		}
+		var event events.APIGatewayProxyRequest
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return serveV1(ctx, handler, event)
+	})
+}
+
+// Serve an HTTP API (payload format 2.0) or function URL event.
+func serveV2(ctx context.Context, handler http.Handler, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	target := event.RawPath
+	if len(event.RawQueryString) > 0 {
+		target += "?" + event.RawQueryString
+	}
+	headers := make(http.Header)
+	for k, v := range event.Headers {
+		headers.Set(k, v)
+	}
+	if len(event.Cookies) > 0 {
+		headers.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	r, err := lambdaRequest(ctx, event.RequestContext.HTTP.Method, target, headers, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{}, err
+	}
+	r.RemoteAddr = event.RequestContext.HTTP.SourceIP
+	status, header, body, encoded := lambdaServe(handler, r)
+	response := events.APIGatewayV2HTTPResponse{StatusCode: status, Body: body, IsBase64Encoded: encoded,
+		Headers: make(map[string]string)}
+	// Payload format 2.0 ignores multi-valued headers: values are comma-joined, except for cookies,
+	// which have their own field.
+	for k, v := range header {
+		if http.CanonicalHeaderKey(k) == "Set-Cookie" {
+			response.Cookies = append(response.Cookies, v...)
+			continue
+		}
+		response.Headers[k] = strings.Join(v, ",")
+	}
+	return response, nil
+}
+
+// Serve a REST API (payload format 1.0) proxy event.
+func serveV1(ctx context.Context, handler http.Handler, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	query := make(url.Values)
+	for k, v := range event.MultiValueQueryStringParameters {
+		query[k] = v
+	}
+	for k, v := range event.QueryStringParameters {
+		if _, ok := query[k]; !ok {
+			query.Set(k, v)
+		}
+	}
+	target := event.Path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	headers := make(http.Header)
+	for k, v := range event.MultiValueHeaders {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range event.Headers {
+		if len(headers.Values(k)) == 0 {
+			headers.Set(k, v)
+		}
+	}
+	r, err := lambdaRequest(ctx, event.HTTPMethod, target, headers, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	r.RemoteAddr = event.RequestContext.Identity.SourceIP
+	status, header, body, encoded := lambdaServe(handler, r)
+	response := events.APIGatewayProxyResponse{StatusCode: status, Body: body, IsBase64Encoded: encoded,
+		MultiValueHeaders: header}
+	return response, nil
+}
+
+func lambdaRequest(ctx context.Context, method, target string, headers http.Header, body string, encoded bool) (*http.Request, error) {
+	data := []byte(body)
+	if encoded {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(body); err != nil {
+			return nil, err
+		}
+	}
+	r, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r.Header = headers
+	r.Host = headers.Get("Host")
+	return r, nil
+}
+
+// Run the request through the handler, returning the response in the form that API Gateway
+// expects.  Anything other than text or JSON is base64-encoded, so that binary downloads survive.
+func lambdaServe(handler http.Handler, r *http.Request) (int, map[string][]string, string, bool) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	support.FlushErrorTracking() // The function may be frozen as soon as it returns
+	result := w.Result()
+	body := w.Body.Bytes()
+	contentType := result.Header.Get("Content-Type")
+	if len(body) == 0 || strings.HasPrefix(contentType, "text/") || strings.HasPrefix(contentType, "application/json") {
+		return result.StatusCode, result.Header, string(body), false
+	}
+	return result.StatusCode, result.Header, base64.StdEncoding.EncodeToString(body), true
+}
@@ -0,0 +1,202 @@
+/*! @file live.go
+ * @brief Streaming of real-time observations from loggers, for live displays
+ *
+ * With the "live-streaming" feature enabled, a connected logger can stream real-time observations by
+ * a long-running POST (chunked, one observation per line) to /v1/live: each line is either an
+ * NMEA0183 sentence as received (checked against its checksum, if it has one), or a decimated
+ * NMEA2000 observation as a JSON object with its "pgn".  Observations beyond the rate in the
+ * configuration are dropped, so a logger can't flood the displays.  The server keeps the recent
+ * observations from each logger (see support/live.go), and republishes them as server-sent events to
+ * displays through the administration API, starting with those kept.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The longest observation line accepted.
+const maxObservation = 64 << 10
+
+// How often a comment is sent to displays when there are no observations, to keep the connection.
+const liveHeartbeat = 15 * time.Second
+
+// Parse one line of a stream as an observation received at the time given.
+func parseObservation(line string, received time.Time) (api.Observation, error) {
+	obs := api.Observation{Received: received}
+	if strings.HasPrefix(line, "$") || strings.HasPrefix(line, "!") {
+		if body, checksum, ok := strings.Cut(line[1:], "*"); ok {
+			want, err := strconv.ParseUint(checksum, 16, 8)
+			if err != nil {
+				return obs, errors.New("malformed NMEA0183 checksum")
+			}
+			var sum byte
+			for i := 0; i < len(body); i++ {
+				sum ^= body[i]
+			}
+			if uint64(sum) != want {
+				return obs, errors.New("NMEA0183 checksum mismatch")
+			}
+		}
+		obs.Source, obs.Sentence = "nmea0183", line
+		return obs, nil
+	}
+	var value struct {
+		PGN uint32 `json:"pgn"`
+	}
+	if err := json.Unmarshal([]byte(line), &value); err != nil || value.PGN == 0 {
+		return obs, errors.New("neither an NMEA0183 sentence nor an NMEA2000 observation with a PGN")
+	}
+	obs.Source, obs.PGN, obs.Data = "nmea2000", value.PGN, json.RawMessage(line)
+	return obs, nil
+}
+
+// Accept a stream of observations from a logger, until the logger ends it, it goes idle, or the
+// server shuts down.  The response gives the number of observations accepted, dropped for exceeding
+// the rate, and malformed.
+func (app *application) liveStream(w http.ResponseWriter, r *http.Request) {
+	logger := support.LoggerID(r)
+	idle := time.Duration(app.config.Live.IdleSeconds) * time.Second
+	control := http.NewResponseController(w)
+	control.SetWriteDeadline(time.Time{})
+	control.SetReadDeadline(time.Now().Add(idle))
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-app.live.Done():
+			control.SetReadDeadline(time.Now())
+		case <-finished:
+		}
+	}()
+
+	support.Infof("LIVE: logger %s started streaming from %s.\n", logger, r.RemoteAddr)
+	counts := map[string]int{"accepted": 0, "dropped": 0, "malformed": 0}
+	var second int64
+	var inSecond int
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 4096), maxObservation)
+	for scanner.Scan() {
+		control.SetReadDeadline(time.Now().Add(idle))
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		now := time.Now().UTC()
+		obs, err := parseObservation(line, now)
+		if err != nil {
+			counts["malformed"]++
+			continue
+		}
+		if now.Unix() != second {
+			second, inSecond = now.Unix(), 0
+		}
+		if limit := app.config.Live.MaxPerSecond; limit > 0 && inSecond >= limit {
+			counts["dropped"]++
+			continue
+		}
+		inSecond++
+		obs.Logger = logger
+		app.live.Publish(logger, obs)
+		if pos, ok := observedPosition(obs); ok {
+			app.live.Locate(logger, pos)
+		}
+		counts["accepted"]++
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		support.Warnf("LIVE: stream from logger %s ended: %s\n", logger, err)
+	}
+	support.Infof("LIVE: logger %s stopped streaming (%d accepted, %d dropped, %d malformed).\n",
+		logger, counts["accepted"], counts["dropped"], counts["malformed"])
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// Republish the observations from a logger (or all loggers, if none is given in the path) as
+// server-sent events, starting with those kept, unless the "recent" query parameter is "false".
+func (app *application) liveEvents(w http.ResponseWriter, r *http.Request) {
+	if !app.config.FeatureEnabled("live-streaming") {
+		http.NotFound(w, r)
+		return
+	}
+	logger := r.PathValue("logger")
+	control := http.NewResponseController(w)
+	control.SetWriteDeadline(time.Time{})
+	updates, unsubscribe := app.live.Subscribe(logger)
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(obs api.Observation) error {
+		data, err := json.Marshal(obs)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: observation\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return control.Flush()
+	}
+	if r.URL.Query().Get("recent") != "false" {
+		loggers := []string{logger}
+		if len(logger) == 0 {
+			loggers = app.live.Loggers()
+		}
+		for _, l := range loggers {
+			for _, obs := range app.live.Recent(l) {
+				if err := send(obs); err != nil {
+					return
+				}
+			}
+		}
+	}
+	control.Flush()
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case obs := <-updates:
+			if err := send(obs); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil || control.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-app.live.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/*! @file loggersessions.go
+ * @brief Session tokens for loggers, issued at checkin
+ *
+ * When sessions are enabled, each checkin response carries a short-lived session token (see
+ * support/sessions.go) that the logger can use on its uploads in place of its upload token.  The
+ * sessions currently active, with the traffic seen in each, are listed for the operators.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Issue a session to the logger making the request, if sessions are enabled, returning nil if not.
+func (app *application) issueLoggerSession(r *http.Request) *api.SessionGrant {
+	if app.grants == nil {
+		return nil
+	}
+	logger := support.LoggerID(r)
+	token, session, err := app.grants.Issue(logger, support.TokenID(r))
+	if err != nil {
+		support.Errorf("API: failed to issue session to logger %s: %s\n", logger, err)
+		return nil
+	}
+	return &api.SessionGrant{Token: token, Expires: session.Expires}
+}
+
+// List the logger sessions that are active (on this instance, if there are several).
+func (app *application) listLoggerSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := make([]support.LoggerSession, 0)
+	if app.grants != nil {
+		sessions = app.grants.List()
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
@@ -0,0 +1,148 @@
+/*! @file maintenance.go
+ * @brief Maintenance logs for the loggers' hardware
+ *
+ * The history of a logger's hardware (when it was installed, antennas changed, firmware flashed,
+ * the site visited) explains much about its data, but tends to live in someone's spreadsheet.  These
+ * end-points keep a maintenance log in each logger's registry record, so that it travels with the
+ * fleet data and appears with the logger in the administration API.  Entries are kept in order of
+ * the date of the work, and can be corrected or removed by operators if entered in error.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Report the maintenance log for a logger, which is empty if the logger has none.
+func (app *application) listMaintenance(w http.ResponseWriter, r *http.Request) {
+	record, _ := app.registry.Get(r.PathValue("id"))
+	rtn := record.Maintenance
+	if rtn == nil {
+		rtn = []support.Maintenance{}
+	}
+	writeJSON(w, http.StatusOK, rtn)
+}
+
+// Add an entry to a logger's maintenance log.
+func (app *application) addMaintenance(w http.ResponseWriter, r *http.Request) {
+	var request api.MaintenanceInfo
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if err := support.ValidateMaintenance(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entryID, err := support.RandomToken(6)
+	if err != nil {
+		support.Errorf("ADMIN: failed to generate maintenance entry ID: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to add maintenance entry")
+		return
+	}
+	entry := support.Maintenance{
+		ID: entryID, Recorded: time.Now().UTC(), Author: support.CurrentPrincipal(r).Name, MaintenanceInfo: request,
+	}
+	id := r.PathValue("id")
+	if _, err := app.registry.Update(id, func(l *support.LoggerRecord) error {
+		l.Maintenance = append(slices.Clone(l.Maintenance), entry)
+		support.SortMaintenance(l.Maintenance)
+		return nil
+	}); err != nil {
+		support.Errorf("ADMIN: failed to add maintenance entry for logger %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to add maintenance entry")
+		return
+	}
+	app.recordAction(r, "maintenance.add", id, entry.Kind+" "+entry.Date)
+	writeJSON(w, http.StatusCreated, entry)
+}
+
+// Correct an entry in a logger's maintenance log.  The entry keeps its ID and original author.
+func (app *application) replaceMaintenance(w http.ResponseWriter, r *http.Request) {
+	var request api.MaintenanceInfo
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if err := support.ValidateMaintenance(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, entryID := r.PathValue("id"), r.PathValue("entry")
+	var entry support.Maintenance
+	_, err := app.registry.Update(id, func(l *support.LoggerRecord) error {
+		l.Maintenance = slices.Clone(l.Maintenance) // The registry restores the original if saving fails
+		for i := range l.Maintenance {
+			if l.Maintenance[i].ID == entryID {
+				l.Maintenance[i].MaintenanceInfo = request
+				entry = l.Maintenance[i]
+				support.SortMaintenance(l.Maintenance)
+				return nil
+			}
+		}
+		return support.ErrNotFound
+	})
+	if !app.maintenanceResult(w, id, err) {
+		return
+	}
+	app.recordAction(r, "maintenance.update", id, entryID)
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// Remove an entry from a logger's maintenance log.
+func (app *application) deleteMaintenance(w http.ResponseWriter, r *http.Request) {
+	id, entryID := r.PathValue("id"), r.PathValue("entry")
+	_, err := app.registry.Update(id, func(l *support.LoggerRecord) error {
+		l.Maintenance = slices.Clone(l.Maintenance) // The registry restores the original if saving fails
+		for i := range l.Maintenance {
+			if l.Maintenance[i].ID == entryID {
+				l.Maintenance = append(l.Maintenance[:i], l.Maintenance[i+1:]...)
+				return nil
+			}
+		}
+		return support.ErrNotFound
+	})
+	if !app.maintenanceResult(w, id, err) {
+		return
+	}
+	app.recordAction(r, "maintenance.delete", id, entryID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Write an error response for a failed change to a maintenance log, returning true if there was no
+// error.
+func (app *application) maintenanceResult(w http.ResponseWriter, logger string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such maintenance entry")
+	default:
+		support.Errorf("ADMIN: failed to update maintenance log for logger %s: %s\n", logger, err)
+		writeError(w, http.StatusInternalServerError, "failed to update maintenance log")
+	}
+	return false
+}
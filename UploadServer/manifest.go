@@ -0,0 +1,111 @@
+/*! @file manifest.go
+ * @brief Daily manifests of the files accepted, written into storage
+ *
+ * Downstream batch jobs need to find new data without listing every key in the bucket or asking the
+ * monitor, so the manifest job writes a manifest for each day (by time of receipt, in UTC) under the
+ * prefix in the configuration, as {prefix}{year}-{month}-{day}.jsonl, with one line for each upload
+ * accepted that day.  In a cluster, each instance writes the manifest of the uploads it accepted, as
+ * {prefix}{year}-{month}-{day}-{host}.jsonl.  The job rewrites the manifests for the current and previous days each time it
+ * runs, so that a day's manifest is complete once the day is over.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Generate the storage key of the manifest for the day given.
+func (app *application) manifestKey(day time.Time) string {
+	return app.config.Storage.Manifests + day.Format("2006-01-02") + clusterSuffix(app.config, "-") + ".jsonl"
+}
+
+// Write the manifest of the uploads accepted on the day (in UTC) starting at the time given,
+// returning the number of entries.
+func (app *application) writeManifest(ctx context.Context, day time.Time) (int, error) {
+	uploads := app.uploads.Select(day, day.Add(24*time.Hour), func(u *support.UploadRecord) bool {
+		return u.Status == support.UploadAccepted && len(u.Key) > 0
+	})
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, u := range uploads {
+		entry := api.ManifestEntry{UUID: u.UUID, Logger: u.Logger, FileID: u.FileID, Key: u.Key, Type: u.Type,
+			Size: u.Size, MD5: u.MD5, Received: u.Received}
+		if err := encoder.Encode(entry); err != nil {
+			return 0, err
+		}
+	}
+	metadata := map[string]string{"date": day.Format("2006-01-02"), "entries": fmt.Sprint(len(uploads))}
+	if err := app.putObject(ctx, app.manifestKey(day), buffer.Bytes(), metadata); err != nil {
+		return 0, err
+	}
+	return len(uploads), nil
+}
+
+// Rewrite the manifests already written for the days given (e.g., after uploads on those days have
+// been removed), returning the number rewritten.
+func (app *application) rewriteManifests(ctx context.Context, days map[time.Time]bool) (int, error) {
+	if len(app.config.Storage.Manifests) == 0 {
+		return 0, nil
+	}
+	var n int
+	for day := range days {
+		rc, _, err := app.storage.Get(ctx, app.manifestKey(day))
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		rc.Close()
+		if _, err := app.writeManifest(ctx, day); err != nil {
+			return n, fmt.Errorf("writing manifest %s: %w", app.manifestKey(day), err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Write the manifests for the current and previous days.
+func (app *application) manifestJob(ctx context.Context) (string, error) {
+	if len(app.config.Storage.Manifests) == 0 {
+		return "manifests are not configured", nil
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	var entries int
+	for _, day := range []time.Time{today.Add(-24 * time.Hour), today} {
+		n, err := app.writeManifest(ctx, day)
+		if err != nil {
+			return "", fmt.Errorf("writing manifest %s: %w", app.manifestKey(day), err)
+		}
+		entries += n
+	}
+	return fmt.Sprintf("wrote manifests for %s and %s (%d entries)", today.Add(-24*time.Hour).Format("2006-01-02"),
+		today.Format("2006-01-02"), entries), nil
+}
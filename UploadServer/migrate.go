@@ -0,0 +1,210 @@
+/*! @file migrate.go
+ * @brief Migrating stored objects from one storage backend to another
+ *
+ * A deployment that starts on a laptop (local storage) and graduates to production infrastructure
+ * (S3, possibly in another account) has to take its stored files with it.  The "migrate-storage"
+ * command copies every object (with its metadata) from the storage backend in one configuration to
+ * the backend in another, reading each copy back to check it against the original.  Objects are
+ * copied as stored (i.e., still compressed, if they were), except that local encryption is that of
+ * the destination.  Each verified copy is noted in a journal, so that a migration that's interrupted
+ * (or that fails for some objects) can be run again and carries on where it left off; objects that
+ * changed size since they were copied are copied again.  Keys don't change, so the upload history
+ * and the other records in the state directory are still valid once the server's configuration is
+ * switched to the new backend.  The source is never modified.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A migratedObject records an object that has been copied and verified.
+type migratedObject struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	MD5      string    `json:"md5"`
+	Migrated time.Time `json:"migrated"`
+}
+
+// Copy the objects from the storage backend in one configuration to that in another.
+func migrateStorageCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	var fromFiles, toFiles configFiles
+	fs.Var(&fromFiles, "config", "Filename to load the JSON configuration with the source storage (may be repeated)")
+	fs.Var(&toFiles, "to", "Filename to load the JSON configuration with the destination storage (may be repeated)")
+	prefix := fs.String("prefix", "", "Only migrate objects whose keys start with this prefix")
+	journal := fs.String("journal", "", "Journal of objects migrated (default storage-migration.jsonl in the state directory)")
+	dryRun := fs.Bool("dry-run", false, "List the objects that would be copied without copying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(toFiles) == 0 {
+		return errors.New("usage: migrate-storage [-config <source>] -to <destination> [-prefix <prefix>] [-journal <file>] [-dry-run]")
+	}
+	fromConfig, err := loadConfig(fromFiles)
+	if err != nil {
+		return err
+	}
+	toConfig, err := support.NewConfig(toFiles...)
+	if err != nil {
+		return err
+	}
+	if fromConfig.Storage.Backend == "memory" || toConfig.Storage.Backend == "memory" {
+		return errors.New("memory storage can't be migrated from or to")
+	}
+	source, err := storage.New(fromConfig.Storage, fromConfig.AWS)
+	if err != nil {
+		return fmt.Errorf("source storage: %w", err)
+	}
+	destination, err := storage.New(toConfig.Storage, toConfig.AWS)
+	if err != nil {
+		return fmt.Errorf("destination storage: %w", err)
+	}
+	if source.Location() == destination.Location() && fromConfig.Storage.Backend == toConfig.Storage.Backend {
+		return errors.New("source and destination storage are the same")
+	}
+	if len(*journal) == 0 {
+		if err := os.MkdirAll(fromConfig.State.Directory, 0700); err != nil {
+			return err
+		}
+		*journal = filepath.Join(fromConfig.State.Directory, "storage-migration.jsonl")
+	}
+	log := support.NewJournal(*journal)
+	done := make(map[string]migratedObject)
+	err = log.Scan(func(line []byte) error {
+		var m migratedObject
+		if json.Unmarshal(line, &m) == nil {
+			done[m.Key] = m
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading journal %q: %w", *journal, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	support.Infof("MIGRATE: copying objects from %s (%s) to %s (%s).\n", source.Location(), fromConfig.Storage.Backend,
+		destination.Location(), toConfig.Storage.Backend)
+	var copied, skipped, failed int
+	var total int64
+	err = source.List(ctx, *prefix, func(info storage.ObjectInfo) error {
+		if m, ok := done[info.Key]; ok && m.Size == info.Size {
+			skipped++
+			return nil
+		}
+		if *dryRun {
+			fmt.Printf("%s\t%d\n", info.Key, info.Size)
+			copied++
+			total += info.Size
+			return nil
+		}
+		m, err := migrateObject(ctx, source, destination, info.Key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			support.Errorf("MIGRATE: failed to copy %s: %s\n", info.Key, err)
+			failed++
+			return nil
+		}
+		if err := log.Append(m); err != nil {
+			return fmt.Errorf("writing journal %q: %w", *journal, err)
+		}
+		copied++
+		total += m.Size
+		if copied%100 == 0 {
+			support.Infof("MIGRATE: %d objects (%d bytes) copied so far.\n", copied, total)
+		}
+		return nil
+	})
+	verb := "copied"
+	if *dryRun {
+		verb = "to copy"
+	}
+	support.Infof("MIGRATE: %d objects (%d bytes) %s, %d already migrated, %d failed.\n", copied, total, verb, skipped, failed)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d objects failed to copy; run the migration again to retry them", failed)
+	}
+	return nil
+}
+
+// Copy one object, with its metadata, and check the copy by reading it back.  The object is hashed as
+// it's read, and the copy is hashed as it's read back rather than held, so that only the one copy
+// that the backend needs to store is held in memory.
+func migrateObject(ctx context.Context, source, destination storage.Backend, key string) (migratedObject, error) {
+	object, info, err := source.Get(ctx, key)
+	if err != nil {
+		return migratedObject{}, err
+	}
+	hash := md5.New()
+	data, err := io.ReadAll(io.TeeReader(object, hash))
+	object.Close()
+	if err != nil {
+		return migratedObject{}, err
+	}
+	sum, size := hash.Sum(nil), int64(len(data))
+	if err := destination.Put(ctx, key, data, info.Metadata); err != nil {
+		return migratedObject{}, err
+	}
+	readBack, err := objectMD5(ctx, destination, key)
+	if err != nil {
+		return migratedObject{}, fmt.Errorf("reading back copy: %w", err)
+	}
+	if !bytes.Equal(readBack, sum) {
+		return migratedObject{}, errors.New("copy doesn't match the original")
+	}
+	return migratedObject{Key: key, Size: size, MD5: hex.EncodeToString(sum), Migrated: time.Now().UTC()}, nil
+}
+
+// Compute the MD5 digest of an object by streaming it through the hash.
+func objectMD5(ctx context.Context, backend storage.Backend, key string) ([]byte, error) {
+	object, _, err := backend.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, object); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,63 @@
+/*! @file mock.go
+ * @brief Inspection of what the server did in mock mode
+ *
+ * With "mock" set in the configuration, files are kept in memory rather than in the storage backend,
+ * and the notifications that would have gone to the processing chain are recorded instead of sent,
+ * so that a firmware developer can run the whole server locally without any cloud set-up.  What
+ * "would" have happened (the files stored, and the notifications sent) can then be seen through the
+ * administration API.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/notify"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+)
+
+// The number of notifications kept in mock mode.
+const mockEvents = 1000
+
+// The mockView lists the files stored, and the notifications sent, in mock mode.
+type mockView struct {
+	Stored        []storage.ObjectInfo `json:"stored"`
+	Notifications []notify.Event       `json:"notifications"`
+}
+
+// Report the files stored, and the notifications that would have been sent, in mock mode.
+func (app *application) mockStatus(w http.ResponseWriter, r *http.Request) {
+	if app.mock == nil {
+		writeError(w, http.StatusNotFound, "server is not running in mock mode")
+		return
+	}
+	view := mockView{Stored: []storage.ObjectInfo{}, Notifications: app.mock.Events()}
+	err := app.storage.List(r.Context(), "", func(info storage.ObjectInfo) error {
+		view.Stored = append(view.Stored, info)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list stored files")
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
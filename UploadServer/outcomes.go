@@ -0,0 +1,186 @@
+/*! @file outcomes.go
+ * @brief Reports from the processing chain of what happened to each file
+ *
+ * Once a file has been passed on, the server can't otherwise tell whether it was converted,
+ * refused, or submitted to DCDB.  Components of the processing chain (e.g., the conversion Lambda,
+ * or wibl-python) that have a callback token in the configuration (see ProcessingParam in
+ * support/config.go) report each outcome to /v1/processing/{uuid} (or to /v1/processing,
+ * identifying the file by its trace ID; see trace.go), and the server records it against the
+ * upload.  Conversion or submission marks the file as processed (so that it's archived in due
+ * course; see archive.go), and rejection marks it as failed and raises an alert.  Operators see the
+ * outcomes with the file's record (and can list files by their latest outcome; see files.go), and
+ * loggers are told of the outcomes for their files at their next checkin.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The most outcomes reported to a logger at one checkin (the most recent are kept).
+const outcomeLimit = 100
+
+var knownOutcomes = []string{support.OutcomeConverted, support.OutcomeRejected, support.OutcomeSubmitted}
+
+// Find the name under which the request's bearer token appears in the tokens given, by name.
+func namedToken(r *http.Request, tokens map[string]string) (string, bool) {
+	token, ok := support.BearerToken(r)
+	if !ok {
+		return "", false
+	}
+	for name, secret := range tokens {
+		if len(secret) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Record a processing chain component's report of what happened to a file, identified by the UUID in
+// the path or, if there isn't one, the trace ID in the report.  The response is the upload record.
+func (app *application) reportOutcome(w http.ResponseWriter, r *http.Request) {
+	tokens := app.config.Processing.CallbackTokens
+	if len(tokens) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	reporter, ok := namedToken(r, tokens)
+	if !ok {
+		support.Warnf("API: processing report from %s failed authentication.\n", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var report api.ProcessingReport
+	if !readJSON(w, r, &report) {
+		return
+	}
+	if !slices.Contains(knownOutcomes, report.Outcome) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("outcome must be one of %v", knownOutcomes))
+		return
+	}
+	now := time.Now().UTC()
+	outcome := support.ProcessingOutcome{Outcome: report.Outcome, Detail: report.Detail, Reference: report.Reference,
+		Reporter: reporter, Time: now, Reported: now}
+	if report.Time != nil {
+		outcome.Time = report.Time.UTC()
+	}
+	uuid := r.PathValue("uuid")
+	if len(uuid) == 0 {
+		if len(report.Trace) == 0 {
+			writeError(w, http.StatusBadRequest, "the file's UUID or trace ID is required")
+			return
+		}
+		traced, ok := app.tracedUpload(report.Trace)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such file")
+			return
+		}
+		uuid = traced.UUID
+	}
+	errNotAccepted := errors.New("file was not accepted")
+	errWrongTrace := errors.New("trace ID does not match the file")
+	errRepeated := errors.New("outcome already recorded")
+	record, err := app.uploads.Update(uuid, func(u *support.UploadRecord) error {
+		if u.Status != support.UploadAccepted {
+			return errNotAccepted
+		}
+		if len(report.Trace) > 0 && report.Trace != u.Trace {
+			return errWrongTrace
+		}
+		if latest, ok := u.LatestOutcome(); ok && latest.Outcome == outcome.Outcome &&
+			latest.Reference == outcome.Reference && latest.Reporter == outcome.Reporter {
+			return errRepeated
+		}
+		u.Outcomes = append(u.Outcomes, outcome)
+		switch {
+		case u.State == support.StateCorrupt || u.State == support.StateMissing:
+		case outcome.Outcome == support.OutcomeRejected:
+			u.State = support.StateFailed
+		case u.State != support.StateProcessed:
+			u.State, u.Processed = support.StateProcessed, &outcome.Time
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errRepeated):
+		record, _ = app.uploads.Get(uuid)
+		writeJSON(w, http.StatusOK, record)
+		return
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such file")
+		return
+	case errors.Is(err, errNotAccepted), errors.Is(err, errWrongTrace):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		support.Errorf("API: failed to record processing outcome for %s: %s\n", uuid, err)
+		writeError(w, http.StatusInternalServerError, "failed to update file")
+		return
+	}
+	support.Infof("API: %s reported file %s from logger %s as %s.\n", reporter, uuid, record.Logger, outcome.Outcome)
+	app.audit.Record(reporter, r.RemoteAddr, "file.outcome", uuid, outcome.Outcome)
+	if outcome.Outcome == support.OutcomeRejected {
+		app.alerts.Raise("processing", uuid, fmt.Sprintf("rejected by %s (logger %s): %s", reporter, record.Logger, outcome.Detail))
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Generate the list of outcomes reported for the logger's files since the time given (when they were
+// reported, rather than when they happened), or nil if there were none.
+func (app *application) outcomeNotices(logger string, since time.Time) []api.FileOutcome {
+	if since.IsZero() {
+		since = time.Now().UTC().Add(-changelogWindow)
+	}
+	var rtn []api.FileOutcome
+	records := app.uploads.SelectLogger(logger, time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return len(u.Outcomes) > 0
+	})
+	for _, record := range records {
+		for _, outcome := range record.Outcomes {
+			if outcome.Reported.After(since) {
+				rtn = append(rtn, api.FileOutcome{MD5: record.MD5, FileID: record.FileID, Outcome: outcome.Outcome,
+					Detail: outcome.Detail, Time: outcome.Time})
+			}
+		}
+	}
+	slices.SortFunc(rtn, func(a, b api.FileOutcome) int { return a.Time.Compare(b.Time) })
+	if len(rtn) > outcomeLimit {
+		rtn = rtn[len(rtn)-outcomeLimit:]
+	}
+	return rtn
+}
+
+// Provide the latest outcome reported for a file, or "" if there hasn't been one.
+func latestOutcome(u *support.UploadRecord) string {
+	if outcome, ok := u.LatestOutcome(); ok {
+		return outcome.Outcome
+	}
+	return ""
+}
@@ -0,0 +1,349 @@
+/*! @file payload.go
+ * @brief Checks that an upload is a file, rather than something else
+ *
+ * Gateways and captive portals on vessel networks sometimes answer a logger's request themselves,
+ * and the logger can end up forwarding an HTML error page as if it were a data file.  Uploads are
+ * therefore required to have one of the configured content types (by default,
+ * application/octet-stream, which is what the firmware sends), and must start with the packet that
+ * every WIBL file starts with, before they're accepted.
+ *
+ * Loggers also produce files other than WIBL data (e.g., self-test reports or crash dumps).  The
+ * configuration can list these as payload types, which the logger names in the X-Payload-Type
+ * header; each has its own content types, size limit, storage prefix, and notification targets, and
+ * isn't checked for a WIBL header or sent to the processing chain.  WIBL data and each of the other
+ * types have separate size limits, which are enforced before the body is read, so that a runaway
+ * upload of (e.g.) a crash dump is refused without being buffered or using the logger's quota.
+ *
+ * Where vessel owners require that their data is confidential until it's processed, loggers can
+ * encrypt files before uploading them, naming the key in the X-Encryption-Key-Id header.  Only the
+ * keys listed in the configuration are accepted.  The digest is checked against the ciphertext,
+ * which is stored as it is, with the key ID recorded (in the upload history, the object's metadata,
+ * and the notification) so that the processing chain can decrypt it; the contents can't be checked.
+ *
+ * Operators often need to tie a stored file back to "file 23 on boat X", so the ID of the file on
+ * the logger is recorded with each upload: from the X-File-Id header, if the logger gives it, or
+ * otherwise from the logger's last reported inventory, by digest.  Stored files can also be named
+ * with the logger and file ID, as well as the UUID, if the configuration asks.
+ *
+ * With the "date" layout, files are partitioned by the day they were received, so that batch jobs
+ * can find a day's files by prefix (see also manifest.go).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/notify"
+	"ccom.unh.edu/wibl-monitor/src/support"
+	"ccom.unh.edu/wibl-monitor/src/wibl"
+)
+
+// The header with which a logger names the type of file it's uploading.  Without it, the file is
+// taken to be WIBL data.
+const payloadHeader = "X-Payload-Type"
+
+// The payload type name for WIBL data, which is always accepted.
+const wiblPayload = "wibl"
+
+// The header with which a logger names the key it encrypted an upload with.
+const encryptionHeader = "X-Encryption-Key-Id"
+
+// The header with which a logger gives the ID of the file it's uploading, as in its status.
+const fileIDHeader = "X-File-Id"
+
+// The schemes for naming stored files.
+const (
+	namingUUID   = "uuid"        // {uuid}.wibl
+	namingLogger = "logger-file" // {logger}-{file ID}-{uuid}.wibl
+)
+
+// The layouts for stored files.
+const (
+	layoutFlat = "flat" // All files together (under the type's prefix)
+	layoutDate = "date" // Under {year}/{month}/{day}/ for the day the file was received
+)
+
+// Find the payload type of an upload, as named by the logger, giving "" for WIBL data.  The result
+// is false if the type isn't one of those configured.
+func (app *application) payloadType(r *http.Request) (string, bool) {
+	name := strings.TrimSpace(r.Header.Get(payloadHeader))
+	if len(name) == 0 || name == wiblPayload {
+		return "", true
+	}
+	_, ok := app.config.Upload.Types[name]
+	return name, ok
+}
+
+// Find the key that an upload was encrypted with, giving "" if it wasn't encrypted.  The result is
+// false if the key isn't one of those configured.
+func (app *application) encryptionKey(r *http.Request) (string, bool) {
+	key := strings.TrimSpace(r.Header.Get(encryptionHeader))
+	if len(key) == 0 {
+		return "", true
+	}
+	return key, slices.Contains(app.config.Upload.KeyIDs, key)
+}
+
+// Check that the request has one of the content types accepted for its payload type.  If no types
+// are configured, anything is accepted.
+func (app *application) acceptableType(r *http.Request) bool {
+	payload, ok := app.payloadType(r)
+	if !ok {
+		return false
+	}
+	types := app.config.Upload.ContentTypes
+	if len(payload) > 0 {
+		types = app.config.Upload.Types[payload].ContentTypes
+	}
+	if len(types) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(types, func(t string) bool { return strings.EqualFold(t, mediaType) })
+}
+
+// Refuse uploads of an unknown payload type, encrypted with an unknown key, or without an acceptable
+// content type, with HTTP 415 (Unsupported Media Type), before the body is read.  The refusal is
+// recorded in the upload history.
+func (app *application) requireType(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.encryptionKey(r); !ok {
+			support.Warnf("TRANS: refusing upload from %s encrypted with unknown key %q.\n",
+				support.LoggerID(r), r.Header.Get(encryptionHeader))
+			app.refuseUpload(r, r.ContentLength, "unknown encryption key")
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if !app.acceptableType(r) {
+			reason := "unsupported content type"
+			if _, ok := app.payloadType(r); !ok {
+				reason = "unknown payload type"
+			}
+			support.Warnf("TRANS: refusing upload from %s with payload type %q and content type %q.\n",
+				support.LoggerID(r), r.Header.Get(payloadHeader), r.Header.Get("Content-Type"))
+			app.refuseUpload(r, r.ContentLength, reason)
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Refuse uploads larger than their payload type allows, with HTTP 413 (Content Too Large), before
+// the body is read.  The Content-Length is checked if it's given, and the body is limited in case it
+// isn't (or is wrong), which the handler reports with tooLarge.
+func (app *application) limitSize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := app.payloadType(r)
+		if limit := app.payloadLimit(payload); limit > 0 {
+			if r.ContentLength > limit {
+				support.Warnf("TRANS: refusing upload of %d bytes from %s (limit %d).\n", r.ContentLength, support.LoggerID(r), limit)
+				app.refuseUpload(r, r.ContentLength, "file too large")
+				http.Error(w, "Content Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r)
+	}
+}
+
+// Determine whether a failure to read the body of an upload was because it exceeded the size
+// limit, in which case the refusal is recorded and the logger told with HTTP 413.
+func (app *application) tooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var maxBytes *http.MaxBytesError
+	if !errors.As(err, &maxBytes) {
+		return false
+	}
+	support.Warnf("TRANS: refusing upload from %s larger than %d bytes.\n", support.LoggerID(r), maxBytes.Limit)
+	app.refuseUpload(r, r.ContentLength, "file too large")
+	http.Error(w, "Content Too Large", http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// Record an upload refused before its body was read (or assembled) in the upload history, unless it
+// was only being validated.
+func (app *application) refuseUpload(r *http.Request, size int64, reason string) {
+	if r.URL.Path == validatePath {
+		return
+	}
+	record := support.UploadRecord{
+		UUID:     support.NewUUID(),
+		Logger:   support.LoggerID(r),
+		Received: time.Now().UTC(),
+		Remote:   r.RemoteAddr,
+		Size:     max(size, 0),
+	}
+	record.Type, _ = app.payloadType(r)
+	record.KeyID = strings.TrimSpace(r.Header.Get(encryptionHeader))
+	record.Trace, record.Correlation = newTraceID(), requestCorrelation(r)
+	app.recordUpload(record, support.UploadRejected, reason)
+}
+
+// Find the size limit for files of the payload type given, or zero if there's no limit.
+func (app *application) payloadLimit(payload string) int64 {
+	if len(payload) == 0 {
+		return app.config.Upload.MaxBytes
+	}
+	return app.config.Upload.Types[payload].MaxBytes
+}
+
+// Check that a file is acceptable as the payload type given: that it's within the type's size limit
+// and, for WIBL data that wasn't encrypted (with the key given), that it starts with a WIBL header,
+// if the configuration requires.
+func (app *application) checkPayload(payload, key string, body []byte) error {
+	if limit := app.payloadLimit(payload); limit > 0 && int64(len(body)) > limit {
+		return fmt.Errorf("file too large (%d bytes, limit %d)", len(body), limit)
+	}
+	if len(payload) > 0 || len(key) > 0 || !app.config.Upload.CheckHeader {
+		return nil
+	}
+	return wibl.CheckHeader(body)
+}
+
+// The reasons for an upload to fail that may not hold if it's tried again later.
+var transientRefusals = map[string]bool{"": true, "storage failure": true, "storage cancelled": true, "quota exceeded": true,
+	"logger awaiting approval": true}
+
+// Accept a file that arrived other than by upload from the logger (e.g., as an email attachment), and
+// so has no digest to check, as from the logger and remote given.  The result is true if the file was
+// accepted (or repeats one that was), along with whether a file that wasn't accepted might be if
+// tried again later (e.g., if storage failed, or the same file is being uploaded already).
+func (app *application) acceptFile(ctx context.Context, logger, remote, name string, body []byte) (bool, bool) {
+	record := support.UploadRecord{
+		UUID:     support.NewUUID(),
+		Logger:   logger,
+		Received: time.Now().UTC(),
+		Remote:   remote,
+		Size:     int64(len(body)),
+		MD5:      fmt.Sprintf("%X", md5.Sum(body)),
+	}
+	if id, ok := app.fileID(logger, record.MD5); ok {
+		record.FileID = &id
+	}
+	if limit := app.payloadLimit(""); limit > 0 && record.Size > limit {
+		support.Warnf("TRANS: refusing %q from %s for logger %s (%d bytes, limit %d).\n", name, remote, logger, record.Size, limit)
+		app.recordUpload(record, support.UploadRejected, "file too large")
+		return false, false
+	}
+	if _, _, ok := app.acceptUpload(ctx, record, body); ok {
+		return true, false
+	}
+	refused, _ := app.uploads.Get(record.UUID) // Not recorded if the file is being uploaded already
+	return false, transientRefusals[refused.Reason]
+}
+
+// Find the ID of an uploaded file on the logger, from the header if the logger gave it, or else
+// from the logger's last reported inventory.  The result is nil if the ID isn't known.
+func (app *application) reportedFileID(r *http.Request, logger, digest string) *uint {
+	if header := r.Header.Get(fileIDHeader); len(header) > 0 {
+		if id, err := strconv.ParseUint(strings.TrimSpace(header), 10, 0); err == nil {
+			rtn := uint(id)
+			return &rtn
+		}
+		support.Warnf("TRANS: ignoring malformed file ID %q from logger %s.\n", header, logger)
+	}
+	if id, ok := app.fileID(logger, digest); ok {
+		return &id
+	}
+	return nil
+}
+
+// Generate the prefix for the storage keys of an upload's objects, according to the layout in the
+// configuration.
+func (app *application) partition(record support.UploadRecord) string {
+	if app.config.Storage.Layout == layoutDate {
+		return record.Received.UTC().Format("2006/01/02/")
+	}
+	return ""
+}
+
+// Generate the storage key for an accepted file, according to its payload type and the naming
+// scheme and layout in the configuration.
+func (app *application) payloadKey(record support.UploadRecord) string {
+	name := record.UUID
+	if app.config.Upload.Naming == namingLogger {
+		name = safeName(record.Logger) + "-"
+		if record.FileID != nil {
+			name += strconv.FormatUint(uint64(*record.FileID), 10) + "-"
+		}
+		name += record.UUID
+	}
+	name = app.partition(record) + name
+	if len(record.Type) == 0 && len(record.Route) > 0 {
+		return app.routePrefix(record.Route) + name + ".wibl"
+	}
+	if len(record.Type) == 0 {
+		return name + ".wibl"
+	}
+	t := app.config.Upload.Types[record.Type]
+	prefix := t.Prefix
+	if len(prefix) == 0 {
+		prefix = record.Type + "/"
+	}
+	return prefix + name + t.Extension
+}
+
+// Make a name safe to use in a storage key, replacing anything other than letters, digits, '.', '_',
+// and '-' with '_'.
+func safeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Generate the notifiers for each of the payload types configured.  In mock mode, all notifications
+// go to the recorder.
+func payloadNotifiers(config *support.Config, recorder *notify.Recorder) (map[string]notify.Multi, error) {
+	rtn := make(map[string]notify.Multi)
+	for name, t := range config.Upload.Types {
+		if name == wiblPayload {
+			return nil, fmt.Errorf("payload type %q is reserved for WIBL data", name)
+		}
+		if recorder != nil {
+			rtn[name] = notify.Multi{recorder}
+			continue
+		}
+		n, err := notify.New(t.Notify, config.AWS)
+		if err != nil {
+			return nil, fmt.Errorf("payload type %s: %w", name, err)
+		}
+		rtn[name] = n
+	}
+	return rtn, nil
+}
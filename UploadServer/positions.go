@@ -0,0 +1,233 @@
+/*! @file positions.go
+ * @brief Last-known positions of the fleet, as GeoJSON for web maps
+ *
+ * The server hears where loggers are from several sources: the position extension to the status
+ * message at checkin, the estimate that a satellite gateway gives with a relayed beacon (see
+ * gateway.go), and position observations in a live stream (see live.go).  This end-point combines
+ * them, taking the most recent for each logger, into a GeoJSON FeatureCollection of points that a web
+ * map can display directly.  Each feature gives the logger, its vessel (if linked), where the position
+ * came from, its age, and whether it's stale (older than the "stale_minutes" query parameter, by
+ * default an hour), so that the map can tell vessels in contact from those last seen long ago.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The default and maximum age (minutes) beyond which a position is reported as stale.
+const (
+	defaultStaleMinutes = 60
+	maxStaleMinutes     = 7 * 24 * 60
+)
+
+// The NMEA2000 PGN for Position, Rapid Update.
+const pgnPosition = 129025
+
+// A positionFix is a logger's last-known position, and where it came from.
+type positionFix struct {
+	Latitude  float64
+	Longitude float64
+	Time      time.Time
+	Source    string  // "status", "beacon", or "live"
+	CEP       float64 // Radius of the circular error probable (km), if known
+}
+
+type pointGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"` // Longitude, latitude, as GeoJSON requires
+}
+
+type positionProperties struct {
+	Logger string    `json:"logger"`
+	Vessel string    `json:"vessel,omitempty"` // Name of the vessel that the logger is linked to
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+	Age    int64     `json:"age_seconds"`
+	Stale  bool      `json:"stale"`
+	CEP    float64   `json:"cep_km,omitempty"`
+}
+
+type positionFeature struct {
+	Type       string             `json:"type"`
+	ID         string             `json:"id"`
+	Geometry   pointGeometry      `json:"geometry"`
+	Properties positionProperties `json:"properties"`
+}
+
+type positionCollection struct {
+	Type      string            `json:"type"`
+	Generated time.Time         `json:"generated"`
+	Features  []positionFeature `json:"features"`
+}
+
+// Determine whether a position is a valid latitude and longitude (and not the 0,0 that receivers
+// often report without a fix).
+func plausiblePosition(lat, lon float64) bool {
+	return !math.IsNaN(lat) && !math.IsNaN(lon) && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 &&
+		(lat != 0 || lon != 0)
+}
+
+// Extract the position from a live observation, if it's a fix: an NMEA0183 GGA or RMC sentence with
+// a valid fix, or an NMEA2000 Position, Rapid Update with "latitude" and "longitude" values.
+func observedPosition(obs api.Observation) (api.Position, bool) {
+	pos := api.Position{Time: &obs.Received}
+	switch obs.Source {
+	case "nmea0183":
+		body, _, _ := strings.Cut(obs.Sentence, "*")
+		fields := strings.Split(body, ",")
+		address := strings.TrimLeft(fields[0], "$!") // Talker and sentence type, e.g., "GPGGA"
+		if len(address) != 5 {
+			return pos, false
+		}
+		var lat, lon []string
+		switch address[2:] {
+		case "GGA":
+			if len(fields) < 7 || fields[6] == "" || fields[6] == "0" {
+				return pos, false
+			}
+			lat, lon = fields[2:4], fields[4:6]
+		case "RMC":
+			if len(fields) < 7 || fields[2] != "A" {
+				return pos, false
+			}
+			lat, lon = fields[3:5], fields[5:7]
+		default:
+			return pos, false
+		}
+		var ok bool
+		if pos.Latitude, ok = nmeaDegrees(lat[0], lat[1], "N", "S"); !ok {
+			return pos, false
+		}
+		if pos.Longitude, ok = nmeaDegrees(lon[0], lon[1], "E", "W"); !ok {
+			return pos, false
+		}
+	case "nmea2000":
+		if obs.PGN != pgnPosition {
+			return pos, false
+		}
+		var value struct {
+			Latitude  *float64 `json:"latitude"`
+			Longitude *float64 `json:"longitude"`
+		}
+		if err := json.Unmarshal(obs.Data, &value); err != nil || value.Latitude == nil || value.Longitude == nil {
+			return pos, false
+		}
+		pos.Latitude, pos.Longitude = *value.Latitude, *value.Longitude
+	default:
+		return pos, false
+	}
+	return pos, plausiblePosition(pos.Latitude, pos.Longitude)
+}
+
+// Convert an NMEA0183 angle (degrees and decimal minutes, as dddmm.mmmm) and its hemisphere to
+// decimal degrees.
+func nmeaDegrees(value, hemisphere, positive, negative string) (float64, bool) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	degrees := math.Floor(v/100) + math.Mod(v, 100)/60
+	switch hemisphere {
+	case positive:
+		return degrees, true
+	case negative:
+		return -degrees, true
+	}
+	return 0, false
+}
+
+// Find the most recent position known for each logger.
+func (app *application) lastPositions() map[string]positionFix {
+	rtn := make(map[string]positionFix)
+	update := func(logger string, fix positionFix) {
+		if !plausiblePosition(fix.Latitude, fix.Longitude) {
+			return
+		}
+		if current, ok := rtn[logger]; !ok || fix.Time.After(current.Time) {
+			rtn[logger] = fix
+		}
+	}
+	for _, status := range app.fleet.List() {
+		if pos := status.Status.Position; pos != nil {
+			fixed := status.LastCheckin
+			if pos.Time != nil {
+				fixed = pos.Time.UTC()
+			}
+			update(status.LoggerID, positionFix{Latitude: pos.Latitude, Longitude: pos.Longitude, Time: fixed, Source: "status"})
+		}
+		if b := status.Beacon; b != nil && b.Latitude != nil && b.Longitude != nil {
+			update(status.LoggerID, positionFix{Latitude: *b.Latitude, Longitude: *b.Longitude, Time: b.Sent, Source: "beacon", CEP: b.CEP})
+		}
+	}
+	for logger, pos := range app.live.Positions() {
+		update(logger, positionFix{Latitude: pos.Latitude, Longitude: pos.Longitude, Time: *pos.Time, Source: "live"})
+	}
+	return rtn
+}
+
+// Report the last-known position of each logger as a GeoJSON FeatureCollection.
+func (app *application) fleetPositions(w http.ResponseWriter, r *http.Request) {
+	staleMinutes := defaultStaleMinutes
+	if value := r.URL.Query().Get("stale_minutes"); len(value) > 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxStaleMinutes {
+			writeError(w, http.StatusBadRequest, "stale_minutes must be between 1 and 10080")
+			return
+		}
+		staleMinutes = n
+	}
+	stale := time.Duration(staleMinutes) * time.Minute
+	now := time.Now().UTC()
+	rtn := positionCollection{Type: "FeatureCollection", Generated: now, Features: make([]positionFeature, 0)}
+	for logger, fix := range app.lastPositions() {
+		age := now.Sub(fix.Time)
+		feature := positionFeature{
+			Type:     "Feature",
+			ID:       logger,
+			Geometry: pointGeometry{Type: "Point", Coordinates: []float64{fix.Longitude, fix.Latitude}},
+			Properties: positionProperties{
+				Logger: logger, Source: fix.Source, Time: fix.Time, Age: int64(max(age, 0).Seconds()),
+				Stale: age > stale, CEP: fix.CEP,
+			},
+		}
+		if vessel := app.vesselFor(logger); vessel != nil {
+			feature.Properties.Vessel = vessel.Name
+		}
+		rtn.Features = append(rtn.Features, feature)
+	}
+	sort.Slice(rtn.Features, func(i, j int) bool { return rtn.Features[i].ID < rtn.Features[j].ID })
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(rtn); err != nil {
+		support.Errorf("API: failed to encode fleet positions: %s\n", err)
+	}
+}
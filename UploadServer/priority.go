@@ -0,0 +1,71 @@
+/*! @file priority.go
+ * @brief Keeping checkins prompt while uploads are busy
+ *
+ * A logger that can't check in never finds out when to retry its uploads, so checkins have to be
+ * answered promptly however busy the server is with uploads.  Uploads are limited to a number in
+ * progress at once (each holding its file in memory, and taking storage bandwidth), with later
+ * uploads waiting briefly for a slot and then being told to retry (HTTP 503 with Retry-After);
+ * checkins don't take a slot, so they are never queued behind uploads.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+const (
+	uploadSlotWait   = 5 * time.Second // How long an upload waits for a slot before being refused
+	uploadRetryAfter = 30              // Seconds a refused logger is asked to wait before retrying
+)
+
+// Generate the slots for uploads in progress, or nil for no limit.
+func newUploadSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+// Limit the number of uploads in progress at once to the slots available.
+func (app *application) limitUploads(next http.HandlerFunc) http.HandlerFunc {
+	if app.slots == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(uploadSlotWait)
+		defer timer.Stop()
+		select {
+		case app.slots <- struct{}{}:
+			defer func() { <-app.slots }()
+			next(w, r)
+		case <-timer.C:
+			support.Warnf("TRANS: no upload slot free for logger %s; asking it to retry.\n", support.LoggerID(r))
+			w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfter))
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*! @file probe.go
+ * @brief Asking whether the server already holds a file, before sending it
+ *
+ * A logger that's been re-provisioned (or restored from a backup) can come back with files that the
+ * server already has, and sending them again only to have them recognised as repeats wastes exactly the
+ * bandwidth that loggers are shortest of.  Before an upload, the logger can ask about the file by its
+ * MD5 digest and length: the server answers HTTP 200 (OK) if it holds a good copy of the file from the
+ * same logger, with the ETag set to the digest, and HTTP 404 (Not Found) if it doesn't, in which case
+ * the logger should upload it as usual.  Only the logger's own uploads count, so that one logger can't
+ * find out what another has sent, and copies that failed their integrity check (or have gone missing
+ * from storage) don't count, since the logger may delete its copy once the server says it has one.
+ * The question can be asked with HEAD, to keep the exchange as small as possible, or with GET for a
+ * JSON description of the copy held.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A heldFile describes the server's copy of a file that a logger asked about.
+type heldFile struct {
+	MD5      string    `json:"md5"`
+	Length   int64     `json:"length"`
+	Received time.Time `json:"received"`
+}
+
+// Find the most recent upload from the logger given with the MD5 digest (upper-case hex) and length
+// given that was accepted and stored, and is still good.
+func (app *application) heldUpload(logger, digest string, length int64) (support.UploadRecord, bool) {
+	matches := app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.Logger == logger && u.MD5 == digest && u.Size == length && u.Status == support.UploadAccepted &&
+			len(u.Key) > 0 && u.State != support.StateCorrupt && u.State != support.StateMissing
+	})
+	if len(matches) == 0 {
+		return support.UploadRecord{}, false
+	}
+	return matches[len(matches)-1], true
+}
+
+// Answer a logger's question whether the server holds the file with the MD5 digest in the path and
+// the length in the "length" query parameter.
+func (app *application) probeFile(w http.ResponseWriter, r *http.Request) {
+	logger := support.LoggerID(r)
+	digest := strings.ToUpper(r.PathValue("md5"))
+	if raw, err := hex.DecodeString(digest); err != nil || len(raw) != 16 {
+		writeError(w, http.StatusBadRequest, "malformed MD5 digest")
+		return
+	}
+	length, err := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, "malformed or missing length")
+		return
+	}
+	record, ok := app.heldUpload(logger, digest, length)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such file")
+		return
+	}
+	support.Infof("TRANS: logger %s asked about file %s (%d bytes), held as upload %s.\n", logger, digest, length, record.UUID)
+	w.Header().Set("ETag", strconv.Quote(digest))
+	writeJSON(w, http.StatusOK, heldFile{MD5: digest, Length: length, Received: record.Received})
+}
@@ -0,0 +1,186 @@
+/*! @file processing.go
+ * @brief Preparation of accepted files for the processing chain
+ *
+ * The processing chain takes the platform description for each file from the metadata packets in
+ * the file, which depend on the firmware having been configured correctly.  Optionally, the server
+ * can supply the description from the vessel record for the logger instead (see vessels.go), either
+ * by rewriting the packets in the file or by storing a sidecar JSON file alongside it.  The vessel
+ * owner's consent settings determine whether the vessel's identity is included.  Once the file is
+ * stored, the processing chain is notified (see src/notify) that it's ready, unless the logger is
+ * on a vessel whose owner hasn't agreed to the data being submitted to a Trusted Node, in which
+ * case the file is only stored (and has no platform metadata added).  Loggers without a vessel
+ * record are handled as before vessel records existed.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+
+	"ccom.unh.edu/wibl-monitor/src/notify"
+	"ccom.unh.edu/wibl-monitor/src/support"
+	"ccom.unh.edu/wibl-monitor/src/wibl"
+)
+
+// The modes for injection of platform metadata.
+const (
+	injectNone    = ""
+	injectFile    = "file"
+	injectSidecar = "sidecar"
+)
+
+// The ship name used when the vessel's owner hasn't agreed to share its identity.
+const anonymousVessel = "Anonymous"
+
+// Generate the IHO B.12 style platform description for a vessel.
+func platformMetadata(v *support.Vessel) map[string]any {
+	platform := map[string]any{"type": "Ship"}
+	if v.Consent.ShareIdentity {
+		platform["name"] = v.Name
+		if len(v.MMSI) > 0 {
+			platform["IDType"], platform["IDNumber"] = "MMSI", v.MMSI
+		} else if len(v.IMO) > 0 {
+			platform["IDType"], platform["IDNumber"] = "IMO", v.IMO
+		}
+	} else {
+		platform["name"] = anonymousVessel
+	}
+	var sensors []map[string]any
+	if o := v.Offsets.Sounder; o != nil || v.Draft != nil {
+		sounder := map[string]any{"type": "Sounder"}
+		if o != nil {
+			sounder["position"] = []float64{o.X, o.Y, o.Z}
+		}
+		if v.Draft != nil {
+			sounder["draft"] = *v.Draft
+			sounder["draftUnitOfMeasure"] = "meters"
+		}
+		sensors = append(sensors, sounder)
+	}
+	if o := v.Offsets.Position; o != nil {
+		sensors = append(sensors, map[string]any{"type": "GNSS", "position": []float64{o.X, o.Y, o.Z}})
+	}
+	if len(sensors) > 0 {
+		platform["sensors"] = sensors
+	}
+	platform["positionOffsetsDocumented"] = v.Offsets.Position != nil && v.Offsets.Sounder != nil
+	return platform
+}
+
+// Add the platform metadata for the logger's vessel to an accepted file, according to the
+// configuration, returning the data to be stored.  Failure to add the metadata isn't fatal: the file
+// is stored as uploaded, with a warning.  Metadata can't be written into files that the logger
+// encrypted, so they get a sidecar instead.
+func (app *application) injectPlatform(ctx context.Context, record *support.UploadRecord, body []byte) []byte {
+	mode := app.config.Processing.InjectMetadata
+	if mode == injectFile && len(record.KeyID) > 0 {
+		mode = injectSidecar
+	}
+	if mode == injectNone || record.Vessel == nil || !record.Vessel.Consent.ShareData {
+		return body
+	}
+	platform := platformMetadata(record.Vessel)
+	switch mode {
+	case injectFile:
+		data, err := wibl.InjectMetadata(body, record.Logger, platform["name"].(string),
+			map[string]map[string]any{"platform": platform})
+		if err != nil {
+			support.Warnf("TRANS: failed to add platform metadata to %s: %s\n", record.UUID, err)
+			return body
+		}
+		record.Stored = fmt.Sprintf("%X", md5.Sum(data))
+		return data
+	case injectSidecar:
+		data, err := json.Marshal(map[string]any{"platform": platform})
+		if err != nil {
+			support.Warnf("TRANS: failed to encode platform metadata for %s: %s\n", record.UUID, err)
+			return body
+		}
+		key := app.partition(*record) + record.UUID + ".platform.json"
+		if err := app.putObject(ctx, key, data, map[string]string{"uuid": record.UUID, "logger": record.Logger}); err != nil {
+			support.Warnf("TRANS: failed to store platform metadata for %s: %s\n", record.UUID, err)
+			return body
+		}
+		record.Sidecar = key
+	}
+	return body
+}
+
+// Tell the processing chain that a file has been stored (or, for other payload types, the type's
+// notification targets), marking it as queued for processing if that succeeds.  Failures raise an
+// alert and put the file in the dead-letter store (see deadletter.go), since the file won't be
+// processed without intervention.  Consent is taken from the vessel that the logger was on when the
+// file arrived, as in injectPlatform(), rather than the one it's on now.
+func (app *application) notifyStored(record support.UploadRecord) error {
+	notifier, target := app.notifier, "processing chain"
+	if len(record.Type) > 0 {
+		notifier, target = app.payloads[record.Type], record.Type+" payload targets"
+	} else if routed, ok := app.routed[record.Route]; ok {
+		notifier, target = routed, record.Route+" route targets"
+	}
+	if len(notifier) == 0 {
+		return nil
+	}
+	if vessel := record.Vessel; len(record.Type) == 0 && vessel != nil && !vessel.Consent.ShareData {
+		support.Infof("TRANS: not sending %s to the %s: the owner of vessel %s hasn't consented to sharing data.\n",
+			record.UUID, target, vessel.Name)
+		return nil
+	}
+	event := notify.Event{
+		UUID:        record.UUID,
+		Logger:      record.Logger,
+		Location:    app.storage.Location(),
+		Key:         record.Key,
+		Size:        record.Size,
+		MD5:         record.ObjectMD5(),
+		Received:    record.Received,
+		KeyID:       record.KeyID,
+		Compress:    record.Compress,
+		Trace:       record.Trace,
+		Correlation: record.Correlation,
+	}
+	if err := notifier.Notify(app.ctx, event); err != nil {
+		app.ingest.Failure()
+		app.alerts.Raise("processing", record.UUID, fmt.Sprintf("failed to notify %s: %s", target, err))
+		if err := app.dead.Add(record, target, err); err != nil {
+			support.Errorf("TRANS: failed to record %s as a dead letter: %s\n", record.UUID, err)
+		}
+		return err
+	}
+	if _, ok := app.dead.Get(record.UUID); ok {
+		if err := app.dead.Remove(record.UUID); err != nil {
+			support.Errorf("TRANS: failed to remove dead letter for %s: %s\n", record.UUID, err)
+		}
+	}
+	_, err := app.uploads.Update(record.UUID, func(u *support.UploadRecord) error {
+		if u.State == support.StateStored {
+			u.State = support.StateQueued
+		}
+		return nil
+	})
+	if err != nil {
+		support.Errorf("TRANS: failed to mark %s as queued: %s\n", record.UUID, err)
+	}
+	return nil
+}
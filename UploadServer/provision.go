@@ -0,0 +1,188 @@
+/*! @file provision.go
+ * @brief Provisioning bundles, which give a logger everything it needs to use the server
+ *
+ * Installing a logger in the field means entering the server's address, the logger's credentials,
+ * and the certificate to trust, which is slow and error-prone on a boat.  A provisioning bundle puts
+ * them all in one JSON document: the server's URL, the logger's identifier, a newly-minted upload
+ * token, the CA certificate for the server (see ProvisionParam in support/config.go), and the checkin
+ * interval.  The bundle is also available as a QR code (PNG) of the same JSON, which the logger's
+ * configuration app can scan.  Bundles can be generated through the administration API, or with the
+ * "provision" command on the server host.  Each bundle has a new token; earlier ones remain good until
+ * they expire or are revoked.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"rsc.io/qr"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The number of image pixels for each module of a provisioning QR code.
+const provisionQRScale = 4
+
+// Generate the provisioning bundle for a logger with the token given.
+func provisioningBundle(config *support.Config, logger, token string, expires *time.Time) (api.ProvisioningBundle, error) {
+	param := config.Provision
+	if len(param.ServerURL) == 0 {
+		return api.ProvisioningBundle{}, errors.New("no server URL configured for provisioning")
+	}
+	caFile := param.CACert
+	if len(caFile) == 0 {
+		caFile = serverCert
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return api.ProvisioningBundle{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return api.ProvisioningBundle{}, fmt.Errorf("no PEM certificate in %s", caFile)
+	}
+	return api.ProvisioningBundle{
+		Server:         param.ServerURL,
+		Logger:         logger,
+		Token:          token,
+		Expires:        expires,
+		CACert:         string(pem.EncodeToMemory(block)),
+		CheckinMinutes: param.CheckinMinutes,
+	}, nil
+}
+
+// Encode a provisioning bundle as a QR code image (PNG).
+func provisioningQR(bundle api.ProvisioningBundle) ([]byte, error) {
+	text, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	code, err := qr.Encode(string(text), qr.L)
+	if err != nil {
+		return nil, err
+	}
+	code.Scale = provisionQRScale
+	return code.PNG(), nil
+}
+
+// Generate a provisioning bundle for a logger, with a new upload token, as JSON or, if the "format"
+// query parameter is "png", as a QR code image.
+func (app *application) provisionLogger(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) > 0 && format != "json" && format != "png" {
+		writeError(w, http.StatusBadRequest, "format must be json or png")
+		return
+	}
+	if len(app.config.Provision.ServerURL) == 0 {
+		writeError(w, http.StatusServiceUnavailable, "provisioning is not configured (no server URL)")
+		return
+	}
+	logger := r.PathValue("id")
+	token, record, err := app.tokens.Mint(logger, "provisioning bundle")
+	if err != nil {
+		support.Errorf("ADMIN: failed to mint upload token for provisioning logger %s: %s\n", logger, err)
+		writeError(w, http.StatusInternalServerError, "failed to mint token")
+		return
+	}
+	bundle, err := provisioningBundle(app.config, logger, token, record.Expires)
+	bundle.CheckinMinutes = int(app.checkinInterval(logger) / time.Minute)
+	var image []byte
+	if err == nil && format == "png" {
+		image, err = provisioningQR(bundle)
+	}
+	if err != nil {
+		support.Errorf("ADMIN: failed to generate provisioning bundle for logger %s: %s\n", logger, err)
+		if err := app.tokens.Revoke(record.ID); err != nil {
+			support.Errorf("ADMIN: failed to revoke upload token %s: %s\n", record.ID, err)
+		}
+		writeError(w, http.StatusInternalServerError, "failed to generate provisioning bundle")
+		return
+	}
+	app.recordAction(r, "logger.provision", logger, "token "+record.ID)
+	if format != "png" {
+		writeJSON(w, http.StatusCreated, bundle)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(image)
+}
+
+// Generate a provisioning bundle for a logger on the server host, minting a token directly in the
+// token store.  The bundle is written as JSON to standard output, and as a QR code to the file given
+// with -qr, if any.
+func provisionCommand(args []string) error {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
+	logger := fs.String("logger", "", "Unique identifier of the logger to provision")
+	qrFile := fs.String("qr", "", "File to write the bundle to as a QR code (PNG)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*logger) == 0 {
+		return errors.New("a logger identifier is required (-logger)")
+	}
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	tokens, err := openTokenStore(config)
+	if err != nil {
+		return err
+	}
+	token, record, err := tokens.Mint(*logger, "provisioning bundle")
+	if err != nil {
+		return err
+	}
+	bundle, err := provisioningBundle(config, *logger, token, record.Expires)
+	if err != nil {
+		tokens.Revoke(record.ID)
+		return err
+	}
+	if len(*qrFile) > 0 {
+		image, err := provisioningQR(bundle)
+		if err != nil {
+			tokens.Revoke(record.ID)
+			return err
+		}
+		if err := os.WriteFile(*qrFile, image, 0600); err != nil {
+			tokens.Revoke(record.ID)
+			return err
+		}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(bundle); err != nil {
+		return err
+	}
+	support.Infof("minted upload token %s for logger %s.\n", record.ID, *logger)
+	return nil
+}
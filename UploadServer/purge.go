@@ -0,0 +1,243 @@
+/*! @file purge.go
+ * @brief Removal of all data associated with a logger
+ *
+ * When a vessel owner withdraws consent for their data to be used, everything that the server holds
+ * for their logger has to be removed: the stored files, the upload history, and the status
+ * information, along with its upload tokens, staged upload sessions, quarantined payloads, failed
+ * notifications, the observations buffered for the live feed, and its entries in the daily
+ * manifests (which are rewritten without them).  Maintenance notes go with the registry record.
+ * Since this can't be undone, it's a two-step process: a POST to the purge end-point describes
+ * what would be removed and returns a confirmation token, which has to be presented (in the
+ * X-Confirmation-Token header, so that it stays out of access logs) on a DELETE to the logger's
+ * data end-point within a few minutes for the purge to happen.  The audit trail records both steps.
+ *
+ * Data under legal hold (see holds.go) is left in place: a logger that is held can't be purged, and
+ * held uploads are skipped.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The header in which the confirmation token for a purge is presented.
+const confirmationHeader = "X-Confirmation-Token"
+
+// Request a purge of a logger's data, returning a summary of what would be removed and the
+// token required to confirm it.
+func (app *application) requestPurge(w http.ResponseWriter, r *http.Request) {
+	logger := r.PathValue("id")
+	if app.loggerHeld(w, logger) {
+		return
+	}
+	summary := app.purgeSummary(logger)
+	token, expires, err := app.confirm.Request("purge:"+logger, support.CurrentPrincipal(r).Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate confirmation")
+		return
+	}
+	app.recordAction(r, "logger.purge-requested", logger,
+		fmt.Sprintf("%d uploads, %d files, %d bytes", summary.Uploads, summary.Files, summary.Bytes))
+	writeJSON(w, http.StatusAccepted, api.PurgeConfirmation{
+		Summary:      summary,
+		Confirmation: token,
+		Expires:      expires.UTC(),
+	})
+}
+
+// Carry out a purge of a logger's data, given the confirmation token from requestPurge() in the
+// X-Confirmation-Token header.
+func (app *application) purgeLogger(w http.ResponseWriter, r *http.Request) {
+	logger := r.PathValue("id")
+	token := r.Header.Get(confirmationHeader)
+	if !app.confirm.Confirm("purge:"+logger, support.CurrentPrincipal(r).Name, token) {
+		writeError(w, http.StatusPreconditionFailed, "missing, invalid, or expired confirmation token")
+		return
+	}
+	if app.loggerHeld(w, logger) {
+		return
+	}
+	var summary api.PurgeSummary
+	summary.Logger = logger
+	var failures int
+	for _, token := range app.tokens.List() {
+		if token.Logger != logger {
+			continue
+		}
+		if err := app.tokens.Revoke(token.ID); err != nil && !errors.Is(err, support.ErrNotFound) {
+			support.Errorf("ADMIN: failed to revoke token %s during purge of %s: %s\n", token.ID, logger, err)
+			failures++
+			continue
+		}
+		summary.Tokens++
+	}
+	summary.Grants = app.grants.Forget(logger)
+	days := make(map[time.Time]bool)
+	for _, record := range app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.Logger == logger
+	}) {
+		if _, held := app.holds.Holding(record); held {
+			summary.Held++
+			continue
+		}
+		if len(record.Key) > 0 {
+			// A file that's already gone counts as deleted, so that a purge interrupted part way
+			// through can be retried.
+			if err := app.storage.Delete(r.Context(), record.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				// Keep the history record so that the file can be found for a retry.
+				support.Errorf("ADMIN: failed to delete %s during purge of %s: %s\n", record.Key, logger, err)
+				failures++
+				continue
+			}
+			summary.Files++
+			summary.Bytes += record.Size
+		}
+		if len(record.Sidecar) > 0 {
+			if err := app.storage.Delete(r.Context(), record.Sidecar); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				support.Errorf("ADMIN: failed to delete %s during purge of %s: %s\n", record.Sidecar, logger, err)
+				failures++
+				continue
+			}
+		}
+		if err := app.uploads.Delete(record.UUID); err != nil {
+			support.Errorf("ADMIN: failed to delete upload record %s during purge of %s: %s\n", record.UUID, logger, err)
+			failures++
+			continue
+		}
+		app.forgetUpload(logger, record.MD5)
+		app.dropReplica(r.Context(), record)
+		if record.Status == support.UploadAccepted && len(record.Key) > 0 {
+			days[record.Received.UTC().Truncate(24*time.Hour)] = true
+		}
+		summary.Uploads++
+	}
+	n, err := app.rewriteManifests(r.Context(), days)
+	if err != nil {
+		support.Errorf("ADMIN: failed to rewrite manifests during purge of %s: %s\n", logger, err)
+		failures++
+	}
+	summary.Manifests = n
+	for _, session := range app.staged.List(func(s *api.UploadSession) bool { return s.Logger == logger }) {
+		app.deleteChunks(r.Context(), sessionPrefix+session.ID+"/")
+	}
+	if summary.Sessions, err = app.staged.Forget(logger); err != nil {
+		support.Errorf("ADMIN: failed to remove upload sessions during purge of %s: %s\n", logger, err)
+		failures++
+	}
+	for _, entry := range app.suspect.List(func(e *support.QuarantineEntry) bool { return e.Logger == logger }) {
+		if err := app.suspect.Remove(entry.ID); err != nil && !errors.Is(err, support.ErrNotFound) {
+			support.Errorf("ADMIN: failed to remove quarantined payload %s during purge of %s: %s\n", entry.ID, logger, err)
+			failures++
+			continue
+		}
+		summary.Quarantined++
+	}
+	for _, letter := range app.dead.List() {
+		if letter.Logger != logger {
+			continue
+		}
+		if err := app.dead.Remove(letter.UUID); err != nil && !errors.Is(err, support.ErrNotFound) {
+			support.Errorf("ADMIN: failed to remove dead letter %s during purge of %s: %s\n", letter.UUID, logger, err)
+			failures++
+			continue
+		}
+		summary.DeadLetters++
+	}
+	summary.Observations = app.live.Forget(logger)
+	app.deleteChunks(r.Context(), chunkLoggerPrefix(logger))
+	app.fleet.Delete(logger)
+	app.capture.Clear(logger)
+	if _, err := app.commands.Take(logger); err != nil {
+		support.Errorf("ADMIN: failed to clear command queue during purge of %s: %s\n", logger, err)
+		failures++
+	}
+	if err := app.state.Delete("reconcile:" + logger); err != nil && !errors.Is(err, support.ErrNotFound) {
+		support.Errorf("ADMIN: failed to delete reconciliation report during purge of %s: %s\n", logger, err)
+		failures++
+	}
+	if err := app.registry.Delete(logger); err != nil && !errors.Is(err, support.ErrNotFound) {
+		support.Errorf("ADMIN: failed to delete registry record during purge of %s: %s\n", logger, err)
+		failures++
+	}
+	detail := fmt.Sprintf("%d uploads, %d files, %d bytes, %d tokens, %d upload sessions, %d quarantined, %d dead letters removed",
+		summary.Uploads, summary.Files, summary.Bytes, summary.Tokens, summary.Sessions, summary.Quarantined, summary.DeadLetters)
+	if summary.Held > 0 {
+		detail += fmt.Sprintf(", %d held", summary.Held)
+	}
+	if failures > 0 {
+		detail += fmt.Sprintf(", %d failures", failures)
+	}
+	app.recordAction(r, "logger.purge", logger, detail)
+	if failures > 0 {
+		writeJSON(w, http.StatusInternalServerError, summary)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// Refuse to purge a logger that is under a legal hold, with HTTP 409 (Conflict).
+func (app *application) loggerHeld(w http.ResponseWriter, logger string) bool {
+	hold, ok := app.holds.Get(support.HoldLogger, logger)
+	if ok {
+		writeError(w, http.StatusConflict, fmt.Sprintf("logger is under legal hold (%s)", hold.Reason))
+	}
+	return ok
+}
+
+// Summarise the data held for a logger.
+func (app *application) purgeSummary(logger string) api.PurgeSummary {
+	summary := api.PurgeSummary{Logger: logger}
+	for _, record := range app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.Logger == logger
+	}) {
+		if _, held := app.holds.Holding(record); held {
+			summary.Held++
+			continue
+		}
+		summary.Uploads++
+		if len(record.Key) > 0 {
+			summary.Files++
+			summary.Bytes += record.Size
+		}
+	}
+	for _, token := range app.tokens.List() {
+		if token.Logger == logger {
+			summary.Tokens++
+		}
+	}
+	summary.Sessions = len(app.staged.List(func(s *api.UploadSession) bool { return s.Logger == logger }))
+	summary.Quarantined = len(app.suspect.List(func(e *support.QuarantineEntry) bool { return e.Logger == logger }))
+	for _, letter := range app.dead.List() {
+		if letter.Logger == logger {
+			summary.DeadLetters++
+		}
+	}
+	summary.Observations = len(app.live.Recent(logger))
+	return summary
+}
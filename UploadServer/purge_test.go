@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A strictStorage reports deleting an object that doesn't exist as storage.ErrNotFound, as some
+// backends do.
+type strictStorage struct {
+	storage.Backend
+}
+
+func (s strictStorage) Delete(ctx context.Context, key string) error {
+	obj, _, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	obj.Close()
+	return s.Backend.Delete(ctx, key)
+}
+
+// Generate an application holding two uploads from logger L1 (the second of which has already gone
+// from storage) and one from logger L2.
+func newPurgeApplication(t *testing.T) *application {
+	t.Helper()
+	app := newTestApplication(t)
+	app.storage = strictStorage{app.storage}
+	if err := app.storage.Put(context.Background(), "k1", []byte("data"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.storage.Put(context.Background(), "k3", []byte("other"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []support.UploadRecord{
+		{UUID: "u1", Logger: "L1", Key: "k1", Size: 4, Status: support.UploadAccepted},
+		{UUID: "u2", Logger: "L1", Key: "k2", Size: 5, Status: support.UploadAccepted},
+		{UUID: "u3", Logger: "L2", Key: "k3", Size: 5, Status: support.UploadAccepted},
+	} {
+		if err := app.uploads.Put(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return app
+}
+
+// Request a purge of the logger given, returning the summary and confirmation token.
+func requestPurge(t *testing.T, app *application, logger string) api.PurgeConfirmation {
+	t.Helper()
+	w := serve(app, "POST", "/admin/v1/loggers/"+logger+"/purge", "Bearer "+adminToken, "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("purge request: status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+	var confirmation api.PurgeConfirmation
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmation); err != nil {
+		t.Fatal(err)
+	}
+	return confirmation
+}
+
+func TestPurgeConfirmation(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  func(token string) string
+		header func(token string) string
+		status int
+	}{
+		{"no token", nil, nil, http.StatusPreconditionFailed},
+		{"token in query", func(token string) string { return "?confirm=" + token }, nil, http.StatusPreconditionFailed},
+		{"wrong token", nil, func(token string) string { return token + "x" }, http.StatusPreconditionFailed},
+		{"token in header", nil, func(token string) string { return token }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newPurgeApplication(t)
+			token := requestPurge(t, app, "L1").Confirmation
+			target, header := "/admin/v1/loggers/L1/data", []string{}
+			if tt.query != nil {
+				target += tt.query(token)
+			}
+			if tt.header != nil {
+				header = append(header, confirmationHeader, tt.header(token))
+			}
+			w := serve(app, "DELETE", target, "Bearer "+adminToken, "", header...)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.status, w.Body)
+			}
+			_, kept := app.uploads.Get("u1")
+			if purged := tt.status == http.StatusOK; kept == purged {
+				t.Errorf("upload u1 kept = %v, want %v", kept, !purged)
+			}
+		})
+	}
+}
+
+func TestPurgeLogger(t *testing.T) {
+	app := newPurgeApplication(t)
+	confirmation := requestPurge(t, app, "L1")
+	if s := confirmation.Summary; s.Uploads != 2 || s.Files != 2 || s.Bytes != 9 {
+		t.Errorf("summary of purge = %+v, want 2 uploads, 2 files, 9 bytes", s)
+	}
+	token := confirmation.Confirmation
+	w := serve(app, "DELETE", "/admin/v1/loggers/L1/data", "Bearer "+adminToken, "", confirmationHeader, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%s)", w.Code, http.StatusOK, w.Body)
+	}
+	var summary api.PurgeSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	// The file that had already gone from storage counts as deleted.
+	if summary.Uploads != 2 || summary.Files != 2 || summary.Bytes != 9 {
+		t.Errorf("summary = %+v, want 2 uploads, 2 files, 9 bytes", summary)
+	}
+	tests := []struct {
+		uuid, key string
+		kept      bool
+	}{
+		{"u1", "k1", false},
+		{"u2", "k2", false},
+		{"u3", "k3", true},
+	}
+	for _, tt := range tests {
+		if _, ok := app.uploads.Get(tt.uuid); ok != tt.kept {
+			t.Errorf("upload %s kept = %v, want %v", tt.uuid, ok, tt.kept)
+		}
+		_, _, err := app.storage.Get(context.Background(), tt.key)
+		if stored := err == nil; stored != tt.kept {
+			t.Errorf("object %s stored = %v, want %v", tt.key, stored, tt.kept)
+		}
+	}
+	// The token can only be used once.
+	w = serve(app, "DELETE", "/admin/v1/loggers/L1/data", "Bearer "+adminToken, "", confirmationHeader, token)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("second purge: status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+}
+
+func TestPurgeHeld(t *testing.T) {
+	app := newPurgeApplication(t)
+	token := requestPurge(t, app, "L1").Confirmation
+	if err := app.holds.Place(support.Hold{Kind: support.HoldLogger, Target: "L1", Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, target string
+	}{
+		{"POST", "/admin/v1/loggers/L1/purge"},
+		{"DELETE", "/admin/v1/loggers/L1/data"},
+	}
+	for _, tt := range tests {
+		w := serve(app, tt.method, tt.target, "Bearer "+adminToken, "", confirmationHeader, token)
+		if w.Code != http.StatusConflict {
+			t.Errorf("%s %s with the logger held: status = %d, want %d", tt.method, tt.target, w.Code, http.StatusConflict)
+		}
+	}
+	if err := app.holds.Release(support.HoldLogger, "L1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.holds.Place(support.Hold{Kind: support.HoldUpload, Target: "u1", Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	token = requestPurge(t, app, "L1").Confirmation
+	w := serve(app, "DELETE", "/admin/v1/loggers/L1/data", "Bearer "+adminToken, "", confirmationHeader, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%s)", w.Code, http.StatusOK, w.Body)
+	}
+	if _, ok := app.uploads.Get("u1"); !ok {
+		t.Error("held upload u1 was purged")
+	}
+	if _, _, err := app.storage.Get(context.Background(), "k1"); err != nil {
+		t.Errorf("held object k1 was deleted (%v)", err)
+	}
+	if _, ok := app.uploads.Get("u2"); ok {
+		t.Error("upload u2 wasn't purged")
+	}
+}
@@ -0,0 +1,125 @@
+/*! @file quarantine.go
+ * @brief Keeping and inspecting the payloads of refused checkins and uploads
+ *
+ * A checkin whose status doesn't parse, or an upload that fails validation (a digest that doesn't
+ * check, a missing WIBL header, and so on), is refused with little more than an HTTP status, which
+ * leaves nothing to investigate when a logger starts failing.  The payloads of such requests are kept
+ * in the quarantine (see support/quarantine.go) with the reason they were refused, within the limits
+ * in the configuration; operators can list them, fetch each payload, and discard them once they've
+ * been dealt with.  A daily job drops entries older than the retention period.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Keep the body of a checkin from the logger whose status couldn't be parsed.
+func (app *application) quarantineCheckin(r *http.Request, body []byte, reason string) {
+	app.quarantine(support.QuarantineEntry{Kind: support.QuarantineCheckin, Logger: support.LoggerID(r),
+		Remote: r.RemoteAddr, Reason: reason, ContentType: r.Header.Get("Content-Type")}, body)
+}
+
+// Keep the body of an upload that failed validation, with the record of the refusal.
+func (app *application) quarantineUpload(record support.UploadRecord, body []byte, reason string) {
+	app.quarantine(support.QuarantineEntry{Kind: support.QuarantineUpload, Logger: record.Logger,
+		Remote: record.Remote, Reason: reason, Upload: record.UUID}, body)
+}
+
+func (app *application) quarantine(entry support.QuarantineEntry, body []byte) {
+	param := app.config.Quarantine
+	if param.MaxEntries <= 0 {
+		return
+	}
+	entry.Received = time.Now().UTC()
+	if err := app.suspect.Add(entry, body, param.MaxBytes, param.MaxEntries); err != nil {
+		support.Errorf("API: failed to quarantine %s from logger %s: %s\n", entry.Kind, entry.Logger, err)
+	}
+}
+
+// Drop the quarantined payloads that are older than the retention period.
+func (app *application) quarantineJob(ctx context.Context) (string, error) {
+	days := app.config.Quarantine.RetentionDays
+	if days <= 0 {
+		return "no retention period set", nil
+	}
+	pruned, err := app.suspect.Prune(time.Now().UTC().AddDate(0, 0, -days))
+	return fmt.Sprintf("dropped %d quarantined payloads", pruned), err
+}
+
+// List the quarantined requests, optionally only those from one logger, of one kind ("checkin" or
+// "upload"), or received since a time (see queryTime()), oldest first.
+func (app *application) listQuarantine(w http.ResponseWriter, r *http.Request) {
+	logger := r.URL.Query().Get("logger")
+	kind := r.URL.Query().Get("kind")
+	since, ok := queryTime(w, r, "since")
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, app.suspect.List(func(e *support.QuarantineEntry) bool {
+		return (len(logger) == 0 || e.Logger == logger) && (len(kind) == 0 || e.Kind == kind) &&
+			!e.Received.Before(since)
+	}))
+}
+
+// Provide the payload kept for a quarantined request, as it was received (up to the size limit).
+func (app *application) getQuarantined(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	data, err := app.suspect.Payload(id)
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such entry")
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to read quarantined payload %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to read payload")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Discard a quarantined request once it's been dealt with.
+func (app *application) discardQuarantined(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch err := app.suspect.Remove(id); {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such entry")
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to discard quarantined payload %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to discard entry")
+		return
+	}
+	app.recordAction(r, "quarantine.discard", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+/*! @file queue.go
+ * @brief Delivery and administration of the commands queued for loggers
+ *
+ * Commands for a logger (see support/commands.go) are handed over in its next checkin response, and
+ * removed from the queue once delivered.  Operators can see what is waiting for each logger, and
+ * cancel commands that are no longer wanted before they're delivered.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Collect the commands waiting for a logger, for its checkin response.  Failures are logged, and the
+// commands left for the next checkin.
+func (app *application) deliverCommands(logger string) []api.Command {
+	commands, err := app.commands.Take(logger)
+	if err != nil {
+		support.Errorf("CHECKIN: failed to collect commands for logger %s: %s\n", logger, err)
+		return nil
+	}
+	for _, c := range commands {
+		support.Infof("CHECKIN: delivering command %s (%s) to logger %s.\n", c.ID, c.Action, logger)
+		if c.Action == support.CommandUpload {
+			app.openUploads(logger, c.ID)
+		}
+	}
+	return commands
+}
+
+// List the commands waiting for a logger.
+func (app *application) listCommands(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	commands, err := app.commands.Pending(id)
+	if err != nil {
+		support.Errorf("ADMIN: failed to read command queue for %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to read command queue")
+		return
+	}
+	writeJSON(w, http.StatusOK, commands)
+}
+
+// Cancel a command before it's delivered.
+func (app *application) cancelCommand(w http.ResponseWriter, r *http.Request) {
+	id, command := r.PathValue("id"), r.PathValue("command")
+	switch err := app.commands.Cancel(id, command); {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such command")
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to cancel command %s for %s: %s\n", command, id, err)
+		writeError(w, http.StatusInternalServerError, "failed to cancel command")
+		return
+	}
+	app.recordAction(r, "logger.cancel-command", id, command)
+	w.WriteHeader(http.StatusNoContent)
+}
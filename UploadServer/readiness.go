@@ -0,0 +1,161 @@
+/*! @file readiness.go
+ * @brief Checks of the server's dependencies for the readiness probe
+ *
+ * An instance that can't reach its storage (e.g., because the bucket credentials have expired) still
+ * answers requests, but can't accept any files, so loggers sent to it waste their upload window.
+ * The readiness probe therefore checks each dependency actively: the storage backend by writing,
+ * reading back, and removing a probe object; the shared state by writing and reading a probe key; and
+ * each notification target by asking whether it exists.  The results are cached briefly, since
+ * orchestrators probe often and each check costs requests to the dependencies.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limits on how long each check may take, and how long the results are reused.
+const (
+	readyCheckTimeout = 5 * time.Second
+	readyCacheTTL     = 10 * time.Second
+)
+
+// A dependencyStatus reports the result of checking a dependency.
+type dependencyStatus struct {
+	Status  string  `json:"status"` // "ok" or "failed"
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds"` // Time taken by the check
+}
+
+// The readiness results are held until readyCacheTTL has passed.
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	results map[string]dependencyStatus
+}
+
+// Check the dependencies (unless they were checked recently), returning the status of each and
+// whether all are usable.
+func (app *application) checkDependencies(ctx context.Context) (map[string]dependencyStatus, bool) {
+	app.ready.mu.Lock()
+	defer app.ready.mu.Unlock()
+	if app.ready.results == nil || time.Since(app.ready.checked) > readyCacheTTL {
+		app.ready.results = app.runChecks(ctx)
+		app.ready.checked = time.Now()
+	}
+	ok := true
+	for _, s := range app.ready.results {
+		ok = ok && s.Status == "ok"
+	}
+	return app.ready.results, ok
+}
+
+// Run all of the dependency checks at once.
+func (app *application) runChecks(ctx context.Context) map[string]dependencyStatus {
+	checks := map[string]func(ctx context.Context) error{
+		"storage": app.checkStorage,
+		"state":   app.checkState,
+	}
+	if len(app.notifier) > 0 {
+		checks["notify"] = app.notifier.Check
+	}
+	for name, n := range app.payloads {
+		if len(n) > 0 {
+			checks["notify."+name] = n.Check
+		}
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	rtn := make(map[string]dependencyStatus, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			status := dependencyStatus{Status: "ok"}
+			if err := check(ctx); err != nil {
+				status = dependencyStatus{Status: "failed", Error: err.Error()}
+			}
+			status.Seconds = time.Since(start).Seconds()
+			mu.Lock()
+			rtn[name] = status
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return rtn
+}
+
+// The key of the probe object for this instance, which is outside any logger's files.
+func (app *application) probeKey() string {
+	return "readyz/" + app.instance
+}
+
+// Check that the storage backend can store, return, and remove an object.
+func (app *application) checkStorage(ctx context.Context) error {
+	key := app.probeKey()
+	data := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := app.storage.Put(ctx, key, data, map[string]string{"instance": app.instance}); err != nil {
+		return fmt.Errorf("writing probe object: %w", err)
+	}
+	obj, _, err := app.storage.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("reading probe object: %w", err)
+	}
+	stored, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("reading probe object: %w", err)
+	}
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("probe object read back differs from that written")
+	}
+	if err := app.storage.Delete(ctx, key); err != nil {
+		return fmt.Errorf("removing probe object: %w", err)
+	}
+	return nil
+}
+
+// Check that the shared state can be written and read.  The store doesn't take a context, so the
+// check may outlast the timeout; the result is reported when it ends.
+func (app *application) checkState(ctx context.Context) error {
+	key := app.probeKey()
+	value := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := app.state.Set(key, value, time.Minute); err != nil {
+		return fmt.Errorf("writing probe key: %w", err)
+	}
+	stored, err := app.state.Get(key)
+	if err != nil {
+		return fmt.Errorf("reading probe key: %w", err)
+	}
+	if !bytes.Equal(stored, value) {
+		return fmt.Errorf("probe key read back differs from that written")
+	}
+	return nil
+}
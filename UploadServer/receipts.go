@@ -0,0 +1,75 @@
+/*! @file receipts.go
+ * @brief Publication and checking of signed upload receipts
+ *
+ * Receipts for accepted uploads (see support/receipts.go) are only useful if third parties (e.g.,
+ * the administrators of an incentive programme) can check them.  The server's public key is
+ * published without authentication, so that receipts can be checked independently, and the server
+ * will also check a receipt on request.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// The receiptKey describes the key with which the server signs receipts.
+type receiptKey struct {
+	Algorithm string `json:"algorithm"`
+	ID        string `json:"key_id"`
+	PublicKey string `json:"public_key"` // Base64-encoded
+}
+
+// The receiptCheck reports whether a receipt is valid and, if not, why not.
+type receiptCheck struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// Report the public key with which receipts are signed.
+func (app *application) receiptKey(w http.ResponseWriter, r *http.Request) {
+	if app.receipts == nil {
+		writeError(w, http.StatusNotFound, "receipts are not signed")
+		return
+	}
+	key, id := app.receipts.PublicKey()
+	writeJSON(w, http.StatusOK, receiptKey{Algorithm: "ed25519", ID: id, PublicKey: base64.StdEncoding.EncodeToString(key)})
+}
+
+// Check the signature on a receipt.
+func (app *application) verifyReceipt(w http.ResponseWriter, r *http.Request) {
+	if app.receipts == nil {
+		writeError(w, http.StatusNotFound, "receipts are not signed")
+		return
+	}
+	var receipt api.Receipt
+	if !readJSON(w, r, &receipt) {
+		return
+	}
+	if err := app.receipts.Verify(receipt); err != nil {
+		writeJSON(w, http.StatusOK, receiptCheck{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, receiptCheck{Valid: true})
+}
@@ -0,0 +1,204 @@
+/*! @file reconcile.go
+ * @brief Reconciliation of the files that loggers report against those stored
+ *
+ * Each logger lists the files it holds (ID, length, and MD5) in its status.  A file that a logger
+ * has held for a while, but that the server hasn't stored, has been lost somewhere: an upload that
+ * failed, a digest that didn't check, or a storage incident.  The reconciliation job compares each
+ * logger's last reported inventory with the upload history, keeps a report of the files missing (see
+ * /admin/v1/loggers/{id}/reconciliation), alerts when new gaps appear, and, if configured, asks the
+ * logger to re-send the missing files at its next checkin (see support/commands.go).  Files are given
+ * a grace period before they count as missing, since loggers upload on their own schedule.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// How long a reconciliation report is kept if the logger stops checking in.
+const reconcileReportTTL = 7 * 24 * time.Hour
+
+// A reconcileReport describes the files that a logger reported but which the server hasn't stored.
+type reconcileReport struct {
+	Logger   string        `json:"logger"`
+	Checked  time.Time     `json:"checked"`
+	Reported int           `json:"reported"` // Files in the logger's last status
+	Stored   int           `json:"stored"`   // Files reported that the server has stored
+	Missing  []missingFile `json:"missing"`
+}
+
+// A missingFile is a file that a logger has reported, but the server hasn't stored.  Files become
+// overdue once they've been reported for longer than the grace period.
+type missingFile struct {
+	api.FileEntry
+	FirstSeen time.Time `json:"first_seen"`
+	Overdue   bool      `json:"overdue"`
+}
+
+// Compare each logger's reported files with those stored.
+func (app *application) reconcileJob(ctx context.Context) (string, error) {
+	stored := make(map[string]map[string]bool)
+	app.uploads.Select(time.Time{}, time.Time{}, func(r *support.UploadRecord) bool {
+		if r.Status == support.UploadAccepted && len(r.Key) > 0 {
+			if stored[r.Logger] == nil {
+				stored[r.Logger] = make(map[string]bool)
+			}
+			stored[r.Logger][strings.ToUpper(r.MD5)] = true
+		}
+		return false
+	})
+	loggers, missing, requested := 0, 0, 0
+	for _, status := range app.fleet.List() {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		report, err := app.reconcileLogger(status, stored[status.LoggerID])
+		if err != nil {
+			return "", err
+		}
+		loggers++
+		for _, f := range report.Missing {
+			if f.Overdue {
+				missing++
+			}
+		}
+		requested += app.requestMissing(report)
+	}
+	return fmt.Sprintf("checked %d loggers: %d files overdue, re-send requested for %d", loggers, missing, requested), nil
+}
+
+// Generate and keep the reconciliation report for a logger, carrying forward the time at which
+// each missing file was first seen from the previous report.
+func (app *application) reconcileLogger(status support.LoggerStatus, stored map[string]bool) (reconcileReport, error) {
+	previous, err := app.reconcileReport(status.LoggerID)
+	if err != nil {
+		return reconcileReport{}, err
+	}
+	seen := make(map[string]time.Time)
+	overdue := make(map[string]bool)
+	for _, f := range previous.Missing {
+		seen[strings.ToUpper(f.MD5)] = f.FirstSeen
+		overdue[strings.ToUpper(f.MD5)] = f.Overdue
+	}
+	now := time.Now().UTC()
+	grace := time.Duration(app.config.Reconcile.GraceHours) * time.Hour
+	report := reconcileReport{Logger: status.LoggerID, Checked: now, Missing: []missingFile{}}
+	newlyOverdue := 0
+	for _, f := range status.Status.Files.Detail {
+		if len(f.MD5) == 0 {
+			continue
+		}
+		report.Reported++
+		digest := strings.ToUpper(f.MD5)
+		if stored[digest] {
+			report.Stored++
+			continue
+		}
+		first, ok := seen[digest]
+		if !ok {
+			first = now
+		}
+		m := missingFile{FileEntry: f, FirstSeen: first, Overdue: now.Sub(first) >= grace}
+		if m.Overdue && !overdue[digest] {
+			newlyOverdue++
+		}
+		report.Missing = append(report.Missing, m)
+	}
+	if newlyOverdue > 0 {
+		app.alerts.Raise("reconcile", status.LoggerID,
+			fmt.Sprintf("%d files reported by the logger for over %s have not been stored", newlyOverdue, grace))
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return reconcileReport{}, err
+	}
+	if err := app.state.Set("reconcile:"+status.LoggerID, data, reconcileReportTTL); err != nil {
+		return reconcileReport{}, err
+	}
+	return report, nil
+}
+
+// Ask the logger to re-send its overdue files, if configured to, returning the number of files
+// newly requested.
+func (app *application) requestMissing(report reconcileReport) int {
+	if !app.config.Reconcile.Resend {
+		return 0
+	}
+	var files []uint
+	for _, f := range report.Missing {
+		if f.Overdue {
+			files = append(files, f.Id)
+		}
+	}
+	if len(files) == 0 {
+		return 0
+	}
+	command, queued, err := app.commands.Enqueue(report.Logger, api.Command{Action: support.CommandResend, Files: files,
+		Reason: "reported by the logger but not stored on the server"})
+	if err != nil {
+		support.Errorf("RECONCILE: failed to request re-send from %s: %s\n", report.Logger, err)
+		return 0
+	}
+	if !queued {
+		return 0
+	}
+	support.Infof("RECONCILE: asked logger %s to re-send files %v.\n", report.Logger, command.Files)
+	return len(command.Files)
+}
+
+// Provide the last reconciliation report for a logger (empty, if there isn't one).
+func (app *application) reconcileReport(logger string) (reconcileReport, error) {
+	var report reconcileReport
+	data, err := app.state.Get("reconcile:" + logger)
+	if errors.Is(err, support.ErrNotFound) {
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, json.Unmarshal(data, &report)
+}
+
+// Report the files that a logger has reported, but which the server hasn't stored.
+func (app *application) getReconciliation(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	report, err := app.reconcileReport(id)
+	if err != nil {
+		support.Errorf("ADMIN: failed to read reconciliation report for %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to read reconciliation report")
+		return
+	}
+	if len(report.Logger) == 0 {
+		writeError(w, http.StatusNotFound, "logger has not been reconciled")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
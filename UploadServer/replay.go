@@ -0,0 +1,120 @@
+/*! @file replay.go
+ * @brief Replay of recorded logger requests against another server
+ *
+ * Requests recorded from production (see support/record.go) can be sent to another instance of the
+ * server, e.g., one running a new version or configuration, to check that it handles the fleet's
+ * traffic in the same way.  Credentials aren't recorded, so the upload token for each logger has to
+ * be given, either one for all loggers (-token) or a JSON file mapping logger identifiers to tokens
+ * (-tokens).  Requests are sent as fast as possible, or at a multiple of the original pace (-speed),
+ * and any response with a different status from that recorded is reported.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Replay a recording of logger requests against the server at the URL given.
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("url", "", "Base URL of the server to send requests to (e.g., https://localhost:8000)")
+	token := fs.String("token", "", "Upload token to use for all loggers")
+	tokenFile := fs.String("tokens", "", "JSON file mapping logger identifiers to upload tokens")
+	speed := fs.Float64("speed", 0, "Multiple of the recorded pace to send requests at (zero for as fast as possible)")
+	insecure := fs.Bool("insecure", false, "Don't verify the server's TLS certificate (e.g., if self-signed)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*target) == 0 || fs.NArg() != 1 {
+		return errors.New("usage: replay -url <server> [-token <token> | -tokens <file>] [-speed <n>] [-insecure] <recording>")
+	}
+	tokens := make(map[string]string)
+	if len(*tokenFile) > 0 {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			return fmt.Errorf("reading tokens from %q: %w", *tokenFile, err)
+		}
+	}
+	client := &http.Client{Timeout: time.Minute}
+	if *insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	var sent, mismatched, failed int
+	var first, start time.Time
+	err := support.ReadRecording(fs.Arg(0), func(request support.RecordedRequest) error {
+		if first.IsZero() {
+			first, start = request.Time, time.Now()
+		} else if *speed > 0 {
+			due := start.Add(time.Duration(float64(request.Time.Sub(first)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+		req, err := http.NewRequest(request.Method, strings.TrimRight(*target, "/")+request.URL, bytes.NewReader(request.Body))
+		if err != nil {
+			return err
+		}
+		req.Header = request.Header.Clone()
+		secret, ok := tokens[request.Logger]
+		if !ok {
+			secret = *token
+		}
+		req.SetBasicAuth(request.Logger, secret)
+		sent++
+		resp, err := client.Do(req)
+		if err != nil {
+			support.Errorf("REPLAY: %s %s from %s failed: %s\n", request.Method, request.URL, request.Logger, err)
+			failed++
+			return nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != request.Status {
+			support.Warnf("REPLAY: %s %s from %s at %s returned %d (recorded %d).\n", request.Method, request.URL,
+				request.Logger, request.Time.Format(time.RFC3339), resp.StatusCode, request.Status)
+			mismatched++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	support.Infof("REPLAY: %d requests sent, %d with a different status, %d failed.\n", sent, mismatched, failed)
+	if mismatched > 0 || failed > 0 {
+		return errors.New("replay did not match the recording")
+	}
+	return nil
+}
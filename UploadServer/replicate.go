@@ -0,0 +1,278 @@
+/*! @file replicate.go
+ * @brief Replication of accepted uploads to a second site
+ *
+ * A shore station's disk is a single point of failure for a season's data until the processing chain
+ * has picked it up.  If a second site is configured (see ReplicationParam in support/config.go), the
+ * "replicate" job copies each accepted upload, with its platform metadata sidecar and its upload
+ * record (as JSON, under the file's key with ".upload.json" appended), to either another storage
+ * backend or a peer server.  Objects are copied as stored (i.e., still compressed, if they were), so
+ * the copy can stand in for the original.  Copying is asynchronous, so it doesn't slow uploads; the
+ * upload record notes when each file was copied, and /metrics reports the number of files waiting and
+ * how long the oldest has waited.  Files purged from the server are removed from the second site too.
+ *
+ * A server accepts copies from its peers if it has a token for them, storing them under a prefix in
+ * its own storage (which has to be given), so that they don't mix with its own uploads.  Copies are
+ * limited in size to the upload limit (with an allowance for upload records), or to 512MB if uploads
+ * have no limit.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The suffix added to a file's key for the copy of its upload record at the second site.
+const replicaRecordSuffix = ".upload.json"
+
+// The allowance beyond the upload size limit for objects from peers, for upload records and platform
+// metadata sidecars, and the limit on their size if uploads have no limit.
+const (
+	maxReplicaOverhead = 1 << 20
+	maxReplicaBytes    = 512 << 20
+)
+
+// A replicationCounts counts the files copied to the second site, and the failures, since the server
+// started.
+type replicationCounts struct {
+	copied   atomic.Int64
+	failures atomic.Int64
+}
+
+// Open the second site given in the configuration, or return nil if there isn't one.
+func openReplica(config *support.Config) (storage.Backend, error) {
+	param := config.Replicate
+	if len(param.AcceptToken) > 0 && len(param.AcceptPrefix) == 0 {
+		return nil, errors.New("copies from peers have to be stored under a prefix (accept_prefix)")
+	}
+	switch {
+	case len(param.PeerURL) > 0 && len(param.Storage.Backend) > 0:
+		return nil, errors.New("replication can be to a storage backend or a peer server, not both")
+	case len(param.PeerURL) > 0:
+		return storage.NewPeer(param.PeerURL, param.PeerToken, param.PeerCACert)
+	case len(param.Storage.Backend) > 0:
+		return storage.New(param.Storage, config.AWS)
+	}
+	return nil, nil
+}
+
+// Determine whether an upload is yet to be copied to the second site.
+func awaitingReplication(u *support.UploadRecord) bool {
+	return u.Status == support.UploadAccepted && len(u.Key) > 0 && u.Replicated == nil &&
+		u.State != support.StateCorrupt && u.State != support.StateMissing
+}
+
+// Copy the files accepted since the last run to the second site.
+func (app *application) replicateJob(ctx context.Context) (string, error) {
+	if app.replica == nil {
+		return "replication is not configured", nil
+	}
+	due := app.uploads.Select(time.Time{}, time.Time{}, awaitingReplication)
+	source := storage.Underlying(app.storage)
+	var copied, failed int
+	for _, u := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := app.replicateUpload(ctx, source, u); err != nil {
+			support.Errorf("REPLICATE: failed to copy %s: %s\n", u.Key, err)
+			app.replicas.failures.Add(1)
+			failed++
+			continue
+		}
+		app.replicas.copied.Add(1)
+		copied++
+	}
+	return fmt.Sprintf("copied %d files to %s (%d failures)", copied, app.replica.Location(), failed), ctx.Err()
+}
+
+// Copy an upload's objects and record to the second site, and note the copy in the upload history.
+func (app *application) replicateUpload(ctx context.Context, source storage.Backend, record support.UploadRecord) error {
+	for _, key := range []string{record.Key, record.Sidecar} {
+		if len(key) == 0 {
+			continue
+		}
+		object, info, err := source.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(object)
+		object.Close()
+		if err != nil {
+			return err
+		}
+		if err := app.putReplica(ctx, key, data, info.Metadata); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	record.Replicated = &now
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := app.putReplica(ctx, record.Key+replicaRecordSuffix, data, nil); err != nil {
+		return err
+	}
+	_, err = app.uploads.Update(record.UUID, func(u *support.UploadRecord) error {
+		u.Replicated = &now
+		return nil
+	})
+	return err
+}
+
+// Store an object at the second site, retrying if it fails.
+func (app *application) putReplica(ctx context.Context, key string, data []byte, metadata map[string]string) error {
+	return app.retry.Do(ctx, "replica.put", func(ctx context.Context) error {
+		return app.replica.Put(ctx, key, data, metadata)
+	})
+}
+
+// Remove the copies of an upload from the second site, if it was copied, as when the upload is purged.
+// Failures are logged, but not otherwise reported.
+func (app *application) dropReplica(ctx context.Context, record support.UploadRecord) {
+	if app.replica == nil || record.Replicated == nil {
+		return
+	}
+	for _, key := range []string{record.Key, record.Sidecar, record.Key + replicaRecordSuffix} {
+		if len(key) == 0 {
+			continue
+		}
+		if err := app.replica.Delete(ctx, key); err != nil {
+			support.Errorf("REPLICATE: failed to remove copy of %s: %s\n", key, err)
+		}
+	}
+}
+
+// Write the replication metrics, if replication is configured: the files waiting to be copied and how
+// long the oldest has waited, and the files copied and failures since the server started.
+func (app *application) replicationMetrics(w io.Writer) {
+	if app.replica == nil {
+		return
+	}
+	pending := app.uploads.Select(time.Time{}, time.Time{}, awaitingReplication)
+	var lag time.Duration
+	for _, u := range pending {
+		lag = max(lag, time.Since(u.Received))
+	}
+	metricFamily(w, "wibl_replication_pending_files", "Number of accepted files not yet copied to the second site.", "gauge")
+	metricSample(w, "wibl_replication_pending_files", int64(len(pending)))
+	metricFamily(w, "wibl_replication_lag_seconds", "Time since the oldest file not yet copied to the second site was received.", "gauge")
+	metricSample(w, "wibl_replication_lag_seconds", int64(lag.Seconds()))
+	metricFamily(w, "wibl_replication_copied_total", "Number of files copied to the second site since the server started.", "counter")
+	metricSample(w, "wibl_replication_copied_total", app.replicas.copied.Load())
+	metricFamily(w, "wibl_replication_failures_total", "Number of failures to copy a file to the second site since the server started.", "counter")
+	metricSample(w, "wibl_replication_failures_total", app.replicas.failures.Load())
+}
+
+// Check that a request from a peer server carries the token that this server accepts from peers.
+func (app *application) peerAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	secret := app.config.Replicate.AcceptToken
+	return ok && len(secret) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// Find the key under which to keep a copy from a peer, writing an error response if the request isn't
+// acceptable.
+func (app *application) replicaKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if len(app.config.Replicate.AcceptToken) == 0 {
+		http.NotFound(w, r)
+		return "", false
+	}
+	if !app.peerAuthorized(r) {
+		support.Warnf("REPLICATE: request from %s failed authentication.\n", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return "", false
+	}
+	key := r.PathValue("key")
+	if !fs.ValidPath(key) || key == "." {
+		writeError(w, http.StatusBadRequest, "invalid object key")
+		return "", false
+	}
+	return app.config.Replicate.AcceptPrefix + key, true
+}
+
+// Store a copy of an object from a peer server.
+func (app *application) acceptReplica(w http.ResponseWriter, r *http.Request) {
+	key, ok := app.replicaKey(w, r)
+	if !ok {
+		return
+	}
+	var metadata map[string]string
+	if header := r.Header.Get(storage.PeerMetadataHeader); len(header) > 0 {
+		if err := json.Unmarshal([]byte(header), &metadata); err != nil {
+			writeError(w, http.StatusBadRequest, "malformed object metadata: "+err.Error())
+			return
+		}
+	}
+	limit := int64(maxReplicaBytes)
+	if app.config.Upload.MaxBytes > 0 {
+		limit = app.config.Upload.MaxBytes + maxReplicaOverhead
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("object too large (limit %d bytes)", limit))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read object: "+err.Error())
+		return
+	}
+	if _, err := support.CheckDigest(r.Header.Get("Digest"), data); err != nil {
+		writeError(w, http.StatusBadRequest, "object digest: "+err.Error())
+		return
+	}
+	if err := app.putObject(r.Context(), key, data, metadata); err != nil {
+		support.Errorf("REPLICATE: failed to store copy of %s from %s: %s\n", key, r.RemoteAddr, err)
+		writeError(w, http.StatusInternalServerError, "failed to store object")
+		return
+	}
+	support.Infof("REPLICATE: stored copy of %s (%d bytes) from %s.\n", key, len(data), r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove a copy of an object that a peer server has purged.
+func (app *application) deleteReplica(w http.ResponseWriter, r *http.Request) {
+	key, ok := app.replicaKey(w, r)
+	if !ok {
+		return
+	}
+	if err := app.storage.Delete(r.Context(), key); err != nil {
+		support.Errorf("REPLICATE: failed to remove copy of %s for %s: %s\n", key, r.RemoteAddr, err)
+		writeError(w, http.StatusInternalServerError, "failed to remove object")
+		return
+	}
+	support.Infof("REPLICATE: removed copy of %s for %s.\n", key, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,223 @@
+/*! @file reports.go
+ * @brief Periodic usage reports for program reporting
+ *
+ * Programs that deploy loggers typically have to report monthly on what's been collected.  The
+ * usage report summarises the upload history for a time range by tenant and logger: the number of
+ * uploads, the bytes accepted, why uploads were rejected, and the number of days for which there is
+ * data.  The report for each month is generated by a scheduled job, kept in the storage backend
+ * under reports/, and emailed to the configured recipients; reports for arbitrary time ranges can
+ * also be generated through the administration API.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The maximum number of days that a single file can contribute to coverage, so that a file with a
+// bad clock doesn't swamp the report.
+const maxCoverageDays = 31
+
+// A usageSummary accumulates the upload history for one row of the usage report.
+type usageSummary struct {
+	tenant   string
+	logger   string
+	uploads  int
+	accepted int
+	bytes    int64
+	reasons  map[string]int
+	days     map[string]bool
+}
+
+func newUsageSummary(tenant, logger string) *usageSummary {
+	return &usageSummary{tenant: tenant, logger: logger, reasons: make(map[string]int), days: make(map[string]bool)}
+}
+
+func (s *usageSummary) add(u *support.UploadRecord) {
+	s.uploads++
+	if u.Status != support.UploadAccepted {
+		s.reasons[u.Reason]++
+		return
+	}
+	s.accepted++
+	s.bytes += u.Size
+	if u.Metadata != nil && u.Metadata.Start != nil && u.Metadata.End != nil {
+		day := u.Metadata.Start.UTC().Truncate(24 * time.Hour)
+		for n := 0; n < maxCoverageDays && !day.After(*u.Metadata.End); n++ {
+			s.days[day.Format(time.DateOnly)] = true
+			day = day.Add(24 * time.Hour)
+		}
+	} else {
+		s.days[u.Received.Format(time.DateOnly)] = true
+	}
+}
+
+func (s *usageSummary) fields() []string {
+	reasons := make([]string, 0, len(s.reasons))
+	for reason, count := range s.reasons {
+		reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+	}
+	sort.Strings(reasons)
+	return []string{s.tenant, s.logger, strconv.Itoa(s.uploads), strconv.Itoa(s.accepted),
+		strconv.Itoa(s.uploads - s.accepted), strconv.FormatInt(s.bytes, 10), strings.Join(reasons, ";"),
+		strconv.Itoa(len(s.days))}
+}
+
+// Write the usage report for uploads received in [from, to) as CSV.  There is a row for each
+// logger, ordered by tenant, followed by a row for each tenant with the logger column empty.
+func (app *application) writeUsageReport(out io.Writer, from, to time.Time) error {
+	loggers := make(map[string]*usageSummary)
+	tenants := make(map[string]*usageSummary)
+	app.uploads.Select(from, to, func(u *support.UploadRecord) bool {
+		summary, ok := loggers[u.Logger]
+		if !ok {
+			tenant := ""
+			if record, ok := app.registry.Get(u.Logger); ok {
+				tenant = record.Tenant
+			}
+			summary = newUsageSummary(tenant, u.Logger)
+			loggers[u.Logger] = summary
+		}
+		summary.add(u)
+		total, ok := tenants[summary.tenant]
+		if !ok {
+			total = newUsageSummary(summary.tenant, "")
+			tenants[summary.tenant] = total
+		}
+		total.add(u)
+		return false
+	})
+	rows := make([]*usageSummary, 0, len(loggers)+len(tenants))
+	for _, s := range loggers {
+		rows = append(rows, s)
+	}
+	for _, s := range tenants {
+		rows = append(rows, s)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].tenant != rows[j].tenant {
+			return rows[i].tenant < rows[j].tenant
+		}
+		if (len(rows[i].logger) == 0) != (len(rows[j].logger) == 0) {
+			return len(rows[j].logger) == 0 // Tenant totals after the tenant's loggers
+		}
+		return rows[i].logger < rows[j].logger
+	})
+
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"tenant", "logger", "uploads", "accepted", "rejected", "bytes", "rejection_reasons", "coverage_days"})
+	for _, s := range rows {
+		cw.Write(s.fields())
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Generate a usage report for the time range given by the "from" and "to" query parameters.
+func (app *application) usageReport(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	app.recordAction(r, "report.usage", r.URL.RawQuery, "")
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	if err := app.writeUsageReport(w, from, to); err != nil {
+		support.Errorf("ADMIN: usage report failed: %s\n", err)
+	}
+}
+
+// The metadata that marks a stored report as still to be emailed.
+const (
+	reportEmail        = "email"
+	reportEmailPending = "pending"
+)
+
+// Generate the usage report for the previous calendar month, if it hasn't already been generated,
+// store it, and email it to the recipients in the configuration.  The job runs daily by default, so
+// the report appears within a day of the end of the month.  A report is stored marked as still to be
+// emailed, and the mark is only cleared once the email has been sent, so that a failed send is tried
+// again on the next run.
+func (app *application) reportJob(ctx context.Context) (string, error) {
+	now := time.Now().UTC()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, -1, 0)
+	name := "usage-" + from.Format("2006-01") + clusterSuffix(app.config, "-") + ".csv"
+	key := "reports/" + name
+	recipients := app.config.Reports.Recipients
+
+	var report []byte
+	obj, info, err := app.storage.Get(ctx, key)
+	switch {
+	case err == nil:
+		if info.Metadata[reportEmail] != reportEmailPending || len(recipients) == 0 {
+			obj.Close()
+			return key + " already generated", nil
+		}
+		report, err = io.ReadAll(obj)
+		obj.Close()
+		if err != nil {
+			return "", err
+		}
+	case !errors.Is(err, storage.ErrNotFound):
+		return "", err
+	default:
+		var buffer bytes.Buffer
+		if err := app.writeUsageReport(&buffer, from, to); err != nil {
+			return "", err
+		}
+		report = buffer.Bytes()
+		metadata := map[string]string{"report": "usage"}
+		if len(recipients) > 0 {
+			metadata[reportEmail] = reportEmailPending
+		}
+		if err := app.storage.Put(ctx, key, report, metadata); err != nil {
+			return "", err
+		}
+		if len(recipients) == 0 {
+			return "stored " + key, nil
+		}
+	}
+	month := from.Format("January 2006") + clusterSuffix(app.config, " from ")
+	err = support.SendMail(app.config.Mail, recipients, "WIBL usage report for "+month,
+		"The WIBL logger usage report for "+month+" is attached.\n", name, report)
+	if err != nil {
+		return "stored " + key + ", but failed to email; will retry", err
+	}
+	if err := app.storage.Put(ctx, key, report, map[string]string{"report": "usage"}); err != nil {
+		return "emailed " + key + ", but failed to mark it as sent", err
+	}
+	return "stored and emailed " + key, nil
+}
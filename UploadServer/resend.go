@@ -0,0 +1,120 @@
+/*! @file resend.go
+ * @brief Requests for loggers to re-send files
+ *
+ * When the server knows that it hasn't got a good copy of a file that a logger holds (the upload's
+ * digest didn't check, or storage failed), it asks the logger to re-send the file at its next checkin
+ * (see queue.go), rather than leaving the gap for the reconciliation job to find.  Operators can also
+ * ask for specific files, by the IDs or MD5 digests in the logger's inventory (e.g., after a storage
+ * incident).  Files are identified to the logger by the IDs in its last reported status, so files
+ * that the logger hasn't reported can't be requested.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A resendRequest asks for a logger to re-send files, by ID or MD5 digest.
+type resendRequest struct {
+	Files  []uint   `json:"files"`
+	MD5    []string `json:"md5"`
+	Reason string   `json:"reason"`
+}
+
+// The commandResult reports whether a command was queued (it isn't if the same was already waiting,
+// or all of the files to re-send were), and if so, the command.
+type commandResult struct {
+	Queued  bool         `json:"queued"`
+	Command *api.Command `json:"command,omitempty"`
+}
+
+// Find the ID of the file with the given MD5 digest in the logger's last reported inventory.
+func (app *application) fileID(logger, digest string) (uint, bool) {
+	status, ok := app.fleet.Get(logger)
+	if !ok || len(digest) == 0 {
+		return 0, false
+	}
+	for _, f := range status.Status.Files.Detail {
+		if strings.EqualFold(f.MD5, digest) {
+			return f.Id, true
+		}
+	}
+	return 0, false
+}
+
+// Ask the logger to re-send the file with the MD5 digest given, if it has reported the file,
+// because the server hasn't got a good copy of it.
+func (app *application) resendFailed(logger, digest, reason string) {
+	id, ok := app.fileID(logger, digest)
+	if !ok {
+		return
+	}
+	_, queued, err := app.commands.Enqueue(logger, api.Command{Action: support.CommandResend, Files: []uint{id}, Reason: reason})
+	if err != nil {
+		support.Errorf("TRANS: failed to request re-send of file %d from %s: %s\n", id, logger, err)
+	} else if queued {
+		support.Infof("TRANS: asked logger %s to re-send file %d (%s).\n", logger, id, reason)
+	}
+}
+
+// Ask a logger to re-send files at its next checkin.
+func (app *application) requestResend(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var request resendRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	files := append([]uint(nil), request.Files...)
+	for _, digest := range request.MD5 {
+		f, ok := app.fileID(id, digest)
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("no file with digest %s in the logger's last status", digest))
+			return
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		writeError(w, http.StatusBadRequest, "no files given")
+		return
+	}
+	reason := request.Reason
+	if len(reason) == 0 {
+		reason = "requested by operator"
+	}
+	command, queued, err := app.commands.Enqueue(id, api.Command{Action: support.CommandResend, Files: files, Reason: reason})
+	if err != nil {
+		support.Errorf("ADMIN: failed to request re-send from %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to queue command")
+		return
+	}
+	if !queued {
+		writeJSON(w, http.StatusOK, commandResult{})
+		return
+	}
+	app.recordAction(r, "logger.resend", id, fmt.Sprintf("files %v", command.Files))
+	writeJSON(w, http.StatusAccepted, commandResult{Queued: true, Command: &command})
+}
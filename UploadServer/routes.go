@@ -0,0 +1,194 @@
+/*! @file routes.go
+ * @brief Routing some WIBL files to processing pipelines under test
+ *
+ * A new version of the processing chain needs real data to prove itself on before it replaces the
+ * production one.  The configuration can give routes (see ProcessingParam in support/config.go), each
+ * of which takes the files from the loggers that it lists, and a percentage of the others, stores them
+ * under its own prefix, and tells its own notification targets about them instead of the production
+ * chain; everything else follows the production path.  The share of files is chosen by each file's
+ * digest, so that a file sent again goes the same way.  Routes are tried in order, and their
+ * percentages are taken in turn from the same range, so that they don't overlap.  The route is kept
+ * with the upload record, and operators can compare the routes (with production) by the files sent
+ * down each and the outcomes that the processing chain reported for them.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/notify"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The name under which files that aren't routed are reported.
+const productionRoute = "production"
+
+// Check the routes in the configuration, and generate the notifiers for each, by name.  In mock mode,
+// all notifications go to the recorder.
+func routeNotifiers(config *support.Config, recorder *notify.Recorder) (map[string]notify.Multi, error) {
+	rtn := make(map[string]notify.Multi)
+	var total float64
+	for _, route := range config.Processing.Routes {
+		switch {
+		case len(route.Name) == 0:
+			return nil, errors.New("every route needs a name")
+		case route.Name == productionRoute:
+			return nil, fmt.Errorf("route name %q is reserved", route.Name)
+		case route.Percent < 0 || route.Percent > 100:
+			return nil, fmt.Errorf("route %s: percentage must be between 0 and 100", route.Name)
+		}
+		if _, ok := rtn[route.Name]; ok {
+			return nil, fmt.Errorf("route %s is given more than once", route.Name)
+		}
+		if total += route.Percent; total > 100 {
+			return nil, errors.New("routes take more than 100 percent of files between them")
+		}
+		if recorder != nil {
+			rtn[route.Name] = notify.Multi{recorder}
+			continue
+		}
+		n, err := notify.New(route.Notify, config.AWS)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.Name, err)
+		}
+		rtn[route.Name] = n
+	}
+	return rtn, nil
+}
+
+// Choose the route for a WIBL file, returning its configuration, or false if the file should follow
+// the production path.
+func (app *application) chooseRoute(record support.UploadRecord) (support.RouteParam, bool) {
+	routes := app.config.Processing.Routes
+	for _, route := range routes {
+		if slices.Contains(route.Loggers, record.Logger) {
+			return route, true
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(record.MD5))
+	share := float64(h.Sum32()%10000) / 100
+	var from float64
+	for _, route := range routes {
+		if share < from+route.Percent {
+			return route, true
+		}
+		from += route.Percent
+	}
+	return support.RouteParam{}, false
+}
+
+// Find the configuration of the named route.
+func (app *application) route(name string) (support.RouteParam, bool) {
+	i := slices.IndexFunc(app.config.Processing.Routes, func(r support.RouteParam) bool { return r.Name == name })
+	if i < 0 {
+		return support.RouteParam{}, false
+	}
+	return app.config.Processing.Routes[i], true
+}
+
+// Find the storage prefix for the named route.
+func (app *application) routePrefix(name string) string {
+	if route, ok := app.route(name); ok && len(route.Prefix) > 0 {
+		return route.Prefix
+	}
+	return name + "/"
+}
+
+// A routeStats summarises the WIBL files sent down a route: the number and size of those accepted,
+// the number in each processing state, and the number whose latest outcome is each of those reported
+// by the processing chain (see outcomes.go).
+type routeStats struct {
+	Name     string           `json:"name"`
+	Loggers  []string         `json:"loggers,omitempty"`
+	Percent  float64          `json:"percent"`
+	Files    int64            `json:"files"`
+	Bytes    int64            `json:"bytes"`
+	States   map[string]int64 `json:"states"`
+	Outcomes map[string]int64 `json:"outcomes"`
+}
+
+// Summarise the WIBL files accepted since the time given for each route, and for production.  The
+// running totals kept by the upload store are used when the time is zero (e.g., for the metrics).
+func (app *application) summariseRoutes(since time.Time) []routeStats {
+	rtn := make([]routeStats, 0, len(app.config.Processing.Routes)+1)
+	var share float64
+	for _, route := range app.config.Processing.Routes {
+		rtn = append(rtn, routeStats{Name: route.Name, Loggers: route.Loggers, Percent: route.Percent})
+		share += route.Percent
+	}
+	rtn = append(rtn, routeStats{Name: productionRoute, Percent: 100 - share})
+	index := make(map[string]int, len(rtn))
+	for i := range rtn {
+		rtn[i].States, rtn[i].Outcomes = make(map[string]int64), make(map[string]int64)
+		index[rtn[i].Name] = i
+	}
+	for _, count := range app.uploads.RouteCounts(since) {
+		name := count.Route
+		if len(name) == 0 {
+			name = productionRoute
+		}
+		i, ok := index[name]
+		if !ok {
+			// Routes taken out of the configuration are still reported while they have files.
+			i, index[name] = len(rtn), len(rtn)
+			rtn = append(rtn, routeStats{Name: name})
+		}
+		rtn[i].Files, rtn[i].Bytes, rtn[i].States, rtn[i].Outcomes = count.Files, count.Bytes, count.States, count.Outcomes
+	}
+	return rtn
+}
+
+// Report the files sent down each route, and down the production path, optionally only those received
+// since a time (see queryTime()).
+func (app *application) listRoutes(w http.ResponseWriter, r *http.Request) {
+	since, ok := queryTime(w, r, "since")
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, app.summariseRoutes(since))
+}
+
+// Write the per-route metrics in the Prometheus text exposition format.
+func (app *application) routeMetrics(w io.Writer) {
+	stats := app.summariseRoutes(time.Time{})
+	metricFamily(w, "wibl_route_files", "Number of accepted WIBL files in the upload history sent down the processing route.", "gauge")
+	for _, s := range stats {
+		metricSample(w, "wibl_route_files", s.Files, "route", s.Name)
+	}
+	metricFamily(w, "wibl_route_bytes", "Number of bytes of accepted WIBL files in the upload history sent down the processing route.", "gauge")
+	for _, s := range stats {
+		metricSample(w, "wibl_route_bytes", s.Bytes, "route", s.Name)
+	}
+	metricFamily(w, "wibl_route_outcomes", "Number of files sent down the processing route with each latest processing outcome.", "gauge")
+	for _, s := range stats {
+		for _, outcome := range knownOutcomes {
+			metricSample(w, "wibl_route_outcomes", s.Outcomes[outcome], "route", s.Name, "outcome", outcome)
+		}
+	}
+}
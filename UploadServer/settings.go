@@ -0,0 +1,80 @@
+/*! @file settings.go
+ * @brief Administration API end-points for the settings that can be changed at run-time
+ *
+ * Admins can change the log level, rate limits, and quotas (see support/settings.go) without
+ * restarting the server.  Changes are made with a PATCH containing only the settings to change, and
+ * are recorded in the audit trail.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Report the current run-time settings.
+func (app *application) getSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.settings.Get())
+}
+
+// Change some of the run-time settings.  The body has the same form as the settings, but only the
+// values given are changed; a per-logger quota of -1 removes the logger's entry, so that it gets
+// the default quota.
+func (app *application) updateSettings(w http.ResponseWriter, r *http.Request) {
+	var patch json.RawMessage
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	updated, err := app.settings.Update(func(s *support.Settings) error {
+		decoder := json.NewDecoder(bytes.NewReader(patch))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(s); err != nil {
+			return err
+		}
+		for logger, limit := range s.Quota.Loggers {
+			if limit == -1 {
+				delete(s.Quota.Loggers, logger)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, support.ErrInvalidSettings) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		support.Errorf("ADMIN: failed to save settings: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to save settings")
+		return
+	}
+	app.recordAction(r, "settings.update", "", string(patch))
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// Provide the current rate limits, for the rate-limit middleware.
+func (app *application) checkinLimit() int { return app.settings.Get().RateLimit.CheckinPerMinute }
+func (app *application) uploadLimit() int  { return app.settings.Get().RateLimit.UploadPerMinute }
+func (app *application) loginLimit() int   { return app.settings.Get().RateLimit.LoginPerMinute }
@@ -0,0 +1,254 @@
+/*! @file admin.go
+ * @brief Specification for types used in the administration API
+ *
+ * Operators manage the server through an administration API under /admin/v1, separate from the
+ * end-points that the loggers use.  This file specifies the JSON encoding of the requests and
+ * responses for that API that aren't simply the server's internal records.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import "time"
+
+// An ErrorResponse is returned by the administration API when a request fails.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// A MintTokenRequest asks the server to generate a new upload token for a logger, which can only be
+// used by that logger.
+type MintTokenRequest struct {
+	Logger      string `json:"logger"`
+	Description string `json:"description"`
+}
+
+// A MintTokenResponse provides a newly-minted upload token.  This is the only time that the
+// plain-text token is available from the server.
+type MintTokenResponse struct {
+	ID          string     `json:"id"`
+	Token       string     `json:"token"`
+	Logger      string     `json:"logger"`
+	Description string     `json:"description"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+// A LoginRequest provides the credentials for an admin user to log in.
+type LoginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// A LoginResponse provides the session token for an admin user that has logged in.  If the
+// user's password has expired, the session can only be used to change the password.
+type LoginResponse struct {
+	Token           string    `json:"token"`
+	Expires         time.Time `json:"expires"`
+	PasswordExpired bool      `json:"password_expired"`
+}
+
+// A PasswordChangeRequest asks the server to change the caller's password.
+type PasswordChangeRequest struct {
+	Current     string `json:"current"`
+	Replacement string `json:"replacement"`
+}
+
+// A NewUserRequest asks the server to create an admin user, with a temporary password that has
+// to be changed on first login.  A user with a Tenant can only see that tenant's files.
+type NewUserRequest struct {
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	Tenant   string `json:"tenant,omitempty"`
+	Password string `json:"password"`
+}
+
+// A PasswordResetRequest sets a new temporary password for an admin user.
+type PasswordResetRequest struct {
+	Password string `json:"password"`
+}
+
+// A UserInfo describes an admin user (without the password hash).
+type UserInfo struct {
+	Name            string    `json:"name"`
+	Role            string    `json:"role"`
+	Tenant          string    `json:"tenant,omitempty"`
+	PasswordChanged time.Time `json:"password_changed"`
+	MustChange      bool      `json:"must_change"`
+	Created         time.Time `json:"created"`
+	LastLogin       time.Time `json:"last_login,omitempty"`
+}
+
+// A PurgeSummary describes the data held for a logger that a purge would remove (or has removed).
+type PurgeSummary struct {
+	Logger  string `json:"logger"`
+	Uploads int    `json:"uploads"`
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Held    int    `json:"held,omitempty"` // Uploads kept because of legal holds
+
+	Tokens       int `json:"tokens,omitempty"`       // Upload tokens revoked
+	Grants       int `json:"grants,omitempty"`       // Session accounts dropped
+	Sessions     int `json:"sessions,omitempty"`     // Staged upload sessions, and their parts
+	Quarantined  int `json:"quarantined,omitempty"`  // Quarantined payloads
+	DeadLetters  int `json:"dead_letters,omitempty"` // Notifications that had failed
+	Observations int `json:"observations,omitempty"` // Observations buffered for the live feed
+	Manifests    int `json:"manifests,omitempty"`    // Daily manifests rewritten without the uploads
+}
+
+// A PurgeConfirmation is returned when a purge is requested, and has to be presented to carry out
+// the purge before it expires.
+type PurgeConfirmation struct {
+	Summary      PurgeSummary `json:"summary"`
+	Confirmation string       `json:"confirmation"`
+	Expires      time.Time    `json:"expires"`
+}
+
+// A StateUpdate reports a change in the processing state of an upload (i.e., that it has been
+// processed).
+type StateUpdate struct {
+	State string `json:"state"`
+}
+
+// A TagUpdate adds and removes tags on an upload or logger.
+type TagUpdate struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// A NoteRequest adds a free-text note to an upload or logger.
+type NoteRequest struct {
+	Text string `json:"text"`
+}
+
+// An EnrolmentCodeRequest asks the server for a one-time code with which a new logger can enrol,
+// valid for the hours given (the server's default if zero).  Tenant, Vessel, and Profile are given to
+// the logger's registry record when it enrols.
+type EnrolmentCodeRequest struct {
+	Description string `json:"description"`
+	Tenant      string `json:"tenant,omitempty"`
+	Vessel      string `json:"vessel,omitempty"`
+	Profile     string `json:"profile,omitempty"`
+	Hours       int    `json:"hours,omitempty"`
+}
+
+// An EnrolmentCodeResponse provides a newly-minted enrolment code.  This is the only time that the
+// plain-text code is available from the server.
+type EnrolmentCodeResponse struct {
+	ID      string    `json:"id"`
+	Code    string    `json:"code"`
+	Expires time.Time `json:"expires"`
+}
+
+// A MaintenanceInfo describes work done on a logger's hardware: the kind of work (installed, removed,
+// antenna, firmware, visit, repair, or other), the date it was done (YYYY-MM-DD), and what was done.
+// Firmware gives the version flashed, and is required for firmware flashes.
+type MaintenanceInfo struct {
+	Kind     string `json:"kind"`
+	Date     string `json:"date"`
+	Text     string `json:"text"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// A LoggerUpdate changes the registry information for a logger.  Only the fields given are changed.
+type LoggerUpdate struct {
+	Tenant  *string      `json:"tenant,omitempty"`
+	Vessel  *string      `json:"vessel,omitempty"`          // Vessel ID, or empty to remove the association
+	Profile *string      `json:"profile,omitempty"`         // Transfer profile, or empty for the default
+	Hours   *UploadHours `json:"upload_hours,omitempty"`    // Upload hours, or no periods to remove the restriction
+	Checkin *int         `json:"checkin_minutes,omitempty"` // Checkin interval in minutes, or zero for the default
+}
+
+// UploadHours restrict when a logger may upload to daily periods, each from Start to End as "HH:MM"
+// in TimeZone (an IANA name, or the upload schedule's time zone if not given).  If End is before
+// Start, the period runs past midnight.
+type UploadHours struct {
+	TimeZone string        `json:"time_zone,omitempty"`
+	Periods  []DailyPeriod `json:"periods"`
+}
+
+type DailyPeriod struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// An Offset is the position of a sensor relative to the vessel's reference point, in metres
+// (X positive forward, Y positive to starboard, Z positive down).
+type Offset struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// The SensorOffsets give the positions of the sensors used by the logger on a vessel.
+type SensorOffsets struct {
+	Position *Offset `json:"position,omitempty"` // GNSS antenna
+	Sounder  *Offset `json:"sounder,omitempty"`  // Echosounder transducer
+}
+
+// A Consent records what the vessel's owner has agreed may be done with the data.
+type Consent struct {
+	ShareData     bool `json:"share_data"`     // Data may be submitted to a Trusted Node
+	ShareIdentity bool `json:"share_identity"` // Vessel name and identifiers may accompany the data
+}
+
+// A VesselInfo describes a vessel on which loggers are installed.
+type VesselInfo struct {
+	Name    string        `json:"name"`
+	MMSI    string        `json:"mmsi,omitempty"`
+	IMO     string        `json:"imo,omitempty"`
+	Draft   *float64      `json:"draft,omitempty"` // Metres
+	Owner   string        `json:"owner,omitempty"`
+	Offsets SensorOffsets `json:"offsets"`
+	Consent Consent       `json:"consent"`
+}
+
+// A FleetEntry describes a logger in a fleet definition, as imported or exported in bulk: its registry
+// information, the vessel that it's installed on, and its upload tokens.  On import, the logger gets
+// the token given in plain text, the tokens given by hash (as exported by another server), and a new
+// token if MintToken is set.  Token hashes are only exported on request.
+type FleetEntry struct {
+	Logger      string      `json:"logger"`
+	Tenant      string      `json:"tenant,omitempty"`
+	Profile     string      `json:"profile,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Vessel      *VesselInfo `json:"vessel,omitempty"`
+	Token       string      `json:"token,omitempty"`
+	TokenHashes []string    `json:"token_hashes,omitempty"`
+	MintToken   bool        `json:"mint_token,omitempty"`
+}
+
+// A FleetImportResult reports what was done for one entry of a fleet import.  A minted token is only
+// available here.
+type FleetImportResult struct {
+	Logger  string `json:"logger"`
+	Created bool   `json:"created"`          // Logger was not in the registry before
+	Vessel  string `json:"vessel,omitempty"` // ID of the vessel record, matched or created
+	Tokens  int    `json:"tokens"`           // Number of tokens imported
+	Token   string `json:"token,omitempty"`  // Newly-minted token, if requested
+}
+
+// A FleetImportError reports an entry of a fleet import that was refused, by its position in the
+// input (counting from one, after any header).
+type FleetImportError struct {
+	Row    int    `json:"row"`
+	Logger string `json:"logger,omitempty"`
+	Error  string `json:"error"`
+}
@@ -26,6 +26,11 @@
 
 package api
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type VersionInfo struct {
 	Firmware         string `json:"firmware"`
 	CommandProcessor string `json:"commandproc"`
@@ -72,13 +77,358 @@ type FileInfo struct {
 }
 
 type Status struct {
+	Logger      string        `json:"logger,omitempty"`    // Logger's unique ID, if it reports it
+	Timestamp   *time.Time    `json:"timestamp,omitempty"` // Logger's clock when the status was sent
 	Versions    VersionInfo   `json:"version"`
 	Elapsed     uint32        `json:"elapsed"`
 	Server      WebServerInfo `json:"webserver"`
 	CurrentData DataSummary   `json:"data"`
 	Files       FileInfo      `json:"files"`
+	Position    *Position     `json:"position,omitempty"` // Extension: logger's last fix, if it reports it
+}
+
+// A Position is a logger's position (WGS84, decimal degrees), and the time of the fix, if known.
+type Position struct {
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	Time      *time.Time `json:"time,omitempty"`
 }
 
 type TransferResult struct {
-	Status string `json:"status"`
+	Status  string   `json:"status"`
+	Missing []int    `json:"missing,omitempty"` // Chunks not yet received, when assembling a chunked upload
+	Receipt *Receipt `json:"receipt,omitempty"` // Proof that the file was accepted, if the server signs receipts
+	Trace   string   `json:"trace,omitempty"`   // Trace ID of the upload, by which the file can be followed downstream
+	Reason  string   `json:"reason,omitempty"`  // Why the file wasn't accepted, if it wasn't
+}
+
+// A Receipt is the server's signed statement that it accepted a file from a logger.  The Signature
+// (Ed25519, base64-encoded) is made with the server key identified by Key; see
+// support/receipts.go for the message signed.
+type Receipt struct {
+	UUID      string    `json:"uuid"`
+	Logger    string    `json:"logger"`
+	MD5       string    `json:"md5"`
+	Size      int64     `json:"len"`
+	Issued    time.Time `json:"issued"`
+	Key       string    `json:"key_id"`
+	Signature string    `json:"signature"`
+}
+
+// A ChunkInfo describes one chunk of a chunked upload that the server has received.
+type ChunkInfo struct {
+	Index int   `json:"index"`
+	Size  int64 `json:"len"`
+}
+
+// A ChunkList lists the chunks of an upload that the server has received.
+type ChunkList struct {
+	ID     string      `json:"id"`
+	Chunks []ChunkInfo `json:"chunks"`
+}
+
+// A BlockSignature describes a file that the server already has (the Basis, by upload UUID) as the
+// digests of its blocks, so that a logger re-sending the file can send only the blocks that differ.
+// Weak is the Adler-32 checksum of a block (for a rolling search), and Strong its MD5 digest (hex);
+// the last block may be short.
+type BlockSignature struct {
+	Basis     string      `json:"basis"`
+	Size      int64       `json:"len"`
+	BlockSize int         `json:"block_size"`
+	Blocks    []BlockHash `json:"blocks"`
+}
+
+// A BlockHash gives the digests of one block of a file.
+type BlockHash struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// An AssembleRequest asks the server to assemble a chunked upload from the number of chunks given.
+type AssembleRequest struct {
+	Count int `json:"count"`
+}
+
+// A QuotaWarning tells a logger that it is approaching (or has reached) the limit on the storage
+// that it can use on the server, so that it can throttle uploads rather than have them rejected.
+type QuotaWarning struct {
+	Level string `json:"level"` // "warning" when approaching the limit, "exceeded" at the limit
+	Used  int64  `json:"used"`
+	Limit int64  `json:"limit"`
+}
+
+// A ServerInfo describes the server's build, so that loggers can tell which protocol features it
+// supports: the semantic version, the commit it was built from (marked as modified if built from a
+// tree with uncommitted changes), the build date, the experimental features enabled, the
+// algorithms accepted in the Digest header of uploads, and the encodings accepted for checkins.
+type ServerInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Modified  bool     `json:"modified,omitempty"`
+	BuildDate string   `json:"build_date,omitempty"`
+	Features  []string `json:"features"`
+	Digests   []string `json:"digests"`
+	Protocol  int      `json:"protocol"`  // Version of the logger protocol that the server speaks
+	Auth      []string `json:"auth"`      // Authentication methods that loggers may use
+	Encodings []string `json:"encodings"` // Content types accepted for checkins and their responses
+}
+
+// A CompactStatus is the subset of a logger's Status that constrained relays send over CoAP, as
+// CBOR with integer keys.  Time is the logger's clock (Unix seconds) when the status was sent.
+type CompactStatus struct {
+	Logger   string `cbor:"1,keyasint"`
+	Time     int64  `cbor:"2,keyasint"`
+	Elapsed  uint32 `cbor:"3,keyasint,omitempty"`
+	Firmware string `cbor:"4,keyasint,omitempty"`
+	Files    uint   `cbor:"5,keyasint,omitempty"`
+	Current  string `cbor:"6,keyasint,omitempty"` // Web server status
+}
+
+// A CompactResult is the server's response to a CompactStatus: the number of commands waiting for
+// the logger, which it has to check in over HTTP to collect.
+type CompactResult struct {
+	Commands int `cbor:"1,keyasint"`
+}
+
+// An Observation is one real-time observation that a logger streams: an NMEA0183 sentence as the
+// logger received it, or a decimated NMEA2000 value (as JSON, including its PGN).  Received is the
+// server's time of receipt.
+type Observation struct {
+	Logger   string          `json:"logger"`
+	Received time.Time       `json:"received"`
+	Source   string          `json:"source"` // "nmea0183" or "nmea2000"
+	Sentence string          `json:"sentence,omitempty"`
+	PGN      uint32          `json:"pgn,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// An EnrolmentRequest is sent by a new logger to enrol itself with a one-time code that an operator
+// minted for it, with its hardware serial number and firmware version, for the operator's reference.
+type EnrolmentRequest struct {
+	Code     string `json:"code"`
+	Serial   string `json:"serial,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// An Enrolment gives a newly-enrolled logger its unique identifier and upload token.  Uploads aren't
+// accepted from the logger until an operator approves it, which Pending shows.
+type Enrolment struct {
+	Logger  string     `json:"logger"`
+	Token   string     `json:"token"`
+	Expires *time.Time `json:"expires,omitempty"` // When the token expires, if it does
+	Pending bool       `json:"pending"`
+}
+
+// A ChallengeRequest asks the server for a nonce with which a logger can authenticate by
+// challenge-response, for loggers speaking the protocol version given.
+type ChallengeRequest struct {
+	Logger   string `json:"logger"`
+	Protocol int    `json:"protocol"`
+}
+
+// A Challenge gives a logger a single-use nonce to sign to authenticate, before it expires.
+type Challenge struct {
+	Nonce   string    `json:"nonce"`
+	Expires time.Time `json:"expires"`
+}
+
+// A ChallengeResponse gives the server a logger's signature of the nonce it was given, as the
+// hex-encoded HMAC-SHA256 of "wibl-auth/1\n{logger}\n{nonce}" keyed with the logger's signing key,
+// which is the HMAC-SHA256 of "wibl-signing" keyed with its upload token.
+type ChallengeResponse struct {
+	Logger    string `json:"logger"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+// An UploadChange describes one upload received from a logger, identified by the MD5 digest of the
+// file.  Rejected uploads give the reason for rejection.
+type UploadChange struct {
+	MD5      string    `json:"md5"`
+	Size     int64     `json:"len"`
+	Received time.Time `json:"received"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// An UploadChangelog summarises the uploads received from a logger since its previous checkin.  If
+// there were too many to list, only the most recent are given, and Truncated is set.
+type UploadChangelog struct {
+	Since     time.Time      `json:"since"`
+	Accepted  []UploadChange `json:"accepted,omitempty"`
+	Rejected  []UploadChange `json:"rejected,omitempty"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// A ManifestEntry describes one accepted upload in a daily storage manifest (one entry per line).
+// MD5 is the digest of the file as the logger sent it, and Size its length; the stored object may
+// differ if the server added metadata or compressed it.
+type ManifestEntry struct {
+	UUID     string    `json:"uuid"`
+	Logger   string    `json:"logger"`
+	FileID   *uint     `json:"file_id,omitempty"`
+	Key      string    `json:"key"`
+	Type     string    `json:"type,omitempty"`
+	Size     int64     `json:"len"`
+	MD5      string    `json:"md5"`
+	Received time.Time `json:"received"`
+}
+
+// An UploadWindow tells a logger when it should upload its files: not before Earliest, and (if
+// given) finishing before Latest, with at most MaxFiles at once and at no more than MaxKBps
+// kilobytes per second (zero for no limit).
+type UploadWindow struct {
+	Earliest time.Time  `json:"earliest"`
+	Latest   *time.Time `json:"latest,omitempty"`
+	MaxFiles int        `json:"max_files,omitempty"`
+	MaxKBps  int        `json:"max_kbps,omitempty"`
+}
+
+// A Command asks a logger to do something at its next checkin.  The Action says what: "resend"
+// asks for the Files listed (by the IDs that the logger reports in its status) to be uploaded again,
+// "upgrade" says that the logger's firmware is out of the fleet's policy, and has to be upgraded
+// (the Reason says why), and "upload" asks for all of the files not yet uploaded to be sent at once,
+// regardless of the upload window.
+type Command struct {
+	ID      string    `json:"id"`
+	Action  string    `json:"action"`
+	Files   []uint    `json:"files,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// A CheckinResponse is the server's reply to a status message.
+type CheckinResponse struct {
+	Status   string           `json:"status"`
+	Server   *ServerInfo      `json:"server,omitempty"`
+	Quota    *QuotaWarning    `json:"quota,omitempty"`
+	Changes  *UploadChangelog `json:"changes,omitempty"`
+	Clock    *float64         `json:"clock_offset,omitempty"` // Seconds the logger's clock is ahead of the server's
+	Upload   *UploadWindow    `json:"upload,omitempty"`
+	Commands []Command        `json:"commands,omitempty"` // Commands queued for the logger since its last checkin
+	Token    *TokenExpiry     `json:"token,omitempty"`    // Given when the logger's upload token is due to expire
+	Session  *SessionGrant    `json:"session,omitempty"`  // Session token for uploads, if the server issues them
+	Pins     []CertificatePin `json:"pins,omitempty"`     // Server certificates, for loggers that pin them
+	Transfer *TransferProfile `json:"transfer,omitempty"` // How the logger should send files over its link
+	Outcomes []FileOutcome    `json:"outcomes,omitempty"` // Processing outcomes for the logger's files since its last checkin
+}
+
+// A TransferProfile tells a logger how to send files over its link: the size of chunk to send them in
+// (see chunks.go), how long the server waits for a request and its response, and how often and how
+// many times to retry (resuming chunked uploads) before giving up until the next checkin.
+type TransferProfile struct {
+	Name         string `json:"name"`
+	ChunkBytes   int    `json:"chunk_bytes"`
+	ReadSeconds  int    `json:"read_timeout"`
+	WriteSeconds int    `json:"write_timeout"`
+	RetrySeconds int    `json:"retry_interval"`
+	MaxRetries   int    `json:"max_retries"`
+}
+
+// A ProvisioningBundle is everything that a logger needs to start using the server: where the server
+// is, the logger's identifier and upload token (and when the token expires, if it does), the CA
+// certificate (PEM) to trust for the server, and how often to check in.
+type ProvisioningBundle struct {
+	Server         string     `json:"server"`
+	Logger         string     `json:"logger"`
+	Token          string     `json:"token"`
+	Expires        *time.Time `json:"token_expires,omitempty"`
+	CACert         string     `json:"ca_cert"`
+	CheckinMinutes int        `json:"checkin_minutes"`
+}
+
+// A CertificatePin identifies one of the server's TLS certificates: the one in use ("current"), or
+// the one that will replace it ("next").  SHA256 is the hex-encoded digest of the DER certificate,
+// and SPKI the base64-encoded SHA-256 digest of its public key.
+type CertificatePin struct {
+	Role      string    `json:"role"`
+	SHA256    string    `json:"sha256"`
+	SPKI      string    `json:"spki_sha256"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// A SessionGrant gives a logger a short-lived token to send as "Authorization: Bearer {token}" on
+// its uploads until it expires, in place of its upload token.
+type SessionGrant struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// A TokenExpiry warns a logger that its upload token expires soon, and tells it where to renew it.
+type TokenExpiry struct {
+	Expires time.Time `json:"expires"`
+	Renew   string    `json:"renew"` // Path to POST to, with the current token, for a new one
+}
+
+// A TokenRenewal gives a logger its new upload token, which replaces the one it authenticated with.
+type TokenRenewal struct {
+	ID      string     `json:"id"`
+	Token   string     `json:"token"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// A FederatedCheckin is a checkin that a downstream server received from one of its loggers, as
+// forwarded to the upstream server.
+type FederatedCheckin struct {
+	Logger string    `json:"logger"`
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"` // Address the logger checked in from, on the downstream server
+	Status Status    `json:"status"`
+}
+
+// A SyncCursor records how far a downstream server has forwarded its records to the upstream server:
+// the time of receipt of the last upload, and of the last checkin, that it forwarded.
+type SyncCursor struct {
+	Uploads  time.Time `json:"uploads"`
+	Checkins time.Time `json:"checkins"`
+}
+
+// An UploadBegin starts an upload session, giving the size of the file to be sent if the logger knows
+// it.  The payload type, encryption key, and file ID are given in the headers, as for a file transfer.
+type UploadBegin struct {
+	Size int64 `json:"size,omitempty"`
+}
+
+// An UploadSession describes a file being uploaded in stages: the session is begun, the data sent in
+// one or more parts (each starting where the last ended, so that a dropped transfer can be resumed),
+// and the session then committed with the digest of the whole file.
+type UploadSession struct {
+	ID          string    `json:"id"`
+	Logger      string    `json:"logger"`
+	Remote      string    `json:"remote"`
+	State       string    `json:"state"` // "open", "committed", "failed", "aborted", or "expired"
+	Type        string    `json:"type,omitempty"`
+	KeyID       string    `json:"key_id,omitempty"`
+	FileID      *uint     `json:"file_id,omitempty"`
+	Trace       string    `json:"trace"`
+	Correlation string    `json:"correlation,omitempty"` // ID the logger gave in X-Trace-Id, if any
+	Size        int64     `json:"size,omitempty"`        // As declared when the session began, if it was
+	Received    int64     `json:"received"`              // Bytes received so far, and so the offset of the next part
+	Parts       int       `json:"parts"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Expires     time.Time `json:"expires"`          // When the session is abandoned if it's still open
+	Upload      string    `json:"upload,omitempty"` // UUID of the upload record, once committed
+	Error       string    `json:"error,omitempty"`  // Why the session failed, if it did
+}
+
+// A ProcessingReport is a processing chain component's report of what happened to a file: "converted",
+// "rejected", or "submitted" (to DCDB), with any detail, and the file's identifier in the system that it
+// was passed to, if it has one.  The file is identified by its upload UUID, its trace ID, or both.
+type ProcessingReport struct {
+	Outcome   string     `json:"outcome"`
+	Detail    string     `json:"detail,omitempty"`
+	Reference string     `json:"reference,omitempty"`
+	Trace     string     `json:"trace,omitempty"` // Trace ID of the file, from the notification that it was ready
+	Time      *time.Time `json:"time,omitempty"`  // When it happened, if not when reported
+}
+
+// A FileOutcome tells a logger what the processing chain did with one of its files, identified
+// by the MD5 digest of the file (and the logger's file ID, if known).
+type FileOutcome struct {
+	MD5     string    `json:"md5"`
+	FileID  *uint     `json:"file_id,omitempty"`
+	Outcome string    `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+	Time    time.Time `json:"time"`
 }
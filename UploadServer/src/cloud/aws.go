@@ -0,0 +1,86 @@
+/*! @file aws.go
+ * @brief AWS configuration shared by the server's AWS integrations
+ *
+ * The S3 storage backend and the SNS/SQS notifiers all need AWS credentials and a region.  By
+ * default these come from the environment (variables, shared configuration files, or an instance
+ * role), as with the AWS command line tools, but the configuration can specify the region and shared
+ * configuration profile to use, a role to assume (e.g., in another account), and endpoint overrides
+ * for each service (for S3-compatible stores, LocalStack, or VPC endpoints).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Generate the AWS configuration from the server configuration, starting from the default chain
+// of credential sources.
+func AWSConfig(param support.AWSParam) (aws.Config, error) {
+	var options []func(*config.LoadOptions) error
+	if len(param.Region) > 0 {
+		options = append(options, config.WithRegion(param.Region))
+	}
+	if len(param.Profile) > 0 {
+		options = append(options, config.WithSharedConfigProfile(param.Profile))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if len(param.RoleARN) > 0 {
+		client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+			if endpoint := param.Endpoints["sts"]; len(endpoint) > 0 {
+				o.BaseEndpoint = aws.String(endpoint)
+			}
+		})
+		provider := stscreds.NewAssumeRoleProvider(client, param.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "wibl-monitor"
+			if len(param.SessionName) > 0 {
+				o.RoleSessionName = param.SessionName
+			}
+			if len(param.ExternalID) > 0 {
+				o.ExternalID = aws.String(param.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	if len(cfg.Region) == 0 {
+		return aws.Config{}, fmt.Errorf("no AWS region in configuration or environment")
+	}
+	return cfg, nil
+}
+
+// Provide the endpoint override for the named service (e.g., "s3"), if there is one.
+func Endpoint(param support.AWSParam, service string) *string {
+	if endpoint, ok := param.Endpoints[service]; ok && len(endpoint) > 0 {
+		return aws.String(endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+/*! @file coap.go
+ * @brief Minimal CoAP (RFC 7252) message encoding and a UDP server loop
+ *
+ * Only as much of CoAP as the ingest adapter needs: the message format (header, token, options, and
+ * payload), the Uri-Path and Uri-Query options, piggybacked responses to confirmable requests, and
+ * de-duplication of retransmitted requests.  Block-wise transfer, observation, proxying, and DTLS
+ * aren't supported.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package coap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The message types.
+const (
+	Confirmable     = 0
+	NonConfirmable  = 1
+	Acknowledgement = 2
+	Reset           = 3
+)
+
+// The method and response codes used, as class << 5 | detail.
+const (
+	Empty        = 0x00
+	POST         = 0x02
+	Changed      = 0x44 // 2.04
+	BadRequest   = 0x80 // 4.00
+	Unauthorized = 0x81 // 4.01
+	Forbidden    = 0x83 // 4.03
+	NotFound     = 0x84 // 4.04
+	NotAllowed   = 0x85 // 4.05
+	Unsupported  = 0x8F // 4.15
+	ServerError  = 0xA0 // 5.00
+)
+
+// The option numbers used.
+const (
+	OptionURIPath       = 11
+	OptionContentFormat = 12
+	OptionURIQuery      = 15
+)
+
+// The content format for CBOR payloads.
+const FormatCBOR = 60
+
+// How long a response is kept to answer retransmissions of the request (EXCHANGE_LIFETIME).
+const exchangeLifetime = 247 * time.Second
+
+// ErrMalformed is returned for data that isn't a CoAP message.
+var ErrMalformed = errors.New("malformed CoAP message")
+
+// An Option is one option of a message.
+type Option struct {
+	Number int
+	Value  []byte
+}
+
+// A Message is a CoAP request or response.
+type Message struct {
+	Type      int
+	Code      int
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Provide the path of a request, from its Uri-Path options.
+func (m *Message) Path() string {
+	var parts []string
+	for _, o := range m.Options {
+		if o.Number == OptionURIPath {
+			parts = append(parts, string(o.Value))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Provide the value of the query parameter given, from the Uri-Query options ("name=value").
+func (m *Message) Query(name string) string {
+	for _, o := range m.Options {
+		if o.Number != OptionURIQuery {
+			continue
+		}
+		if key, value, ok := strings.Cut(string(o.Value), "="); ok && key == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// Decode a message from a datagram.
+func Parse(data []byte) (*Message, error) {
+	if len(data) < 4 || data[0]>>6 != 1 {
+		return nil, ErrMalformed
+	}
+	tokenLength := int(data[0] & 0x0F)
+	if tokenLength > 8 || len(data) < 4+tokenLength {
+		return nil, ErrMalformed
+	}
+	m := &Message{Type: int(data[0]>>4) & 0x03, Code: int(data[1]), MessageID: binary.BigEndian.Uint16(data[2:4]),
+		Token: append([]byte(nil), data[4:4+tokenLength]...)}
+	data = data[4+tokenLength:]
+	number := 0
+	for len(data) > 0 {
+		if data[0] == 0xFF {
+			if len(data) == 1 {
+				return nil, ErrMalformed
+			}
+			m.Payload = append([]byte(nil), data[1:]...)
+			break
+		}
+		delta, length := int(data[0]>>4), int(data[0]&0x0F)
+		data = data[1:]
+		var err error
+		if delta, data, err = extended(delta, data); err != nil {
+			return nil, err
+		}
+		if length, data, err = extended(length, data); err != nil {
+			return nil, err
+		}
+		if len(data) < length {
+			return nil, ErrMalformed
+		}
+		number += delta
+		m.Options = append(m.Options, Option{Number: number, Value: append([]byte(nil), data[:length]...)})
+		data = data[length:]
+	}
+	return m, nil
+}
+
+// Decode an extended option delta or length.
+func extended(value int, data []byte) (int, []byte, error) {
+	switch value {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, ErrMalformed
+		}
+		return int(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, ErrMalformed
+		}
+		return int(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, ErrMalformed
+	}
+	return value, data, nil
+}
+
+// Encode the message for sending.
+func (m *Message) Marshal() []byte {
+	rtn := []byte{1<<6 | byte(m.Type)<<4 | byte(len(m.Token)), byte(m.Code), 0, 0}
+	binary.BigEndian.PutUint16(rtn[2:], m.MessageID)
+	rtn = append(rtn, m.Token...)
+	options := append([]Option(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	number := 0
+	for _, o := range options {
+		delta, deltaExt := nibble(o.Number - number)
+		length, lengthExt := nibble(len(o.Value))
+		rtn = append(rtn, byte(delta<<4|length))
+		rtn = append(append(rtn, deltaExt...), lengthExt...)
+		rtn = append(rtn, o.Value...)
+		number = o.Number
+	}
+	if len(m.Payload) > 0 {
+		rtn = append(append(rtn, 0xFF), m.Payload...)
+	}
+	return rtn
+}
+
+// Encode an option delta or length as its nibble and any extended bytes.
+func nibble(value int) (int, []byte) {
+	switch {
+	case value < 13:
+		return value, nil
+	case value < 269:
+		return 13, []byte{byte(value - 13)}
+	}
+	return 14, binary.BigEndian.AppendUint16(nil, uint16(value-269))
+}
+
+// Encode an unsigned integer option value (in as few bytes as possible).
+func Uint(value uint) []byte {
+	var rtn []byte
+	for ; value > 0; value >>= 8 {
+		rtn = append([]byte{byte(value)}, rtn...)
+	}
+	return rtn
+}
+
+// A Handler generates the response code and payload for a request, from the address given.
+type Handler func(request *Message, remote net.Addr) (code int, payload []byte)
+
+// A cached response, to answer retransmissions.
+type exchange struct {
+	response []byte
+	expires  time.Time
+}
+
+// Serve requests arriving on the connection until the context is done (when the connection is
+// closed).  Confirmable requests get a piggybacked acknowledgement, and non-confirmable requests a
+// non-confirmable response; retransmitted requests get the same response as the first time.  Since
+// every cached response lives for the same time, the keys are queued in order of expiry, so that
+// expired responses can be dropped from the front of the queue without a pass over the cache.
+func Serve(ctx context.Context, conn net.PacketConn, handler Handler) error {
+	seen := make(map[string]exchange)
+	var order []string
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buffer := make([]byte, 1500)
+	for {
+		n, remote, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		request, err := Parse(buffer[:n])
+		if err != nil || request.Type == Acknowledgement || request.Type == Reset {
+			continue
+		}
+		if request.Code == Empty { // Ping
+			if request.Type == Confirmable {
+				conn.WriteTo((&Message{Type: Reset, MessageID: request.MessageID}).Marshal(), remote)
+			}
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", remote, request.MessageID)
+		now := time.Now()
+		if cached, ok := seen[key]; ok && now.Before(cached.expires) {
+			conn.WriteTo(cached.response, remote)
+			continue
+		}
+		for len(order) > 0 && !now.Before(seen[order[0]].expires) {
+			delete(seen, order[0])
+			order = order[1:]
+		}
+		code, payload := handler(request, remote)
+		response := &Message{Type: NonConfirmable, Code: code, MessageID: request.MessageID, Token: request.Token, Payload: payload}
+		if request.Type == Confirmable {
+			response.Type = Acknowledgement
+		}
+		if len(payload) > 0 {
+			response.Options = []Option{{Number: OptionContentFormat, Value: Uint(FormatCBOR)}}
+		}
+		data := response.Marshal()
+		seen[key] = exchange{response: data, expires: now.Add(exchangeLifetime)}
+		order = append(order, key)
+		conn.WriteTo(data, remote)
+	}
+}
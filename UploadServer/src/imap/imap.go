@@ -0,0 +1,246 @@
+/*! @file imap.go
+ * @brief Minimal IMAP4rev1 (RFC 3501) client for collecting messages from a mailbox
+ *
+ * Only as much of IMAP as the email ingestion worker needs: connecting over TLS, logging in,
+ * selecting a mailbox, finding unseen messages, fetching a message whole, and marking it seen.
+ * Literals in responses are handled, but responses are otherwise only parsed as far as these
+ * commands need.  STARTTLS, IDLE, and authentication mechanisms other than LOGIN aren't supported.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The longest a single command (including its responses) may take.
+const commandTimeout = 2 * time.Minute
+
+// The largest literal accepted in a response.
+const maxLiteral = 64 << 20
+
+// ErrMalformed is returned for responses that can't be parsed.
+var ErrMalformed = errors.New("malformed IMAP response")
+
+// A Client is a connection to an IMAP server.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// A response is one untagged response from the server: its text (with each literal replaced by
+// its "{n}" marker), and the literals it contained, in order.
+type response struct {
+	text     string
+	literals [][]byte
+}
+
+// Connect to the IMAP server at the address given (host:port) over TLS, and wait for its greeting.
+func Dial(address string, config *tls.Config, timeout time.Duration) (*Client, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(timeout))
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting.text, "* OK") && !strings.HasPrefix(greeting.text, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("IMAP server refused connection: %s", greeting.text)
+	}
+	return c, nil
+}
+
+// Log in with the username and password given.
+func (c *Client) Login(username, password string) error {
+	user, err := quote(username)
+	if err != nil {
+		return err
+	}
+	pass, err := quote(password)
+	if err != nil {
+		return err
+	}
+	_, err = c.command("LOGIN " + user + " " + pass)
+	return err
+}
+
+// Select the mailbox given, so that messages can be fetched from it.
+func (c *Client) Select(mailbox string) error {
+	name, err := quote(mailbox)
+	if err != nil {
+		return err
+	}
+	_, err = c.command("SELECT " + name)
+	return err
+}
+
+// Provide the UIDs of the messages in the selected mailbox that haven't been seen.
+func (c *Client) Unseen() ([]uint32, error) {
+	responses, err := c.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var rtn []uint32
+	for _, r := range responses {
+		fields := strings.Fields(r.text)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+		for _, f := range fields[2:] {
+			uid, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, ErrMalformed
+			}
+			rtn = append(rtn, uint32(uid))
+		}
+	}
+	return rtn, nil
+}
+
+// Fetch the whole of the message with the UID given (headers and body, as RFC 5322 text), without
+// marking it seen.
+func (c *Client) Fetch(uid uint32) ([]byte, error) {
+	responses, err := c.command(fmt.Sprintf("UID FETCH %d BODY.PEEK[]", uid))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range responses {
+		if strings.Contains(strings.ToUpper(r.text), "FETCH") && len(r.literals) > 0 {
+			return r.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("no message with UID %d", uid)
+}
+
+// Mark the message with the UID given as seen, so that it isn't collected again.
+func (c *Client) MarkSeen(uid uint32) error {
+	_, err := c.command(fmt.Sprintf("UID STORE %d +FLAGS.SILENT (\\Seen)", uid))
+	return err
+}
+
+// Log out and close the connection.
+func (c *Client) Logout() error {
+	_, err := c.command("LOGOUT")
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close the connection without logging out.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Send a command, and collect the untagged responses to it until the tagged completion, which is an
+// error unless it's OK.
+func (c *Client) command(cmd string) ([]response, error) {
+	c.tag++
+	tag := fmt.Sprintf("w%04d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, cmd); err != nil {
+		return nil, err
+	}
+	var rtn []response
+	for {
+		r, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(r.text, tag+" ") {
+			rtn = append(rtn, r)
+			continue
+		}
+		status := strings.TrimPrefix(r.text, tag+" ")
+		if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+			verb, _, _ := strings.Cut(cmd, " ")
+			return nil, fmt.Errorf("IMAP %s failed: %s", verb, status)
+		}
+		return rtn, nil
+	}
+}
+
+// Read one response line, along with any literals that it contains.
+func (c *Client) readResponse() (response, error) {
+	var r response
+	var text strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return r, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		text.WriteString(line)
+		n, ok := literalSize(line)
+		if !ok {
+			r.text = text.String()
+			return r, nil
+		}
+		if n > maxLiteral {
+			return r, fmt.Errorf("IMAP literal of %d bytes is too large", n)
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return r, err
+		}
+		r.literals = append(r.literals, literal)
+	}
+}
+
+// Determine whether a line ends with a literal marker ("{n}"), returning the size of the literal.
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(line[open+1 : len(line)-1])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Quote a string for a command.
+func quote(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n") {
+		return "", errors.New("IMAP strings cannot contain line breaks")
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`, nil
+}
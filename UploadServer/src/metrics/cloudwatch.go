@@ -0,0 +1,107 @@
+/*! @file cloudwatch.go
+ * @brief Publishing of ingest metrics to Amazon CloudWatch
+ *
+ * For deployments standardised on AWS-native monitoring, the ingest metrics are sent to CloudWatch
+ * as custom metrics in the configured namespace, with the configured dimensions (e.g., to separate
+ * environments or instances).  Counts are sent for every interval, even if zero, so that alarms on
+ * missing data behave; latency is sent as a statistic set, when there were requests to time.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// A CloudWatch publishes the ingest metrics to CloudWatch.
+type CloudWatch struct {
+	client     *cloudwatch.Client
+	namespace  string
+	dimensions []types.Dimension
+}
+
+func NewCloudWatch(cfg aws.Config, endpoint *string, namespace string, dimensions map[string]string) (*CloudWatch, error) {
+	if len(namespace) == 0 {
+		return nil, fmt.Errorf("no namespace for CloudWatch metrics")
+	}
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c := &CloudWatch{
+		client:    cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) { o.BaseEndpoint = endpoint }),
+		namespace: namespace,
+	}
+	for _, name := range names {
+		c.dimensions = append(c.dimensions, types.Dimension{Name: aws.String(name), Value: aws.String(dimensions[name])})
+	}
+	return c, nil
+}
+
+func (c *CloudWatch) Publish(ctx context.Context, s Snapshot) error {
+	data := []types.MetricDatum{
+		c.count("UploadsAccepted", s.Time, s.Accepted, types.StandardUnitCount),
+		c.count("UploadsRejected", s.Time, s.Rejected, types.StandardUnitCount),
+		c.count("UploadBytes", s.Time, s.Bytes, types.StandardUnitBytes),
+		c.count("UploadFailures", s.Time, s.Failures, types.StandardUnitCount),
+	}
+	if s.Latency.Count > 0 {
+		data = append(data, types.MetricDatum{
+			MetricName: aws.String("UploadLatency"),
+			Dimensions: c.dimensions,
+			Timestamp:  aws.Time(s.Time),
+			Unit:       types.StandardUnitMilliseconds,
+			StatisticValues: &types.StatisticSet{
+				SampleCount: aws.Float64(float64(s.Latency.Count)),
+				Sum:         aws.Float64(milliseconds(s.Latency.Sum)),
+				Minimum:     aws.Float64(milliseconds(s.Latency.Min)),
+				Maximum:     aws.Float64(milliseconds(s.Latency.Max)),
+			},
+		})
+	}
+	_, err := c.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{Namespace: aws.String(c.namespace), MetricData: data})
+	if err != nil {
+		return fmt.Errorf("sending metrics to CloudWatch: %w", err)
+	}
+	return nil
+}
+
+func (c *CloudWatch) count(name string, t time.Time, value int64, unit types.StandardUnit) types.MetricDatum {
+	return types.MetricDatum{
+		MetricName: aws.String(name),
+		Dimensions: c.dimensions,
+		Timestamp:  aws.Time(t),
+		Value:      aws.Float64(float64(value)),
+		Unit:       unit,
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
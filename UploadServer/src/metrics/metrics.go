@@ -0,0 +1,147 @@
+/*! @file metrics.go
+ * @brief Collection of ingest metrics for publishing to monitoring services
+ *
+ * The Prometheus-style metrics at /metrics are scraped, and describe what's stored.  Deployments
+ * standardised on other monitoring services need the core ingest metrics (uploads accepted and
+ * rejected, bytes received, server-side failures, and upload latency) pushed to them instead.  An
+ * Ingest collects these as uploads are handled, and Run publishes what has been collected at each
+ * interval to the configured Publishers, starting afresh each time.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A Snapshot holds the ingest metrics for an interval.
+type Snapshot struct {
+	Time     time.Time // End of the interval
+	Accepted int64     // Uploads accepted
+	Rejected int64     // Uploads rejected (for any reason)
+	Bytes    int64     // Bytes in the uploads accepted
+	Failures int64     // Server-side failures (e.g., storage or notification errors)
+	Latency  Latency   // Time taken to handle upload requests
+}
+
+// A Latency summarises the time taken to handle the requests in an interval.
+type Latency struct {
+	Count int64
+	Sum   time.Duration
+	Min   time.Duration
+	Max   time.Duration
+}
+
+func (l *Latency) add(d time.Duration) {
+	if l.Count == 0 || d < l.Min {
+		l.Min = d
+	}
+	if d > l.Max {
+		l.Max = d
+	}
+	l.Count++
+	l.Sum += d
+}
+
+// An Ingest collects the ingest metrics until they're taken for publishing.
+type Ingest struct {
+	mu      sync.Mutex
+	current Snapshot
+}
+
+func NewIngest() *Ingest {
+	return &Ingest{}
+}
+
+// Count an upload, accepted or rejected, with the size of the file.
+func (i *Ingest) Upload(accepted bool, size int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if accepted {
+		i.current.Accepted++
+		i.current.Bytes += size
+	} else {
+		i.current.Rejected++
+	}
+}
+
+// Count a server-side failure in handling an upload.
+func (i *Ingest) Failure() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.current.Failures++
+}
+
+// Add the time taken to handle an upload request.
+func (i *Ingest) Latency(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.current.Latency.add(d)
+}
+
+// Take the metrics collected so far, starting afresh.
+func (i *Ingest) Take() Snapshot {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	rtn := i.current
+	rtn.Time = time.Now().UTC()
+	i.current = Snapshot{}
+	return rtn
+}
+
+// A Publisher sends the metrics for an interval to a monitoring service.
+type Publisher interface {
+	Publish(ctx context.Context, s Snapshot) error
+}
+
+// The time allowed for each publisher to send the metrics.
+const publishTimeout = 30 * time.Second
+
+// Publish the metrics collected to each of the publishers at the interval given, until the context
+// is cancelled, when the metrics collected since the last interval are published before returning.
+// Metrics that can't be published are dropped, with an error logged.
+func Run(ctx context.Context, interval time.Duration, ingest *Ingest, publishers []Publisher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			publish(context.Background(), ingest.Take(), publishers)
+			return
+		case <-ticker.C:
+			publish(ctx, ingest.Take(), publishers)
+		}
+	}
+}
+
+func publish(ctx context.Context, s Snapshot, publishers []Publisher) {
+	for _, p := range publishers {
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		if err := p.Publish(ctx, s); err != nil {
+			support.Errorf("failed to publish metrics: %s\n", err)
+		}
+		cancel()
+	}
+}
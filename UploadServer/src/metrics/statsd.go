@@ -0,0 +1,90 @@
+/*! @file statsd.go
+ * @brief Publishing of ingest metrics over the StatsD protocol
+ *
+ * Some host institutions run a StatsD-compatible agent (e.g., Datadog's) on every server, and
+ * require services to report through it.  The ingest metrics for each interval are sent to the agent
+ * as a single UDP packet: counts as counters, and latency as gauges of the mean and maximum.  Tags
+ * are added in the DogStatsD format ("|#name:value,..."), which agents that don't support them
+ * generally ignore.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A StatsD publishes the ingest metrics to a StatsD agent.
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	tags   string // Formatted for appending to each metric, or empty
+}
+
+func NewStatsD(address, prefix string, tags map[string]string) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("StatsD agent: %w", err)
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := &StatsD{conn: conn, prefix: prefix}
+	for i, name := range names {
+		if i == 0 {
+			s.tags = "|#"
+		} else {
+			s.tags += ","
+		}
+		s.tags += name + ":" + tags[name]
+	}
+	return s, nil
+}
+
+func (s *StatsD) Publish(ctx context.Context, snapshot Snapshot) error {
+	var b strings.Builder
+	s.line(&b, "uploads.accepted", float64(snapshot.Accepted), "c")
+	s.line(&b, "uploads.rejected", float64(snapshot.Rejected), "c")
+	s.line(&b, "uploads.bytes", float64(snapshot.Bytes), "c")
+	s.line(&b, "uploads.failures", float64(snapshot.Failures), "c")
+	if l := snapshot.Latency; l.Count > 0 {
+		s.line(&b, "uploads.latency_ms.mean", milliseconds(l.Sum)/float64(l.Count), "g")
+		s.line(&b, "uploads.latency_ms.max", milliseconds(l.Max), "g")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := s.conn.Write([]byte(strings.TrimSuffix(b.String(), "\n"))); err != nil {
+		return fmt.Errorf("sending metrics to StatsD agent: %w", err)
+	}
+	return nil
+}
+
+func (s *StatsD) line(b *strings.Builder, name string, value float64, kind string) {
+	fmt.Fprintf(b, "%s%s:%s|%s%s\n", s.prefix, name, strconv.FormatFloat(value, 'f', -1, 64), kind, s.tags)
+}
@@ -0,0 +1,129 @@
+/*! @file aws.go
+ * @brief Notification of the processing chain through AWS SNS and SQS
+ *
+ * The WIBL processing chain on AWS is triggered by SNS topics (and can equally be fed from SQS
+ * queues).  These notifiers publish a message for each new file, in either the chain's native format
+ * or the S3 event format (see message.go).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package notify
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// The message attribute giving the trace ID of the upload, so that subscribers can filter or log by it.
+const traceAttribute = "trace_id"
+
+// An SNS notifier publishes a message to a topic for each new file.
+type SNS struct {
+	client *sns.Client
+	topic  string
+	format string
+	region string
+}
+
+// Generate an SNS notifier for the topic given, with an optional endpoint override.
+func NewSNS(cfg aws.Config, endpoint *string, topic, format string) (*SNS, error) {
+	format, err := checkFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	client := sns.NewFromConfig(cfg, func(o *sns.Options) { o.BaseEndpoint = endpoint })
+	return &SNS{client: client, topic: topic, format: format, region: cfg.Region}, nil
+}
+
+func (n *SNS) Notify(ctx context.Context, event Event) error {
+	msg, err := message(event, n.format, n.region)
+	if err != nil {
+		return err
+	}
+	input := &sns.PublishInput{TopicArn: &n.topic, Message: &msg}
+	if len(event.Trace) > 0 {
+		input.MessageAttributes = map[string]snstypes.MessageAttributeValue{
+			traceAttribute: {DataType: aws.String("String"), StringValue: aws.String(event.Trace)},
+		}
+	}
+	_, err = n.client.Publish(ctx, input)
+	if err != nil {
+		return fmt.Errorf("publishing %s to SNS topic: %w", event.Key, err)
+	}
+	return nil
+}
+
+// Check that the topic exists and can be read with the credentials available.
+func (n *SNS) Check(ctx context.Context) error {
+	if _, err := n.client.GetTopicAttributes(ctx, &sns.GetTopicAttributesInput{TopicArn: &n.topic}); err != nil {
+		return fmt.Errorf("checking SNS topic: %w", err)
+	}
+	return nil
+}
+
+// An SQS notifier sends a message to a queue for each new file.
+type SQS struct {
+	client *sqs.Client
+	queue  string
+	format string
+	region string
+}
+
+// Generate an SQS notifier for the queue given, with an optional endpoint override.
+func NewSQS(cfg aws.Config, endpoint *string, queue, format string) (*SQS, error) {
+	format, err := checkFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	client := sqs.NewFromConfig(cfg, func(o *sqs.Options) { o.BaseEndpoint = endpoint })
+	return &SQS{client: client, queue: queue, format: format, region: cfg.Region}, nil
+}
+
+func (n *SQS) Notify(ctx context.Context, event Event) error {
+	msg, err := message(event, n.format, n.region)
+	if err != nil {
+		return err
+	}
+	input := &sqs.SendMessageInput{QueueUrl: &n.queue, MessageBody: &msg}
+	if len(event.Trace) > 0 {
+		input.MessageAttributes = map[string]sqstypes.MessageAttributeValue{
+			traceAttribute: {DataType: aws.String("String"), StringValue: aws.String(event.Trace)},
+		}
+	}
+	_, err = n.client.SendMessage(ctx, input)
+	if err != nil {
+		return fmt.Errorf("sending %s to SQS queue: %w", event.Key, err)
+	}
+	return nil
+}
+
+// Check that the queue exists and can be read with the credentials available.
+func (n *SQS) Check(ctx context.Context) error {
+	if _, err := n.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: &n.queue}); err != nil {
+		return fmt.Errorf("checking SQS queue: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*! @file manager.go
+ * @brief Notification of the wibl-python processing chain through its REST interfaces
+ *
+ * Installations that run the wibl-python processing chain on-premises (rather than as AWS Lambdas)
+ * need to be told about new files directly, rather than through S3 events.  This notifier does what
+ * the submission Lambda would: it registers the file with the wibl-manager status database (POST to
+ * /wibl/<fileid>, with the size in MB), and then posts the same message that the chain's SNS
+ * notifier generates ({"bucket", "filename", "size"}) to a queue end-point, from which the
+ * processing workers take files.  Either can be omitted from the configuration.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A Manager notifies the wibl-python processing manager and queue.
+type Manager struct {
+	manager string // Base URL for the wibl-manager REST API, ending in '/'
+	queue   string // URL to post processing requests to
+	client  *http.Client
+}
+
+func NewManager(config support.ManagerParam) (*Manager, error) {
+	m := &Manager{queue: config.QueueURL, client: &http.Client{Timeout: 30 * time.Second}}
+	if config.TimeoutSeconds > 0 {
+		m.client.Timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	if len(config.URL) > 0 {
+		if _, err := url.Parse(config.URL); err != nil {
+			return nil, err
+		}
+		m.manager = strings.TrimSuffix(config.URL, "/") + "/"
+	}
+	if len(m.queue) > 0 {
+		if _, err := url.Parse(m.queue); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Manager) Notify(ctx context.Context, event Event) error {
+	if len(m.manager) > 0 {
+		// The manager expects the size in MB, and responds 201 (Created) on success.
+		size := map[string]float64{"size": float64(event.Size) / (1024 * 1024)}
+		if err := m.post(ctx, m.manager+"wibl/"+url.PathEscape(event.Key), size, http.StatusCreated); err != nil {
+			return fmt.Errorf("registering %s with processing manager: %w", event.Key, err)
+		}
+	}
+	if len(m.queue) > 0 {
+		if err := m.post(ctx, m.queue, nativeMessage(event), 0); err != nil {
+			return fmt.Errorf("queueing %s for processing: %w", event.Key, err)
+		}
+	}
+	return nil
+}
+
+// Check that the processing manager and queue are responding.  Any response other than a server
+// error will do, since the end-points only accept POST.
+func (m *Manager) Check(ctx context.Context) error {
+	for _, target := range []string{m.manager, m.queue} {
+		if len(target) == 0 {
+			continue
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+		if err != nil {
+			return err
+		}
+		response, err := m.client.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 500 {
+			return fmt.Errorf("%s responded %s", target, response.Status)
+		}
+	}
+	return nil
+}
+
+// Post a JSON body to the URL given, checking for the status code expected (or any 2xx status if
+// zero).
+func (m *Manager) post(ctx context.Context, target string, body any, expected int) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := m.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if (expected != 0 && response.StatusCode != expected) ||
+		(expected == 0 && (response.StatusCode < 200 || response.StatusCode > 299)) {
+		return fmt.Errorf("%s responded %s", target, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*! @file message.go
+ * @brief Message formats understood by the WIBL processing chain
+ *
+ * The processing Lambdas in wibl-python accept two formats of message: the chain's own "native"
+ * message ({"bucket", "filename", "size"}, as generated by its SNS notifier between stages), and
+ * the S3 event notification that AWS generates when an object is created in a bucket.  Deployments
+ * where the chain is triggered directly by S3 events can have the monitor inserted upstream without
+ * changing any Lambda code by having it generate the S3 event format instead.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The message formats that can be generated.
+const (
+	FormatNative  = "native"
+	FormatS3Event = "s3-event"
+)
+
+// Check that the format named is one that can be generated, returning the default for an empty name.
+func checkFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return FormatNative, nil
+	case FormatNative, FormatS3Event:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown message format %q", format)
+}
+
+// Generate the message for an event in the format given.  The region is only used in the S3
+// event format.
+func message(event Event, format, region string) (string, error) {
+	var msg any
+	switch format {
+	case FormatS3Event:
+		msg = s3Event(event, region)
+	default:
+		msg = nativeMessage(event)
+	}
+	data, err := json.Marshal(msg)
+	return string(data), err
+}
+
+// Generate the processing chain's own message for an event.  The key ID is only given for files
+// that the logger encrypted, and the compression for files stored compressed, so that the chain
+// knows to decrypt or decompress them.  The trace ID is given for the chain to report back with, and
+// the ID that the logger gave for the upload, if it gave one, so that the two can be matched up.
+func nativeMessage(event Event) map[string]any {
+	msg := map[string]any{"bucket": event.Location, "filename": event.Key, "size": event.Size}
+	if len(event.KeyID) > 0 {
+		msg["key_id"] = event.KeyID
+	}
+	if len(event.Compress) > 0 {
+		msg["compression"] = event.Compress
+	}
+	if len(event.Trace) > 0 {
+		msg[traceAttribute] = event.Trace
+	}
+	if len(event.Correlation) > 0 {
+		msg["correlation_id"] = event.Correlation
+	}
+	return msg
+}
+
+type s3EventMessage struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventVersion      string            `json:"eventVersion"`
+	EventSource       string            `json:"eventSource"`
+	AWSRegion         string            `json:"awsRegion"`
+	EventTime         string            `json:"eventTime"`
+	EventName         string            `json:"eventName"`
+	UserIdentity      principal         `json:"userIdentity"`
+	RequestParameters map[string]string `json:"requestParameters"`
+	ResponseElements  map[string]string `json:"responseElements"`
+	S3                s3Entity          `json:"s3"`
+}
+
+type principal struct {
+	PrincipalID string `json:"principalId"`
+}
+
+type s3Entity struct {
+	SchemaVersion   string   `json:"s3SchemaVersion"`
+	ConfigurationID string   `json:"configurationId"`
+	Bucket          s3Bucket `json:"bucket"`
+	Object          s3Object `json:"object"`
+}
+
+type s3Bucket struct {
+	Name          string    `json:"name"`
+	OwnerIdentity principal `json:"ownerIdentity"`
+	ARN           string    `json:"arn"`
+}
+
+type s3Object struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"eTag"`
+	Sequencer string `json:"sequencer"`
+}
+
+// Generate the response elements of an S3 event for the file.  The trace ID has an element of its
+// own, since x-amz-id-2 is S3's host ID, which consumers may parse as such.
+func responseElements(event Event) map[string]string {
+	rtn := map[string]string{"x-amz-request-id": event.UUID, "x-amz-id-2": "wibl-monitor"}
+	if len(event.Trace) > 0 {
+		rtn["x-wibl-"+traceAttribute] = event.Trace
+	}
+	return rtn
+}
+
+// Generate an S3 ObjectCreated:Put event for the file.  As with S3, the key is URL-encoded with
+// spaces as '+' (the chain decodes it with unquote_plus).
+func s3Event(event Event, region string) s3EventMessage {
+	return s3EventMessage{Records: []s3EventRecord{{
+		EventVersion:      "2.1",
+		EventSource:       "aws:s3",
+		AWSRegion:         region,
+		EventTime:         event.Received.UTC().Format("2006-01-02T15:04:05.000Z"),
+		EventName:         "ObjectCreated:Put",
+		UserIdentity:      principal{PrincipalID: "wibl-monitor"},
+		RequestParameters: map[string]string{"sourceIPAddress": ""},
+		ResponseElements:  responseElements(event),
+		S3: s3Entity{
+			SchemaVersion:   "1.0",
+			ConfigurationID: "wibl-monitor",
+			Bucket: s3Bucket{
+				Name: event.Location,
+				ARN:  "arn:aws:s3:::" + event.Location,
+			},
+			Object: s3Object{
+				Key:       strings.ReplaceAll(url.QueryEscape(event.Key), "%2F", "/"),
+				Size:      event.Size,
+				ETag:      strings.ToLower(event.MD5),
+				Sequencer: fmt.Sprintf("%016X", event.Received.UnixNano()),
+			},
+		},
+	}}}
+}
@@ -0,0 +1,127 @@
+/*! @file notify.go
+ * @brief Notification of the processing chain when new files are stored
+ *
+ * Once a file has been accepted and stored, the processing chain has to be told that it's there.
+ * How depends on the deployment (e.g., SNS topics for the AWS processing chain, or the wibl-python
+ * processing manager for on-premises installations), so each mechanism is a Notifier, and the configuration determines which are
+ * used.  All of the notifiers configured are called for each file.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/cloud"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// An Event describes a file that has been stored and is ready for processing.
+type Event struct {
+	UUID        string    `json:"uuid"`
+	Logger      string    `json:"logger"`
+	Location    string    `json:"location"` // Where the file is stored (directory or bucket)
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	MD5         string    `json:"md5"`
+	Received    time.Time `json:"received"`
+	KeyID       string    `json:"key_id,omitempty"`      // Key the file is encrypted with, if the logger encrypted it
+	Compress    string    `json:"compress,omitempty"`    // Compression of the stored object, if any
+	Trace       string    `json:"trace,omitempty"`       // Trace ID of the upload, to be given back with processing outcomes
+	Correlation string    `json:"correlation,omitempty"` // ID the logger gave for the upload, if any
+}
+
+// A Notifier tells some part of the processing chain about a new file, giving up if the context
+// is cancelled.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// A Checker is a Notifier that can check that its target is reachable, without notifying it of
+// anything (e.g., for readiness checks).
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// A Multi calls each of a list of notifiers in turn.  All of the notifiers are called, even if some
+// fail; the error returned reports all of the failures.
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check each of the notifiers that can be checked, reporting all of the failures.
+func (m Multi) Check(ctx context.Context) error {
+	var errs []error
+	for _, n := range m {
+		if c, ok := n.(Checker); ok {
+			if err := c.Check(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Generate the notifiers specified in the configuration.  If none are configured, the result
+// is an empty Multi, which does nothing.
+func New(config support.NotifyParam, aws support.AWSParam) (Multi, error) {
+	var rtn Multi
+	if len(config.Manager.URL) > 0 || len(config.Manager.QueueURL) > 0 {
+		m, err := NewManager(config.Manager)
+		if err != nil {
+			return nil, fmt.Errorf("processing manager: %w", err)
+		}
+		rtn = append(rtn, m)
+	}
+	if len(config.SNS.Target) == 0 && len(config.SQS.Target) == 0 {
+		return rtn, nil
+	}
+	cfg, err := cloud.AWSConfig(aws)
+	if err != nil {
+		return nil, fmt.Errorf("AWS configuration: %w", err)
+	}
+	if len(config.SNS.Target) > 0 {
+		n, err := NewSNS(cfg, cloud.Endpoint(aws, "sns"), config.SNS.Target, config.SNS.Format)
+		if err != nil {
+			return nil, fmt.Errorf("SNS: %w", err)
+		}
+		rtn = append(rtn, n)
+	}
+	if len(config.SQS.Target) > 0 {
+		n, err := NewSQS(cfg, cloud.Endpoint(aws, "sqs"), config.SQS.Target, config.SQS.Format)
+		if err != nil {
+			return nil, fmt.Errorf("SQS: %w", err)
+		}
+		rtn = append(rtn, n)
+	}
+	return rtn, nil
+}
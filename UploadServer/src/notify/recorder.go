@@ -0,0 +1,63 @@
+/*! @file recorder.go
+ * @brief Notifier that records events rather than sending them, for development
+ *
+ * In the server's mock mode (see wibl-monitor.go), nothing is sent to the processing chain; instead,
+ * the events that would have been sent are kept so that a developer can check what the server did.
+ * Only the most recent events are kept.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package notify
+
+import (
+	"context"
+	"sync"
+)
+
+// A Recorder keeps the most recent events that it is asked to send.
+type Recorder struct {
+	mu     sync.Mutex
+	limit  int
+	events []Event
+}
+
+// Generate a recorder that keeps the last limit events.
+func NewRecorder(limit int) *Recorder {
+	return &Recorder{limit: limit}
+}
+
+func (n *Recorder) Notify(ctx context.Context, event Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+	if len(n.events) > n.limit {
+		n.events = n.events[len(n.events)-n.limit:]
+	}
+	return nil
+}
+
+// Provide the events recorded, oldest first.
+func (n *Recorder) Events() []Event {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rtn := make([]Event, len(n.events))
+	copy(rtn, n.events)
+	return rtn
+}
@@ -0,0 +1,59 @@
+/*! @file retry.go
+ * @brief Retries of notifications that fail
+ *
+ * Each notifier is retried separately (see support/retry.go), so that a target that fails
+ * transiently doesn't cause the others to be notified twice.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package notify
+
+import (
+	"context"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// A retrying notifier repeats failed notifications with the retrier given.
+type retrying struct {
+	notifier Notifier
+	retrier  *support.Retrier
+}
+
+// Wrap each of the notifiers given so that failed notifications are retried.
+func WithRetry(m Multi, retrier *support.Retrier) Multi {
+	rtn := make(Multi, 0, len(m))
+	for _, n := range m {
+		rtn = append(rtn, &retrying{notifier: n, retrier: retrier})
+	}
+	return rtn
+}
+
+func (r *retrying) Notify(ctx context.Context, event Event) error {
+	return r.retrier.Do(ctx, "notify", func(ctx context.Context) error { return r.notifier.Notify(ctx, event) })
+}
+
+// Check the notifier, if it can be checked, without retrying.
+func (r *retrying) Check(ctx context.Context) error {
+	if c, ok := r.notifier.(Checker); ok {
+		return c.Check(ctx)
+	}
+	return nil
+}
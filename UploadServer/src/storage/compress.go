@@ -0,0 +1,128 @@
+/*! @file compress.go
+ * @brief Compression of stored objects
+ *
+ * Objects can be compressed with zstd before they're stored, which cuts the cost of keeping files
+ * for a long time, or on a small local disk.  The object's metadata records the compression, and the
+ * size and MD5 digest of the data before compression, so that backends wrapped with Decompressing
+ * give the original data back to anything that reads the object.  Sizes from listings are only
+ * corrected where the backend lists metadata (i.e., not for S3).  Anything that reads stored objects
+ * directly (e.g., the processing chain) has to decompress them itself; notifications say when it must.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compression algorithms available, by name.
+const CompressZstd = "zstd"
+
+// The metadata keys that describe a compressed object.
+const (
+	MetaCompression  = "compression"
+	MetaOriginalSize = "original_size"
+	MetaOriginalMD5  = "original_md5"
+)
+
+// The encoder and decoder are safe for concurrent use with EncodeAll and DecodeAll.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Compress data for storage with the algorithm named, returning the compressed data and a copy of
+// the metadata with the compression recorded.
+func Compress(algorithm string, data []byte, metadata map[string]string) ([]byte, map[string]string, error) {
+	if algorithm != CompressZstd {
+		return nil, nil, fmt.Errorf("unknown compression %q", algorithm)
+	}
+	rtn := maps.Clone(metadata)
+	if rtn == nil {
+		rtn = make(map[string]string)
+	}
+	rtn[MetaCompression] = algorithm
+	rtn[MetaOriginalSize] = strconv.Itoa(len(data))
+	rtn[MetaOriginalMD5] = fmt.Sprintf("%X", md5.Sum(data))
+	return zstdEncoder.EncodeAll(data, nil), rtn, nil
+}
+
+// A Decompressing backend gives the original data for objects that were compressed before they were
+// stored; other objects are read as they are.
+type Decompressing struct {
+	Backend
+}
+
+// Wrap a backend so that compressed objects are decompressed when they're read.
+func NewDecompressing(backend Backend) *Decompressing {
+	return &Decompressing{Backend: backend}
+}
+
+// Provide the backend that holds the objects as they're stored, without decompression, so that they
+// can be copied as they are.
+func Underlying(backend Backend) Backend {
+	if d, ok := backend.(*Decompressing); ok {
+		return d.Backend
+	}
+	return backend
+}
+
+func (d *Decompressing) Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	object, info, err := d.Backend.Get(ctx, key)
+	if err != nil || info.Metadata[MetaCompression] == "" {
+		return object, info, err
+	}
+	defer object.Close()
+	if algorithm := info.Metadata[MetaCompression]; algorithm != CompressZstd {
+		return nil, ObjectInfo{}, fmt.Errorf("%s: unknown compression %q", key, algorithm)
+	}
+	compressed, err := io.ReadAll(object)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	data, err := zstdDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("%s: decompressing: %w", key, err)
+	}
+	info.Size = int64(len(data))
+	return nopCloser{bytes.NewReader(data)}, info, nil
+}
+
+func (d *Decompressing) SetClass(ctx context.Context, key, class string) error {
+	return SetClass(ctx, d.Backend, key, class)
+}
+
+func (d *Decompressing) List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error {
+	return d.Backend.List(ctx, prefix, func(info ObjectInfo) error {
+		if size, err := strconv.ParseInt(info.Metadata[MetaOriginalSize], 10, 64); err == nil {
+			info.Size = size
+		}
+		return fn(info)
+	})
+}
@@ -0,0 +1,391 @@
+/*! @file encrypt.go
+ * @brief Encryption at rest for the local backend
+ *
+ * Shore stations are often in public harbour offices, where the hardware might walk away, so the
+ * local backend can encrypt the objects it writes.  Each object is encrypted with its own AES-256
+ * data key, which is stored in the object's header wrapped by a key encryption key: either a key
+ * held in a file on the server, or an AWS KMS key (in which case the data key is generated, and
+ * unwrapped, by KMS).
+ *
+ * The data is encrypted with AES-GCM in fixed-size chunks, so that objects can be read (and
+ * seeked) without decrypting all of them first.  Each chunk's nonce is a random prefix for the
+ * object, the chunk's index, and a flag marking the last chunk, so that chunks can't be re-ordered
+ * or the object truncated without detection; the header is authenticated with every chunk.  Objects
+ * written before encryption was enabled are read as they are.  The metadata sidecars are not
+ * encrypted.  Other data (e.g., backups of the state directory) can be encrypted in the same way,
+ * with a magic number of its own.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+
+	"ccom.unh.edu/wibl-monitor/src/cloud"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The magic number at the start of an encrypted object, and of other data encrypted in the same way
+// (which is distinct, so that the local backend doesn't take such data stored in it for one of its
+// own encrypted objects).
+const (
+	encryptedMagic = "WIBLENC1"
+	sealedMagic    = "WIBLSEA1"
+)
+
+// The size of each encrypted chunk of plaintext, and the overhead that encryption adds to it.
+const (
+	chunkSize     = 64 * 1024
+	chunkOverhead = 16 // GCM tag
+	noncePrefix   = 7
+)
+
+// A KeySource provides the data keys with which objects are encrypted.  WrapKey generates a new data
+// key, returning it along with the wrapped form that's stored with the object; UnwrapKey recovers
+// the data key from the wrapped form.
+type KeySource interface {
+	WrapKey(ctx context.Context) (key, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// Generate the key source specified in the configuration, or nil if encryption isn't configured.
+func NewKeySource(config support.EncryptionParam, param support.AWSParam) (KeySource, error) {
+	switch {
+	case len(config.KeyFile) > 0 && len(config.KMSKey) > 0:
+		return nil, errors.New("encryption can use a key file or a KMS key, but not both")
+	case len(config.KeyFile) > 0:
+		return newFileKey(config.KeyFile)
+	case len(config.KMSKey) > 0:
+		cfg, err := cloud.AWSConfig(param)
+		if err != nil {
+			return nil, err
+		}
+		client := kms.NewFromConfig(cfg, func(o *kms.Options) {
+			o.BaseEndpoint = cloud.Endpoint(param, "kms")
+		})
+		return &kmsKey{client: client, id: config.KMSKey}, nil
+	}
+	return nil, nil
+}
+
+// A fileKey wraps data keys with AES-GCM under a key read from a file.
+type fileKey struct {
+	aead cipher.AEAD
+}
+
+// Read a key encryption key from a file, as 64 hexadecimal digits.
+func newFileKey(filename string) (*fileKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: key must be 64 hexadecimal digits", filename)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &fileKey{aead: aead}, nil
+}
+
+func (k *fileKey) WrapKey(ctx context.Context) ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return key, k.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (k *fileKey) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(wrapped) < size {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return k.aead.Open(nil, wrapped[:size], wrapped[size:], nil)
+}
+
+// A kmsKey has data keys generated and unwrapped by AWS KMS.
+type kmsKey struct {
+	client *kms.Client
+	id     string
+}
+
+func (k *kmsKey) WrapKey(ctx context.Context) ([]byte, []byte, error) {
+	out, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{KeyId: aws.String(k.id), KeySpec: types.DataKeySpecAes256})
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (k *kmsKey) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := k.client.Decrypt(ctx, &kms.DecryptInput{KeyId: aws.String(k.id), CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Generate the nonce for a chunk of an object.
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefix:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt an object with a new data key.  The result is the header (the magic number, chunk size,
+// wrapped key, and nonce prefix) followed by the encrypted chunks.  There's always at least one
+// chunk, so that an empty object still has a last chunk.
+func encryptObject(ctx context.Context, keys KeySource, data []byte) ([]byte, error) {
+	return encrypt(ctx, keys, encryptedMagic, data)
+}
+
+// Encrypt data with a new data key, with the magic number given at the start of its header.
+func encrypt(ctx context.Context, keys KeySource, magic string, data []byte) ([]byte, error) {
+	key, wrapped, err := keys.WrapKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generating data key: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	var header bytes.Buffer
+	header.WriteString(magic)
+	binary.Write(&header, binary.BigEndian, uint32(chunkSize))
+	binary.Write(&header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+	prefix := make([]byte, noncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header.Write(prefix)
+
+	chunks := max((len(data)+chunkSize-1)/chunkSize, 1)
+	rtn := make([]byte, 0, header.Len()+len(data)+chunks*chunkOverhead)
+	rtn = append(rtn, header.Bytes()...)
+	for i := 0; i < chunks; i++ {
+		plain := data[i*chunkSize : min((i+1)*chunkSize, len(data))]
+		rtn = aead.Seal(rtn, chunkNonce(prefix, uint32(i), i == chunks-1), plain, header.Bytes())
+	}
+	return rtn, nil
+}
+
+// Encrypt data that's kept other than as an object in the local backend (e.g., a backup archive) as
+// if it were one, with a new data key from the key source given.
+func Encrypt(ctx context.Context, keys KeySource, data []byte) ([]byte, error) {
+	return encrypt(ctx, keys, sealedMagic, data)
+}
+
+// Decrypt data encrypted by Encrypt().  Data that isn't encrypted is returned as it is.
+func Decrypt(ctx context.Context, keys KeySource, data []byte) ([]byte, error) {
+	header, err := readMagicHeader(bytes.NewReader(data), sealedMagic)
+	if err != nil || header == nil {
+		return data, err
+	}
+	if keys == nil {
+		return nil, errors.New("data is encrypted, but no encryption key is configured")
+	}
+	key, err := keys.UnwrapKey(ctx, header.key)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	body := data[len(header.raw):]
+	stride := header.chunk + chunkOverhead
+	chunks := max((len(body)+stride-1)/stride, 1)
+	rtn := make([]byte, 0, header.plainSize(int64(len(data))))
+	for i := 0; i < chunks; i++ {
+		sealed := body[i*stride : min((i+1)*stride, len(body))]
+		if rtn, err = aead.Open(rtn, chunkNonce(header.prefix, uint32(i), i == chunks-1), sealed, header.raw); err != nil {
+			return nil, fmt.Errorf("chunk %d of encrypted data doesn't authenticate", i)
+		}
+	}
+	return rtn, nil
+}
+
+// An objectHeader describes an encrypted object.
+type objectHeader struct {
+	raw    []byte // For authentication of the chunks
+	chunk  int
+	key    []byte // Wrapped
+	prefix []byte
+}
+
+// Read the header of an object, if it's encrypted.  The result is nil (with no error) if it isn't.
+func readHeader(r io.Reader) (*objectHeader, error) {
+	return readMagicHeader(r, encryptedMagic)
+}
+
+// Read the header of data encrypted with the magic number given, if it is.
+func readMagicHeader(r io.Reader, magic string) (*objectHeader, error) {
+	fixed := make([]byte, len(magic)+6)
+	if _, err := io.ReadFull(r, fixed); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if string(fixed[:len(magic)]) != magic {
+		return nil, nil
+	}
+	chunk := int(binary.BigEndian.Uint32(fixed[len(magic):]))
+	keyLen := int(binary.BigEndian.Uint16(fixed[len(magic)+4:]))
+	rest := make([]byte, keyLen+noncePrefix)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	if chunk <= 0 {
+		return nil, errors.New("bad chunk size in encryption header")
+	}
+	return &objectHeader{
+		raw:    append(fixed, rest...),
+		chunk:  chunk,
+		key:    rest[:keyLen],
+		prefix: rest[keyLen:],
+	}, nil
+}
+
+// Compute the size of the plaintext of an encrypted object from the size of the file.
+func (h *objectHeader) plainSize(fileSize int64) int64 {
+	body := fileSize - int64(len(h.raw))
+	stride := int64(h.chunk + chunkOverhead)
+	chunks := max((body+stride-1)/stride, 1)
+	return max(body-chunks*chunkOverhead, 0)
+}
+
+// A decrypter reads the plaintext of an encrypted object, a chunk at a time.
+type decrypter struct {
+	f      *os.File
+	header *objectHeader
+	aead   cipher.AEAD
+	size   int64 // Of the plaintext
+	pos    int64
+	index  int64 // Of the chunk in plain, or -1 if none
+	plain  []byte
+}
+
+// Open an encrypted object for reading, given its header and size.
+func newDecrypter(ctx context.Context, keys KeySource, f *os.File, header *objectHeader, size int64) (*decrypter, error) {
+	if keys == nil {
+		return nil, errors.New("object is encrypted, but no encryption key is configured")
+	}
+	key, err := keys.UnwrapKey(ctx, header.key)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	d := &decrypter{f: f, header: header, aead: aead, size: size, index: -1}
+	// Checking the last chunk up front means that a truncated object is detected on opening.
+	if err := d.load(max(d.size-1, 0) / int64(header.chunk)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	index := d.pos / int64(d.header.chunk)
+	if index != d.index {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-index*int64(d.header.chunk):])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// Read and decrypt the chunk given.
+func (d *decrypter) load(index int64) error {
+	stride := int64(d.header.chunk + chunkOverhead)
+	offset := int64(len(d.header.raw)) + index*stride
+	last := (index+1)*int64(d.header.chunk) >= d.size
+	sealed := make([]byte, stride)
+	n, err := d.f.ReadAt(sealed, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	nonce := chunkNonce(d.header.prefix, uint32(index), last)
+	if d.plain, err = d.aead.Open(d.plain[:0], nonce, sealed[:n], d.header.raw); err != nil {
+		return fmt.Errorf("chunk %d of encrypted object doesn't authenticate", index)
+	}
+	d.index = index
+	return nil
+}
+
+func (d *decrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decrypter) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,219 @@
+/*! @file local.go
+ * @brief Storage backend using the local filesystem
+ *
+ * For demonstration, or small deployments (e.g., a shore station with no cloud connection), the
+ * uploaded files can be kept in a directory on the server.  Each object is a file under the root
+ * directory named by its key, with the object's metadata in a sidecar file alongside it.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The suffix for the sidecar file that holds an object's metadata.
+const metadataSuffix = ".meta"
+
+// A Local backend stores objects as files in a directory, encrypting them if it has a source of keys
+// (see encrypt.go).
+type Local struct {
+	root string
+	keys KeySource
+}
+
+// Generate a local backend rooted at the directory given, creating it if required.  Objects are
+// encrypted with keys from the source given, unless it's nil.
+func NewLocal(root string, keys KeySource) (*Local, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &Local{root: root, keys: keys}, nil
+}
+
+func (l *Local) Location() string {
+	return l.root
+}
+
+// Convert a key to a path under the root, refusing keys that would escape the root.
+func (l *Local) path(key string) (string, error) {
+	if !fs.ValidPath(key) || strings.HasSuffix(key, metadataSuffix) {
+		return "", errors.New("invalid object key")
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+func (l *Local) Put(ctx context.Context, key string, data []byte, metadata map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if l.keys != nil {
+		if data, err = encryptObject(ctx, l.keys, data); err != nil {
+			return err
+		}
+	}
+	// The object is written under a temporary name and renamed into place so that readers never
+	// see a partial object; the metadata is written first so that it's there when the object is.
+	if err := writeAtomic(path+metadataSuffix, meta); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err == nil {
+		err = writeAtomic(path, data)
+	}
+	if err != nil {
+		// Don't leave the metadata without the object it describes.
+		os.Remove(path + metadataSuffix)
+		return err
+	}
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	path, err := l.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ObjectInfo{}, ErrNotFound
+		}
+		return nil, ObjectInfo{}, err
+	}
+	info, header, err := l.describe(key, path, f)
+	if err == nil && header == nil {
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			return f, info, nil
+		}
+	}
+	var object *decrypter
+	if err == nil {
+		object, err = newDecrypter(ctx, l.keys, f, header, info.Size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("%s: %w", key, err)
+	}
+	return object, info, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(path + metadataSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error {
+	return filepath.WalkDir(l.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, metadataSuffix) || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := l.info(key, path)
+		if err != nil {
+			return err
+		}
+		return fn(info)
+	})
+}
+
+func (l *Local) info(key, path string) (ObjectInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer f.Close()
+	info, _, err := l.describe(key, path, f)
+	return info, err
+}
+
+// Describe the object in the file given, which is open at its start, along with the encryption
+// header, if the object is encrypted.  The size is that of the object, not of the file.
+func (l *Local) describe(key, path string, f *os.File) (ObjectInfo, *objectHeader, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	header, err := readHeader(f)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	info := ObjectInfo{Key: key, Size: stat.Size(), Modified: stat.ModTime().UTC()}
+	if header != nil {
+		info.Size = header.plainSize(stat.Size())
+	}
+	if meta, err := os.ReadFile(path + metadataSuffix); err == nil {
+		json.Unmarshal(meta, &info.Metadata)
+	}
+	return info, header, nil
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,130 @@
+/*! @file peer.go
+ * @brief Storage at a peer server, for replication to a sister site
+ *
+ * A server can keep copies of its uploads at a peer server (e.g., at another shore station) rather
+ * than in a second storage backend of its own (see replicate.go in the main package).  This backend
+ * sends objects to the peer's replication end-point, authenticating with a token that the peer has
+ * been configured to accept, and the peer stores them in its own storage.  Only storing and removing
+ * objects is possible; the peer doesn't give its copies back through this interface.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The header in which objects' metadata is sent to a peer, as a JSON object.
+const PeerMetadataHeader = "X-Object-Metadata"
+
+// A Peer backend stores objects at another server's replication end-point.
+type Peer struct {
+	base   string // URL of the objects end-point, ending in '/'
+	token  string
+	client *http.Client
+}
+
+// Generate a backend for the peer server with the base URL given, presenting the token given.  If a
+// CA certificate file (PEM) is given, the peer's certificate must be signed by it; otherwise the
+// system's roots are used.
+func NewPeer(server, token, caFile string) (*Peer, error) {
+	if _, err := url.Parse(server); err != nil {
+		return nil, err
+	}
+	if len(token) == 0 {
+		return nil, errors.New("a token is required for the peer server")
+	}
+	p := &Peer{
+		base:   strings.TrimSuffix(server, "/") + "/replica/v1/objects/",
+		token:  token,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(caFile) > 0 {
+		pool, err := support.CertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		p.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return p, nil
+}
+
+func (p *Peer) Put(ctx context.Context, key string, data []byte, metadata map[string]string) error {
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, p.base+key, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Digest", fmt.Sprintf("md5=%x", md5.Sum(data)))
+	request.Header.Set(PeerMetadataHeader, string(meta))
+	return p.do(request)
+}
+
+func (p *Peer) Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	return nil, ObjectInfo{}, ErrUnsupported
+}
+
+func (p *Peer) Delete(ctx context.Context, key string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.base+key, nil)
+	if err != nil {
+		return err
+	}
+	return p.do(request)
+}
+
+func (p *Peer) List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error {
+	return ErrUnsupported
+}
+
+func (p *Peer) Location() string {
+	return p.base
+}
+
+func (p *Peer) do(request *http.Request) error {
+	request.Header.Set("Authorization", "Bearer "+p.token)
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("peer responded %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+/*! @file s3.go
+ * @brief Storage backend using an AWS S3 bucket
+ *
+ * Cloud deployments store files in an S3 bucket, which is where the AWS processing chain expects to
+ * find them.  Keys are optionally placed under a prefix, so that a bucket can be shared.  Objects are
+ * streamed as they're read, rather than held in memory; a seek to somewhere other than where the
+ * stream has got to starts a new request for the rest of the object from there (with a Range
+ * header), so that large objects can be served in part without reading all of them.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"ccom.unh.edu/wibl-monitor/src/cloud"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// An S3 backend stores objects in a bucket, with the storage class given (or the bucket's default).
+type S3 struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	class  types.StorageClass
+}
+
+// Generate an S3 backend for the bucket and prefix in the configuration.
+func NewS3(config support.StorageParam, param support.AWSParam) (*S3, error) {
+	if len(config.Bucket) == 0 {
+		return nil, errors.New("no bucket specified for S3 storage")
+	}
+	cfg, err := cloud.AWSConfig(param)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = cloud.Endpoint(param, "s3")
+		o.UsePathStyle = param.S3PathStyle
+	})
+	prefix := strings.Trim(config.Prefix, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	return &S3{client: client, bucket: config.Bucket, prefix: prefix, class: types.StorageClass(config.Class)}, nil
+}
+
+func (b *S3) Put(ctx context.Context, key string, data []byte, metadata map[string]string) error {
+	// S3 only creates the object once all of the data has arrived, so an interrupted upload doesn't
+	// leave a partial object behind.
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &b.bucket,
+		Key:          aws.String(b.prefix + key),
+		Body:         bytes.NewReader(data),
+		Metadata:     metadata,
+		StorageClass: b.class,
+	})
+	return err
+}
+
+func (b *S3) Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.bucket,
+		Key:    aws.String(b.prefix + key),
+	})
+	if err != nil {
+		var missing *types.NoSuchKey
+		if errors.As(err, &missing) {
+			return nil, ObjectInfo{}, ErrNotFound
+		}
+		return nil, ObjectInfo{}, err
+	}
+	info := ObjectInfo{Key: key, Size: aws.ToInt64(out.ContentLength), Metadata: out.Metadata}
+	if out.LastModified != nil {
+		info.Modified = *out.LastModified
+	}
+	return &s3Reader{ctx: ctx, backend: b, key: key, size: info.Size, body: out.Body}, info, nil
+}
+
+// An s3Reader streams an object from S3, starting a new request from the current position when it
+// has been moved by a seek.
+type s3Reader struct {
+	ctx     context.Context
+	backend *S3
+	key     string
+	size    int64
+	pos     int64         // Of the next byte to be read
+	body    io.ReadCloser // Response body for the current request, if any
+	at      int64         // Position in the object that body has reached
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.at != r.pos {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		out, err := r.backend.client.GetObject(r.ctx, &s3.GetObjectInput{
+			Bucket: &r.backend.bucket,
+			Key:    aws.String(r.backend.prefix + r.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", r.pos)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.at = out.Body, r.pos
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.at = r.pos
+	if errors.Is(err, io.EOF) && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// Move an object to another storage class, by copying it over itself.
+func (b *S3) SetClass(ctx context.Context, key, class string) error {
+	_, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            &b.bucket,
+		Key:               aws.String(b.prefix + key),
+		CopySource:        aws.String(url.PathEscape(b.bucket + "/" + b.prefix + key)),
+		MetadataDirective: types.MetadataDirectiveCopy,
+		StorageClass:      types.StorageClass(class),
+	})
+	return err
+}
+
+func (b *S3) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &b.bucket,
+		Key:    aws.String(b.prefix + key),
+	})
+	return err
+}
+
+// List the objects with the prefix given.  The metadata for each object isn't available without a
+// request per object, so it isn't provided.
+func (b *S3) List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error {
+	pages := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: &b.bucket,
+		Prefix: aws.String(b.prefix + prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			info := ObjectInfo{Key: strings.TrimPrefix(aws.ToString(obj.Key), b.prefix), Size: aws.ToInt64(obj.Size)}
+			if obj.LastModified != nil {
+				info.Modified = *obj.LastModified
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *S3) Location() string {
+	return b.bucket
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
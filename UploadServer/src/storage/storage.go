@@ -0,0 +1,103 @@
+/*! @file storage.go
+ * @brief Storage backends for files uploaded to the server
+ *
+ * Files accepted from the loggers are stored under a key (typically UUID.wibl) in a storage
+ * backend, from which they can be picked up for processing.  The backend is selected in the
+ * configuration; this file provides the interface that all backends implement, and the factory
+ * that generates the configured backend.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// An ErrNotFound is returned when the object requested does not exist in the backend.
+var ErrNotFound = errors.New("object not found")
+
+// An ObjectInfo describes an object held in a storage backend.  The metadata is a set of
+// string key-value pairs stored with the object.
+type ObjectInfo struct {
+	Key      string            `json:"key"`
+	Size     int64             `json:"size"`
+	Modified time.Time         `json:"modified"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// A Backend stores objects by key.  Keys may contain '/' to group objects, as with S3.  Operations
+// stop early if the context is cancelled (e.g., because the client went away, or the server is
+// shutting down), and return the context's error.
+type Backend interface {
+	// Store the data given under the key, replacing any existing object.  If the object can't be
+	// stored, nothing is left under the key (as far as the backend can arrange it).
+	Put(ctx context.Context, key string, data []byte, metadata map[string]string) error
+	// Open the object with the given key for reading.  The caller must close the object.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error)
+	// Remove the object with the given key.  Removing an object that doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// Call the function given with each object whose key starts with the prefix given.
+	List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error
+	// Identify where the objects are held (e.g., the directory or bucket name), for use by the
+	// processing chain.
+	Location() string
+}
+
+// ErrUnsupported is returned when a backend can't do what is asked of it (e.g., change the storage
+// class of an object).
+var ErrUnsupported = errors.New("not supported by this storage backend")
+
+// A Tiered backend can move objects between storage classes (e.g., to an archive class once
+// they're no longer needed often).
+type Tiered interface {
+	SetClass(ctx context.Context, key, class string) error
+}
+
+// Move an object to the storage class given, if the backend supports storage classes.
+func SetClass(ctx context.Context, backend Backend, key, class string) error {
+	if tiered, ok := backend.(Tiered); ok {
+		return tiered.SetClass(ctx, key, class)
+	}
+	return ErrUnsupported
+}
+
+// Generate the storage backend specified in the configuration.
+func New(config support.StorageParam, aws support.AWSParam) (Backend, error) {
+	switch config.Backend {
+	case "local":
+		keys, err := NewKeySource(config.Encryption, aws)
+		if err != nil {
+			return nil, err
+		}
+		return NewLocal(config.Directory, keys)
+	case "s3":
+		return NewS3(config, aws)
+	case "memory":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+}
@@ -0,0 +1,81 @@
+/*! @file alerts.go
+ * @brief Alerts raised for conditions that need an operator's attention
+ *
+ * Some problems aren't the result of any particular request, and so can't be reported to whoever
+ * caused them (e.g., a stored file that no longer matches its digest).  These are raised as alerts,
+ * which are logged and kept in a journal in the state directory so that the operator can review them
+ * through the administration API.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// An Alert records a single condition that needs attention.  The Source is the part of the server
+// that raised the alert (e.g., "integrity"), and the Target the object that it concerns.
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Target  string    `json:"target"`
+	Message string    `json:"message"`
+}
+
+// An AlertLog is the journal of alerts raised.
+type AlertLog struct {
+	journal *Journal
+}
+
+func NewAlertLog(filename string) *AlertLog {
+	return &AlertLog{journal: NewJournal(filename)}
+}
+
+// Raise an alert.  The alert is always logged, even if it can't be recorded in the journal.
+func (a *AlertLog) Raise(source, target, message string) {
+	alert := Alert{
+		Time:    time.Now().UTC(),
+		Source:  source,
+		Target:  target,
+		Message: message,
+	}
+	Errorf("ALERT: %s: %s: %s\n", source, target, message)
+	TrackMessage("warning", message, map[string]string{"alert": source, "target": target})
+	if err := a.journal.Append(alert); err != nil {
+		Errorf("ALERT: failed to record alert: %s\n", err)
+	}
+}
+
+// Call the function given with each alert in the time range [from, to), in the order in which they
+// were raised.  Zero times leave the corresponding end of the range open.
+func (a *AlertLog) Scan(from, to time.Time, fn func(alert Alert) error) error {
+	return a.journal.Scan(func(line []byte) error {
+		var alert Alert
+		if err := json.Unmarshal(line, &alert); err != nil {
+			return nil
+		}
+		if !InRange(alert.Time, from, to) {
+			return nil
+		}
+		return fn(alert)
+	})
+}
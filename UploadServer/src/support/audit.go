@@ -0,0 +1,183 @@
+/*! @file audit.go
+ * @brief Audit trail of administrative actions
+ *
+ * Actions that change the server's state (minting tokens, managing users, deleting data, etc.)
+ * are recorded in an audit trail, along with who did them and from where, so that data-handling
+ * reviews can establish what happened to the data the server holds.  Accepted uploads are recorded
+ * too, so that the trail covers the arrival of the data as well as its deletion.
+ *
+ * The trail is a hash chain: each entry carries its sequence number, the hash of the entry before it,
+ * and its own hash (SHA-256 over the entry, with the hash left empty).  Editing, removing, or
+ * re-ordering entries therefore breaks the chain, which VerifyAudit detects.  Removing entries from
+ * the end can't be detected from the file alone, so reviews should compare the head of the chain
+ * against one recorded earlier.  Entries written before the chain was introduced have no hash, and
+ * are reported, but not checked.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// An AuditEntry records a single administrative action.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Remote string    `json:"remote"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+	Seq    uint64    `json:"seq,omitempty"`  // Position in the hash chain, from one
+	Prev   string    `json:"prev,omitempty"` // Hash of the previous entry, empty for the first
+	Hash   string    `json:"hash,omitempty"`
+}
+
+// Compute the hash of an entry, which covers everything but the hash itself.
+func (e AuditEntry) chainHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// An AuditLog is the journal of audit entries, and the head of its hash chain.
+type AuditLog struct {
+	mu      sync.Mutex
+	journal *Journal
+	seq     uint64
+	head    string
+}
+
+// Open the audit log in the file given, which need not exist, finding the head of the chain so that
+// new entries can be added to it.
+func NewAuditLog(filename string) (*AuditLog, error) {
+	a := &AuditLog{journal: NewJournal(filename)}
+	err := a.journal.Scan(func(line []byte) error {
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err == nil && len(entry.Hash) > 0 {
+			a.seq, a.head = entry.Seq, entry.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Add an entry to the audit trail.  Failure to record is logged, but is not otherwise reported,
+// since the action has already happened by the time it's recorded.
+func (a *AuditLog) Record(actor, remote, action, target, detail string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Remote: remote,
+		Action: action,
+		Target: target,
+		Detail: detail,
+		Seq:    a.seq + 1,
+		Prev:   a.head,
+	}
+	entry.Hash = entry.chainHash()
+	if err := a.journal.Append(entry); err != nil {
+		Errorf("AUDIT: failed to record %s on %s by %s: %s\n", action, target, actor, err)
+		return
+	}
+	a.seq, a.head = entry.Seq, entry.Hash
+}
+
+// An AuditVerification summarises a check of the audit trail's hash chain: the number of entries
+// written before the chain was introduced (which can't be checked), the number in the chain, and
+// the hash at its head.
+type AuditVerification struct {
+	Unchained int    `json:"unchained"`
+	Chained   int    `json:"chained"`
+	Head      string `json:"head"`
+}
+
+// ErrAuditTampered is returned (wrapped with the details) when the audit trail's hash chain is broken.
+var ErrAuditTampered = errors.New("audit trail has been altered")
+
+// Check the hash chain of the audit trail in the file given, returning ErrAuditTampered (with the
+// line at which the chain breaks) if any entry has been altered, removed, or inserted.
+func VerifyAudit(filename string) (AuditVerification, error) {
+	var result AuditVerification
+	var seq uint64
+	line := 0
+	err := NewJournal(filename).Scan(func(data []byte) error {
+		line++
+		var entry AuditEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("%w: line %d is not an audit entry (%v)", ErrAuditTampered, line, err)
+		}
+		switch {
+		case len(entry.Hash) == 0 && result.Chained == 0:
+			result.Unchained++
+			return nil
+		case len(entry.Hash) == 0:
+			return fmt.Errorf("%w: line %d has no hash", ErrAuditTampered, line)
+		case entry.chainHash() != entry.Hash:
+			return fmt.Errorf("%w: line %d (entry %d) does not match its hash", ErrAuditTampered, line, entry.Seq)
+		case entry.Seq != seq+1 || entry.Prev != result.Head:
+			return fmt.Errorf("%w: line %d (entry %d) does not follow entry %d", ErrAuditTampered, line, entry.Seq, seq)
+		}
+		seq, result.Head = entry.Seq, entry.Hash
+		result.Chained++
+		return nil
+	})
+	return result, err
+}
+
+// Call the function given with each audit entry in the time range [from, to), in the order in which
+// they were recorded.  Zero times leave the corresponding end of the range open.
+func (a *AuditLog) Scan(from, to time.Time, fn func(entry AuditEntry) error) error {
+	return a.journal.Scan(func(line []byte) error {
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil
+		}
+		if !InRange(entry.Time, from, to) {
+			return nil
+		}
+		return fn(entry)
+	})
+}
+
+// Determine whether the time given is in the range [from, to), where zero times leave the
+// corresponding end of the range open.
+func InRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !t.Before(to) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+/*! @file backup.go
+ * @brief Backup archives of the server's state and configuration
+ *
+ * Everything that a shore station needs to be rebuilt, other than the stored files themselves, is
+ * in the state directory (registry, upload history, tokens, keys, and so on) and the configuration.
+ * A backup is a gzip-compressed tar archive with a manifest, the effective configuration (as
+ * JSON), and every file in the state directory, which can be restored into an empty state directory
+ * on a new machine.  The state files are written atomically or only appended to, so each is
+ * consistent even if the archive is made while the server is running.  Backups include the server's
+ * secrets (token hashes, signing keys, and any secrets in the configuration other than the admin
+ * API keys), so have to be kept as carefully.  A backup is restored into a new directory, which
+ * then replaces the state directory, so that a restore that fails part-way leaves the state
+ * directory as it was, and one that replaces a state directory doesn't mix old state files with
+ * those from the backup.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The names of the parts of a backup archive.
+const (
+	backupManifest = "manifest.json"
+	backupConfig   = "config.json"
+	backupState    = "state/"
+)
+
+// A BackupManifest describes a backup: when it was made, by which version of the server, the version
+// that the state directory had reached (see migrations.go), and the state files it holds.
+type BackupManifest struct {
+	Created      time.Time    `json:"created"`
+	Server       string       `json:"server"`
+	StateVersion int          `json:"state_version"`
+	Files        []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name string `json:"name"` // Relative to the state directory, with '/' separators
+	Size int64  `json:"size"`
+}
+
+// Write a backup of the state directory given, and the configuration (as JSON), to w.  Temporary files
+// left by atomic writes are skipped.
+func WriteBackup(w io.Writer, dir, server string, config []byte) (BackupManifest, error) {
+	version, err := ReadStateVersion(dir)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	manifest := BackupManifest{Created: time.Now().UTC(), Server: server, StateVersion: version.Version, Files: []BackupFile{}}
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || strings.HasSuffix(name, ".tmp") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{Name: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	if err := addBackupEntry(archive, backupConfig, config, manifest.Created); err != nil {
+		return manifest, err
+	}
+	for i, f := range manifest.Files {
+		// The file may have grown (or been compacted) since it was listed, so it's read whole now, and
+		// the manifest (which comes last) gives the size archived.
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Name)))
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files[i].Size = int64(len(data))
+		if err := addBackupEntry(archive, backupState+f.Name, data, manifest.Created); err != nil {
+			return manifest, err
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := addBackupEntry(archive, backupManifest, data, manifest.Created); err != nil {
+		return manifest, err
+	}
+	if err := archive.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+func addBackupEntry(archive *tar.Writer, name string, data []byte, modified time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: modified, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
+
+// Restore a backup from r into the state directory given, which has to be empty unless overwrite is
+// set, and write the configuration from the backup to the file given (unless it's empty).  The
+// backup is unpacked into a new directory beside the state directory, which then replaces it, so
+// that the state directory holds either what it did or exactly what the backup holds, even if the
+// restore fails part-way.  The manifest of the backup is returned.
+func RestoreBackup(r io.Reader, dir, configFile string, overwrite bool) (BackupManifest, error) {
+	var manifest BackupManifest
+	dir = filepath.Clean(dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return manifest, err
+	} else if len(entries) > 0 && !overwrite {
+		return manifest, fmt.Errorf("state directory %s isn't empty", dir)
+	}
+	existing := err == nil
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return manifest, err
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".restore-")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.RemoveAll(staging) // Nothing is left once it's renamed into place
+	config, err := unpackBackup(r, staging, &manifest)
+	if err != nil {
+		return manifest, err
+	}
+	if existing {
+		replaced := staging + ".replaced"
+		if err := os.Rename(dir, replaced); err != nil {
+			return manifest, err
+		}
+		if err := os.Rename(staging, dir); err != nil {
+			os.Rename(replaced, dir)
+			return manifest, err
+		}
+		if err := os.RemoveAll(replaced); err != nil {
+			Warnf("failed to remove the replaced state directory %s: %s\n", replaced, err)
+		}
+	} else if err := os.Rename(staging, dir); err != nil {
+		return manifest, err
+	}
+	if len(configFile) > 0 && config != nil {
+		if err := os.WriteFile(configFile, config, 0600); err != nil {
+			return manifest, err
+		}
+	}
+	return manifest, nil
+}
+
+// Unpack a backup archive from r into the directory given, filling in its manifest, and returning
+// the configuration that it holds.
+func unpackBackup(r io.Reader, dir string, manifest *BackupManifest) ([]byte, error) {
+	var config []byte
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch name := header.Name; {
+		case name == backupManifest:
+			if err := json.NewDecoder(archive).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("reading backup manifest: %w", err)
+			}
+		case name == backupConfig:
+			if config, err = io.ReadAll(archive); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(name, backupState):
+			rel := path.Clean(strings.TrimPrefix(name, backupState))
+			if !filepath.IsLocal(filepath.FromSlash(rel)) {
+				return nil, fmt.Errorf("backup entry %q is outside the state directory", name)
+			}
+			target := filepath.Join(dir, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(archive)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(target, data, 0600); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if manifest.Created.IsZero() {
+		return nil, errors.New("backup has no manifest")
+	}
+	return config, nil
+}
@@ -0,0 +1,133 @@
+/*! @file bandwidth.go
+ * @brief Limits on the bandwidth used by uploads
+ *
+ * A shore station often shares a thin uplink with the vessel operations it supports, and a fleet of
+ * loggers uploading their backlog at once could saturate it.  Uploads can be limited to a rate each,
+ * and all uploads together to a total rate, by reading the request body no faster than allowed; TCP
+ * flow control then slows the sender down.  The limits are token buckets, with a burst of one
+ * second's worth of data.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	throttleChunk = 16 * 1024        // Largest read from a throttled body at once, so that waits are short
+	throttleGrace = 30 * time.Second // Time allowed to finish the request after each read
+)
+
+// A rateLimiter is a token bucket, refilled at rate bytes per second up to one second's worth.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// Take n bytes from the bucket, waiting until they are available (or the context is cancelled).
+// A nil limiter doesn't limit.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A Bandwidth limits the rate at which each upload, and all uploads together, are read.
+type Bandwidth struct {
+	upload int64
+	total  *rateLimiter
+}
+
+// Generate a bandwidth limit of upload bytes per second for each upload, and total bytes per second
+// for all uploads together.  Zero means no limit.
+func NewBandwidth(upload, total int64) *Bandwidth {
+	return &Bandwidth{upload: upload, total: newRateLimiter(total)}
+}
+
+// Limit the rate at which the handler given can read request bodies.
+func (b *Bandwidth) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	if b.upload <= 0 && b.total == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), control: http.NewResponseController(w),
+			limits: []*rateLimiter{newRateLimiter(b.upload), b.total}}
+		next(w, r)
+	}
+}
+
+// A throttledReader waits after each read until the limits allow the data read.  Since a throttled
+// upload can take much longer than the server's timeouts allow, the deadlines for the connection are
+// extended after each read, so that they only apply if the upload stalls.
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	control *http.ResponseController
+	limits  []*rateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	for _, l := range r.limits {
+		if werr := l.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	deadline := time.Now().Add(throttleGrace)
+	r.control.SetReadDeadline(deadline)
+	r.control.SetWriteDeadline(deadline)
+	return n, err
+}
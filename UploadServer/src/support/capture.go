@@ -0,0 +1,150 @@
+/*! @file capture.go
+ * @brief Capture of recent raw requests from each logger, for debugging
+ *
+ * Diagnosing a firmware or protocol problem usually needs the exact request that the logger sent,
+ * which otherwise means a packet capture at the server.  If enabled in the configuration, the last
+ * few checkin and upload requests from each logger are kept in memory (headers, less credentials,
+ * and the start of the body), along with the status the server returned, so that they can be looked
+ * at through the administration API.  Nothing is kept by default, and nothing is written to disk.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A CapturedRequest is a copy of a request received from a logger.  The body is given as text if it
+// is valid UTF-8, and otherwise as base64; only the first part is kept if it was longer than the
+// configured limit, but BodySize is always the full length.
+type CapturedRequest struct {
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Remote     string      `json:"remote"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 []byte      `json:"body_base64,omitempty"`
+	BodySize   int64       `json:"body_size"`
+	Truncated  bool        `json:"truncated,omitempty"`
+	Status     int         `json:"status"`
+}
+
+// A RequestCapture keeps the most recent requests from each logger, in a ring of fixed size.
+type RequestCapture struct {
+	mu       sync.Mutex
+	size     int
+	maxBody  int
+	requests map[string][]CapturedRequest // Indexed by logger, oldest first
+}
+
+// Generate a capture that keeps the last size requests from each logger, with up to maxBody bytes of
+// each body.  A size of zero (or less) disables capture.
+func NewRequestCapture(size, maxBody int) *RequestCapture {
+	return &RequestCapture{size: size, maxBody: max(maxBody, 0), requests: make(map[string][]CapturedRequest)}
+}
+
+// Report whether requests are being captured.
+func (c *RequestCapture) Enabled() bool {
+	return c.size > 0
+}
+
+// Capture the requests passed to the handler given, which must be behind BasicAuth so that the
+// logger is known (and so that the number of loggers, and therefore the memory used, is bounded by
+// the number of upload tokens).
+func (c *RequestCapture) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	if !c.Enabled() {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		capture := CapturedRequest{
+			Time:   time.Now().UTC(),
+			Method: r.Method,
+			URL:    r.URL.String(),
+			Remote: r.RemoteAddr,
+			Header: r.Header.Clone(),
+		}
+		capture.Header.Del("Authorization")
+		body := &countingReader{ReadCloser: r.Body, limit: c.maxBody}
+		r.Body = body
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		capture.Status = recorder.status
+		capture.BodySize = body.count
+		capture.Truncated = body.count > int64(body.kept.Len())
+		if utf8.Valid(body.kept.Bytes()) {
+			capture.Body = body.kept.String()
+		} else {
+			capture.BodyBase64 = body.kept.Bytes()
+		}
+		c.add(LoggerID(r), capture)
+	}
+}
+
+func (c *RequestCapture) add(logger string, capture CapturedRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ring := append(c.requests[logger], capture)
+	if len(ring) > c.size {
+		ring = ring[len(ring)-c.size:]
+	}
+	c.requests[logger] = ring
+}
+
+// Provide the requests captured from the logger given, oldest first.
+func (c *RequestCapture) Get(logger string) []CapturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rtn := make([]CapturedRequest, len(c.requests[logger]))
+	copy(rtn, c.requests[logger])
+	return rtn
+}
+
+// Discard the requests captured from the logger given.
+func (c *RequestCapture) Clear(logger string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.requests, logger)
+}
+
+// A countingReader passes a request body through to the handler, keeping a copy of the first part
+// and counting the total read.
+type countingReader struct {
+	io.ReadCloser
+	limit int
+	kept  bytes.Buffer
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if keep := min(n, r.limit-r.kept.Len()); keep > 0 {
+		r.kept.Write(p[:keep])
+	}
+	r.count += int64(n)
+	return n, err
+}
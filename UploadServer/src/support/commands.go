@@ -0,0 +1,180 @@
+/*! @file commands.go
+ * @brief Queue of commands for loggers, delivered at their next checkin
+ *
+ * The server can't contact a logger directly: it has to wait for the logger to check in.  Commands
+ * for a logger (e.g., to re-send files that the server doesn't have) are therefore queued, and handed
+ * over in the next checkin response, whichever instance of the server the logger reaches.  The queue
+ * is held in the shared state for that reason.  Queued commands that are never collected (e.g.,
+ * because the logger has been retired) expire after commandTTL.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// The actions that a command can ask for.
+const (
+	CommandResend  = "resend"
+	CommandUpgrade = "upgrade"
+	CommandUpload  = "upload"
+)
+
+// Limits on how long commands wait for collection, and how often a change to the queue is
+// attempted if other instances keep changing it at the same time.
+const (
+	commandTTL      = 30 * 24 * time.Hour
+	commandAttempts = 10
+)
+
+var errCommandContention = errors.New("command queue is changing too quickly to update")
+
+// A CommandQueue holds the commands waiting for each logger.
+type CommandQueue struct {
+	state SharedState
+}
+
+func NewCommandQueue(state SharedState) *CommandQueue {
+	return &CommandQueue{state: state}
+}
+
+// Queue a command for the logger, returning the command as queued and true if it was queued.  A
+// command asking for something already asked for isn't queued again: for "resend", files already
+// waiting to be re-sent are left out, and nothing is queued if none remain.
+func (q *CommandQueue) Enqueue(logger string, command api.Command) (api.Command, bool, error) {
+	command.ID = NewUUID()
+	command.Created = time.Now().UTC()
+	queued := false
+	_, err := q.update(logger, func(commands []api.Command) []api.Command {
+		for _, c := range commands {
+			if c.Action != command.Action {
+				continue
+			}
+			if command.Action != CommandResend {
+				return commands
+			}
+			command.Files = slices.DeleteFunc(command.Files, func(id uint) bool { return slices.Contains(c.Files, id) })
+		}
+		if command.Action == CommandResend && len(command.Files) == 0 {
+			return commands
+		}
+		queued = true
+		return append(commands, command)
+	})
+	return command, queued, err
+}
+
+// Provide the commands waiting for the logger, in the order in which they were queued.
+func (q *CommandQueue) Pending(logger string) ([]api.Command, error) {
+	data, err := q.state.Get(commandKey(logger))
+	if errors.Is(err, ErrNotFound) {
+		return []api.Command{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var commands []api.Command
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// Remove and return all of the commands waiting for the logger, for delivery.
+func (q *CommandQueue) Take(logger string) ([]api.Command, error) {
+	return q.update(logger, func(commands []api.Command) []api.Command { return nil })
+}
+
+// Remove a command from the logger's queue before it's delivered.
+func (q *CommandQueue) Cancel(logger, id string) error {
+	found := false
+	_, err := q.update(logger, func(commands []api.Command) []api.Command {
+		return slices.DeleteFunc(commands, func(c api.Command) bool {
+			found = found || c.ID == id
+			return c.ID == id
+		})
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// Apply a change to the logger's queue, returning the commands that were queued before the change.
+// The change is made only if no other instance has changed the queue meanwhile, and is otherwise
+// tried again with the new queue.
+func (q *CommandQueue) update(logger string, fn func(commands []api.Command) []api.Command) ([]api.Command, error) {
+	key := commandKey(logger)
+	for attempt := 0; attempt < commandAttempts; attempt++ {
+		old, err := q.state.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			old, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var commands []api.Command
+		if old != nil {
+			if err := json.Unmarshal(old, &commands); err != nil {
+				return nil, err
+			}
+		}
+		updated := fn(slices.Clone(commands))
+		var done bool
+		switch {
+		case len(updated) == 0 && old == nil:
+			done = true
+		case len(updated) == 0:
+			done, err = q.state.CompareAndDelete(key, old)
+		default:
+			done, err = q.setJSON(key, old, updated)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return commands, nil
+		}
+	}
+	return nil, errCommandContention
+}
+
+// Store the commands given under the key if it still holds the old value (or doesn't exist, if nil).
+func (q *CommandQueue) setJSON(key string, old []byte, commands []api.Command) (bool, error) {
+	data, err := json.Marshal(commands)
+	if err != nil {
+		return false, err
+	}
+	if old == nil {
+		return q.state.SetNX(key, data, commandTTL)
+	}
+	return q.state.CompareAndSwap(key, old, data, commandTTL)
+}
+
+func commandKey(logger string) string {
+	return "commands:" + logger
+}
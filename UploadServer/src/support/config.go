@@ -3,7 +3,10 @@
  *
  * Centralised configuration management for the demonstration upload server.  This reads
  * a JSON file for the configuration, and defaults to a standard configuration if no file
- * is available, or specified on server start.
+ * is available, or specified on server start.  Several files can be given, so that a fleet of
+ * shore stations can share a base configuration and override only what differs at each site:
+ * each file is applied in turn on top of the ones before it.  A file can also name files to
+ * apply before itself in an "include" list (relative to the including file).
  *
  * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
  *
@@ -27,38 +30,589 @@
 package support
 
 import (
+	"bytes"
 	"encoding/json"
-	"io"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 )
 
 // An APIParam provides parameters required to set up the server (e.g., the port to
-// listen on).
+// listen on).  MaxUploads limits the number of uploads handled at once, so that checkins are
+// always answered promptly (zero for no limit).
 type APIParam struct {
-	Port int `json:"port"`
+	Port       int    `json:"port"`
+	MaxUploads int    `json:"max_uploads"`
+	NextCert   string `json:"next_cert"` // Certificate that will replace the server's, if installed
+	CoAPPort   int    `json:"coap_port"` // For the CoAP listener, if enabled
+}
+
+// An AdminKey is a pre-shared bearer token for the administration API, along with the
+// role (viewer, operator, or admin) that the holder of the token is given, and the tenant that the
+// holder is restricted to (none, if empty).
+type AdminKey struct {
+	Name   string `json:"name"`
+	Token  string `json:"token"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// An AdminParam provides parameters for the administration API.  Users log in to get a session
+// token that lasts for SessionMinutes; passwords have to be changed after PasswordMaxAgeDays (zero
+// for no limit).
+type AdminParam struct {
+	Keys               []AdminKey `json:"keys"`
+	SessionMinutes     int        `json:"session_minutes"`
+	PasswordMaxAgeDays int        `json:"password_max_age_days"`
+}
+
+// A StateParam provides the location in which the server keeps state that has to persist
+// between restarts (e.g., upload tokens), and whether the server applies migrations of the state
+// files (see migrations.go) at startup, or leaves them to the "migrate" command.
+type StateParam struct {
+	Directory string `json:"directory"`
+	Migrate   bool   `json:"migrate"`
+}
+
+// A StorageParam specifies where files accepted from the loggers are stored.  The "local" backend
+// stores files under Directory; the "s3" backend stores them in Bucket, under Prefix; the "memory"
+// backend keeps them in memory until the server stops (for development only).  Layout "date" puts
+// files under a {year}/{month}/{day}/ prefix for the day they were received (the default, "flat",
+// doesn't); daily manifests of the uploads accepted are written under Manifests, if it's given.
+type StorageParam struct {
+	Backend    string          `json:"backend"`
+	Directory  string          `json:"directory"`
+	Bucket     string          `json:"bucket"`
+	Prefix     string          `json:"prefix"`
+	Encryption EncryptionParam `json:"encryption"`    // Local backend only
+	Compress   string          `json:"compress"`      // "zstd" to compress accepted files, or empty
+	Class      string          `json:"storage_class"` // S3 backend only; the bucket's default if empty
+	Archive    ArchiveParam    `json:"archive"`       // S3 backend only
+	Layout     string          `json:"layout"`
+	Manifests  string          `json:"manifests"`
+}
+
+// An ArchiveParam controls the move of files to an archive storage class (e.g., "GLACIER") once the
+// processing chain has confirmed that they have been processed, and AfterDays have passed.  Files
+// aren't archived unless the class is given.
+type ArchiveParam struct {
+	Class     string `json:"storage_class"`
+	AfterDays int    `json:"after_days"`
+}
+
+// An EncryptionParam specifies the key encryption key for objects stored by the local backend (see
+// storage/encrypt.go): a file holding the key (as 64 hexadecimal digits), or the ID or ARN of a KMS
+// key.  Objects aren't encrypted if neither is given.
+type EncryptionParam struct {
+	KeyFile string `json:"key_file"`
+	KMSKey  string `json:"kms_key"`
+}
+
+// An AWSParam configures access to AWS for the S3 storage backend and the SNS/SQS notifiers.
+// Anything not given comes from the environment, as for the AWS command line tools.  If RoleARN is
+// given, the server assumes that role (with ExternalID, if required) using the base credentials.
+// Endpoints override the default endpoint for each service, by name (e.g., "s3", "sns", "sqs",
+// "sts"); S3PathStyle is usually needed with S3-compatible stores.
+type AWSParam struct {
+	Region      string            `json:"region"`
+	Profile     string            `json:"profile"`
+	RoleARN     string            `json:"role_arn"`
+	ExternalID  string            `json:"external_id"`
+	SessionName string            `json:"session_name"`
+	Endpoints   map[string]string `json:"endpoints"`
+	S3PathStyle bool              `json:"s3_path_style"`
+}
+
+// An IntegrityParam controls the check that re-reads stored files and compares them against the
+// digest recorded when they were uploaded.  Each run reads a random SampleFraction of the stored
+// files (1.0 for all of them).
+type IntegrityParam struct {
+	SampleFraction float64 `json:"sample_fraction"`
+}
+
+// A JobParam controls when a background job runs.  Jobs without an entry in the configuration
+// use the defaults they were registered with (see support/scheduler.go).
+type JobParam struct {
+	Enabled         bool `json:"enabled"`
+	IntervalMinutes int  `json:"interval_minutes"`
+}
+
+// A QuotaParam limits the storage that each logger can use, in bytes.  Loggers with an entry in
+// Loggers use that limit, and all others DefaultBytes; a limit of zero means no limit.  Loggers are
+// warned when they have used WarnPercent of their limit.  Quotas can be changed at run-time (see
+// support/settings.go).
+type QuotaParam struct {
+	DefaultBytes int64            `json:"default_bytes"`
+	Loggers      map[string]int64 `json:"loggers"`
+	WarnPercent  int              `json:"warn_percent"`
+}
+
+// A MailParam specifies the SMTP server (as host:port) used to send email, and the credentials
+// to use with it, if any.
+type MailParam struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// A ReportParam controls the periodic usage reports.  Reports are always kept in storage, and are
+// also emailed to the Recipients, if there are any.
+type ReportParam struct {
+	Recipients []string `json:"recipients"`
+}
+
+// A ProcessingParam controls what the server does to files before passing them on for processing.
+// If InjectMetadata is "file", the platform metadata from the logger's vessel record is written into
+// the WIBL file; if "sidecar", it's stored alongside the file as JSON; otherwise, the file is
+// passed on as uploaded.  CallbackTokens gives the tokens with which components of the processing
+// chain (e.g., the conversion Lambda, or wibl-python) report what happened to each file, by name.
+// Routes send some WIBL files to processing pipelines under test rather than the production one.
+type ProcessingParam struct {
+	InjectMetadata string            `json:"inject_metadata"`
+	CallbackTokens map[string]string `json:"callback_tokens"`
+	Routes         []RouteParam      `json:"routes"`
+}
+
+// A RouteParam sends some WIBL files to a processing pipeline under test (see routes.go): all of those
+// from the Loggers listed, and Percent of the others.  The files are stored under Prefix (the route's
+// name and "/", if empty), and the targets in Notify are told about them instead of the production
+// processing chain.
+type RouteParam struct {
+	Name    string      `json:"name"`
+	Loggers []string    `json:"loggers"`
+	Percent float64     `json:"percent"`
+	Prefix  string      `json:"prefix"`
+	Notify  NotifyParam `json:"notify"`
+}
+
+// A ManagerParam locates the wibl-python processing chain's REST interfaces: URL is the base of the
+// wibl-manager API (as MANAGEMENT_URL for the chain), and QueueURL the end-point that accepts
+// processing requests.  Either may be empty.
+type ManagerParam struct {
+	URL            string `json:"url"`
+	QueueURL       string `json:"queue_url"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+}
+
+// A TopicParam specifies an SNS topic or SQS queue to notify of new files, and the format of the
+// message: "native" for the processing chain's own format, or "s3-event" to match the notification
+// that S3 generates when an object is created.
+type TopicParam struct {
+	Target string `json:"target"` // Topic ARN or queue URL
+	Format string `json:"format"`
+}
+
+// A NotifyParam specifies how the processing chain is told about new files (see src/notify).
+type NotifyParam struct {
+	Manager ManagerParam `json:"manager"`
+	SNS     TopicParam   `json:"sns"`
+	SQS     TopicParam   `json:"sqs"`
+}
+
+// A RedisParam locates the Redis server used for shared state.  All keys are given the Prefix.
+type RedisParam struct {
+	Address  string `json:"address"` // As host:port
+	Username string `json:"username"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	TLS      bool   `json:"tls"`
+	Prefix   string `json:"prefix"`
+}
+
+// A SharedParam specifies where short-lived state that has to be shared between instances of the
+// server is held (see support/shared.go): "memory" for a single instance, or "redis".
+type SharedParam struct {
+	Backend string     `json:"backend"`
+	Redis   RedisParam `json:"redis"`
+}
+
+// A RateLimitParam limits the number of requests that each logger (for checkins and uploads) or
+// remote address (for admin logins) can make per minute.  Zero means no limit.  The limits can be
+// changed at run-time (see support/settings.go).
+type RateLimitParam struct {
+	CheckinPerMinute int `json:"checkin_per_minute"`
+	UploadPerMinute  int `json:"upload_per_minute"`
+	LoginPerMinute   int `json:"login_per_minute"`
+}
+
+// An ErrorTrackingParam configures reporting of errors to a Sentry-compatible error tracker (see
+// support/tracking.go).  Nothing is reported unless a DSN is given.  SampleRate is the fraction of
+// errors reported, and ServerName identifies the server (the host name, if empty).
+type ErrorTrackingParam struct {
+	DSN         string  `json:"dsn"`
+	Environment string  `json:"environment"`
+	SampleRate  float64 `json:"sample_rate"`
+	ServerName  string  `json:"server_name"`
+}
+
+// A FirmwareParam is the fleet's firmware policy (see firmware.go in the main package): loggers that
+// report firmware older than Minimum (compared component by component, numerically where both are
+// numbers), or one of the Blocked versions, are out of policy.  If UpgradeCommand is set, they're
+// also told to upgrade at checkin.  The policy can be changed at run-time (see support/settings.go).
+type FirmwareParam struct {
+	Minimum        string   `json:"minimum"`
+	Blocked        []string `json:"blocked"`
+	UpgradeCommand bool     `json:"upgrade_command"`
+}
+
+// A ClockParam sets the limit on the difference between a logger's clock and the server's, in
+// seconds, beyond which an alert is raised (zero for no limit).
+type ClockParam struct {
+	MaxDriftSeconds float64 `json:"max_drift_seconds"`
+}
+
+// A FloodParam sets how many times more often than it should (every CheckinMinutes; see
+// ProvisionParam, unless the logger has its own interval in the registry) a logger may check in
+// before it's taken to be flooding the server (see flood.go in the main package), and its checkins
+// are refused until the interval is over.  Zero means no limit.
+type FloodParam struct {
+	Factor int `json:"factor"`
+}
+
+// An UploadParam controls the checks made on uploads before they're accepted: the content types
+// accepted (anything, if the list is empty), whether files have to start with a WIBL header, and the
+// largest file accepted in bytes (zero for no limit).  Loggers may also upload the other kinds of
+// file listed in Types, by name (see payload.go), and files that they have encrypted with one of the
+// keys in KeyIDs (see payload.go; none are accepted if the list is empty).  Naming chooses how stored
+// files are named: "uuid" for the upload's UUID alone, or "logger-file" to include the logger and
+// the file's ID on the logger.
+type UploadParam struct {
+	ContentTypes []string               `json:"content_types"`
+	CheckHeader  bool                   `json:"check_header"`
+	MaxBytes     int64                  `json:"max_bytes"`
+	Types        map[string]PayloadType `json:"types"`
+	KeyIDs       []string               `json:"key_ids"`
+	Naming       string                 `json:"naming"`
+}
+
+// A PayloadType describes a kind of file other than WIBL data that loggers may upload (e.g.,
+// self-test reports, NMEA captures, or crash dumps): the content types accepted for it (anything,
+// if the list is empty), the largest file accepted in bytes (zero for no limit), the storage prefix
+// (the type name, if empty) and extension for its files, and who is told when one is stored.  The
+// WIBL processing chain can't use these files, so nothing is notified unless Notify is given.
+type PayloadType struct {
+	ContentTypes []string    `json:"content_types"`
+	MaxBytes     int64       `json:"max_bytes"`
+	Prefix       string      `json:"prefix"`
+	Extension    string      `json:"extension"`
+	Notify       NotifyParam `json:"notify"`
+}
+
+// A BandwidthParam limits the rate at which uploads are received, in kilobytes per second, for
+// each upload and for all uploads together (see support/bandwidth.go).  Zero means no limit.
+type BandwidthParam struct {
+	UploadKBps int `json:"upload_kbps"`
+	TotalKBps  int `json:"total_kbps"`
+}
+
+// A DebugParam enables facilities for diagnosing problems with loggers.  If CaptureRequests is
+// positive, that many of the most recent requests from each logger are kept, with up to
+// CaptureBodyBytes of each body (see support/capture.go).  If RecordFile is given, all requests from
+// loggers are recorded there, until it reaches RecordMaxMB, for replay (see support/record.go).
+type DebugParam struct {
+	CaptureRequests  int    `json:"capture_requests"`
+	CaptureBodyBytes int    `json:"capture_body_bytes"`
+	RecordFile       string `json:"record_file"`
+	RecordMaxMB      int    `json:"record_max_mb"`
+}
+
+// A QuarantineParam controls the keeping of refused checkin and upload payloads for investigation
+// (see support/quarantine.go): the most entries kept (nothing is kept if zero), the bytes kept of
+// each payload (zero for all of it), and the days for which entries are kept.
+type QuarantineParam struct {
+	MaxEntries    int   `json:"max_entries"`
+	MaxBytes      int64 `json:"max_bytes"`
+	RetentionDays int   `json:"retention_days"`
+}
+
+// A BackupParam controls the scheduled backups of the server's state and configuration (see
+// support/backup.go) to the storage backend: the prefix under which they're stored (none are made if
+// empty), the number of the most recent backups kept there, and the key with which they're encrypted
+// (the storage backend's, if not given).  Backups hold the server's secrets, so they're only stored
+// if they can be encrypted.
+type BackupParam struct {
+	Prefix     string          `json:"prefix"`
+	Keep       int             `json:"keep"`
+	Encryption EncryptionParam `json:"encryption"`
+}
+
+// A MetricsParam controls the publishing of ingest metrics to monitoring services, which happens at
+// the interval given (see src/metrics).
+type MetricsParam struct {
+	IntervalSeconds int             `json:"interval_seconds"`
+	CloudWatch      CloudWatchParam `json:"cloudwatch"`
+	StatsD          StatsDParam     `json:"statsd"`
+}
+
+// A CloudWatchParam enables publishing of the ingest metrics to CloudWatch, under the namespace
+// given, with the dimensions given attached to every metric.
+type CloudWatchParam struct {
+	Enabled    bool              `json:"enabled"`
+	Namespace  string            `json:"namespace"`
+	Dimensions map[string]string `json:"dimensions"`
+}
+
+// A StatsDParam enables publishing of the ingest metrics to a StatsD agent (e.g., Datadog's) at
+// Address (host:port), with the Prefix on each metric name and the Tags attached to every metric.
+// Nothing is sent if no address is given.
+type StatsDParam struct {
+	Address string            `json:"address"`
+	Prefix  string            `json:"prefix"`
+	Tags    map[string]string `json:"tags"`
+}
+
+// A RetryParam controls how backend operations (storage writes and notifications) are retried: the
+// number of attempts in all, and the wait before the first retry, which doubles with each attempt
+// up to the maximum (see support/retry.go).
+type RetryParam struct {
+	Attempts      int `json:"attempts"`
+	InitialMillis int `json:"initial_ms"`
+	MaxMillis     int `json:"max_ms"`
+}
+
+// A ReconcileParam controls the comparison of the files that loggers report with those stored (see
+// reconcile.go): how long a reported file may go unstored before it's counted as missing, and
+// whether loggers are asked to re-send missing files automatically.
+type ReconcileParam struct {
+	GraceHours int  `json:"grace_hours"`
+	Resend     bool `json:"resend"`
+}
+
+// A ReceiptParam controls the signed receipts given for accepted uploads (see support/receipts.go).
+// KeyFile holds the Ed25519 signing key; by default, it's receipt-key.pem in the state directory.
+type ReceiptParam struct {
+	Enabled bool   `json:"enabled"`
+	KeyFile string `json:"key_file"`
+}
+
+// A TokenParam controls the expiry of upload tokens: how long a token lasts (zero for ever, the
+// default, since firmware that can't renew its token would otherwise be locked out), how long before
+// expiry the logger is told to renew it, and how long the old token remains good once it's been
+// renewed.  The lifetime applies to tokens minted or renewed after it's set; existing tokens keep the
+// expiry they were given.
+type TokenParam struct {
+	LifetimeDays int `json:"lifetime_days"`
+	WarnDays     int `json:"warn_days"`
+	GraceHours   int `json:"grace_hours"`
+}
+
+// A SessionParam controls the short-lived session tokens given to loggers at checkin (see
+// support/sessions.go): whether they're issued, how long they last, and the file holding the signing
+// key (by default, session-key in the state directory; generated if missing).
+type SessionParam struct {
+	Enabled         bool   `json:"enabled"`
+	LifetimeMinutes int    `json:"lifetime_minutes"`
+	KeyFile         string `json:"key_file"`
+}
+
+// An EnrollParam controls the enrolment of loggers for client certificates (see support/enroll.go):
+// whether it's offered (in which case the server also accepts client certificates), the CA's
+// certificate and key files (by default, ca.crt and ca.key in ./certs; generated if neither exists),
+// and how long certificates are good for (at most as long as the logger's upload token).
+type EnrollParam struct {
+	Enabled      bool   `json:"enabled"`
+	CACert       string `json:"ca_cert"`
+	CAKey        string `json:"ca_key"`
+	ValidityDays int    `json:"validity_days"`
+}
+
+// A GatewayParam controls the store-and-forward gateways (e.g., Iridium SBD) through which offshore
+// loggers send status beacons (see gateway.go): the secret that the gateway service has to present,
+// and the logger that each device (by IMEI, for Iridium) belongs to.  The same secret admits inbound
+// mail relays (see email.go).  Nothing is accepted through a gateway unless a secret is given.
+type GatewayParam struct {
+	Secret  string            `json:"secret"`
+	Devices map[string]string `json:"devices"`
+}
+
+// An InboundParam controls the collection of files that vessels send as email attachments (see
+// email.go): the IMAP server (host:port, over TLS) and credentials for the mailbox they're sent to,
+// and the sender addresses allowed, with the logger that each sends for.  Nothing is collected
+// unless a server is given.
+type InboundParam struct {
+	Server   string            `json:"server"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	Mailbox  string            `json:"mailbox"`
+	Senders  map[string]string `json:"senders"`
+}
+
+// A DropParam controls the collection of files from a drop directory that an SFTP server (or anything
+// else) writes to (see drop.go): the directory, the logger that the files in each of its
+// subdirectories belong to, and how long a file has to go unmodified before it's taken to be
+// complete.  Nothing is collected unless a directory is given.
+type DropParam struct {
+	Directory     string            `json:"directory"`
+	Loggers       map[string]string `json:"loggers"`
+	SettleSeconds int               `json:"settle_seconds"`
+}
+
+// A TransferParam defines the transfer profiles that loggers are assigned in the registry to suit
+// their links (see transfer.go), and the profile for loggers that haven't been assigned one.
+type TransferParam struct {
+	Default  string                  `json:"default"`
+	Profiles map[string]ProfileParam `json:"profiles"`
+}
+
+// A ProfileParam describes a transfer profile: the size of chunk in which loggers send files, how long
+// the server waits to receive a request and to send its response, and how often and how many times
+// loggers retry.
+type ProfileParam struct {
+	ChunkKB      int `json:"chunk_kb"`
+	ReadSeconds  int `json:"read_seconds"`
+	WriteSeconds int `json:"write_seconds"`
+	RetrySeconds int `json:"retry_seconds"`
+	MaxRetries   int `json:"max_retries"`
+}
+
+// A LiveParam controls the streaming of real-time observations from loggers (see live.go): the
+// number of recent observations kept for each logger, and the most bytes of them kept for each logger
+// and for all loggers together (the oldest are dropped first), the most accepted from a logger each
+// second (the rest are dropped), and how long a stream may go without an observation before it's
+// closed.
+type LiveParam struct {
+	BufferSize   int   `json:"buffer_size"`
+	LoggerBytes  int64 `json:"logger_bytes"`
+	TotalBytes   int64 `json:"total_bytes"`
+	MaxPerSecond int   `json:"max_per_second"`
+	IdleSeconds  int   `json:"idle_seconds"`
+}
+
+// A ProvisionParam describes the server to loggers being provisioned (see provision.go): the base URL
+// at which loggers reach it, the PEM file of the CA certificate that they should trust for it (the
+// server's own certificate, if not given), and how often (minutes) they should check in.
+type ProvisionParam struct {
+	ServerURL      string `json:"server_url"`
+	CACert         string `json:"ca_cert"`
+	CheckinMinutes int    `json:"checkin_minutes"`
+}
+
+// A ReplicationParam controls the copying of accepted uploads, with their upload records, to a second
+// site (see replicate.go): another storage backend (of whose parameters only the backend, location, and
+// encryption apply), or a peer server at PeerURL, which has to accept PeerToken (with its certificate
+// signed by PeerCACert, if given).  Nothing is copied unless one is given.  A server accepts copies
+// from its peers if AcceptToken is given, and stores them under AcceptPrefix (which can't be empty) in
+// its own storage.
+type ReplicationParam struct {
+	Storage      StorageParam `json:"storage"`
+	PeerURL      string       `json:"peer_url"`
+	PeerToken    string       `json:"peer_token"`
+	PeerCACert   string       `json:"peer_ca_cert"`
+	AcceptToken  string       `json:"accept_token"`
+	AcceptPrefix string       `json:"accept_prefix"`
+}
+
+// A FederationParam links servers so that a downstream one (e.g., on a research vessel's LAN) forwards
+// the uploads and checkins that it collects to an upstream one whenever it can reach it (see
+// federation.go).  A downstream server gives the upstream server's base URL, the token it's known by
+// there, and the CA certificate (PEM) to trust for the upstream server, if not one of the system's.
+// An upstream server gives the token of each downstream server that may forward to it, by name.
+type FederationParam struct {
+	UpstreamURL string            `json:"upstream_url"`
+	Token       string            `json:"token"`
+	CACert      string            `json:"ca_cert"`
+	Downstreams map[string]string `json:"downstreams"`
 }
 
 // The Config object encapsulates all of the parameters required for the server, and
 // subsequent upload of the data to the processing instances.
 type Config struct {
-	API APIParam `json:"api"`
+	API        APIParam            `json:"api"`
+	Admin      AdminParam          `json:"admin"`
+	State      StateParam          `json:"state"`
+	Storage    StorageParam        `json:"storage"`
+	Integrity  IntegrityParam      `json:"integrity"`
+	Jobs       map[string]JobParam `json:"jobs"`
+	Quota      QuotaParam          `json:"quota"`
+	Mail       MailParam           `json:"mail"`
+	Reports    ReportParam         `json:"reports"`
+	Processing ProcessingParam     `json:"processing"`
+	Notify     NotifyParam         `json:"notify"`
+	AWS        AWSParam            `json:"aws"`
+	Shared     SharedParam         `json:"shared"`
+	RateLimit  RateLimitParam      `json:"rate_limit"`
+	Tracking   ErrorTrackingParam  `json:"error_tracking"`
+	Features   map[string]bool     `json:"features"` // See support/features.go
+	Logging    LoggingParam        `json:"logging"`
+	Clock      ClockParam          `json:"clock"`
+	Firmware   FirmwareParam       `json:"firmware"`
+	Flood      FloodParam          `json:"checkin_flood"`
+	Debug      DebugParam          `json:"debug"`
+	Quarantine QuarantineParam     `json:"quarantine"`
+	Backup     BackupParam         `json:"backup"`
+	Bandwidth  BandwidthParam      `json:"bandwidth"`
+	Mock       bool                `json:"mock"` // Replace storage and notification with in-memory stubs
+	Schedule   UploadScheduleParam `json:"upload_schedule"`
+	Upload     UploadParam         `json:"upload"`
+	Metrics    MetricsParam        `json:"metrics"`
+	Retry      RetryParam          `json:"retry"`
+	Reconcile  ReconcileParam      `json:"reconcile"`
+	Receipts   ReceiptParam        `json:"receipts"`
+	Tokens     TokenParam          `json:"tokens"`
+	Sessions   SessionParam        `json:"sessions"`
+	Enrollment EnrollParam         `json:"enrollment"`
+	Gateway    GatewayParam        `json:"gateway"`
+	Inbound    InboundParam        `json:"inbound_mail"`
+	Drop       DropParam           `json:"drop"`
+	Transfer   TransferParam       `json:"transfer"`
+	Live       LiveParam           `json:"live"`
+	Provision  ProvisionParam      `json:"provisioning"`
+	Replicate  ReplicationParam    `json:"replication"`
+	Federation FederationParam     `json:"federation"`
 }
 
-// Generate a new Config object from a given JSON file.  Errors are returned
-// if the file can't be opened, or if the JSON cannot be decoded to the Config type.
-func NewConfig(filename string) (*Config, error) {
-	config := new(Config)
-	f, err := os.Open(filename)
+// Generate a new Config object from the given JSON files, applied in order.  Any parameters not
+// specified in the files retain their default values (see NewDefaultConfig).  Where files give the
+// same parameter, the later file wins, except that maps (e.g., per-logger quotas) are merged by key;
+// lists (e.g., admin keys) are replaced as a whole.  Errors are returned if a file can't be opened,
+// if the JSON cannot be decoded to the Config type, or if files include each other in a loop.
+func NewConfig(filenames ...string) (*Config, error) {
+	config := NewDefaultConfig()
+	for _, filename := range filenames {
+		if err := config.apply(filename, nil); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Apply the named file to the configuration, after any files that it includes.  The files that
+// are including this one are listed so that loops can be detected.
+func (c *Config) apply(filename string, including []string) error {
+	filename = filepath.Clean(filename)
+	if slices.Contains(including, filename) {
+		return fmt.Errorf("configuration file %q is included in a loop", filename)
+	}
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		Errorf("failed to open %q for JSON configuration\n", filename)
-		return nil, err
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
 	}
-	decoder := json.NewDecoder(f)
-	if err := decoder.Decode(config); err != nil && err != io.EOF {
+	var header struct {
+		Include []string `json:"include"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
 		Errorf("failed to decode JSON parameters from %q (%v)\n", filename, err)
-		return nil, err
+		return err
 	}
-	return config, nil
+	for _, include := range header.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		if err := c.apply(include, append(including, filename)); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		Errorf("failed to decode JSON parameters from %q (%v)\n", filename, err)
+		return err
+	}
+	return nil
 }
 
 // Generate a basic-functionality Config structure if there is no further information
@@ -66,5 +620,67 @@ func NewConfig(filename string) (*Config, error) {
 func NewDefaultConfig() *Config {
 	config := new(Config)
 	config.API.Port = 8000
+	config.API.MaxUploads = 32
+	config.Admin.SessionMinutes = 60
+	config.Admin.PasswordMaxAgeDays = 90
+	config.State.Directory = "./state"
+	config.State.Migrate = true
+	config.Storage.Backend = "local"
+	config.Storage.Directory = "./data"
+	config.Integrity.SampleFraction = 1.0
+	config.Quota.WarnPercent = 80
+	config.Shared.Backend = "memory"
+	config.Shared.Redis.Prefix = "wibl-monitor:"
+	config.RateLimit.LoginPerMinute = 10
+	config.Tracking.SampleRate = 1.0
+	config.Logging.Level = "info"
+	config.Clock.MaxDriftSeconds = 30
+	config.Flood.Factor = 10
+	config.Debug.CaptureBodyBytes = 64 * 1024
+	config.Debug.RecordMaxMB = 100
+	config.Quarantine.MaxEntries = 1000
+	config.Quarantine.MaxBytes = 1024 * 1024
+	config.Quarantine.RetentionDays = 30
+	config.Backup.Keep = 14
+	config.Schedule.TimeZone = "UTC"
+	config.Schedule.SpreadMinutes = 60
+	config.Schedule.MaxFiles = 1
+	config.Schedule.BusyPercent = 75
+	config.Upload.ContentTypes = []string{"application/octet-stream"}
+	config.Upload.CheckHeader = true
+	config.Upload.Naming = "uuid"
+	config.Metrics.IntervalSeconds = 60
+	config.Metrics.CloudWatch.Namespace = "WIBL/UploadServer"
+	config.Metrics.StatsD.Prefix = "wibl."
+	config.Retry.Attempts = 3
+	config.Retry.InitialMillis = 200
+	config.Retry.MaxMillis = 5000
+	config.Reconcile.GraceHours = 24
+	config.Reconcile.Resend = true
+	config.Receipts.Enabled = true
+	config.Storage.Archive.AfterDays = 30
+	config.Storage.Layout = "flat"
+	config.Tokens.LifetimeDays = 0
+	config.Tokens.WarnDays = 30
+	config.Tokens.GraceHours = 24
+	config.Sessions.Enabled = true
+	config.Sessions.LifetimeMinutes = 60
+	config.Enrollment.ValidityDays = 90
+	config.API.NextCert = "./certs/next.crt"
+	config.API.CoAPPort = 5683
+	config.Inbound.Mailbox = "INBOX"
+	config.Drop.SettleSeconds = 60
+	config.Live.BufferSize = 500
+	config.Live.LoggerBytes = 1 << 20
+	config.Live.TotalBytes = 64 << 20
+	config.Live.MaxPerSecond = 10
+	config.Live.IdleSeconds = 120
+	config.Provision.CheckinMinutes = 60
+	config.Replicate.AcceptPrefix = "replica/"
+	config.Transfer.Default = "standard"
+	config.Transfer.Profiles = map[string]ProfileParam{
+		"standard":  {ChunkKB: 1024, ReadSeconds: 10, WriteSeconds: 30, RetrySeconds: 60, MaxRetries: 3},
+		"satellite": {ChunkKB: 16, ReadSeconds: 120, WriteSeconds: 300, RetrySeconds: 15, MaxRetries: 20},
+	}
 	return config
 }
@@ -0,0 +1,189 @@
+/*! @file configdoc.go
+ * @brief Generation of a documented configuration file
+ *
+ * The defaults in NewDefaultConfig() aren't visible to operators without reading the source, and
+ * neither is the full set of parameters.  This writes out a configuration with every parameter
+ * present, set to its default, along with a short description of each section.  Since JSON has no
+ * comments, the descriptions are held in keys starting with "//", which the configuration loader
+ * ignores, so the output can be used directly as a starting point.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Descriptions of the configuration, by JSON path.
+var configDocs = map[string]string{
+	"include":         "Other configuration files to apply before this one, relative to this file (optional)",
+	"api":             "Port for the HTTPS server (certificates are read from ./certs), the number of uploads handled at once (zero for no limit), the certificate that will replace the server's (advertised to loggers that pin certificates, if it exists), and the UDP port for CoAP telemetry (if the coap-listener feature is enabled)",
+	"admin":           "Pre-shared keys (name, token, role of viewer, operator, or admin, and optional tenant) and login policy for the administration API",
+	"state":           "Directory for state that persists between restarts (tokens, upload history, audit trail), and whether to apply migrations of the state files at startup (otherwise they have to be applied with the migrate command)",
+	"storage":         "Where accepted files are stored: backend \"local\" (under directory), \"s3\" (in bucket, under prefix), or \"memory\" (for development); the local backend encrypts files if given a key file (64 hex digits) or a KMS key ID under encryption; accepted files are compressed if compress is \"zstd\"; the S3 backend stores files in storage_class (the bucket's default, if empty) and, if archive gives a class, moves them there after_days after processing is confirmed; layout \"date\" stores files under {year}/{month}/{day}/ (\"flat\" doesn't); if manifests gives a prefix, a JSONL manifest of each day's uploads is kept under it",
+	"integrity":       "Fraction of stored files re-read and checked against their digest on each integrity check",
+	"jobs":            "Schedule for each background job, which can be disabled or run at a different interval",
+	"quota":           "Storage quota per logger in bytes (zero for no limit), per-logger overrides, and warning threshold (percent)",
+	"mail":            "SMTP server (host:port) and credentials for sending reports",
+	"reports":         "Recipients of the monthly usage report",
+	"processing":      "Platform metadata injection from the vessel record: \"\" (none), \"file\", or \"sidecar\"; and the tokens with which processing chain components report outcomes for files (by component name; none, if empty); and routes, each sending WIBL files from the loggers listed, and the percentage given of the others, to a pipeline under test: stored under the prefix (the route's name and \"/\", if empty), with the targets given (as for notify) told in place of the production chain",
+	"notify":          "How the processing chain is told about new files; empty targets are not used",
+	"notify.sns":      "SNS topic ARN to publish to, with message format \"native\" or \"s3-event\"",
+	"notify.sqs":      "SQS queue URL to send to, with message format \"native\" or \"s3-event\"",
+	"aws":             "AWS access for S3 and SNS/SQS; anything not given comes from the environment",
+	"shared":          "Where state shared between instances is held: \"memory\" (single instance) or \"redis\"",
+	"rate_limit":      "Requests per minute per logger (checkins, uploads) or remote address (logins); zero for no limit",
+	"error_tracking":  "Sentry-compatible error tracker; nothing is reported without a DSN",
+	"features":        "Experimental features, off unless enabled",
+	"logging":         "Log level: debug, info, warn, or error",
+	"clock":           "Largest difference (seconds) between a logger's reported time and the server's before an alert is raised; zero for no limit",
+	"firmware":        "Fleet firmware policy: the minimum version (none, if empty) and versions that are blocked; checkins from loggers out of policy raise an alert, and if upgrade_command is set, the logger is told to upgrade; can be changed at run-time (see /admin/v1/settings)",
+	"checkin_flood":   "Number of checkins from a logger in one checkin interval (provisioning.checkin_minutes) beyond which it's taken to be faulty: an alert is raised, and its checkins are refused until the interval ends; zero for no limit",
+	"mock":            "For development: keep files in memory and record notifications rather than sending them (see /admin/v1/mock)",
+	"bandwidth":       "Limits on the rate at which uploads are received (kilobytes per second), for each upload and in total; zero for no limit",
+	"upload_schedule": "When loggers are told to upload: quiet hours ({\"start\", \"end\"} as HH:MM in time_zone), spread (minutes) over which loggers are staggered, files per logger at once, and percentage of upload slots in use at which the server is busy",
+	"upload":          "Content types accepted for uploads (any, if empty), whether files must start with a WIBL header, the largest WIBL file accepted (bytes, zero for no limit), and the IDs of the keys with which loggers may encrypt files (named in the X-Encryption-Key-Id header; none, if empty); stored files are named by naming: \"uuid\" ({uuid}.wibl) or \"logger-file\" ({logger}-{file ID}-{uuid}.wibl)",
+	"upload.types":    "Other kinds of file loggers may upload, named in the X-Payload-Type header: content types accepted, size limit (bytes, zero for none), storage prefix (the name, if empty) and extension, and notification targets (as for notify)",
+	"metrics":         "Publishing of ingest metrics (uploads, bytes, failures, latency) at the interval given (seconds): to CloudWatch if enabled (using the AWS access in aws), under the namespace, with dimensions (name: value) attached to every metric; and to a StatsD agent at address (host:port; none, if empty), with the prefix on each name and tags (name: value) attached",
+	"retry":           "How storage writes and notifications are retried: attempts in all (one for no retries), and the wait before the first retry (milliseconds), doubling up to the maximum, with jitter",
+	"receipts":        "Whether accepted uploads get a signed receipt, and the Ed25519 signing key (PEM PKCS #8; generated if missing, default receipt-key.pem in the state directory)",
+	"tokens":          "Days for which an upload token is good (zero for ever; applies to tokens minted or renewed after it's set), days before expiry that the logger is told to renew it, and hours for which the old token remains good after renewal",
+	"sessions":        "Whether loggers are given a session token at checkin to use on uploads in place of their upload token, how long it lasts (minutes), and the file holding the signing key (hexadecimal; generated if missing, default session-key in the state directory)",
+	"enrollment":      "Whether loggers may enrol for a client certificate for mutual TLS, signed by the CA in ca_cert and ca_key (generated if neither exists; default ./certs/ca.crt and ./certs/ca.key), good for validity_days (but no longer than the logger's upload token)",
+	"gateway":         "Store-and-forward gateways (e.g., Iridium SBD) that relay status beacons from offshore loggers, and inbound mail relays: the secret the gateway service sends (in the X-Gateway-Key header; nothing is accepted without one), and the logger that each device (by IMEI) belongs to",
+	"inbound_mail":    "Collection of files sent as email attachments by vessels: the IMAP server (host:port, over TLS; nothing is collected if empty), credentials, and mailbox to collect from, and the sender addresses allowed (address: logger); each message must also carry the logger's upload token, in an X-WIBL-Token header or a \"WIBL-Token: {token}\" line in its text",
+	"drop":            "Collection of files from a drop directory fed by SFTP (nothing is collected if empty): the logger that files in each subdirectory belong to (subdirectory: logger), and the seconds a file must go unmodified before it's collected; accepted files are removed, and rejected ones moved to .rejected",
+	"transfer":        "Transfer profiles, assigned to loggers in the registry (default, if none): for each, the chunk size (kilobytes) loggers send files in, the seconds the server waits to receive a request and send its response, and the interval (seconds) and number of retries",
+	"live":            "Real-time observations streamed by loggers (if the live-streaming feature is enabled): the number kept for each logger, the most bytes of them kept for each logger and for all loggers together, the most accepted from a logger each second (the rest are dropped), and the seconds a stream may go without an observation before it's closed",
+	"provisioning":    "How loggers being provisioned reach the server: its base URL, the CA certificate file (PEM) they should trust (the server's certificate, if empty), and how often (minutes) they should check in",
+	"replication":     "Copies of accepted uploads and their records at a second site: another storage backend (only the backend, location, and encryption apply), or a peer server's base URL with the token it accepts and the CA certificate (PEM) to trust for it; and the token this server accepts from its peers (none, if empty), with the prefix their copies are stored under (which is required)",
+	"federation":      "Forwarding of uploads and checkins from a downstream server (e.g., on a vessel) to an upstream one: for a downstream server, the upstream server's base URL, the token it's known by there, and the CA certificate (PEM) to trust for it; for an upstream server, the token of each downstream server, by name",
+	"quarantine":      "Payloads of checkins whose status doesn't parse and uploads that fail validation, kept with the reason for investigation: the most entries kept (none, if zero; the oldest are dropped first), bytes kept of each payload (zero for all), and days before entries are dropped",
+	"backup":          "Scheduled backups of the state directory and configuration to the storage backend: the prefix to store them under (none are made, if empty), the number of the most recent backups kept, and the key file or KMS key to encrypt them with (that of storage, if not given; backups aren't stored unless they can be encrypted)",
+	"reconcile":       "Hours a file reported by a logger may go unstored before it counts as missing, and whether loggers are asked to re-send missing files",
+	"debug":           "Number of recent requests kept from each logger for diagnosis (zero to keep none), and bytes kept of each body; file to record requests to for replay (empty for none), and its size limit",
+}
+
+// Write the configuration given as JSON, with every parameter present and each section described.
+func WriteDocumentedConfig(w io.Writer, c *Config) error {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	buf.WriteString(`    "//": "WIBL upload server configuration, with default values",` + "\n")
+	buf.WriteString(`    "//include": ` + quote(configDocs["include"]) + ",\n")
+	buf.WriteString(`    "include": [],` + "\n")
+	if err := writeFields(&buf, reflect.ValueOf(c).Elem(), "", 1); err != nil {
+		return err
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Write the fields of a structure as JSON object members at the indent level given, each preceded
+// by its description, if it has one.
+func writeFields(buf *bytes.Buffer, v reflect.Value, path string, level int) error {
+	indent := strings.Repeat("    ", level)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if len(name) == 0 || name == "-" {
+			continue
+		}
+		child := name
+		if len(path) > 0 {
+			child = path + "." + name
+		}
+		if doc, ok := configDocs[child]; ok {
+			buf.WriteString(indent + quote("//"+name) + ": " + quote(doc) + ",\n")
+		}
+		buf.WriteString(indent + quote(name) + ": ")
+		if err := writeDocumented(buf, v.Field(i), child, level+1); err != nil {
+			return err
+		}
+		if i < t.NumField()-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	return nil
+}
+
+// Write the value given as JSON, with nested objects at the indent level given.
+func writeDocumented(buf *bytes.Buffer, v reflect.Value, path string, level int) error {
+	indent := strings.Repeat("    ", level)
+	switch v.Kind() {
+	case reflect.Struct:
+		buf.WriteString("{\n")
+		if err := writeFields(buf, v, path, level); err != nil {
+			return err
+		}
+		buf.WriteString(strings.Repeat("    ", level-1) + "}")
+	case reflect.Map:
+		if v.Len() == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		buf.WriteString("{\n")
+		for i, k := range keys {
+			buf.WriteString(indent + quote(k) + ": ")
+			if err := writeDocumented(buf, v.MapIndex(reflect.ValueOf(k)), path+"."+k, level+1); err != nil {
+				return err
+			}
+			if i < len(keys)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(strings.Repeat("    ", level-1) + "}")
+	case reflect.Slice:
+		if v.Len() == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+		data, err := json.MarshalIndent(v.Interface(), strings.Repeat("    ", level-1), "    ")
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	default:
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+func quote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
@@ -0,0 +1,89 @@
+/*! @file confirm.go
+ * @brief Confirmation tokens for destructive administrative actions
+ *
+ * Some actions (e.g., purging all of a logger's data) can't be undone, so the administration API
+ * requires them to be requested twice: the first request returns a short-lived confirmation token,
+ * which has to be presented by the same principal with the second request for the action to proceed.
+ * This guards against mistakes (e.g., the wrong logger ID in a script) rather than malice.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type pendingConfirmation struct {
+	Token     string    `json:"token"`
+	Principal string    `json:"principal"`
+	Expires   time.Time `json:"expires"`
+}
+
+// A Confirmations holds the outstanding confirmation tokens in the shared state, indexed by the
+// action that they confirm (e.g., "purge:<logger>").
+type Confirmations struct {
+	ttl   time.Duration
+	state SharedState
+}
+
+func NewConfirmations(state SharedState, ttl time.Duration) *Confirmations {
+	return &Confirmations{ttl: ttl, state: state}
+}
+
+// Generate a confirmation token for the action given, replacing any outstanding token.
+func (c *Confirmations) Request(action, principal string) (string, time.Time, error) {
+	token, err := RandomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(c.ttl)
+	value, err := json.Marshal(pendingConfirmation{Token: token, Principal: principal, Expires: expires})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := c.state.Set("confirm:"+action, value, c.ttl); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+// Check the confirmation token for the action given.  A token can only be used once, even if
+// presented to different instances of the server at the same time.
+func (c *Confirmations) Confirm(action, principal, token string) bool {
+	value, err := c.state.Get("confirm:" + action)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			Errorf("failed to look up confirmation for %s: %s\n", action, err)
+		}
+		return false
+	}
+	var p pendingConfirmation
+	if json.Unmarshal(value, &p) != nil || p.Principal != principal || p.Token != token {
+		return false
+	}
+	// Only the request that removes the token gets to use it.
+	if taken, err := c.state.Take("confirm:" + action); err != nil || string(taken) != string(value) {
+		return false
+	}
+	return time.Now().Before(p.Expires)
+}
@@ -0,0 +1,129 @@
+/*! @file deadletter.go
+ * @brief Record of accepted files that never reached the processing chain
+ *
+ * An accepted file whose notification fails, even after retries, is stored but won't be processed
+ * without intervention.  An alert is raised, but alerts are easily missed, so the file is also held
+ * in the dead-letter store until an operator re-drives it (or discards the entry), which makes sure
+ * that no accepted file silently drops out of the pipeline.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A DeadLetter records an accepted file that couldn't be passed on for processing.
+type DeadLetter struct {
+	UUID     string    `json:"uuid"`
+	Logger   string    `json:"logger"`
+	Key      string    `json:"key"`
+	Type     string    `json:"type,omitempty"` // Payload type, if not WIBL data
+	Target   string    `json:"target"`         // What couldn't be notified
+	Error    string    `json:"error"`
+	Failures int       `json:"failures"` // Number of times the notification has failed
+	First    time.Time `json:"first_failure"`
+	Last     time.Time `json:"last_failure"`
+}
+
+// A DeadLetterStore holds the dead letters, by upload UUID.
+type DeadLetterStore struct {
+	mu       sync.Mutex
+	filename string
+	letters  map[string]*DeadLetter
+}
+
+// Generate a dead-letter store from the given file, which need not exist.
+func NewDeadLetterStore(filename string) (*DeadLetterStore, error) {
+	s := &DeadLetterStore{filename: filename, letters: make(map[string]*DeadLetter)}
+	var letters []*DeadLetter
+	if err := LoadJSON(filename, &letters); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, letter := range letters {
+		s.letters[letter.UUID] = letter
+	}
+	return s, nil
+}
+
+// Record a failure to pass on the upload given, adding to the existing entry if there is one.
+func (s *DeadLetterStore) Add(record UploadRecord, target string, failure error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	letter, ok := s.letters[record.UUID]
+	if !ok {
+		letter = &DeadLetter{UUID: record.UUID, Logger: record.Logger, Type: record.Type, First: now}
+		s.letters[record.UUID] = letter
+	}
+	letter.Key = record.Key
+	letter.Target = target
+	letter.Error = failure.Error()
+	letter.Failures++
+	letter.Last = now
+	return s.save()
+}
+
+// Provide the entry for the upload given.
+func (s *DeadLetterStore) Get(uuid string) (DeadLetter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letter, ok := s.letters[uuid]
+	if !ok {
+		return DeadLetter{}, false
+	}
+	return *letter, true
+}
+
+// Generate a list of all of the entries, oldest failure first.
+func (s *DeadLetterStore) List() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rtn := make([]DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		rtn = append(rtn, *letter)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].First.Before(rtn[j].First) })
+	return rtn
+}
+
+// Remove the entry for the upload given (e.g., once it has been re-driven successfully).
+func (s *DeadLetterStore) Remove(uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.letters[uuid]; !ok {
+		return ErrNotFound
+	}
+	delete(s.letters, uuid)
+	return s.save()
+}
+
+func (s *DeadLetterStore) save() error {
+	letters := make([]*DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	return SaveJSON(s.filename, letters)
+}
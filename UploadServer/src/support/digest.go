@@ -0,0 +1,98 @@
+/*! @file digest.go
+ * @brief Checking the digest that loggers send with their uploads
+ *
+ * Loggers send a digest of each file in the Digest header (as "algorithm=hex value"), so that the
+ * server can tell that the file arrived intact.  MD5 is the original choice, but it's slow on the
+ * smallest loggers, so CRC32C ("crc32c") and xxHash64 ("xxh64") are accepted as alternatives; the
+ * server lists the algorithms it accepts in its version information, so that firmware can choose.
+ * Whichever the logger uses, the server always computes the MD5 digest itself, since that's what
+ * repeats are recognised by and what the processing chain expects.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// The errors returned when checking a Digest header.
+var (
+	ErrNoDigest          = errors.New("no digest header")
+	ErrUnsupportedDigest = errors.New("unsupported digest algorithm")
+	ErrDigestMismatch    = errors.New("digest mismatch")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// The digest algorithms accepted, by name, each generating the digest as hex.
+var digests = map[string]func(data []byte) string{
+	"md5":    func(data []byte) string { return fmt.Sprintf("%X", md5.Sum(data)) },
+	"crc32c": func(data []byte) string { return fmt.Sprintf("%08X", crc32.Checksum(data, castagnoli)) },
+	"xxh64":  func(data []byte) string { return fmt.Sprintf("%016X", xxhash.Sum64(data)) },
+}
+
+// The names of the digest algorithms accepted, in order of preference.
+var DigestAlgorithms = []string{"md5", "crc32c", "xxh64"}
+
+// Extract the MD5 digest from a Digest header, if it has one, giving an empty string otherwise.
+func ClaimedMD5(header string) string {
+	for _, entry := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if strings.EqualFold(name, "md5") {
+			return strings.ToUpper(value)
+		}
+	}
+	return ""
+}
+
+// Check the data against the Digest header given, returning the algorithm used.  The header may give
+// more than one digest, separated by commas; all of those with supported algorithms must match, and
+// the first is reported.
+func CheckDigest(header string, data []byte) (string, error) {
+	if len(strings.TrimSpace(header)) == 0 {
+		return "", ErrNoDigest
+	}
+	var rtn string
+	for _, entry := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.ToLower(name)
+		digest, ok := digests[name]
+		if !ok {
+			continue
+		}
+		if !strings.EqualFold(digest(data), value) {
+			return name, ErrDigestMismatch
+		}
+		if len(rtn) == 0 {
+			rtn = name
+		}
+	}
+	if len(rtn) == 0 {
+		return "", ErrUnsupportedDigest
+	}
+	return rtn, nil
+}
@@ -0,0 +1,62 @@
+package support
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDigest(t *testing.T) {
+	data := []byte("hello world")
+	const (
+		md5Hex    = "5EB63BBBE01EEED093CB22BB8F5ACDC3"
+		crc32cHex = "C99465AA"
+		xxh64Hex  = "45AB6734B21E6968"
+	)
+	tests := []struct {
+		name      string
+		header    string
+		algorithm string
+		err       error
+	}{
+		{"md5", "md5=" + md5Hex, "md5", nil},
+		{"md5 lower case", "MD5=5eb63bbbe01eeed093cb22bb8f5acdc3", "md5", nil},
+		{"crc32c", "crc32c=" + crc32cHex, "crc32c", nil},
+		{"xxh64", "xxh64=" + xxh64Hex, "xxh64", nil},
+		{"several, first reported", "crc32c=" + crc32cHex + ", md5=" + md5Hex, "crc32c", nil},
+		{"unsupported skipped", "sha-256=whatever, md5=" + md5Hex, "md5", nil},
+		{"empty", "", "", ErrNoDigest},
+		{"blank", "   ", "", ErrNoDigest},
+		{"only unsupported", "sha-256=whatever", "", ErrUnsupportedDigest},
+		{"no value", "md5", "md5", ErrDigestMismatch},
+		{"mismatch", "md5=00000000000000000000000000000000", "md5", ErrDigestMismatch},
+		{"one of several mismatches", "md5=" + md5Hex + ",crc32c=00000000", "crc32c", ErrDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algorithm, err := CheckDigest(tt.header, data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("CheckDigest(%q) error = %v, want %v", tt.header, err, tt.err)
+			}
+			if algorithm != tt.algorithm {
+				t.Errorf("CheckDigest(%q) = %q, want %q", tt.header, algorithm, tt.algorithm)
+			}
+		})
+	}
+}
+
+func TestClaimedMD5(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"md5=5eb63bbbe01eeed093cb22bb8f5acdc3", "5EB63BBBE01EEED093CB22BB8F5ACDC3"},
+		{"crc32c=C99465AA, MD5=5EB63BBBE01EEED093CB22BB8F5ACDC3", "5EB63BBBE01EEED093CB22BB8F5ACDC3"},
+		{"crc32c=C99465AA", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ClaimedMD5(tt.header); got != tt.want {
+			t.Errorf("ClaimedMD5(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
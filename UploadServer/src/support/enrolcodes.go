@@ -0,0 +1,184 @@
+/*! @file enrolcodes.go
+ * @brief One-time codes with which new loggers enrol themselves
+ *
+ * Setting up a new logger on the bench used to mean minting a token for it and typing the token
+ * into its configuration.  Instead, an administrator mints a short one-time enrolment code (with
+ * the tenant, vessel, and transfer profile that the logger is to have), and the logger presents the
+ * code once to be assigned its identifier and upload token (see enrolcodes.go in the main package).
+ * As for upload tokens, only the SHA-256 hash of each code is kept, so the code is available only
+ * when minted.  Codes expire if not used, and record the logger that used them.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ErrEnrolmentCode is returned for codes that are unknown, used, or expired.
+var ErrEnrolmentCode = errors.New("enrolment code is not valid")
+
+// An EnrolmentCode is the record of a code that a logger may use once to enrol.
+type EnrolmentCode struct {
+	ID          string     `json:"id"`
+	Hash        string     `json:"hash"`
+	Description string     `json:"description"`
+	Author      string     `json:"author"` // Operator who minted the code
+	Tenant      string     `json:"tenant,omitempty"`
+	Vessel      string     `json:"vessel,omitempty"`
+	Profile     string     `json:"profile,omitempty"`
+	Created     time.Time  `json:"created"`
+	Expires     time.Time  `json:"expires"`
+	Used        *time.Time `json:"used,omitempty"`
+	Logger      string     `json:"logger,omitempty"` // Logger that enrolled with the code, once used
+}
+
+// An EnrolmentCodes holds the enrolment codes that operators have minted.
+type EnrolmentCodes struct {
+	mu       sync.Mutex
+	filename string
+	codes    map[string]EnrolmentCode // Indexed by ID
+}
+
+// Generate a store of enrolment codes from the file given, which need not exist.
+func NewEnrolmentCodes(filename string) (*EnrolmentCodes, error) {
+	s := &EnrolmentCodes{filename: filename, codes: make(map[string]EnrolmentCode)}
+	var codes []EnrolmentCode
+	if err := LoadJSON(filename, &codes); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, c := range codes {
+		s.codes[c.ID] = c
+	}
+	return s, nil
+}
+
+// Generate a new enrolment code from the template given (with description, author, and registry
+// information), good for the lifetime given.  The plain-text code (as groups of four characters) is
+// returned along with the record, and is not available from the store after this.
+func (s *EnrolmentCodes) Mint(template EnrolmentCode, lifetime time.Duration) (string, EnrolmentCode, error) {
+	buffer := make([]byte, 10)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", EnrolmentCode{}, err
+	}
+	raw := base32.StdEncoding.EncodeToString(buffer)
+	code := strings.Join([]string{raw[0:4], raw[4:8], raw[8:12], raw[12:16]}, "-")
+	id, err := RandomToken(6)
+	if err != nil {
+		return "", EnrolmentCode{}, err
+	}
+	record := template
+	record.ID, record.Hash = id, hashCode(code)
+	record.Created = time.Now().UTC()
+	record.Expires = record.Created.Add(lifetime)
+	record.Used, record.Logger = nil, ""
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[id] = record
+	if err := s.save(); err != nil {
+		delete(s.codes, id)
+		return "", EnrolmentCode{}, err
+	}
+	return code, record, nil
+}
+
+// Use an enrolment code for the logger given, returning its record.  Each code can only be used
+// once, before it expires.
+func (s *EnrolmentCodes) Redeem(code, logger string) (EnrolmentCode, error) {
+	hash := hashCode(code)
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, c := range s.codes {
+		if c.Hash != hash {
+			continue
+		}
+		if c.Used != nil || now.After(c.Expires) {
+			return EnrolmentCode{}, ErrEnrolmentCode
+		}
+		c.Used, c.Logger = &now, logger
+		s.codes[id] = c
+		if err := s.save(); err != nil {
+			c.Used, c.Logger = nil, ""
+			s.codes[id] = c
+			return EnrolmentCode{}, err
+		}
+		return c, nil
+	}
+	return EnrolmentCode{}, ErrEnrolmentCode
+}
+
+// Make a code that was redeemed available again, if enrolment failed after it was redeemed.
+func (s *EnrolmentCodes) Release(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.codes[id]
+	if !ok {
+		return ErrNotFound
+	}
+	c.Used, c.Logger = nil, ""
+	s.codes[id] = c
+	return s.save()
+}
+
+// Remove the code with the ID given, so that it can no longer be used.
+func (s *EnrolmentCodes) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.codes[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.codes, id)
+	return s.save()
+}
+
+// Generate a list of all codes in the store, ordered by creation time.
+func (s *EnrolmentCodes) List() []EnrolmentCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rtn := make([]EnrolmentCode, 0, len(s.codes))
+	for _, c := range s.codes {
+		rtn = append(rtn, c)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Created.Before(rtn[j].Created) })
+	return rtn
+}
+
+func (s *EnrolmentCodes) save() error {
+	codes := make([]EnrolmentCode, 0, len(s.codes))
+	for _, c := range s.codes {
+		codes = append(codes, c)
+	}
+	return SaveJSON(s.filename, codes)
+}
+
+// Hash a code, ignoring case and the separators between groups, since codes are often typed in.
+func hashCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return HashToken(code)
+}
@@ -0,0 +1,175 @@
+/*! @file enroll.go
+ * @brief Certificate authority for logger client certificates
+ *
+ * Loggers are easy to provision with an upload token, but mutual TLS is stronger transport
+ * authentication.  To bridge the two, a logger can enrol (see enroll.go in the main package): it
+ * authenticates with its token and sends a certificate signing request, and the server's CA signs a
+ * client certificate for it.  The certificate names the logger (as the common name) and the upload
+ * token used to enrol (as the organisational unit), so that revoking the token revokes the
+ * certificate too, and it never outlives the token.  The CA's certificate and key are PEM files; if
+ * neither exists, a new CA (ECDSA P-256, good for ten years) is generated.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A CertificateAuthority signs client certificates for loggers.
+type CertificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pem  []byte
+}
+
+// Load the CA from the certificate and key files given, generating (and saving) a new CA if neither
+// exists.
+func LoadCertificateAuthority(certFile, keyFile string) (*CertificateAuthority, error) {
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		return newCertificateAuthority(certFile, keyFile)
+	} else if certErr != nil {
+		return nil, certErr
+	} else if keyErr != nil {
+		return nil, keyErr
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certFile, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certFile, err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return nil, fmt.Errorf("%s: not a CA certificate and signing key", certFile)
+	}
+	return &CertificateAuthority{cert: cert, key: key, pem: certPEM}, nil
+}
+
+func newCertificateAuthority(certFile, keyFile string) (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "WIBL logger CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	Infof("generated logger CA in %s.\n", certFile)
+	return &CertificateAuthority{cert: cert, key: key, pem: certPEM}, nil
+}
+
+// Provide the CA's certificate, PEM-encoded.
+func (ca *CertificateAuthority) CertificatePEM() []byte {
+	return ca.pem
+}
+
+// Provide a pool holding the CA's certificate, for checking client certificates.
+func (ca *CertificateAuthority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Sign a client certificate for the public key in the request given, for the logger and upload token
+// given, good until the time given.  The subject of the request is ignored.  The certificate is
+// returned PEM-encoded, along with its serial number.
+func (ca *CertificateAuthority) Sign(csr *x509.CertificateRequest, logger, tokenID string, notAfter time.Time) ([]byte, string, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, "", err
+	}
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: logger, OrganizationalUnit: []string{tokenID}},
+		NotBefore:    time.Now().UTC().Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, "", err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), template.SerialNumber.Text(16), nil
+}
+
+// Find the logger and upload token ID named in the client certificate of a request, if the client
+// gave one that the server verified.
+func ClientCertificate(r *http.Request) (string, string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", "", false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if len(subject.CommonName) == 0 || len(subject.OrganizationalUnit) != 1 {
+		return "", "", false
+	}
+	return subject.CommonName, subject.OrganizationalUnit[0], true
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
@@ -0,0 +1,88 @@
+/*! @file features.go
+ * @brief Feature flags for experimental parts of the server
+ *
+ * New protocol behaviour has to be tried at one site before it's rolled out everywhere, without
+ * maintaining different builds for each.  Experimental subsystems are therefore gated by feature
+ * flags in the "features" block of the configuration, which are off unless enabled.  Each flag is
+ * listed here so that a misspelt name in the configuration is reported rather than silently ignored,
+ * along with whether the subsystem is available in this build: flags can be set ahead of an upgrade,
+ * and have no effect until the subsystem arrives.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A Feature describes an experimental subsystem that can be enabled in the configuration.
+type Feature struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Available   bool   `json:"available"` // Whether this build implements the feature
+	Enabled     bool   `json:"enabled"`
+}
+
+// The features known to the server, by name.
+var knownFeatures = map[string]Feature{
+	"resumable-uploads": {Description: "Uploads of large files in chunks that can be resumed after a dropped connection", Available: true},
+	"pull-mode":         {Description: "Server-initiated transfers from loggers that are reachable on the network"},
+	"grpc-listener":     {Description: "A gRPC listener for the logger protocol alongside HTTPS"},
+	"http3-listener":    {Description: "An HTTP/3 (QUIC) listener alongside HTTPS, on the same port number", Available: true},
+	"coap-listener":     {Description: "A CoAP/UDP listener for compact checkin telemetry from constrained relays", Available: true},
+	"challenge-auth":    {Description: "Challenge-response authentication for loggers, in place of sending the upload token", Available: true},
+	"delta-transfer":    {Description: "Re-sending of files the server partially has by exchanging block digests, so that only changed blocks are sent", Available: true},
+	"live-streaming":    {Description: "Streaming of real-time NMEA observations from loggers, republished to live displays over server-sent events", Available: true},
+	"upload-sessions":   {Description: "Uploads in stages (begin, send data in parts, commit with the file's digest), recorded for diagnosis", Available: true},
+}
+
+// Check that all of the features named in the configuration are known, warning about any that are
+// enabled but not available in this build.
+func CheckFeatures(flags map[string]bool) error {
+	for name, enabled := range flags {
+		f, ok := knownFeatures[name]
+		if !ok {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+		if enabled && !f.Available {
+			Warnf("feature %s is enabled, but not available in this version of the server.\n", name)
+		}
+	}
+	return nil
+}
+
+// Determine whether a feature is enabled in the configuration, and available in this build.
+func (c *Config) FeatureEnabled(name string) bool {
+	return c.Features[name] && knownFeatures[name].Available
+}
+
+// Generate a list of all known features, and whether each is enabled, ordered by name.
+func (c *Config) FeatureList() []Feature {
+	rtn := make([]Feature, 0, len(knownFeatures))
+	for name, f := range knownFeatures {
+		f.Name = name
+		f.Enabled = c.Features[name]
+		rtn = append(rtn, f)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Name < rtn[j].Name })
+	return rtn
+}
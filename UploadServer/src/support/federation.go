@@ -0,0 +1,110 @@
+/*! @file federation.go
+ * @brief The sync cursors of the downstream servers that forward their records to this one
+ *
+ * A downstream server forwards its uploads and checkins in order of receipt, and the upstream server
+ * keeps its cursor (how far it has got) so that the downstream server can pick up where it left off
+ * each time it has a connection, even if it has lost its own state (see federation.go in the main
+ * package).  The cursors are kept in a JSON file in the state directory.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// A Downstream records how far a downstream server has forwarded its records.
+type Downstream struct {
+	Name    string         `json:"name"`
+	Cursor  api.SyncCursor `json:"cursor"`
+	Updated time.Time      `json:"updated"` // When the cursor last moved
+}
+
+// A SyncCursors holds the cursors of the downstream servers, by name.
+type SyncCursors struct {
+	mu       sync.Mutex
+	filename string
+	cursors  map[string]Downstream
+}
+
+// Generate a store of sync cursors from the file given, which need not exist.
+func NewSyncCursors(filename string) (*SyncCursors, error) {
+	s := &SyncCursors{filename: filename, cursors: make(map[string]Downstream)}
+	var cursors []Downstream
+	if err := LoadJSON(filename, &cursors); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, d := range cursors {
+		s.cursors[d.Name] = d
+	}
+	return s, nil
+}
+
+// Provide the cursor of the downstream server given, which is at the start if it hasn't forwarded
+// anything yet.
+func (s *SyncCursors) Get(name string) api.SyncCursor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cursors[name].Cursor
+}
+
+// Move the cursor of the downstream server given.
+func (s *SyncCursors) Set(name string, cursor api.SyncCursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.cursors[name]
+	s.cursors[name] = Downstream{Name: name, Cursor: cursor, Updated: time.Now().UTC()}
+	if err := s.save(); err != nil {
+		if ok {
+			s.cursors[name] = existing
+		} else {
+			delete(s.cursors, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Generate a list of the downstream servers that have forwarded records, ordered by name.
+func (s *SyncCursors) List() []Downstream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rtn := make([]Downstream, 0, len(s.cursors))
+	for _, d := range s.cursors {
+		rtn = append(rtn, d)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Name < rtn[j].Name })
+	return rtn
+}
+
+func (s *SyncCursors) save() error {
+	cursors := make([]Downstream, 0, len(s.cursors))
+	for _, d := range s.cursors {
+		cursors = append(cursors, d)
+	}
+	return SaveJSON(s.filename, cursors)
+}
@@ -0,0 +1,152 @@
+/*! @file fleet.go
+ * @brief Tracking of the most recent status reported by each logger in the fleet
+ *
+ * Every checkin from a logger carries a status message with its firmware versions, the files
+ * that it holds, and so on.  This module keeps the most recent of these for each logger so that
+ * the operator can see the state of the fleet through the administration API.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// A LoggerStatus is the most recent information the server has on a logger.
+type LoggerStatus struct {
+	LoggerID    string     `json:"logger"`
+	LastCheckin time.Time  `json:"last_checkin"`
+	RemoteAddr  string     `json:"remote_addr"`
+	Checkins    uint64     `json:"checkins"`
+	ClockOffset *float64   `json:"clock_offset,omitempty"` // Seconds ahead of the server, if reported
+	Status      api.Status `json:"status"`
+	Beacon      *Beacon    `json:"beacon,omitempty"`          // Most recent beacon relayed by a gateway, if any
+	Warnings    []string   `json:"status_warnings,omitempty"` // Parts of the status the server didn't understand
+}
+
+// A Beacon records a status beacon that a store-and-forward gateway relayed from a logger, with the
+// position that the gateway estimated for the logger, if it gave one.
+type Beacon struct {
+	Gateway   string    `json:"gateway"`
+	Device    string    `json:"device"`
+	Sequence  uint64    `json:"sequence"` // Gateway's message sequence number for the device
+	Sent      time.Time `json:"sent"`
+	Latitude  *float64  `json:"latitude,omitempty"`
+	Longitude *float64  `json:"longitude,omitempty"`
+	CEP       float64   `json:"cep_km,omitempty"` // Radius of the position's circular error probable
+}
+
+// A FleetStatus tracks the most recent status for each logger that has checked in.
+type FleetStatus struct {
+	mu      sync.RWMutex
+	loggers map[string]*LoggerStatus
+}
+
+func NewFleetStatus() *FleetStatus {
+	return &FleetStatus{loggers: make(map[string]*LoggerStatus)}
+}
+
+// Record a new status message from the given logger, along with the offset of its clock from the
+// server's (nil if the logger didn't report its time).
+func (f *FleetStatus) Update(logger, remote string, status api.Status, offset *float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	record, ok := f.loggers[logger]
+	if !ok {
+		record = &LoggerStatus{LoggerID: logger}
+		f.loggers[logger] = record
+	}
+	record.LastCheckin = time.Now().UTC()
+	record.RemoteAddr = remote
+	record.Checkins++
+	record.ClockOffset = offset
+	record.Status = status
+}
+
+// Record a status that a logger gave at the time given, as relayed by another server.  The status only
+// replaces the logger's current one if it's more recent.
+func (f *FleetStatus) Relay(logger, remote string, at time.Time, status api.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	record, ok := f.loggers[logger]
+	if !ok {
+		record = &LoggerStatus{LoggerID: logger}
+		f.loggers[logger] = record
+	}
+	record.Checkins++
+	if at.After(record.LastCheckin) {
+		record.LastCheckin, record.RemoteAddr, record.ClockOffset, record.Status = at.UTC(), remote, nil, status
+	}
+}
+
+// Record the beacon through which the named logger's most recent status was relayed.  The logger
+// must already have a status.
+func (f *FleetStatus) SetBeacon(logger string, beacon Beacon) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if record, ok := f.loggers[logger]; ok {
+		record.Beacon = &beacon
+	}
+}
+
+// Record what the server didn't understand in the named logger's most recent status (see
+// support/lenient.go).  The logger must already have a status.
+func (f *FleetStatus) SetWarnings(logger string, warnings []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if record, ok := f.loggers[logger]; ok {
+		record.Warnings = warnings
+	}
+}
+
+// Provide the current status of the named logger, if it has checked in.
+func (f *FleetStatus) Get(logger string) (LoggerStatus, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	record, ok := f.loggers[logger]
+	if !ok {
+		return LoggerStatus{}, false
+	}
+	return *record, true
+}
+
+// Generate a list of the current status of all loggers, ordered by logger identifier.
+func (f *FleetStatus) List() []LoggerStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rtn := make([]LoggerStatus, 0, len(f.loggers))
+	for _, record := range f.loggers {
+		rtn = append(rtn, *record)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].LoggerID < rtn[j].LoggerID })
+	return rtn
+}
+
+// Remove all status information for the named logger.
+func (f *FleetStatus) Delete(logger string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.loggers, logger)
+}
@@ -0,0 +1,135 @@
+/*! @file holds.go
+ * @brief Legal holds on uploads and loggers
+ *
+ * When data becomes part of an incident investigation, it has to be kept regardless of the usual
+ * data-handling rules.  A legal hold can be placed on a single upload, or on a logger (which holds
+ * everything that the logger has sent, and will send).  Anything that removes data (e.g., a purge)
+ * has to check for holds first, with HoldStore.Holding, and leave held data in place.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The kinds of thing that can be held.
+const (
+	HoldUpload = "upload"
+	HoldLogger = "logger"
+)
+
+// A Hold keeps an upload, or all of a logger's uploads, from being removed.
+type Hold struct {
+	Kind   string    `json:"kind"`
+	Target string    `json:"target"` // Upload UUID or logger identifier
+	Reason string    `json:"reason"`
+	By     string    `json:"by"`
+	Placed time.Time `json:"placed"`
+}
+
+// A HoldStore holds the legal holds, by kind and target.
+type HoldStore struct {
+	mu       sync.Mutex
+	filename string
+	holds    map[string]*Hold
+}
+
+func holdKey(kind, target string) string {
+	return kind + ":" + target
+}
+
+// Generate a hold store from the given file, which need not exist.
+func NewHoldStore(filename string) (*HoldStore, error) {
+	s := &HoldStore{filename: filename, holds: make(map[string]*Hold)}
+	var holds []*Hold
+	if err := LoadJSON(filename, &holds); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, hold := range holds {
+		s.holds[holdKey(hold.Kind, hold.Target)] = hold
+	}
+	return s, nil
+}
+
+// Place a hold, replacing any existing hold on the same target.
+func (s *HoldStore) Place(hold Hold) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holds[holdKey(hold.Kind, hold.Target)] = &hold
+	return s.save()
+}
+
+// Release the hold on the target given.
+func (s *HoldStore) Release(kind, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := holdKey(kind, target)
+	if _, ok := s.holds[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.holds, key)
+	return s.save()
+}
+
+// Provide the hold on the target given, if there is one.
+func (s *HoldStore) Get(kind, target string) (Hold, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hold, ok := s.holds[holdKey(kind, target)]
+	if !ok {
+		return Hold{}, false
+	}
+	return *hold, true
+}
+
+// Find the hold that keeps the upload given from being removed: one on the upload itself, or on the
+// logger that sent it.
+func (s *HoldStore) Holding(record UploadRecord) (Hold, bool) {
+	if hold, ok := s.Get(HoldUpload, record.UUID); ok {
+		return hold, true
+	}
+	return s.Get(HoldLogger, record.Logger)
+}
+
+// Generate a list of all of the holds, oldest first.
+func (s *HoldStore) List() []Hold {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rtn := make([]Hold, 0, len(s.holds))
+	for _, hold := range s.holds {
+		rtn = append(rtn, *hold)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Placed.Before(rtn[j].Placed) })
+	return rtn
+}
+
+func (s *HoldStore) save() error {
+	holds := make([]*Hold, 0, len(s.holds))
+	for _, hold := range s.holds {
+		holds = append(holds, hold)
+	}
+	return SaveJSON(s.filename, holds)
+}
@@ -0,0 +1,116 @@
+/*! @file journal.go
+ * @brief Append-only JSON Lines files for server records
+ *
+ * Records that accumulate over time (audit entries, upload history) are kept as JSON Lines files:
+ * one JSON object per line, appended as they happen.  This is simple, robust against crashes (at
+ * worst the last line is truncated, and is skipped on reading), and easy for other tools to consume.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// A Journal is an append-only JSON Lines file.
+type Journal struct {
+	mu       sync.Mutex
+	filename string
+}
+
+func NewJournal(filename string) *Journal {
+	return &Journal{filename: filename}
+}
+
+// Append the JSON encoding of the value given as a new line in the journal.
+func (j *Journal) Append(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Call the function given with each line of the journal in turn, stopping at the first error.
+// Lines that are not valid JSON (e.g., a partial line from a crash) are skipped.  A journal that
+// doesn't exist yet is treated as empty.
+func (j *Journal) Scan(fn func(line []byte) error) error {
+	f, err := os.Open(j.filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !json.Valid(line) {
+			Warnf("skipping malformed line in %q.\n", j.filename)
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Replace the contents of the journal with the lines generated by the function given, which is
+// called with an encoder for the new contents.  The replacement is atomic.
+func (j *Journal) Rewrite(fn func(enc *json.Encoder) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	tmp := j.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = fn(json.NewEncoder(w)); err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, j.filename)
+}
@@ -0,0 +1,132 @@
+/*! @file leader.go
+ * @brief Election of a single instance to run the scheduled jobs in a cluster
+ *
+ * When several instances of the server share state, the scheduled jobs that work on something they
+ * all share (e.g., collecting files from a mailbox or drop directory) should run on only one of them,
+ * or the work is repeated (and files collected twice).  The instances elect a leader by competing for a lease in the shared state: whoever
+ * holds the lease renews it periodically, and if it stops doing so (e.g., because the instance has
+ * gone away), another instance takes over once the lease expires.  With the in-memory shared state
+ * there's only one instance, which always leads.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A Leader takes part in the election for a named role on behalf of an instance of the server.
+type Leader struct {
+	state SharedState
+	key   string
+	id    []byte
+	lease time.Duration
+
+	mu      sync.Mutex
+	leading bool
+	since   time.Time
+}
+
+// Generate a participant in the election for the role given, identifying this instance by |id|.
+// The leader holds a lease of the given duration, which it renews at a third of that interval.
+func NewLeader(state SharedState, role, id string, lease time.Duration) *Leader {
+	return &Leader{state: state, key: "leader:" + role, id: []byte(id), lease: lease}
+}
+
+// Take part in the election until the context is cancelled, at which point the lease is given up
+// (if held) so that another instance can take over without waiting for it to expire.
+func (l *Leader) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.lease / 3)
+	defer ticker.Stop()
+	l.campaign()
+	for {
+		select {
+		case <-ctx.Done():
+			if l.IsLeader() {
+				if _, err := l.state.CompareAndDelete(l.key, l.id); err != nil {
+					Errorf("LEADER: failed to release lease %s: %s\n", l.key, err)
+				}
+				l.set(false)
+			}
+			return
+		case <-ticker.C:
+			l.campaign()
+		}
+	}
+}
+
+// Attempt to take or renew the lease.  If the shared state can't be reached, leadership is given
+// up, since another instance may be able to take over.
+func (l *Leader) campaign() {
+	var held bool
+	var err error
+	if l.IsLeader() {
+		held, err = l.state.CompareAndSwap(l.key, l.id, l.id, l.lease)
+	} else {
+		held, err = l.state.SetNX(l.key, l.id, l.lease)
+	}
+	if err != nil {
+		Errorf("LEADER: failed to update lease %s: %s\n", l.key, err)
+		held = false
+	}
+	l.set(held)
+}
+
+func (l *Leader) set(leading bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if leading == l.leading {
+		return
+	}
+	l.leading = leading
+	if leading {
+		l.since = time.Now().UTC()
+		Infof("LEADER: %s is now leader for %s.\n", l.id, l.key)
+	} else {
+		l.since = time.Time{}
+		Warnf("LEADER: %s is no longer leader for %s.\n", l.id, l.key)
+	}
+}
+
+// Determine whether this instance currently holds the lease.
+func (l *Leader) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading
+}
+
+// Provide the identifier of the instance holding the lease (empty if none does), and if that's
+// this instance, the time at which it became leader.
+func (l *Leader) Holder() (string, time.Time, error) {
+	holder, err := l.state.Get(l.key)
+	if errors.Is(err, ErrNotFound) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return string(holder), l.since, nil
+}
@@ -0,0 +1,151 @@
+/*! @file lenient.go
+ * @brief Decoding JSON that may not match the server's idea of its structure
+ *
+ * Firmware moves faster than the server: new releases add fields to the status message, or change the
+ * type of one, long before the server knows about it.  Rather than refusing the whole message (or
+ * silently dropping what it doesn't understand), the message is decoded field by field; anything the
+ * server doesn't know, or can't convert, is described in a warning and otherwise ignored, so that the
+ * rest of the message still counts.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// Decode the JSON object given into the structure that v points to, returning warnings for the
+// fields that aren't in the structure and for the values that can't be converted to the field's type
+// (which are left unset).  Elements of arrays are described by the array's path followed by "[]", so
+// that a field unknown in every element gives one warning.  An error is only returned if the data
+// isn't a JSON object.
+func DecodeLenient(data []byte, v any) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("expected a JSON object")
+	}
+	warnings := make(map[string]bool)
+	decodeStruct(fields, reflect.ValueOf(v).Elem(), "", warnings)
+	rtn := make([]string, 0, len(warnings))
+	for w := range warnings {
+		rtn = append(rtn, w)
+	}
+	slices.Sort(rtn)
+	return rtn, nil
+}
+
+func decodeStruct(fields map[string]json.RawMessage, rv reflect.Value, path string, warnings map[string]bool) {
+	t := rv.Type()
+	for name, raw := range fields {
+		i := 0
+		for ; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() && strings.EqualFold(jsonName(f), name) {
+				break
+			}
+		}
+		if i == t.NumField() {
+			warnings[fmt.Sprintf("unknown field %q", joinPath(path, name))] = true
+			continue
+		}
+		decodeValue(raw, rv.Field(i), joinPath(path, name), warnings)
+	}
+}
+
+func decodeValue(raw json.RawMessage, rv reflect.Value, path string, warnings map[string]bool) {
+	t := rv.Type()
+	if string(raw) == "null" || reflect.PointerTo(t).Implements(unmarshalerType) || t.Implements(unmarshalerType) {
+		decodeLeaf(raw, rv, path, warnings)
+		return
+	}
+	switch {
+	case t.Kind() == reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			warnings[mismatch(path, t, err)] = true
+			return
+		}
+		decodeStruct(fields, rv, path, warnings)
+	case t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct:
+		value := reflect.New(t.Elem())
+		decodeValue(raw, value.Elem(), path, warnings)
+		rv.Set(value)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(raw, &elements); err != nil {
+			warnings[mismatch(path, t, err)] = true
+			return
+		}
+		slice := reflect.MakeSlice(t, len(elements), len(elements))
+		for i, element := range elements {
+			decodeValue(element, slice.Index(i), path+"[]", warnings)
+		}
+		rv.Set(slice)
+	default:
+		decodeLeaf(raw, rv, path, warnings)
+	}
+}
+
+func decodeLeaf(raw json.RawMessage, rv reflect.Value, path string, warnings map[string]bool) {
+	value := reflect.New(rv.Type())
+	if err := json.Unmarshal(raw, value.Interface()); err != nil {
+		warnings[mismatch(path, rv.Type(), err)] = true
+		return
+	}
+	rv.Set(value.Elem())
+}
+
+// Describe a value that couldn't be converted to the type of its field.
+func mismatch(path string, t reflect.Type, err error) string {
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return fmt.Sprintf("field %q: expected %s, got %s", path, t, typeError.Value)
+	}
+	return fmt.Sprintf("field %q: expected %s (%s)", path, t, err)
+}
+
+// Find the name under which a field appears in JSON.
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+func joinPath(path, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
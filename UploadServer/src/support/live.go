@@ -0,0 +1,201 @@
+/*! @file live.go
+ * @brief Buffering and republishing of real-time observations streamed by loggers
+ *
+ * Loggers that are connected can stream real-time observations (see live.go in the main package).
+ * The LiveFeed keeps the most recent observations from each logger, so that a display that connects
+ * can be brought up to date, and passes each new observation to the displays subscribed to the
+ * logger (or to all loggers).  The observations kept are limited in number and in bytes for each
+ * logger, and in bytes for all loggers together, so that a large fleet streaming at once can't
+ * exhaust memory; when the total is exceeded, the oldest observations of the logger with the most
+ * buffered are dropped.  A subscriber that can't keep up misses observations rather than holding up
+ * the stream.  The feed also keeps the most recent position observed from each logger,
+ * for the fleet map (see positions.go in the main package).  Like the fleet status, the feed is held
+ * by each instance of the server.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"sort"
+	"sync"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// The number of observations queued for each subscriber before it starts to miss them.
+const liveQueue = 64
+
+// The bytes counted for each observation buffered, on top of its contents.
+const liveOverhead = 128
+
+// A LiveFeed buffers the recent observations from each logger, and passes new ones to subscribers.
+type LiveFeed struct {
+	mu          sync.Mutex
+	param       LiveParam
+	recent      map[string][]api.Observation
+	bytes       map[string]int64                             // Bytes buffered for each logger
+	total       int64                                        // Bytes buffered for all loggers
+	positions   map[string]api.Position                      // Most recent position observed from each logger
+	subscribers map[string]map[chan api.Observation]struct{} // By logger, or "" for all loggers
+	done        chan struct{}
+	once        sync.Once
+}
+
+// Generate a feed keeping as many observations for each logger as the parameters allow (a zero byte
+// limit being no limit).
+func NewLiveFeed(param LiveParam) *LiveFeed {
+	return &LiveFeed{
+		param:       param,
+		recent:      make(map[string][]api.Observation),
+		bytes:       make(map[string]int64),
+		positions:   make(map[string]api.Position),
+		subscribers: make(map[string]map[chan api.Observation]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Add an observation from the logger given, and pass it to its subscribers.
+func (f *LiveFeed) Publish(logger string, obs api.Observation) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recent[logger] = append(f.recent[logger], obs)
+	f.bytes[logger] += observationSize(obs)
+	f.total += observationSize(obs)
+	for len(f.recent[logger]) > f.param.BufferSize || (f.param.LoggerBytes > 0 && f.bytes[logger] > f.param.LoggerBytes) {
+		f.dropOldest(logger)
+	}
+	for f.param.TotalBytes > 0 && f.total > f.param.TotalBytes {
+		var largest string
+		for l, n := range f.bytes {
+			if n > f.bytes[largest] {
+				largest = l
+			}
+		}
+		f.dropOldest(largest)
+	}
+	for _, key := range []string{logger, ""} {
+		for ch := range f.subscribers[key] {
+			select {
+			case ch <- obs:
+			default:
+			}
+		}
+	}
+}
+
+// Drop the oldest observation buffered for the logger given.  Must be called with the lock held, and
+// with at least one observation buffered for the logger.
+func (f *LiveFeed) dropOldest(logger string) {
+	recent := f.recent[logger]
+	size := observationSize(recent[0])
+	f.bytes[logger] -= size
+	f.total -= size
+	if len(recent) == 1 {
+		// The logger stays listed, as it has streamed, but its buffer is released.
+		f.recent[logger] = recent[:0:0]
+		delete(f.bytes, logger)
+		return
+	}
+	recent[0] = api.Observation{}
+	f.recent[logger] = recent[1:]
+}
+
+// Estimate the memory that an observation takes while buffered.
+func observationSize(obs api.Observation) int64 {
+	return int64(len(obs.Logger)+len(obs.Source)+len(obs.Sentence)+len(obs.Data)) + liveOverhead
+}
+
+// Record the position in the most recent observation of one from the logger given.
+func (f *LiveFeed) Locate(logger string, pos api.Position) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.positions[logger] = pos
+}
+
+// Provide the most recent position observed from each logger that has streamed one.
+func (f *LiveFeed) Positions() map[string]api.Position {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rtn := make(map[string]api.Position, len(f.positions))
+	for logger, pos := range f.positions {
+		rtn[logger] = pos
+	}
+	return rtn
+}
+
+// Provide the recent observations from the logger given, oldest first.
+func (f *LiveFeed) Recent(logger string) []api.Observation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]api.Observation(nil), f.recent[logger]...)
+}
+
+// Generate a list of the loggers that have streamed observations, in order.
+func (f *LiveFeed) Loggers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rtn := make([]string, 0, len(f.recent))
+	for logger := range f.recent {
+		rtn = append(rtn, logger)
+	}
+	sort.Strings(rtn)
+	return rtn
+}
+
+// Drop the observations and position buffered for the logger given (e.g., when its data is purged),
+// returning the number of observations dropped.
+func (f *LiveFeed) Forget(logger string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.recent[logger])
+	f.total -= f.bytes[logger]
+	delete(f.recent, logger)
+	delete(f.bytes, logger)
+	delete(f.positions, logger)
+	return n
+}
+
+// Subscribe to new observations from the logger given (or all loggers, if empty).  The function
+// returned ends the subscription.
+func (f *LiveFeed) Subscribe(logger string) (<-chan api.Observation, func()) {
+	ch := make(chan api.Observation, liveQueue)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subscribers[logger] == nil {
+		f.subscribers[logger] = make(map[chan api.Observation]struct{})
+	}
+	f.subscribers[logger][ch] = struct{}{}
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subscribers[logger], ch)
+	}
+}
+
+// Provide a channel that's closed when the feed is closed.
+func (f *LiveFeed) Done() <-chan struct{} {
+	return f.done
+}
+
+// Close the feed, so that streams and subscriptions end (e.g., when the server is shutting down).
+func (f *LiveFeed) Close() {
+	f.once.Do(func() { close(f.done) })
+}
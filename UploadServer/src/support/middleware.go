@@ -1,13 +1,18 @@
 /*! @file middleware.go
- * @brief Support code for HTTP BasicAuth implementation
+ * @brief Support code for HTTP BasicAuth implementation, and role-based access to the admin API
  *
  * This code provides support for BasicAuth in HTTP requests, where the user provides a username:password
- * pair in the "Authorization" header (base-64 encoded).  For simplicity here, we specify the expected
- * username and password directly, although in production you'd obviously want to have these in a database
- * somewhere, encrypted at rest (the conventional method for this would be to have them in environment
- * variables, but since you need one for each logger you have deployed, that's not going to work here).  Since
- * the details of how you'd manage this are implementation dependent and this code is only provided to
- * demonstrate the server side of the upload protocol, this issue is not addressed.
+ * pair in the "Authorization" header (base-64 encoded).  The username is the logger's unique identifier, and
+ * the password is the upload token that the operator configured into the logger.  The tokens that the server
+ * will accept are held in the token store (see tokens.go), which keeps only a hash of each token at rest (the
+ * conventional method for secrets would be to have them in environment variables, but since you need one for
+ * each logger you have deployed, that's not going to work here).
+ *
+ * The administration API uses a separate mechanism: callers present a bearer token, which is
+ * mapped to a principal with one of three roles (viewer, operator, admin).  Each end-point declares
+ * the minimum role that it requires, so that (for example) a field technician can see the state of
+ * the fleet without being able to mint new upload tokens or delete data.  Bearer tokens are either
+ * pre-shared keys from the configuration, or sessions issued when an admin user logs in (see users.go).
  *
  * The code here is heavily based on the article at https://www.alexedwards.net/blog/basic-authentication-in-go
  * That code has an MIT license, which is the same as that used for the rest of the project, so it's
@@ -36,38 +41,43 @@
 package support
 
 import (
+	"context"
 	"crypto/sha256"
-	"crypto/subtle"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
-func BasicAuth(next http.HandlerFunc) http.HandlerFunc {
+type contextKey int
+
+const (
+	loggerIDKey contextKey = iota
+	principalKey
+	tokenIDKey
+	loggerSessionKey
+)
+
+// Check the BasicAuth credentials on a request from a logger.  The username is the logger's
+// unique identifier, and the password is the upload token that it was configured with; the token
+// has to be one that's known to the server, and hasn't expired.  On success, the logger identifier
+// is available to the handler through LoggerID(), and the token's ID through TokenID().
+func BasicAuth(tokens *TokenStore, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username, password, ok := r.BasicAuth()
-		if ok {
-			usernameHash := sha256.Sum256([]byte(username))
-			passwordHash := sha256.Sum256([]byte(password))
-			// You should typically Look up the username and password in a well-known list of loggers
-			// that you're supporting.  For testing, however, you can set the values directly here.
-			var known_username string = "wibl-logger"
-			var known_password string = "1f808ca8-9ae3-4db1-9838-002cd7be04a8"
-
-			// Note the use of SHA256 to generate a fixed-length string here for the authentication information.
-			// You can apparently carefully craft messages to expose how long it takes to do comparisons
-			// of strings on the server, and therefore work out how many characters of the username or
-			// password you have correct ...  This process avoids this attack by making fixed-length strings,
-			// and then using the constant-time compare (i.e., without short-circuit comparison).  SHA256 is
-			// of course not recommended for encryption of data at rest (e.g., in your password file or
-			// database).
-
-			expectedUsernameHash := sha256.Sum256([]byte(known_username))
-			expectedPasswordHash := sha256.Sum256([]byte(known_password))
-
-			usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
-
-			if usernameMatch && passwordMatch {
-				next.ServeHTTP(w, r)
+		if ok && len(username) > 0 {
+			// Note that the token store only holds the SHA256 hash of each token, so the comparison
+			// here is between fixed-length strings, and doesn't expose how much of the token is
+			// correct through the time taken to compare (as would happen with a short-circuit
+			// comparison of the plain-text).  SHA256 is of course not recommended for encryption of
+			// passwords at rest, but upload tokens are random values with high entropy, rather than
+			// something that a user has chosen.  Each token is only good for the logger it's bound
+			// to, so that a logger can't claim to be another.
+			if token, ok := tokens.Authenticate(username, password); ok {
+				TagRequest(r, "logger", username)
+				ctx := context.WithValue(r.Context(), loggerIDKey, username)
+				ctx = context.WithValue(ctx, tokenIDKey, token.ID)
+				next.ServeHTTP(w, r.WithContext(ctx))
 				return
 			}
 		}
@@ -76,3 +86,232 @@ func BasicAuth(next http.HandlerFunc) http.HandlerFunc {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 	})
 }
+
+// Check the credentials on a request from a logger, which may be a verified client certificate (see
+// enroll.go), a session token (see sessions.go) as a Bearer token if sessions are issued (i.e.,
+// sessions isn't nil), or otherwise as for BasicAuth.  The certificate or session must have been
+// issued with an upload token that's still good.  On success, the session ID is available to the
+// handler through LoggerSessionID(), as well as the logger identifier and token ID.
+func LoggerAuth(tokens *TokenStore, sessions *SessionIssuer, next http.HandlerFunc) http.HandlerFunc {
+	basic := BasicAuth(tokens, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if logger, id, ok := ClientCertificate(r); ok {
+			if token, ok := tokens.Get(id); ok && token.Logger == logger && !token.Expired(time.Now()) {
+				TagRequest(r, "logger", logger)
+				ctx := context.WithValue(r.Context(), loggerIDKey, logger)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tokenIDKey, id)))
+				return
+			}
+			Warnf("API: refusing client certificate for logger %s from %s: token %s is no longer good.\n", logger, r.RemoteAddr, id)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || sessions == nil {
+			basic(w, r)
+			return
+		}
+		session, err := sessions.Verify(bearer)
+		if err == nil {
+			if token, ok := tokens.Get(session.Token); !ok || token.Expired(time.Now()) {
+				err = ErrSessionInvalid
+			}
+		}
+		if err != nil {
+			Warnf("API: refusing session token from %s: %s.\n", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="restricted", error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sessions.Account(session.ID, r.ContentLength)
+		TagRequest(r, "logger", session.Logger)
+		ctx := context.WithValue(r.Context(), loggerIDKey, session.Logger)
+		ctx = context.WithValue(ctx, tokenIDKey, session.Token)
+		ctx = context.WithValue(ctx, loggerSessionKey, session.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Provide the ID of the session in which a logger made the request, if it used one.
+func LoggerSessionID(r *http.Request) string {
+	id, _ := r.Context().Value(loggerSessionKey).(string)
+	return id
+}
+
+// Provide the identifier of the logger that authenticated the request.
+func LoggerID(r *http.Request) string {
+	id, _ := r.Context().Value(loggerIDKey).(string)
+	return id
+}
+
+// Attribute a request to the logger given, for requests that arrive on the logger's behalf (e.g., from
+// a downstream server; see federation.go in the main package) rather than from the logger itself.
+func ForLogger(r *http.Request, logger string) *http.Request {
+	TagRequest(r, "logger", logger)
+	return r.WithContext(context.WithValue(r.Context(), loggerIDKey, logger))
+}
+
+// Provide the ID of the upload token with which the logger authenticated the request.
+func TokenID(r *http.Request) string {
+	id, _ := r.Context().Value(tokenIDKey).(string)
+	return id
+}
+
+// A Role determines what a user of the administration API is allowed to do.  Roles are
+// ordered, so that each role can do everything that the roles below it can.
+type Role int
+
+const (
+	RoleViewer   Role = iota + 1 // Read-only access to fleet status and upload information
+	RoleOperator                 // Day-to-day operations (e.g., requesting re-uploads)
+	RoleAdmin                    // Everything, including minting tokens and deleting data
+)
+
+// Convert a role name (as used in the configuration) into a Role.
+func ParseRole(name string) (Role, error) {
+	switch strings.ToLower(name) {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// A Principal is the identity of a user of the administration API.  A principal whose password
+// has expired can only change their password.  A principal with a Tenant can only see the files of
+// loggers that belong to that tenant; one without can see everything.
+type Principal struct {
+	Name            string `json:"name"`
+	Role            Role   `json:"role"`
+	Tenant          string `json:"tenant,omitempty"`
+	PasswordExpired bool   `json:"password_expired,omitempty"`
+}
+
+// An Authenticator maps a bearer token presented to the administration API into the
+// principal that holds it.
+type Authenticator interface {
+	Authenticate(token string) (Principal, bool)
+}
+
+// An Authenticators is a list of sources of principals, which are tried in order.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(token string) (Principal, bool) {
+	for _, auth := range a {
+		if p, ok := auth.Authenticate(token); ok {
+			return p, true
+		}
+	}
+	return Principal{}, false
+}
+
+// An AdminKeyring authenticates administration API requests against the pre-shared keys
+// in the configuration.
+type AdminKeyring struct {
+	keys map[[sha256.Size]byte]Principal
+}
+
+// Generate a keyring from the keys in the configuration, checking that each has a valid role.
+func NewAdminKeyring(keys []AdminKey) (*AdminKeyring, error) {
+	k := &AdminKeyring{keys: make(map[[sha256.Size]byte]Principal)}
+	for _, key := range keys {
+		if len(key.Token) == 0 {
+			return nil, fmt.Errorf("admin key %q has no token", key.Name)
+		}
+		role, err := ParseRole(key.Role)
+		if err != nil {
+			return nil, fmt.Errorf("admin key %q: %v", key.Name, err)
+		}
+		k.keys[sha256.Sum256([]byte(key.Token))] = Principal{Name: key.Name, Role: role, Tenant: key.Tenant}
+	}
+	return k, nil
+}
+
+func (k *AdminKeyring) Authenticate(token string) (Principal, bool) {
+	p, ok := k.keys[sha256.Sum256([]byte(token))]
+	return p, ok
+}
+
+// Check that a request to the administration API carries a bearer token for a principal with
+// at least the role given.  Requests without valid credentials are rejected with HTTP 401
+// (Unauthorized), and those from a principal without sufficient privilege (or with an expired
+// password) with HTTP 403 (Forbidden).  On success, the principal is available to the handler
+// through CurrentPrincipal().
+func RequireRole(auth Authenticator, required Role, next http.HandlerFunc) http.HandlerFunc {
+	return RequireLogin(auth, func(w http.ResponseWriter, r *http.Request) {
+		principal := CurrentPrincipal(r)
+		if principal.PasswordExpired {
+			http.Error(w, "Forbidden: password change required", http.StatusForbidden)
+			return
+		}
+		if principal.Role < required {
+			Warnf("ADMIN: %s (%s) denied access to %s %s (requires %s).\n",
+				principal.Name, principal.Role, r.Method, r.URL.Path, required)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Check that a request to the administration API carries a bearer token for any principal,
+// irrespective of role or password expiry.  This is only appropriate for end-points like
+// changing the password or logging out.
+func RequireLogin(auth Authenticator, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := BearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		principal, ok := auth.Authenticate(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin", error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		TagRequest(r, "principal", principal.Name)
+		ctx := context.WithValue(r.Context(), principalKey, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Extract the bearer token from the Authorization header of a request.
+func BearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Provide the principal that authenticated a request to the administration API.
+func CurrentPrincipal(r *http.Request) Principal {
+	p, _ := r.Context().Value(principalKey).(Principal)
+	return p
+}
@@ -0,0 +1,87 @@
+package support
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The principals that the role tests authenticate as, by token.
+var testKeys = []AdminKey{
+	{Name: "viewer", Token: "viewer-token", Role: "viewer"},
+	{Name: "operator", Token: "operator-token", Role: "operator"},
+	{Name: "admin", Token: "admin-token", Role: "admin"},
+}
+
+func TestRequireRole(t *testing.T) {
+	keyring, err := NewAdminKeyring(testKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A principal whose password has expired can't do anything, whatever their role.
+	auth := Authenticators{keyring, expiredAuth{}}
+	tests := []struct {
+		authorization string
+		required      Role
+		status        int
+	}{
+		{"", RoleViewer, http.StatusUnauthorized},
+		{"Basic dXNlcjpwYXNz", RoleViewer, http.StatusUnauthorized},
+		{"Bearer no-such-token", RoleViewer, http.StatusUnauthorized},
+		{"Bearer viewer-token", RoleViewer, http.StatusOK},
+		{"Bearer viewer-token", RoleOperator, http.StatusForbidden},
+		{"Bearer viewer-token", RoleAdmin, http.StatusForbidden},
+		{"Bearer operator-token", RoleViewer, http.StatusOK},
+		{"Bearer operator-token", RoleOperator, http.StatusOK},
+		{"Bearer operator-token", RoleAdmin, http.StatusForbidden},
+		{"Bearer admin-token", RoleViewer, http.StatusOK},
+		{"Bearer admin-token", RoleOperator, http.StatusOK},
+		{"Bearer admin-token", RoleAdmin, http.StatusOK},
+		{"Bearer expired-token", RoleViewer, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.authorization+" "+tt.required.String(), func(t *testing.T) {
+			handler := RequireRole(auth, tt.required, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			r := httptest.NewRequest(http.MethodGet, "/admin/v1/whoami", nil)
+			if len(tt.authorization) > 0 {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestNewAdminKeyring(t *testing.T) {
+	tests := []struct {
+		name string
+		key  AdminKey
+		ok   bool
+	}{
+		{"valid", AdminKey{Name: "a", Token: "t", Role: "Operator"}, true},
+		{"no token", AdminKey{Name: "a", Role: "admin"}, false},
+		{"unknown role", AdminKey{Name: "a", Token: "t", Role: "root"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAdminKeyring([]AdminKey{tt.key}); (err == nil) != tt.ok {
+				t.Errorf("NewAdminKeyring() error = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// An expiredAuth authenticates an administrator whose password has expired.
+type expiredAuth struct{}
+
+func (expiredAuth) Authenticate(token string) (Principal, bool) {
+	if token != "expired-token" {
+		return Principal{}, false
+	}
+	return Principal{Name: "expired", Role: RoleAdmin, PasswordExpired: true}, true
+}
@@ -0,0 +1,125 @@
+/*! @file migrations.go
+ * @brief Versioned migrations of the files in the state directory
+ *
+ * The server's state (registry, upload history, tokens, and so on) is kept as JSON files in the state
+ * directory (see persist.go) rather than in a database, but the layout of those files still changes
+ * from release to release.  Each change that an older state directory can't simply be read with is
+ * written as a migration, with the next version number; the version that the directory has reached is
+ * kept in state-version.json, with a record of when each migration was applied.  The server applies
+ * pending migrations at startup (or refuses to start, if the configuration says that they're to be
+ * applied with the "migrate" command), and refuses to start with a state directory from a newer
+ * release than its own, rather than misreading it.  Migrations are applied in order, and the version
+ * is recorded after each, so that a migration that fails can be fixed and the rest applied by running
+ * again.  A migration has to cope with files that don't exist yet (e.g., in a new installation).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A StateMigration changes the files in the state directory (given to Apply) from the layout of the
+// previous version to that of Version.
+type StateMigration struct {
+	Version     int
+	Description string
+	Apply       func(dir string) error
+}
+
+// The migrations, in order of version.  New migrations are added at the end.
+var StateMigrations = []StateMigration{
+	{Version: 1, Description: "baseline: state files as they were before versioning"},
+}
+
+// A StateVersion records the version that a state directory has reached, and the migrations that
+// brought it there.
+type StateVersion struct {
+	Version int                `json:"version"`
+	History []AppliedMigration `json:"history,omitempty"`
+}
+
+type AppliedMigration struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	Applied     time.Time `json:"applied"`
+}
+
+const stateVersionFile = "state-version.json"
+
+// Read the version that the state directory given has reached.  A directory without a version is at
+// version zero.
+func ReadStateVersion(dir string) (StateVersion, error) {
+	var v StateVersion
+	if err := LoadJSON(filepath.Join(dir, stateVersionFile), &v); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return v, fmt.Errorf("reading state version: %w", err)
+	}
+	return v, nil
+}
+
+// Provide the migrations that the state directory given is waiting for.  An error is returned if the
+// directory is from a newer release than this one.
+func PendingMigrations(dir string) ([]StateMigration, error) {
+	v, err := ReadStateVersion(dir)
+	if err != nil {
+		return nil, err
+	}
+	latest := StateMigrations[len(StateMigrations)-1].Version
+	if v.Version > latest {
+		return nil, fmt.Errorf("state directory %s is at version %d, but this release only knows up to version %d", dir, v.Version, latest)
+	}
+	for i, m := range StateMigrations {
+		if m.Version > v.Version {
+			return StateMigrations[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// Apply the migrations that the state directory given is waiting for, returning those applied.  The
+// version is recorded after each migration, so that if one fails, those before it aren't repeated.
+func MigrateState(dir string) ([]StateMigration, error) {
+	pending, err := PendingMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ReadStateVersion(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		if m.Apply != nil {
+			if err := m.Apply(dir); err != nil {
+				return pending[:i], fmt.Errorf("state migration %d (%s): %w", m.Version, m.Description, err)
+			}
+		}
+		v.Version = m.Version
+		v.History = append(v.History, AppliedMigration{Version: m.Version, Description: m.Description, Applied: time.Now().UTC()})
+		if err := SaveJSON(filepath.Join(dir, stateVersionFile), v); err != nil {
+			return pending[:i], fmt.Errorf("recording state version %d: %w", m.Version, err)
+		}
+	}
+	return pending, nil
+}
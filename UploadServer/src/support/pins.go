@@ -0,0 +1,152 @@
+/*! @file pins.go
+ * @brief Fingerprints of the server's TLS certificates, for loggers that pin them
+ *
+ * Firmware that pins the server's certificate stops being able to upload when the certificate is
+ * renewed, unless it knows the new one in advance.  The server therefore advertises fingerprints of
+ * its current certificate and, if the operator has installed it, of the certificate that will
+ * replace it, so that the logger can add the new pin before the switch.  Each certificate is given
+ * as the SHA-256 digest of the whole certificate and of its public key (SubjectPublicKeyInfo, as in
+ * HPKP), so that firmware can pin either.  The current pin is taken from the certificate that the
+ * server loaded when it started, so that replacing the file early doesn't advertise a certificate
+ * that the server isn't yet presenting.  The next certificate's file is read again when it changes,
+ * so that it can be installed without restarting the server.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// A PinSet provides the pins for the server's current and next certificates.
+type PinSet struct {
+	mu      sync.Mutex
+	current *api.CertificatePin // Certificate that the server presents, once loaded
+	file    string              // Next certificate
+	changed time.Time           // Modification time of the next certificate when last read
+	next    *api.CertificatePin
+}
+
+// Generate a pin set for the next certificate file given, which need not exist (or be named).  There
+// is no current pin until the server gives the certificate it presents with Serving().
+func NewPinSet(next string) *PinSet {
+	return &PinSet{file: next}
+}
+
+// Set the current pin from the certificate that the server presents.
+func (p *PinSet) Serving(cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("no certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	pin := pinOf(leaf)
+	pin.Role = "current"
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = &pin
+	return nil
+}
+
+// Provide the pins for the certificates that exist, current first.
+func (p *PinSet) Pins() []api.CertificatePin {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var rtn []api.CertificatePin
+	if p.current != nil {
+		rtn = append(rtn, *p.current)
+	}
+	if len(p.file) == 0 {
+		return rtn
+	}
+	info, err := os.Stat(p.file)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			Warnf("failed to check next certificate %s: %s\n", p.file, err)
+		}
+		p.next = nil
+		return rtn
+	}
+	if p.next == nil || !info.ModTime().Equal(p.changed) {
+		pin, err := certificatePin(p.file)
+		if err != nil {
+			Warnf("failed to read next certificate %s: %s\n", p.file, err)
+			p.next = nil
+			return rtn
+		}
+		pin.Role = "next"
+		p.next, p.changed = &pin, info.ModTime()
+	}
+	return append(rtn, *p.next)
+}
+
+// Generate the pin for the first certificate in the PEM file given.
+func certificatePin(filename string) (api.CertificatePin, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return api.CertificatePin{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return api.CertificatePin{}, fmt.Errorf("no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return api.CertificatePin{}, err
+	}
+	return pinOf(cert), nil
+}
+
+// Generate the pin for a certificate.
+func pinOf(cert *x509.Certificate) api.CertificatePin {
+	digest := sha256.Sum256(cert.Raw)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return api.CertificatePin{SHA256: hex.EncodeToString(digest[:]), SPKI: base64.StdEncoding.EncodeToString(spki[:]),
+		NotBefore: cert.NotBefore, NotAfter: cert.NotAfter}
+}
+
+// Load the CA certificates in a PEM file into a pool, for use as the roots trusted for a server that
+// this one connects to (e.g., a peer or upstream server).
+func CertPool(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,207 @@
+/*! @file quarantine.go
+ * @brief Requests that the server couldn't make sense of, kept for investigation
+ *
+ * When a checkin's status doesn't parse, or an upload fails validation, the payload (up to a size
+ * limit) is kept in the quarantine directory with the reason it was refused, so that a logger's
+ * failures can be investigated after the fact.  The entries are indexed in a journal next to the
+ * payloads; the oldest are dropped when there are too many, and the rest once they pass the retention
+ * period (see quarantine.go in the main package).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The kinds of request that are quarantined.
+const (
+	QuarantineCheckin = "checkin"
+	QuarantineUpload  = "upload"
+)
+
+// A QuarantineEntry describes a request that was refused, and the part of its payload that was kept.
+type QuarantineEntry struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Logger      string    `json:"logger"`
+	Remote      string    `json:"remote"`
+	Reason      string    `json:"reason"`
+	Upload      string    `json:"upload,omitempty"` // UUID of the upload record, for uploads
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size"` // Bytes in the payload as received
+	Kept        int64     `json:"kept"` // Bytes of the payload kept
+	Received    time.Time `json:"received"`
+}
+
+// A Quarantine holds the quarantined requests, oldest first.
+type Quarantine struct {
+	mu      sync.RWMutex
+	dir     string
+	journal *Journal
+	entries []QuarantineEntry
+}
+
+// Generate the quarantine in the directory given, which is created if it doesn't exist.
+func NewQuarantine(dir string) (*Quarantine, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Quarantine{dir: dir, journal: NewJournal(filepath.Join(dir, "index.jsonl"))}
+	err := q.journal.Scan(func(line []byte) error {
+		var entry QuarantineEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil
+		}
+		q.entries = append(q.entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Add an entry with the payload given, of which the first |limit| bytes are kept (all of it, if the
+// limit isn't positive).  If there are then more than |count| entries, the oldest are removed.
+func (q *Quarantine) Add(entry QuarantineEntry, payload []byte, limit int64, count int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry.ID = NewUUID()
+	entry.Size = int64(len(payload))
+	if limit > 0 && entry.Size > limit {
+		payload = payload[:limit]
+	}
+	entry.Kept = int64(len(payload))
+	if err := os.WriteFile(q.payloadFile(entry.ID), payload, 0600); err != nil {
+		return err
+	}
+	if err := q.journal.Append(entry); err != nil {
+		os.Remove(q.payloadFile(entry.ID))
+		return err
+	}
+	q.entries = append(q.entries, entry)
+	if excess := len(q.entries) - count; excess > 0 {
+		return q.remove(q.entries[:excess])
+	}
+	return nil
+}
+
+// Provide the entry with the ID given.
+func (q *Quarantine) Get(id string) (QuarantineEntry, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for _, entry := range q.entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return QuarantineEntry{}, false
+}
+
+// Provide the payload kept for the entry with the ID given.
+func (q *Quarantine) Payload(id string) ([]byte, error) {
+	if _, ok := q.Get(id); !ok {
+		return nil, ErrNotFound
+	}
+	return os.ReadFile(q.payloadFile(id))
+}
+
+// Generate a list of the entries for which the filter function returns true (a nil filter accepts
+// everything), oldest first.
+func (q *Quarantine) List(filter func(entry *QuarantineEntry) bool) []QuarantineEntry {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	rtn := make([]QuarantineEntry, 0)
+	for i := range q.entries {
+		if filter == nil || filter(&q.entries[i]) {
+			rtn = append(rtn, q.entries[i])
+		}
+	}
+	return rtn
+}
+
+// Remove the entry with the ID given, with its payload.
+func (q *Quarantine) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.IndexFunc(q.entries, func(entry QuarantineEntry) bool { return entry.ID == id })
+	if i < 0 {
+		return ErrNotFound
+	}
+	return q.remove(q.entries[i : i+1])
+}
+
+// Remove the entries received before the time given, returning the number removed.
+func (q *Quarantine) Prune(before time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var expired []QuarantineEntry
+	for _, entry := range q.entries {
+		if entry.Received.Before(before) {
+			expired = append(expired, entry)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := q.remove(expired); err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// Remove the entries given from the index, and then their payloads.
+func (q *Quarantine) remove(removed []QuarantineEntry) error {
+	ids := make(map[string]bool, len(removed))
+	for _, entry := range removed {
+		ids[entry.ID] = true
+	}
+	kept := slices.DeleteFunc(slices.Clone(q.entries), func(entry QuarantineEntry) bool { return ids[entry.ID] })
+	err := q.journal.Rewrite(func(enc *json.Encoder) error {
+		for _, entry := range kept {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.entries = kept
+	for id := range ids {
+		if err := os.Remove(q.payloadFile(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			Warnf("failed to remove quarantined payload %s: %s\n", id, err)
+		}
+	}
+	return nil
+}
+
+func (q *Quarantine) payloadFile(id string) string {
+	return filepath.Join(q.dir, id)
+}
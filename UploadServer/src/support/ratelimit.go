@@ -0,0 +1,74 @@
+/*! @file ratelimit.go
+ * @brief Limits on the rate of requests to the server
+ *
+ * A misbehaving logger (e.g., firmware stuck in a retry loop) or someone guessing passwords for the
+ * administration API can make requests much faster than the server needs to handle them.  The rate
+ * limit here counts requests in fixed one-minute windows, keyed by whoever is making them, with the
+ * counters held in the shared state so that the limit applies across all instances of the server.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limit the requests to the handler to the number per minute that the limit function gives (so that
+// the limit can change while the server runs) for each key (e.g., logger or remote address) that
+// the key function generates for the request; zero means no limit.  Requests over the limit
+// are rejected with HTTP 429 (Too Many Requests) and a Retry-After header.  If the counters can't
+// be reached, requests are allowed through rather than taking the server down with them.
+func RateLimit(state SharedState, scope string, limit func() int, key func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perMinute := limit()
+		if perMinute <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		window := now.Truncate(time.Minute)
+		id := key(r)
+		count, err := state.Incr(fmt.Sprintf("rate:%s:%s:%d", scope, id, window.Unix()), 2*time.Minute)
+		if err != nil {
+			Errorf("failed to check %s rate limit for %s: %s\n", scope, id, err)
+		} else if count > int64(perMinute) {
+			Warnf("RATE: %s from %s over limit of %d per minute.\n", scope, id, perMinute)
+			retry := int(window.Add(time.Minute).Sub(now).Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Provide the address of the host making a request, without the port.
+func RemoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
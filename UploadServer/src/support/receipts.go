@@ -0,0 +1,156 @@
+/*! @file receipts.go
+ * @brief Signed receipts for accepted uploads
+ *
+ * Vessels that take part in incentive programmes need to be able to show, later and to a third
+ * party, that they contributed specific data.  When the server accepts a file, it signs a receipt
+ * (with Ed25519) over the upload's UUID, the logger that sent it, the MD5 digest and size of the
+ * file, and the time of issue.  The receipt is returned to the logger and kept in the upload
+ * history.  Anyone with the server's public key (see ReceiptSigner.PublicKey) can check a receipt
+ * without access to the server's records.
+ *
+ * The signing key is read from a PEM-encoded PKCS #8 file; if the file doesn't exist, a key is
+ * generated and written there, so that receipts remain verifiable across restarts.  Receipts
+ * signed with a previous key can only be verified against that key.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// The version tag at the start of the signed form of a receipt, so that the format can change.
+const receiptVersion = "wibl-receipt/1"
+
+// A ReceiptSigner signs receipts with the server's Ed25519 key.
+type ReceiptSigner struct {
+	key ed25519.PrivateKey
+	id  string
+}
+
+// Generate a receipt signer with the key in the file given, generating (and saving) a new key if
+// the file doesn't exist.
+func NewReceiptSigner(filename string) (*ReceiptSigner, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return newReceiptKey(filename)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key", filename)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", filename)
+	}
+	return newReceiptSigner(key), nil
+}
+
+func newReceiptKey(filename string) (*ReceiptSigner, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		return nil, err
+	}
+	Infof("generated receipt signing key in %s.\n", filename)
+	return newReceiptSigner(key), nil
+}
+
+func newReceiptSigner(key ed25519.PrivateKey) *ReceiptSigner {
+	public := key.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(public)
+	return &ReceiptSigner{key: key, id: hex.EncodeToString(sum[:8])}
+}
+
+// Provide the public key with which receipts can be checked, and its identifier (which receipts
+// carry, so that the right key can be chosen).
+func (s *ReceiptSigner) PublicKey() (ed25519.PublicKey, string) {
+	return s.key.Public().(ed25519.PublicKey), s.id
+}
+
+// Sign a receipt for an accepted upload.
+func (s *ReceiptSigner) Sign(record UploadRecord) api.Receipt {
+	receipt := api.Receipt{
+		UUID:   record.UUID,
+		Logger: record.Logger,
+		MD5:    record.MD5,
+		Size:   record.Size,
+		Issued: time.Now().UTC(),
+		Key:    s.id,
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, ReceiptMessage(receipt)))
+	return receipt
+}
+
+// Check a receipt's signature against the server's key.
+func (s *ReceiptSigner) Verify(receipt api.Receipt) error {
+	if receipt.Key != s.id {
+		return fmt.Errorf("receipt was signed with key %q, not the current key %q", receipt.Key, s.id)
+	}
+	signature, err := base64.StdEncoding.DecodeString(receipt.Signature)
+	if err != nil {
+		return fmt.Errorf("bad signature encoding: %w", err)
+	}
+	if !ed25519.Verify(s.key.Public().(ed25519.PublicKey), ReceiptMessage(receipt), signature) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// Generate the message that is signed for a receipt: the version tag, UUID, logger, MD5 digest
+// (in upper case), size, and time of issue (RFC 3339, UTC, with nanoseconds), each on its own line.
+func ReceiptMessage(receipt api.Receipt) []byte {
+	return []byte(strings.Join([]string{
+		receiptVersion,
+		receipt.UUID,
+		receipt.Logger,
+		strings.ToUpper(receipt.MD5),
+		strconv.FormatInt(receipt.Size, 10),
+		receipt.Issued.UTC().Format(time.RFC3339Nano),
+	}, "\n"))
+}
@@ -0,0 +1,141 @@
+/*! @file record.go
+ * @brief Recording of requests from loggers, for replay against another server
+ *
+ * Before a configuration change or a new version of the server goes into production, it's useful to
+ * see how it handles the traffic that the fleet actually generates.  If a recording file is given in
+ * the configuration, each checkin and upload request is appended to it (as JSON Lines), less the
+ * credentials, along with the status the server returned; the "replay" command then sends the same
+ * requests to another server (see replay.go).  Recording stops once the file reaches its size limit.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// A RecordedRequest is a request from a logger, as recorded for replay.
+type RecordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Logger string      `json:"logger"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Status int         `json:"status"`
+}
+
+// A RequestRecorder appends requests to a journal, up to a limit on its size.
+type RequestRecorder struct {
+	mu      sync.Mutex
+	journal *Journal
+	limit   int64
+	written int64
+}
+
+// Generate a recorder that appends to the file given until it reaches maxBytes (zero for no limit).
+// If the filename is empty, nothing is recorded.
+func NewRequestRecorder(filename string, maxBytes int64) *RequestRecorder {
+	if len(filename) == 0 {
+		return &RequestRecorder{}
+	}
+	rr := &RequestRecorder{journal: NewJournal(filename), limit: maxBytes}
+	if info, err := os.Stat(filename); err == nil {
+		rr.written = info.Size()
+	}
+	return rr
+}
+
+// Report whether requests are being recorded.
+func (rr *RequestRecorder) Enabled() bool {
+	return rr.journal != nil
+}
+
+// Record the requests passed to the handler given, which must be behind BasicAuth so that the
+// logger is known.  The Authorization and Cookie headers are not recorded.
+func (rr *RequestRecorder) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	if !rr.Enabled() {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		request := RecordedRequest{
+			Time:   time.Now().UTC(),
+			Logger: LoggerID(r),
+			Method: r.Method,
+			URL:    r.URL.RequestURI(),
+			Header: r.Header.Clone(),
+			Body:   body,
+		}
+		request.Header.Del("Authorization")
+		request.Header.Del("Cookie")
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+		request.Status = recorder.status
+		rr.append(request)
+	}
+}
+
+func (rr *RequestRecorder) append(request RecordedRequest) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.limit > 0 && rr.written+int64(len(data)) >= rr.limit {
+		if rr.written < rr.limit {
+			Warnf("RECORD: recording file is full; no more requests will be recorded.\n")
+			rr.written = rr.limit
+		}
+		return
+	}
+	if err := rr.journal.Append(request); err != nil {
+		Errorf("RECORD: failed to record request: %s\n", err)
+		return
+	}
+	rr.written += int64(len(data)) + 1
+}
+
+// Call the function given with each request in a recording, in the order in which they were made.
+func ReadRecording(filename string, fn func(request RecordedRequest) error) error {
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+	return NewJournal(filename).Scan(func(line []byte) error {
+		var request RecordedRequest
+		if err := json.Unmarshal(line, &request); err != nil {
+			return nil
+		}
+		return fn(request)
+	})
+}
@@ -0,0 +1,142 @@
+/*! @file redis.go
+ * @brief Shared state held in a Redis server
+ *
+ * When several instances of the server run behind a load balancer, the short-lived state that they
+ * share (see shared.go) is held in Redis.  All keys are prefixed so that the server can share a
+ * Redis instance with other applications.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A RedisState holds the shared state in a Redis server.
+type RedisState struct {
+	client *redis.Client
+	prefix string
+}
+
+// Connect to the Redis server given in the configuration, checking that it's reachable.
+func NewRedisState(param RedisParam) (*RedisState, error) {
+	options := &redis.Options{
+		Addr:     param.Address,
+		Username: param.Username,
+		Password: param.Password,
+		DB:       param.DB,
+	}
+	if param.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	s := &RedisState{client: redis.NewClient(options), prefix: param.Prefix}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RedisState) Get(key string) ([]byte, error) {
+	value, err := s.client.Get(context.Background(), s.prefix+key).Bytes()
+	return value, redisError(err)
+}
+
+func (s *RedisState) Set(key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(context.Background(), s.prefix+key, value, ttl).Err()
+}
+
+func (s *RedisState) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(context.Background(), s.prefix+key, value, ttl).Result()
+}
+
+func (s *RedisState) Swap(key string, value []byte, ttl time.Duration) ([]byte, error) {
+	previous, err := s.client.SetArgs(context.Background(), s.prefix+key, value,
+		redis.SetArgs{TTL: ttl, Get: true}).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return previous, err
+}
+
+func (s *RedisState) Take(key string) ([]byte, error) {
+	value, err := s.client.GetDel(context.Background(), s.prefix+key).Bytes()
+	return value, redisError(err)
+}
+
+func (s *RedisState) Delete(key string) error {
+	return s.client.Del(context.Background(), s.prefix+key).Err()
+}
+
+// Increment the counter, setting the expiry only when the key is created, so that the window for
+// a rate limit doesn't move with each request.
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n`)
+
+func (s *RedisState) Incr(key string, ttl time.Duration) (int64, error) {
+	return incrScript.Run(context.Background(), s.client, []string{s.prefix + key}, ttl.Milliseconds()).Int64()
+}
+
+var compareAndSwapScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1`)
+
+func (s *RedisState) CompareAndSwap(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	n, err := compareAndSwapScript.Run(context.Background(), s.client, []string{s.prefix + key},
+		old, value, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+var compareAndDeleteScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])`)
+
+func (s *RedisState) CompareAndDelete(key string, old []byte) (bool, error) {
+	n, err := compareAndDeleteScript.Run(context.Background(), s.client, []string{s.prefix + key}, old).Int()
+	return n == 1, err
+}
+
+func redisError(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return ErrNotFound
+	}
+	return err
+}
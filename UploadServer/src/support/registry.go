@@ -0,0 +1,251 @@
+/*! @file registry.go
+ * @brief Registry of information about the loggers in the fleet
+ *
+ * The fleet status (see fleet.go) holds what the loggers report about themselves; the registry
+ * holds what the operators know about them (tenant, vessel, tags, notes, etc.), which has to persist whether or not
+ * the logger has checked in recently.  The registry is backed by a JSON file in the state directory.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// The maximum length of a tag or note.
+const (
+	maxTagLength  = 64
+	maxNoteLength = 4096
+)
+
+// A Note is a free-text annotation by an operator.
+type Note struct {
+	Time   time.Time `json:"time"`
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+}
+
+// Generate a note from the author and text given, checking that the text is acceptable.
+func NewNote(author, text string) (Note, error) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 || len(text) > maxNoteLength {
+		return Note{}, fmt.Errorf("note must be between 1 and %d characters", maxNoteLength)
+	}
+	return Note{Time: time.Now().UTC(), Author: author, Text: text}, nil
+}
+
+// The kinds of maintenance that can be recorded for a logger.
+var MaintenanceKinds = []string{"installed", "removed", "antenna", "firmware", "visit", "repair", "other"}
+
+// A Maintenance is an entry in a logger's maintenance log, with who recorded it and when.
+type Maintenance struct {
+	ID       string    `json:"id"`
+	Recorded time.Time `json:"recorded"`
+	Author   string    `json:"author"`
+	api.MaintenanceInfo
+}
+
+// Check that a maintenance entry is plausible.
+func ValidateMaintenance(info *api.MaintenanceInfo) error {
+	info.Kind = strings.ToLower(strings.TrimSpace(info.Kind))
+	known := false
+	for _, kind := range MaintenanceKinds {
+		known = known || kind == info.Kind
+	}
+	if !known {
+		return fmt.Errorf("kind of maintenance must be one of %s", strings.Join(MaintenanceKinds, ", "))
+	}
+	date, err := time.Parse(time.DateOnly, info.Date)
+	if err != nil {
+		return errors.New("date must be given as YYYY-MM-DD")
+	}
+	if date.After(time.Now().UTC().AddDate(0, 0, 1)) {
+		return errors.New("maintenance can't be recorded for a future date")
+	}
+	info.Text = strings.TrimSpace(info.Text)
+	if len(info.Text) == 0 || len(info.Text) > maxNoteLength {
+		return fmt.Errorf("description must be between 1 and %d characters", maxNoteLength)
+	}
+	info.Firmware = strings.TrimSpace(info.Firmware)
+	if info.Kind == "firmware" && len(info.Firmware) == 0 {
+		return errors.New("firmware version must be given for a firmware flash")
+	}
+	return nil
+}
+
+// Sort a maintenance log by the date of the work, and then by when it was recorded.
+func SortMaintenance(log []Maintenance) {
+	sort.SliceStable(log, func(i, j int) bool {
+		if log[i].Date != log[j].Date {
+			return log[i].Date < log[j].Date
+		}
+		return log[i].Recorded.Before(log[j].Recorded)
+	})
+}
+
+// Apply additions and removals to a list of tags, returning the new (sorted, de-duplicated) list.
+// Tags are trimmed of white space, and must be non-empty and no longer than 64 characters.
+func UpdateTags(tags, add, remove []string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, t := range tags {
+		set[t] = true
+	}
+	for _, t := range add {
+		t = strings.TrimSpace(t)
+		if len(t) == 0 || len(t) > maxTagLength {
+			return nil, fmt.Errorf("tags must be between 1 and %d characters", maxTagLength)
+		}
+		set[t] = true
+	}
+	for _, t := range remove {
+		delete(set, strings.TrimSpace(t))
+	}
+	rtn := make([]string, 0, len(set))
+	for t := range set {
+		rtn = append(rtn, t)
+	}
+	sort.Strings(rtn)
+	return rtn, nil
+}
+
+// Determine whether a list of tags contains the tag given.
+func HasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// A LoggerRecord is the registry's information on a logger.
+type LoggerRecord struct {
+	ID          string        `json:"id"`
+	Created     time.Time     `json:"created"`
+	Updated     time.Time     `json:"updated"`
+	Tenant      string        `json:"tenant,omitempty"`  // Organisation or program that the logger belongs to
+	Vessel      string        `json:"vessel,omitempty"`  // ID of the vessel that the logger is installed on
+	Profile     string        `json:"profile,omitempty"` // Transfer profile for the logger's link, if not the default
+	Pending     bool          `json:"pending,omitempty"` // Enrolled itself, and awaiting approval by an operator
+	Tags        []string      `json:"tags,omitempty"`
+	Notes       []Note        `json:"notes,omitempty"`
+	Maintenance []Maintenance `json:"maintenance,omitempty"` // Hardware history, by date
+
+	Hours   *api.UploadHours `json:"upload_hours,omitempty"`    // When the logger may upload, if restricted
+	Checkin int              `json:"checkin_minutes,omitempty"` // How often the logger checks in, if not the default
+}
+
+// A Registry holds the records for all of the loggers that the operators have annotated.
+type Registry struct {
+	mu       sync.RWMutex
+	filename string
+	loggers  map[string]*LoggerRecord
+}
+
+// Generate a registry from the given file, which need not exist.
+func NewRegistry(filename string) (*Registry, error) {
+	r := &Registry{filename: filename, loggers: make(map[string]*LoggerRecord)}
+	var records []*LoggerRecord
+	if err := LoadJSON(filename, &records); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, record := range records {
+		r.loggers[record.ID] = record
+	}
+	return r, nil
+}
+
+// Provide the record for the logger given.
+func (r *Registry) Get(id string) (LoggerRecord, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	record, ok := r.loggers[id]
+	if !ok {
+		return LoggerRecord{}, false
+	}
+	return *record, true
+}
+
+// Generate a list of all of the records, ordered by logger ID.
+func (r *Registry) List() []LoggerRecord {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rtn := make([]LoggerRecord, 0, len(r.loggers))
+	for _, record := range r.loggers {
+		rtn = append(rtn, *record)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].ID < rtn[j].ID })
+	return rtn
+}
+
+// Apply a change to the record for the logger given, creating the record if it doesn't exist.
+// If the function returns an error, the record is left unchanged.  The updated record is returned.
+func (r *Registry) Update(id string, fn func(record *LoggerRecord) error) (LoggerRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.loggers[id]
+	now := time.Now().UTC()
+	record := LoggerRecord{ID: id, Created: now}
+	if ok {
+		record = *existing
+	}
+	if err := fn(&record); err != nil {
+		return LoggerRecord{}, err
+	}
+	record.Updated = now
+	r.loggers[id] = &record
+	if err := r.save(); err != nil {
+		if ok {
+			r.loggers[id] = existing
+		} else {
+			delete(r.loggers, id)
+		}
+		return LoggerRecord{}, err
+	}
+	return record, nil
+}
+
+// Remove the record for the logger given.
+func (r *Registry) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.loggers[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.loggers, id)
+	return r.save()
+}
+
+func (r *Registry) save() error {
+	records := make([]*LoggerRecord, 0, len(r.loggers))
+	for _, record := range r.loggers {
+		records = append(records, record)
+	}
+	return SaveJSON(r.filename, records)
+}
@@ -0,0 +1,129 @@
+/*! @file retry.go
+ * @brief Retries of backend operations, with exponential backoff and jitter
+ *
+ * Storage writes and notifications of the processing chain can fail transiently (e.g., throttling,
+ * or a brief network interruption), and failing the upload or leaving the file unprocessed on the
+ * first error makes work for operators.  A Retrier repeats an operation up to the configured number
+ * of attempts, waiting between them for an exponentially increasing interval with random jitter (so
+ * that instances retrying together don't all hit the backend at once), and counts the retries and
+ * final failures by operation for the metrics.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"context"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Retrier repeats failed operations according to its parameters.
+type Retrier struct {
+	param    RetryParam
+	mu       sync.Mutex
+	retries  map[string]int64
+	failures map[string]int64
+}
+
+// A RetryCount reports the retries of an operation, and how many times it failed after all of its
+// attempts.
+type RetryCount struct {
+	Operation string `json:"operation"`
+	Retries   int64  `json:"retries"`
+	Failures  int64  `json:"failures"`
+}
+
+func NewRetrier(param RetryParam) *Retrier {
+	return &Retrier{param: param, retries: make(map[string]int64), failures: make(map[string]int64)}
+}
+
+// Run the function given until it succeeds, the attempts are exhausted, or the context is cancelled,
+// returning the last error.  The operation names the kind of work (e.g., "storage.put") for the
+// counts.
+func (r *Retrier) Do(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	attempts := max(r.param.Attempts, 1)
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			r.count(r.retries, operation)
+			timer := time.NewTimer(r.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				r.count(r.failures, operation)
+				return err
+			case <-timer.C:
+			}
+			Warnf("retrying %s (attempt %d of %d) after: %s\n", operation, attempt+1, attempts, err)
+		}
+		if err = fn(ctx); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		r.count(r.failures, operation)
+	}
+	return err
+}
+
+// Determine how long to wait before the attempt given (counting from zero): the initial interval,
+// doubled for each attempt up to the maximum, with the upper half chosen at random.
+func (r *Retrier) backoff(attempt int) time.Duration {
+	delay := time.Duration(r.param.InitialMillis) * time.Millisecond
+	limit := time.Duration(r.param.MaxMillis) * time.Millisecond
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if limit > 0 && delay > limit {
+		delay = limit
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (r *Retrier) count(counts map[string]int64, operation string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts[operation]++
+}
+
+// Report the counts for each operation that has been retried or has failed, sorted by operation.
+func (r *Retrier) Counts() []RetryCount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	operations := make(map[string]bool)
+	for op := range r.retries {
+		operations[op] = true
+	}
+	for op := range r.failures {
+		operations[op] = true
+	}
+	rtn := make([]RetryCount, 0, len(operations))
+	for op := range operations {
+		rtn = append(rtn, RetryCount{Operation: op, Retries: r.retries[op], Failures: r.failures[op]})
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Operation < rtn[j].Operation })
+	return rtn
+}
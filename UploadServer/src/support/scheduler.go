@@ -0,0 +1,239 @@
+/*! @file scheduler.go
+ * @brief Periodic execution of background jobs
+ *
+ * The server has a number of housekeeping tasks that need to happen periodically, rather than in
+ * response to a request (e.g., checking stored files for corruption).  Each is registered with the
+ * scheduler as a named job, with a default interval that can be overridden (or the job disabled)
+ * in the configuration.  The scheduler keeps the status of the most recent run of each job so that
+ * the operator can see what's been happening through the administration API, and jobs can also be
+ * run on demand.  In a cluster, most jobs work through the state that each instance keeps for itself
+ * (e.g., its own upload history), and so run on every instance; jobs registered as global (e.g.,
+ * collecting from a mailbox that all instances share) only run on schedule on the elected leader (see
+ * leader.go).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An ErrJobRunning is returned when a job is asked to run while it is already running.
+var ErrJobRunning = errors.New("job already running")
+
+// A JobFunc does the work of a job, returning a short summary of what it did.  Long-running jobs
+// should stop early if the context is cancelled.
+type JobFunc func(ctx context.Context) (string, error)
+
+// A JobStatus reports the configuration of a job and the outcome of its most recent run.
+type JobStatus struct {
+	Name            string     `json:"name"`
+	Enabled         bool       `json:"enabled"`
+	IntervalMinutes int        `json:"interval_minutes"`
+	Running         bool       `json:"running"`
+	Runs            int        `json:"runs"`
+	LastStarted     *time.Time `json:"last_started,omitempty"`
+	LastFinished    *time.Time `json:"last_finished,omitempty"`
+	LastResult      string     `json:"last_result,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	NextRun         *time.Time `json:"next_run,omitempty"`
+	LeaderOnly      bool       `json:"leader_only"` // Whether the job only runs on schedule on the leader
+}
+
+type job struct {
+	fn     JobFunc
+	status JobStatus
+}
+
+// A Scheduler runs registered jobs at their configured intervals.
+type Scheduler struct {
+	mu     sync.Mutex
+	config map[string]JobParam
+	jobs   map[string]*job
+	ctx    context.Context
+	wg     sync.WaitGroup
+	leader *Leader // Global jobs only run on schedule while this instance leads, if set
+}
+
+// Generate a scheduler, with the per-job settings from the configuration.
+func NewScheduler(config map[string]JobParam) *Scheduler {
+	return &Scheduler{config: config, jobs: make(map[string]*job), ctx: context.Background()}
+}
+
+// Add a job to the scheduler, to run on every instance of the server.  The settings given are used
+// unless the configuration has an entry for the job, in which case that's used instead.  Jobs have to
+// be registered before the scheduler is started.
+func (s *Scheduler) Register(name string, settings JobParam, fn JobFunc) {
+	s.register(name, settings, fn, false)
+}
+
+// Add a job to the scheduler, as for Register(), that only runs on schedule on the leader, since it
+// works on something that all of the instances share.
+func (s *Scheduler) RegisterGlobal(name string, settings JobParam, fn JobFunc) {
+	s.register(name, settings, fn, true)
+}
+
+func (s *Scheduler) register(name string, settings JobParam, fn JobFunc, global bool) {
+	if configured, ok := s.config[name]; ok {
+		settings = configured
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[name] = &job{fn: fn, status: JobStatus{
+		Name:            name,
+		Enabled:         settings.Enabled && settings.IntervalMinutes > 0,
+		IntervalMinutes: settings.IntervalMinutes,
+		LeaderOnly:      global,
+	}}
+}
+
+// Only run global jobs on schedule while this instance holds the leadership given, so that they run
+// once across a cluster of servers.  Jobs can still be run on demand on any instance.
+func (s *Scheduler) SetLeader(leader *Leader) {
+	s.leader = leader
+}
+
+// Start running the enabled jobs, each in its own goroutine, until the context is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	for name, j := range s.jobs {
+		if !j.status.Enabled {
+			Infof("SCHED: job %s is disabled.\n", name)
+			continue
+		}
+		s.wg.Add(1)
+		go s.loop(name, time.Duration(j.status.IntervalMinutes)*time.Minute)
+	}
+}
+
+// Wait for all of the job loops (and any jobs running) to finish after the context passed to
+// Start() has been cancelled.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(name string, interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	s.setNextRun(name, interval)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.leader != nil && s.global(name) && !s.leader.IsLeader() {
+				Infof("SCHED: not running job %s on this instance, which isn't the leader.\n", name)
+			} else if err := s.run(name); err != nil && !errors.Is(err, ErrJobRunning) {
+				Errorf("SCHED: job %s failed: %s\n", name, err)
+			}
+			s.setNextRun(name, interval)
+		}
+	}
+}
+
+func (s *Scheduler) global(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[name].status.LeaderOnly
+}
+
+func (s *Scheduler) setNextRun(name string, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := time.Now().UTC().Add(interval)
+	s.jobs[name].status.NextRun = &next
+}
+
+// Run the named job immediately, in the background.  The job doesn't have to be enabled for
+// this, but can't already be running.
+func (s *Scheduler) RunNow(name string) error {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	if j.status.Running {
+		s.mu.Unlock()
+		return ErrJobRunning
+	}
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.run(name); err != nil && !errors.Is(err, ErrJobRunning) {
+			Errorf("SCHED: job %s failed: %s\n", name, err)
+		}
+	}()
+	return nil
+}
+
+func (s *Scheduler) run(name string) error {
+	s.mu.Lock()
+	j := s.jobs[name]
+	if j.status.Running {
+		s.mu.Unlock()
+		return ErrJobRunning
+	}
+	started := time.Now().UTC()
+	j.status.Running = true
+	j.status.LastStarted = &started
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	Infof("SCHED: starting job %s.\n", name)
+	result, err := j.fn(ctx)
+	finished := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastFinished = &finished
+	j.status.LastResult = result
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+		TrackError(err, map[string]string{"job": name})
+		return err
+	}
+	Infof("SCHED: job %s finished in %s: %s\n", name, finished.Sub(started).Round(time.Millisecond), result)
+	return nil
+}
+
+// Generate a list of the status of all jobs, ordered by name.
+func (s *Scheduler) List() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rtn := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		rtn = append(rtn, j.status)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Name < rtn[j].Name })
+	return rtn
+}
@@ -0,0 +1,208 @@
+/*! @file sessions.go
+ * @brief Short-lived session tokens issued to loggers at checkin
+ *
+ * A logger's upload token is long-lived, so the less often it goes over the wire, the better.  When
+ * sessions are enabled, the checkin response gives the logger a session token, good for a short
+ * time, which it can send (as "Authorization: Bearer ...") on its uploads in place of the upload
+ * token.  (These are not the login sessions of the administration API; see users.go.)  Session
+ * tokens are signed with HMAC-SHA256 under a key held in the state directory, so that any server
+ * instance sharing that key can check them without shared state, and carry the ID of the upload
+ * token used at checkin, so that revoking that token ends the session too.
+ *
+ * Each session keeps a count of the requests made with it, and the bytes sent, so that the traffic
+ * from each session can be seen; the counts are only held in memory.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The version tag at the start of a session token, so that the format can change.
+const sessionVersion = "ws1"
+
+// The errors returned when checking a session token.
+var (
+	ErrSessionInvalid = errors.New("invalid session token")
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// A LoggerSession describes a session issued to a logger, and the traffic seen in it.
+type LoggerSession struct {
+	ID       string    `json:"id"`
+	Logger   string    `json:"logger"`
+	Token    string    `json:"token_id"` // ID of the upload token used when the session was issued
+	Issued   time.Time `json:"issued"`
+	Expires  time.Time `json:"expires"`
+	Requests int       `json:"requests"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// A SessionIssuer issues and checks session tokens, and keeps the accounts for each session.
+type SessionIssuer struct {
+	key      []byte
+	lifetime time.Duration
+	mu       sync.Mutex
+	sessions map[string]*LoggerSession // Indexed by ID
+}
+
+// Generate a session issuer for sessions of the lifetime given, with the key in the file given
+// (as hexadecimal digits), generating (and saving) a new key if the file doesn't exist.
+func NewSessionIssuer(filename string, lifetime time.Duration) (*SessionIssuer, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filename, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		Infof("generated session signing key in %s.\n", filename)
+		data = []byte(hex.EncodeToString(key))
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < 16 {
+		return nil, fmt.Errorf("%s: session key must be at least 16 bytes, as hexadecimal digits", filename)
+	}
+	return &SessionIssuer{key: key, lifetime: lifetime, sessions: make(map[string]*LoggerSession)}, nil
+}
+
+// Issue a new session to the logger given, which authenticated with the upload token with the ID
+// given, returning the session token along with the session.
+func (s *SessionIssuer) Issue(logger, tokenID string) (string, LoggerSession, error) {
+	id, err := RandomToken(8)
+	if err != nil {
+		return "", LoggerSession{}, err
+	}
+	now := time.Now().UTC()
+	session := &LoggerSession{ID: id, Logger: logger, Token: tokenID, Issued: now, Expires: now.Add(s.lifetime)}
+	claims := strings.Join([]string{sessionVersion, id, tokenID, strconv.FormatInt(session.Expires.Unix(), 10), logger}, "\n")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	token := encoded + "." + s.sign(encoded)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	s.sessions[id] = session
+	return token, *session, nil
+}
+
+// Check a session token, returning the session if it's good.  Sessions issued by another instance
+// (or before a restart) are added to the accounts when first seen.
+func (s *SessionIssuer) Verify(token string) (LoggerSession, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return LoggerSession{}, ErrSessionInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return LoggerSession{}, ErrSessionInvalid
+	}
+	fields := strings.SplitN(string(data), "\n", 5)
+	if len(fields) != 5 || fields[0] != sessionVersion {
+		return LoggerSession{}, ErrSessionInvalid
+	}
+	expiry, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return LoggerSession{}, ErrSessionInvalid
+	}
+	now := time.Now().UTC()
+	if !now.Before(time.Unix(expiry, 0)) {
+		return LoggerSession{}, ErrSessionExpired
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[fields[1]]
+	if !ok {
+		expires := time.Unix(expiry, 0).UTC()
+		session = &LoggerSession{ID: fields[1], Logger: fields[4], Token: fields[2], Issued: expires.Add(-s.lifetime), Expires: expires}
+		s.sessions[session.ID] = session
+	}
+	return *session, nil
+}
+
+// Count a request in the session with the ID given, with the number of bytes given.
+func (s *SessionIssuer) Account(id string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[id]; ok {
+		session.Requests++
+		session.Bytes += max(bytes, 0)
+	}
+}
+
+// Generate a list of the sessions that haven't expired, ordered by time of issue.
+func (s *SessionIssuer) List() []LoggerSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	rtn := make([]LoggerSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		rtn = append(rtn, *session)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Issued.Before(rtn[j].Issued) })
+	return rtn
+}
+
+// Drop the accounts of the sessions issued to the logger given, returning the number dropped.  This
+// doesn't end the sessions; revoking the upload tokens with which they were issued does that.
+func (s *SessionIssuer) Forget(logger string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for id, session := range s.sessions {
+		if session.Logger == logger {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Remove sessions that have expired.  The caller must hold the lock.
+func (s *SessionIssuer) prune(now time.Time) {
+	for id, session := range s.sessions {
+		if !now.Before(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *SessionIssuer) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,236 @@
+/*! @file settings.go
+ * @brief Settings that can be changed while the server is running
+ *
+ * During an incident (e.g., a logger flooding the server, or a vessel filling its quota on the last
+ * day of a survey) the operator needs to change some of the configuration without restarting the
+ * server.  A safe subset of the configuration (the log level, rate limits, quotas, including the
+ * quota warning threshold, and the firmware policy) is therefore held here rather than read from the
+ * configuration directly.  It starts from the configuration file, and any changes made through the
+ * administration API are kept in the state directory, which takes precedence over the configuration
+ * file when the server restarts.  Since that can surprise an operator who has just edited the
+ * configuration, each setting that differs from the configuration is logged when the server starts,
+ * and listed in the effective configuration (see "config show").
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// An ErrInvalidSettings is returned when a change would leave the settings unusable.
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// A LoggingParam controls the server's log output: Level is one of "debug", "info", "warn",
+// or "error".
+type LoggingParam struct {
+	Level string `json:"level"`
+}
+
+// The Settings are the part of the configuration that can be changed at run-time.
+type Settings struct {
+	LogLevel  string         `json:"log_level"`
+	RateLimit RateLimitParam `json:"rate_limit"`
+	Quota     QuotaParam     `json:"quota"`
+	Firmware  FirmwareParam  `json:"firmware"`
+}
+
+// Check that the settings are usable.
+func (s *Settings) Validate() error {
+	if _, err := parseLevel(s.LogLevel); err != nil {
+		return err
+	}
+	r := s.RateLimit
+	if r.CheckinPerMinute < 0 || r.UploadPerMinute < 0 || r.LoginPerMinute < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if s.Quota.DefaultBytes < 0 {
+		return errors.New("default quota must not be negative")
+	}
+	for logger, limit := range s.Quota.Loggers {
+		if limit < 0 {
+			return fmt.Errorf("quota for %s must not be negative", logger)
+		}
+	}
+	if s.Quota.WarnPercent < 1 || s.Quota.WarnPercent > 100 {
+		return errors.New("quota warning threshold must be between 1 and 100 percent")
+	}
+	if slices.ContainsFunc(s.Firmware.Blocked, func(v string) bool { return len(strings.TrimSpace(v)) == 0 }) {
+		return errors.New("blocked firmware versions must not be empty")
+	}
+	return nil
+}
+
+// Generate an independent copy of the settings.
+func (s Settings) clone() Settings {
+	s.Quota.Loggers = maps.Clone(s.Quota.Loggers)
+	if s.Quota.Loggers == nil {
+		s.Quota.Loggers = make(map[string]int64)
+	}
+	s.Firmware.Blocked = slices.Clone(s.Firmware.Blocked)
+	return s
+}
+
+// Extract the settings from the configuration.
+func ConfigSettings(c *Config) Settings {
+	return Settings{LogLevel: c.Logging.Level, RateLimit: c.RateLimit, Quota: c.Quota, Firmware: c.Firmware}
+}
+
+// Put the settings given into the configuration, so that it shows what is in effect.
+func (c *Config) ApplySettings(s Settings) {
+	s = s.clone()
+	c.Logging.Level, c.RateLimit, c.Quota, c.Firmware = s.LogLevel, s.RateLimit, s.Quota, s.Firmware
+}
+
+// A SettingsStore holds the current settings, and the file in which changes are kept.
+type SettingsStore struct {
+	mu         sync.RWMutex
+	filename   string
+	configured Settings // As given by the configuration
+	current    Settings
+}
+
+// Generate a settings store, starting from the settings given (from the configuration), unless
+// they've been changed at run-time and saved in the file given.  Each setting that the file
+// overrides is logged.
+func NewSettingsStore(filename string, initial Settings) (*SettingsStore, error) {
+	s := &SettingsStore{filename: filename, configured: initial.clone(), current: initial.clone()}
+	if err := LoadJSON(filename, &s.current); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := s.current.Validate(); err != nil {
+		return nil, err
+	}
+	s.apply()
+	for _, o := range s.Overrides() {
+		Warnf("%s is %s in %s, overriding %s in the configuration.\n", o.Setting, o.Current, filename, o.Configured)
+	}
+	return s, nil
+}
+
+// A SettingOverride is a setting whose current value differs from the configuration, by its name
+// in the configuration, with both values as JSON.
+type SettingOverride struct {
+	Setting    string `json:"setting"`
+	Configured string `json:"configured"`
+	Current    string `json:"current"`
+}
+
+func (o SettingOverride) String() string {
+	return fmt.Sprintf("%s: %s (configured %s)", o.Setting, o.Current, o.Configured)
+}
+
+// Generate the list of settings whose current value differs from the configuration, ordered by name.
+func (s *SettingsStore) Overrides() []SettingOverride {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	was, now := s.configured, s.current
+	var rtn []SettingOverride
+	add := func(setting string, configured, current any) {
+		c, _ := json.Marshal(configured)
+		n, _ := json.Marshal(current)
+		if !bytes.Equal(c, n) {
+			rtn = append(rtn, SettingOverride{Setting: setting, Configured: string(c), Current: string(n)})
+		}
+	}
+	add("logging.level", was.LogLevel, now.LogLevel)
+	add("rate_limit.checkin_per_minute", was.RateLimit.CheckinPerMinute, now.RateLimit.CheckinPerMinute)
+	add("rate_limit.upload_per_minute", was.RateLimit.UploadPerMinute, now.RateLimit.UploadPerMinute)
+	add("rate_limit.login_per_minute", was.RateLimit.LoginPerMinute, now.RateLimit.LoginPerMinute)
+	add("quota.default_bytes", was.Quota.DefaultBytes, now.Quota.DefaultBytes)
+	add("quota.warn_percent", was.Quota.WarnPercent, now.Quota.WarnPercent)
+	loggers := maps.Clone(was.Quota.Loggers)
+	maps.Copy(loggers, now.Quota.Loggers)
+	for logger := range loggers {
+		configured, ok := was.Quota.Loggers[logger]
+		if !ok {
+			configured = was.Quota.DefaultBytes
+		}
+		current, ok := now.Quota.Loggers[logger]
+		if !ok {
+			current = now.Quota.DefaultBytes
+		}
+		add("quota.loggers."+logger, configured, current)
+	}
+	add("firmware.minimum", was.Firmware.Minimum, now.Firmware.Minimum)
+	add("firmware.blocked", was.Firmware.Blocked, now.Firmware.Blocked)
+	add("firmware.upgrade_command", was.Firmware.UpgradeCommand, now.Firmware.UpgradeCommand)
+	slices.SortFunc(rtn, func(a, b SettingOverride) int { return strings.Compare(a.Setting, b.Setting) })
+	return rtn
+}
+
+// Provide a copy of the current settings.
+func (s *SettingsStore) Get() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current.clone()
+}
+
+// Change the settings with the function given.  The result has to be valid, and is saved so that it
+// persists if the server restarts.  The updated settings are returned.  If the function fails, or the
+// result isn't valid, the error satisfies errors.Is(err, ErrInvalidSettings).
+func (s *SettingsStore) Update(fn func(settings *Settings) error) (Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updated := s.current.clone()
+	if err := fn(&updated); err != nil {
+		return Settings{}, fmt.Errorf("%w: %v", ErrInvalidSettings, err)
+	}
+	if err := updated.Validate(); err != nil {
+		return Settings{}, fmt.Errorf("%w: %v", ErrInvalidSettings, err)
+	}
+	if err := SaveJSON(s.filename, updated); err != nil {
+		return Settings{}, err
+	}
+	s.current = updated
+	s.apply()
+	return updated.clone(), nil
+}
+
+// Put the current settings into effect, where they aren't read on demand.  Must be called with the
+// lock held.
+func (s *SettingsStore) apply() {
+	level, _ := parseLevel(s.current.LogLevel)
+	slog.SetLogLoggerLevel(level)
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
@@ -0,0 +1,212 @@
+/*! @file shared.go
+ * @brief Short-lived state that has to be shared between server instances
+ *
+ * Some of the server's state only matters for a few minutes or hours (login sessions, confirmation
+ * tokens, rate-limit counters, uploads in progress), and so isn't worth persisting in the state
+ * directory.  If several servers run behind a load balancer, however, they all have to see the same
+ * values, or a logger's retry (or an operator's next request) landing on a different instance will
+ * behave differently.  The SharedState interface abstracts a key-value store with expiry for this:
+ * the default holds everything in memory (for a single instance), and the "redis" backend holds it
+ * in a Redis server that all of the instances use.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A SharedState is a key-value store in which each value can have a time-to-live, after which it
+// is removed (a zero TTL means that it doesn't expire).  Each operation is atomic across all of the
+// users of the store.  Operations that read a key that doesn't exist return ErrNotFound.
+type SharedState interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	// Set the value only if the key doesn't exist, returning true if the value was set.
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	// Set the value, returning the previous value (or nil if there wasn't one).
+	Swap(key string, value []byte, ttl time.Duration) ([]byte, error)
+	// Remove the key, returning the value that it had.
+	Take(key string) ([]byte, error)
+	Delete(key string) error
+	// Increment an integer value (which starts at zero), setting the TTL when the key is created.
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Replace the value (and TTL) only if the key currently has the value |old|, returning true if
+	// the value was replaced.
+	CompareAndSwap(key string, old, value []byte, ttl time.Duration) (bool, error)
+	// Remove the key only if it currently has the value |old|, returning true if it was removed.
+	CompareAndDelete(key string, old []byte) (bool, error)
+}
+
+// Generate the shared state store specified in the configuration.
+func NewSharedState(param SharedParam) (SharedState, error) {
+	switch param.Backend {
+	case "", "memory":
+		return NewMemoryState(), nil
+	case "redis":
+		return NewRedisState(param.Redis)
+	default:
+		return nil, fmt.Errorf("unknown shared state backend %q", param.Backend)
+	}
+}
+
+type memoryValue struct {
+	value   []byte
+	expires time.Time // Zero for no expiry
+}
+
+func (v memoryValue) expired(now time.Time) bool {
+	return !v.expires.IsZero() && now.After(v.expires)
+}
+
+// A MemoryState holds the shared state in memory, and so only shares it within the server.
+type MemoryState struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+	sweep  time.Time
+}
+
+func NewMemoryState() *MemoryState {
+	return &MemoryState{values: make(map[string]memoryValue)}
+}
+
+func (s *MemoryState) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v.value, nil
+}
+
+func (s *MemoryState) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(key, value, ttl)
+	return nil
+}
+
+func (s *MemoryState) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return false, nil
+	}
+	s.store(key, value, ttl)
+	return true, nil
+}
+
+func (s *MemoryState) Swap(key string, value []byte, ttl time.Duration) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, _ := s.lookup(key)
+	s.store(key, value, ttl)
+	return previous.value, nil
+}
+
+func (s *MemoryState) Take(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(s.values, key)
+	return v.value, nil
+}
+
+func (s *MemoryState) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryState) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.lookup(key)
+	if !ok {
+		s.store(key, []byte("1"), ttl)
+		return 1, nil
+	}
+	n, err := strconv.ParseInt(string(v.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %q is not an integer", key)
+	}
+	n++
+	v.value = []byte(strconv.FormatInt(n, 10))
+	s.values[key] = v
+	return n, nil
+}
+
+func (s *MemoryState) CompareAndSwap(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.lookup(key); !ok || !bytes.Equal(v.value, old) {
+		return false, nil
+	}
+	s.store(key, value, ttl)
+	return true, nil
+}
+
+func (s *MemoryState) CompareAndDelete(key string, old []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.lookup(key); !ok || !bytes.Equal(v.value, old) {
+		return false, nil
+	}
+	delete(s.values, key)
+	return true, nil
+}
+
+// Find the value for a key, if it exists and hasn't expired.  Must be called with the lock held.
+func (s *MemoryState) lookup(key string) (memoryValue, bool) {
+	v, ok := s.values[key]
+	if !ok || v.expired(time.Now()) {
+		return memoryValue{}, false
+	}
+	return v, true
+}
+
+// Set the value for a key, removing any expired values every so often so that the map doesn't
+// grow without limit.  Must be called with the lock held.
+func (s *MemoryState) store(key string, value []byte, ttl time.Duration) {
+	now := time.Now()
+	v := memoryValue{value: value}
+	if ttl > 0 {
+		v.expires = now.Add(ttl)
+	}
+	s.values[key] = v
+	if now.After(s.sweep) {
+		for k, v := range s.values {
+			if v.expired(now) {
+				delete(s.values, k)
+			}
+		}
+		s.sweep = now.Add(time.Minute)
+	}
+}
@@ -0,0 +1,408 @@
+/*! @file tokens.go
+ * @brief Management of the upload tokens that loggers use to authenticate to the server
+ *
+ * Each logger is configured with an upload token, which it sends as the password component of
+ * the BasicAuth header on every request (the username is the logger's unique identifier).  This
+ * module keeps the list of tokens that the server will accept.  Only the SHA-256 hash of each token
+ * is stored, so the plain-text value is available once, when the token is minted, and has to be
+ * transferred to the logger at that point.
+ *
+ * Each token is bound to a single logger, so that a token can't be used to impersonate any other
+ * logger.  Tokens are bound when minted; tokens from before binding (including the demonstration
+ * token) are bound to the first logger that uses them.
+ *
+ * Tokens can be made to expire after a lifetime set in the configuration, so that a lost logger
+ * eventually loses access even if its token is never revoked.  A logger renews its token before then
+ * (it's warned at checkin; see tokens.go in the main package), getting a new token while the old one
+ * stays good for a grace period, in case the logger doesn't receive the new one.  Only firmware that
+ * can renew its token should be given one that expires, so tokens don't expire by default, and tokens
+ * issued before a lifetime was set don't acquire one.
+ *
+ * Loggers that support it can authenticate by challenge-response instead, so that the token never
+ * goes over the wire: the logger signs a nonce from the server with HMAC-SHA256, keyed with a signing
+ * key derived from its token (see SigningKey).  The store keeps the signing key alongside the hash,
+ * but never hands it out: the hash is listed through the administration API and exported with the
+ * fleet, so it can't also be the key.  Tokens imported by hash alone don't have a signing key until
+ * the logger first authenticates with the token itself.
+ *
+ * Tokens issued elsewhere can be imported, by plain text or by hash, so that a fleet can move from
+ * another server without reconfiguring every logger.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The token that was originally hard-coded into the demonstration server.  A new token store is
+// seeded with this so that loggers configured for the demonstration continue to work; operators
+// should revoke it once they have minted their own tokens.
+const demonstrationToken = "1f808ca8-9ae3-4db1-9838-002cd7be04a8"
+
+// An ErrNotFound is returned when an operation refers to an object that the server does not have.
+var ErrNotFound = errors.New("not found")
+
+// A LoggerToken records the information held about an upload token.  The token itself is only
+// available when the token is minted; after that, the server only keeps the hash.
+type LoggerToken struct {
+	ID          string     `json:"id"`
+	Hash        string     `json:"hash"`
+	Logger      string     `json:"logger,omitempty"` // Logger that may use the token (any, until first used, if empty)
+	Description string     `json:"description"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"` // Never, if not given
+	Verifier    string     `json:"-"`                 // Signing key, in hex (see SigningKey), if known
+}
+
+// A storedToken is a token's record as written to the store's file, which (unlike everywhere else
+// the record goes) includes the signing key.
+type storedToken struct {
+	LoggerToken
+	Verifier string `json:"verifier,omitempty"`
+}
+
+// Determine whether the token has expired at the time given.
+func (t *LoggerToken) Expired(at time.Time) bool {
+	return t.Expires != nil && !at.Before(*t.Expires)
+}
+
+// A TokenStore holds the set of upload tokens that the server accepts, backed by a JSON
+// file in the server's state directory.  The tokens are also indexed by hash and by logger, so that
+// checking a logger's credentials doesn't take longer as the fleet grows; every change to the tokens
+// goes through put() and remove() to keep the indices in step.
+type TokenStore struct {
+	mu       sync.RWMutex
+	filename string
+	lifetime time.Duration          // Zero if tokens don't expire
+	tokens   map[string]LoggerToken // Indexed by ID
+	byHash   map[string]string      // Token ID, indexed by hash
+	byLogger map[string][]string    // Token IDs, indexed by the logger they're bound to
+}
+
+// Generate a token store from the given file, for tokens with the lifetime given (zero if they don't
+// expire).  If the file does not exist, the store is seeded with the demonstration token and written
+// out so that the operator can see what's available.  Tokens that were issued without an expiry time
+// keep none, even if tokens now expire, since loggers in the field may have no way to renew them.
+func NewTokenStore(filename string, lifetime time.Duration) (*TokenStore, error) {
+	s := &TokenStore{filename: filename, lifetime: lifetime, tokens: make(map[string]LoggerToken),
+		byHash: make(map[string]string), byLogger: make(map[string][]string)}
+	var tokens []storedToken
+	if err := LoadJSON(filename, &tokens); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		Warnf("no upload token store at %q; seeding with the demonstration token.\n", filename)
+		s.add("demonstration token (revoke for production use)", demonstrationToken)
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	for _, stored := range tokens {
+		t := stored.LoggerToken
+		t.Verifier = stored.Verifier
+		s.put(t)
+	}
+	return s, nil
+}
+
+// Generate a new upload token for the logger given, with a description for the operator's
+// reference.  The plain-text token is returned along with the record, and is not available from the
+// store after this.
+func (s *TokenStore) Mint(logger, description string) (string, LoggerToken, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", LoggerToken{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.add(description, token)
+	record.Logger = logger
+	s.put(record)
+	if err := s.save(); err != nil {
+		s.remove(record.ID)
+		return "", LoggerToken{}, err
+	}
+	return token, record, nil
+}
+
+// Add a token that was issued elsewhere (e.g., by another server) for the logger given, by its hash
+// (see HashToken).  If the store already has the token for the same logger, its record is returned
+// unchanged.
+func (s *TokenStore) Import(logger, description, hash string) (LoggerToken, error) {
+	if raw, err := hex.DecodeString(hash); err != nil || len(raw) != sha256.Size {
+		return LoggerToken{}, errors.New("token hash must be a SHA-256 digest in hex")
+	}
+	return s.importToken(logger, description, strings.ToLower(hash), "")
+}
+
+// Add a token that was issued elsewhere for the logger given, by its plain text, so that the store
+// has its signing key as well as its hash.
+func (s *TokenStore) ImportToken(logger, description, token string) (LoggerToken, error) {
+	return s.importToken(logger, description, HashToken(token), SigningKey(token))
+}
+
+func (s *TokenStore) importToken(logger, description, hash, verifier string) (LoggerToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.find(hash); ok {
+		if existing.Logger != logger {
+			return LoggerToken{}, errors.New("token is already issued to another logger")
+		}
+		if len(existing.Verifier) == 0 && len(verifier) > 0 {
+			existing.Verifier = verifier
+			s.put(existing)
+			return existing, s.save()
+		}
+		return existing, nil
+	}
+	record := s.add(description, "")
+	record.Hash, record.Logger, record.Verifier = hash, logger, verifier
+	s.put(record)
+	if err := s.save(); err != nil {
+		s.remove(record.ID)
+		return LoggerToken{}, err
+	}
+	return record, nil
+}
+
+// Remove the token with the given ID from the store, so that it can no longer be used.
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[id]; !ok {
+		return ErrNotFound
+	}
+	s.remove(id)
+	return s.save()
+}
+
+// Generate a list of all tokens known to the store, ordered by creation time.
+func (s *TokenStore) List() []LoggerToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rtn := make([]LoggerToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		rtn = append(rtn, t)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Created.Before(rtn[j].Created) })
+	return rtn
+}
+
+// Replace the token with the given ID by a new token for the same logger, with a fresh expiry time.
+// The old token remains good for the grace period given (or until it expires, if that's sooner).
+// The plain-text new token is returned along with its record.
+func (s *TokenStore) Renew(id string, grace time.Duration) (string, LoggerToken, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", LoggerToken{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.tokens[id]
+	if !ok {
+		return "", LoggerToken{}, ErrNotFound
+	}
+	record := s.add(old.Description, token)
+	record.Logger = old.Logger
+	s.put(record)
+	if until := time.Now().UTC().Add(grace); !old.Expired(until) {
+		revised := old
+		revised.Expires = &until
+		s.put(revised)
+	}
+	if err := s.save(); err != nil {
+		s.remove(record.ID)
+		s.put(old)
+		return "", LoggerToken{}, err
+	}
+	return token, record, nil
+}
+
+// Determine whether the token presented is one that the server accepts from the logger given,
+// returning its record if so.  A token that isn't yet bound to a logger is bound to this one, and a
+// token without a signing key (e.g., one imported by hash) is given one.
+func (s *TokenStore) Authenticate(logger, token string) (LoggerToken, bool) {
+	hash := HashToken(token)
+	now := time.Now()
+	s.mu.RLock()
+	record, ok := s.find(hash)
+	s.mu.RUnlock()
+	if !ok || record.Expired(now) || record.Logger != logger && len(record.Logger) > 0 {
+		return LoggerToken{}, false
+	}
+	if len(record.Logger) > 0 && len(record.Verifier) > 0 {
+		return record, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok = s.find(hash); !ok {
+		return LoggerToken{}, false
+	} else if len(record.Logger) > 0 && record.Logger != logger { // Bound by another request since the check above
+		return LoggerToken{}, false
+	} else if len(record.Logger) > 0 && len(record.Verifier) > 0 {
+		return record, true
+	}
+	bind := len(record.Logger) == 0
+	record.Logger, record.Verifier = logger, SigningKey(token)
+	s.put(record)
+	if err := s.save(); err != nil {
+		Errorf("failed to save upload token %s for logger %s: %s\n", record.ID, logger, err)
+	}
+	if bind {
+		Infof("bound upload token %s to logger %s on first use.\n", record.ID, logger)
+	}
+	return record, true
+}
+
+// Determine whether the signature given is the HMAC-SHA256 of the message, keyed with the signing key
+// of an upload token that's good for the logger given, returning the token's record if so.  Tokens
+// that aren't yet bound to a logger, or that don't have a signing key, aren't accepted here.
+func (s *TokenStore) VerifySignature(logger string, message, signature []byte) (LoggerToken, bool) {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, id := range s.byLogger[logger] {
+		t := s.tokens[id]
+		if t.Expired(now) {
+			continue
+		}
+		key, err := hex.DecodeString(t.Verifier)
+		if err != nil || len(key) == 0 {
+			continue
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(message)
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return t, true
+		}
+	}
+	return LoggerToken{}, false
+}
+
+// Provide the record of the token with the ID given.
+func (s *TokenStore) Get(id string) (LoggerToken, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tokens[id]
+	return t, ok
+}
+
+// Find the token with the hash given.  The caller must hold the lock.
+func (s *TokenStore) find(hash string) (LoggerToken, bool) {
+	if id, ok := s.byHash[hash]; ok {
+		return s.tokens[id], true
+	}
+	return LoggerToken{}, false
+}
+
+// Add or replace a token's record, updating the indices.  The caller must hold the lock.
+func (s *TokenStore) put(record LoggerToken) {
+	s.remove(record.ID)
+	s.tokens[record.ID] = record
+	s.byHash[record.Hash] = record.ID
+	if len(record.Logger) > 0 {
+		s.byLogger[record.Logger] = append(s.byLogger[record.Logger], record.ID)
+	}
+}
+
+// Remove the token with the ID given, if there is one, updating the indices.  The caller must hold
+// the lock.
+func (s *TokenStore) remove(id string) {
+	record, ok := s.tokens[id]
+	if !ok {
+		return
+	}
+	delete(s.tokens, id)
+	if s.byHash[record.Hash] == id {
+		delete(s.byHash, record.Hash)
+	}
+	if ids := slices.DeleteFunc(s.byLogger[record.Logger], func(x string) bool { return x == id }); len(ids) > 0 {
+		s.byLogger[record.Logger] = ids
+	} else {
+		delete(s.byLogger, record.Logger)
+	}
+}
+
+func (s *TokenStore) add(description, token string) LoggerToken {
+	id, _ := RandomToken(6)
+	record := LoggerToken{
+		ID:          id,
+		Hash:        HashToken(token),
+		Description: description,
+		Created:     time.Now().UTC(),
+		Verifier:    SigningKey(token),
+	}
+	if s.lifetime > 0 {
+		record.Expires = s.expiry()
+	}
+	s.put(record)
+	return record
+}
+
+// Generate the expiry time for a token created now.
+func (s *TokenStore) expiry() *time.Time {
+	rtn := time.Now().UTC().Add(s.lifetime)
+	return &rtn
+}
+
+func (s *TokenStore) save() error {
+	tokens := make([]storedToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, storedToken{LoggerToken: t, Verifier: t.Verifier})
+	}
+	return SaveJSON(s.filename, tokens)
+}
+
+// Generate the hash of a token, as the store keeps it.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generate the key with which a logger signs messages (e.g., challenge responses) from its token:
+// the HMAC-SHA256 of "wibl-signing", keyed with the token, in hex.  This is deliberately not the hash
+// that the store uses to find the token, which isn't secret enough to be a key.
+func SigningKey(token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("wibl-signing"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Generate a random hex-encoded string from the given number of bytes of entropy.
+func RandomToken(n int) (string, error) {
+	buffer := make([]byte, n)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
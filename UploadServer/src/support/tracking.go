@@ -0,0 +1,136 @@
+/*! @file tracking.go
+ * @brief Optional reporting of errors to a Sentry-compatible error tracker
+ *
+ * Loggers in the field fail intermittently and in ways that are hard to reproduce, and the only
+ * record is usually in the server's own log, which may be on a machine that nobody looks at.  If a
+ * DSN is configured, errors are also reported to an error tracker (Sentry, or anything that speaks
+ * its protocol) so that they're collected in one place: panics and server errors in the handlers
+ * (with the request, less any credentials), failed jobs, and alerts.  Without a DSN, nothing is
+ * reported and the functions here do nothing.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Set up error reporting with the configuration given, if a DSN is specified.
+func StartErrorTracking(param ErrorTrackingParam) error {
+	if len(param.DSN) == 0 {
+		return nil
+	}
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         param.DSN,
+		Environment: param.Environment,
+		SampleRate:  param.SampleRate,
+		ServerName:  param.ServerName,
+	})
+}
+
+// Wait (for a short time) for any reports that are still being sent, e.g., before the server exits.
+func FlushErrorTracking() {
+	if sentry.CurrentHub().Client() != nil {
+		sentry.Flush(2 * time.Second)
+	}
+}
+
+// Report an error that isn't associated with a request, with tags to help find it.
+func TrackError(err error, tags map[string]string) {
+	hub := sentry.CurrentHub().Clone()
+	hub.Scope().SetTags(tags)
+	hub.CaptureException(err)
+}
+
+// Report a message (e.g., an alert), with tags to help find it.
+func TrackMessage(level string, message string, tags map[string]string) {
+	hub := sentry.CurrentHub().Clone()
+	hub.Scope().SetTags(tags)
+	hub.Scope().SetLevel(sentry.Level(level))
+	hub.CaptureMessage(message)
+}
+
+// Add a tag to the report for a request, if it generates one (e.g., to identify the logger or user
+// that made the request).
+func TagRequest(r *http.Request, key, value string) {
+	if hub := sentry.GetHubFromContext(r.Context()); hub != nil {
+		hub.Scope().SetTag(key, value)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Report panics and server errors (HTTP 5xx) from the handler given, along with the request that
+// caused them.  Panics are recovered, and the client sent HTTP 500 (Internal Server Error).
+func TrackErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sentry.CurrentHub().Client() == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetRequest(r)
+		r = r.WithContext(sentry.SetHubOnContext(r.Context(), hub))
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				Errorf("panic in handler for %s %s: %v\n", r.Method, r.URL.Path, err)
+				hub.RecoverWithContext(r.Context(), err)
+				if recorder.status == 0 {
+					http.Error(recorder, "Internal Server Error", http.StatusInternalServerError)
+				}
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+		if recorder.status >= 500 {
+			hub.Scope().SetTag("status", fmt.Sprint(recorder.status))
+			hub.CaptureMessage(fmt.Sprintf("HTTP %d from %s %s", recorder.status, r.Method, r.URL.Path))
+		}
+	})
+}
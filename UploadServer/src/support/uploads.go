@@ -0,0 +1,354 @@
+/*! @file uploads.go
+ * @brief History of file uploads received by the server
+ *
+ * Every upload attempt from a logger is recorded, whether it was accepted or not, so that operators
+ * can see what each logger has sent and why anything was rejected.  The records are held in memory
+ * for lookup, and kept on disk as a JSON Lines journal: each change to a record appends the full
+ * record, so that the last line for each upload is the current state.  The journal is compacted to
+ * one line per record when the server starts.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/wibl"
+)
+
+// The status of an upload attempt.
+const (
+	UploadAccepted = "accepted"
+	UploadRejected = "rejected"
+)
+
+// The processing state of an accepted upload.  Rejected uploads have no processing state.
+const (
+	StateStored    = "stored"    // Stored, but not yet known to have been processed
+	StateQueued    = "queued"    // Stored, and the processing chain notified
+	StateCorrupt   = "corrupt"   // Stored object no longer matches the digest recorded on upload
+	StateMissing   = "missing"   // Stored object can no longer be found in storage
+	StateProcessed = "processed" // The processing chain has confirmed that it processed the file
+	StateFailed    = "failed"    // The processing chain reported that it couldn't process the file
+)
+
+// The outcomes that the processing chain can report for a file.
+const (
+	OutcomeConverted = "converted" // Converted to GeoJSON
+	OutcomeRejected  = "rejected"  // Refused by the processing chain (e.g., no usable data)
+	OutcomeSubmitted = "submitted" // Submitted to DCDB
+)
+
+// A ProcessingOutcome is a report from the processing chain about what happened to a file.
+type ProcessingOutcome struct {
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	Reference string    `json:"reference,omitempty"` // Identifier in the downstream system (e.g., DCDB submission)
+	Reporter  string    `json:"reporter"`            // Name of the processing chain component that reported it
+	Time      time.Time `json:"time"`                // When it happened
+	Reported  time.Time `json:"reported"`            // When it was reported to the server
+}
+
+// An UploadRecord describes a single upload attempt from a logger.
+type UploadRecord struct {
+	UUID        string    `json:"uuid"`
+	Logger      string    `json:"logger"`
+	Received    time.Time `json:"received"`
+	Remote      string    `json:"remote"`
+	Size        int64     `json:"size"`
+	MD5         string    `json:"md5"`
+	Type        string    `json:"type,omitempty"`        // Payload type, if not WIBL data
+	KeyID       string    `json:"key_id,omitempty"`      // Key the logger encrypted the file with, if it did
+	FileID      *uint     `json:"file_id,omitempty"`     // ID of the file on the logger, if known
+	Compress    string    `json:"compress,omitempty"`    // Compression of the stored object, if any
+	Digest      string    `json:"digest,omitempty"`      // Algorithm of the digest the logger sent, if not MD5
+	Key         string    `json:"key,omitempty"`         // Storage key, if the file was stored
+	Sidecar     string    `json:"sidecar,omitempty"`     // Storage key of the platform metadata, if stored separately
+	Stored      string    `json:"stored_md5,omitempty"`  // MD5 of the stored object, if it differs from the upload
+	Session     string    `json:"session,omitempty"`     // ID of the upload session that sent the file, if any
+	Trace       string    `json:"trace,omitempty"`       // Trace ID, by which the file can be followed downstream
+	Correlation string    `json:"correlation,omitempty"` // ID the sender gave in X-Trace-Id, if any
+	Route       string    `json:"route,omitempty"`       // Processing route the file was sent down, if not production
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	State       string    `json:"state,omitempty"`   // Processing state, for accepted uploads
+	Deleted     bool      `json:"deleted,omitempty"` // Only used in the journal, to mark removal
+	Tags        []string  `json:"tags,omitempty"`
+	Notes       []Note    `json:"notes,omitempty"`
+
+	Metadata   *wibl.Metadata `json:"metadata,omitempty"`   // Summary of the file contents, if it could be read
+	Vessel     *Vessel        `json:"vessel,omitempty"`     // Vessel the logger was on when the file arrived
+	Receipt    *api.Receipt   `json:"receipt,omitempty"`    // Signed receipt given to the logger, if any
+	Processed  *time.Time     `json:"processed,omitempty"`  // When the processing chain confirmed processing
+	Archived   *time.Time     `json:"archived,omitempty"`   // When the file was moved to the archive storage class
+	Replicated *time.Time     `json:"replicated,omitempty"` // When the file was copied to the second site
+
+	Outcomes []ProcessingOutcome `json:"outcomes,omitempty"` // As reported by the processing chain, oldest first
+}
+
+// Provide the MD5 digest of the stored object, which differs from that of the file uploaded if the
+// server rewrote the file before storing it.
+func (r *UploadRecord) ObjectMD5() string {
+	if len(r.Stored) > 0 {
+		return r.Stored
+	}
+	return r.MD5
+}
+
+// Provide the latest outcome that the processing chain reported for the file, if any.
+func (r *UploadRecord) LatestOutcome() (ProcessingOutcome, bool) {
+	if len(r.Outcomes) == 0 {
+		return ProcessingOutcome{}, false
+	}
+	return r.Outcomes[len(r.Outcomes)-1], true
+}
+
+// An UploadStore holds the history of uploads.
+type UploadStore struct {
+	mu      sync.RWMutex
+	journal *Journal
+	records map[string]*UploadRecord
+	usage   map[string]*Usage              // Indexed by logger
+	loggers map[string]map[string]struct{} // UUIDs of each logger's uploads, indexed by logger
+	routes  map[string]*RouteCount         // Indexed by processing route
+}
+
+// Generate an upload store from the journal given, which need not exist.
+func NewUploadStore(filename string) (*UploadStore, error) {
+	s := &UploadStore{journal: NewJournal(filename), records: make(map[string]*UploadRecord),
+		usage: make(map[string]*Usage), loggers: make(map[string]map[string]struct{}),
+		routes: make(map[string]*RouteCount)}
+	err := s.journal.Scan(func(line []byte) error {
+		record := new(UploadRecord)
+		if err := json.Unmarshal(line, record); err != nil {
+			return nil
+		}
+		if record.Deleted {
+			delete(s.records, record.UUID)
+		} else {
+			s.records[record.UUID] = record
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	for _, record := range s.records {
+		s.account(record, 1)
+		s.index(record, 1)
+	}
+	return s, nil
+}
+
+// Add a new record, or replace an existing record with the same UUID.
+func (s *UploadStore) Put(record UploadRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.journal.Append(record); err != nil {
+		return err
+	}
+	if existing, ok := s.records[record.UUID]; ok {
+		s.account(existing, -1)
+		s.index(existing, -1)
+	}
+	s.records[record.UUID] = &record
+	s.account(&record, 1)
+	s.index(&record, 1)
+	return nil
+}
+
+// Apply a change to the record for the upload with the given UUID.  If the function returns an
+// error, the record is left unchanged.  The updated record is returned.
+func (s *UploadStore) Update(uuid string, fn func(record *UploadRecord) error) (UploadRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.records[uuid]
+	if !ok {
+		return UploadRecord{}, ErrNotFound
+	}
+	record := *existing
+	if err := fn(&record); err != nil {
+		return UploadRecord{}, err
+	}
+	if err := s.journal.Append(record); err != nil {
+		return UploadRecord{}, err
+	}
+	s.account(existing, -1)
+	s.index(existing, -1)
+	s.records[uuid] = &record
+	s.account(&record, 1)
+	s.index(&record, 1)
+	return record, nil
+}
+
+// Remove the record for the upload with the given UUID.
+func (s *UploadStore) Delete(uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.records[uuid]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := s.journal.Append(UploadRecord{UUID: uuid, Deleted: true}); err != nil {
+		return err
+	}
+	s.account(existing, -1)
+	s.index(existing, -1)
+	delete(s.records, uuid)
+	return nil
+}
+
+// Provide the record for the upload with the given UUID.
+func (s *UploadStore) Get(uuid string) (UploadRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[uuid]
+	if !ok {
+		return UploadRecord{}, false
+	}
+	return *record, true
+}
+
+// Generate a list of the uploads received in the time range [from, to) for which the filter
+// function returns true (a nil filter accepts everything), ordered by time of receipt.
+func (s *UploadStore) Select(from, to time.Time, filter func(r *UploadRecord) bool) []UploadRecord {
+	s.mu.RLock()
+	rtn := make([]UploadRecord, 0)
+	for _, record := range s.records {
+		if InRange(record.Received, from, to) && (filter == nil || filter(record)) {
+			rtn = append(rtn, *record)
+		}
+	}
+	s.mu.RUnlock()
+	sortRecords(rtn)
+	return rtn
+}
+
+// Generate a list of the uploads from the named logger, as for Select().  Only that logger's records
+// are examined, so this is cheap enough to use on every request from the logger.
+func (s *UploadStore) SelectLogger(logger string, from, to time.Time, filter func(r *UploadRecord) bool) []UploadRecord {
+	s.mu.RLock()
+	rtn := make([]UploadRecord, 0)
+	for uuid := range s.loggers[logger] {
+		record := s.records[uuid]
+		if InRange(record.Received, from, to) && (filter == nil || filter(record)) {
+			rtn = append(rtn, *record)
+		}
+	}
+	s.mu.RUnlock()
+	sortRecords(rtn)
+	return rtn
+}
+
+// Call the function given with each upload received in the time range [from, to), in order of
+// receipt, stopping at the first error.  Only the order is worked out in advance; each record is
+// copied when it's reached (and skipped if it's been removed), so that the caller can write out a
+// long history without holding all of it at once.
+func (s *UploadStore) Scan(from, to time.Time, fn func(record UploadRecord) error) error {
+	type entry struct {
+		uuid     string
+		received time.Time
+	}
+	s.mu.RLock()
+	entries := make([]entry, 0)
+	for _, record := range s.records {
+		if InRange(record.Received, from, to) {
+			entries = append(entries, entry{record.UUID, record.Received})
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].received.Equal(entries[j].received) {
+			return entries[i].uuid < entries[j].uuid
+		}
+		return entries[i].received.Before(entries[j].received)
+	})
+	for _, e := range entries {
+		record, ok := s.Get(e.uuid)
+		if !ok {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add (sign = +1) or remove (sign = -1) a record from the index by logger.
+func (s *UploadStore) index(record *UploadRecord, sign int64) {
+	uuids, ok := s.loggers[record.Logger]
+	if !ok {
+		uuids = make(map[string]struct{})
+		s.loggers[record.Logger] = uuids
+	}
+	if sign > 0 {
+		uuids[record.UUID] = struct{}{}
+	} else {
+		delete(uuids, record.UUID)
+	}
+	if len(uuids) == 0 {
+		delete(s.loggers, record.Logger)
+	}
+}
+
+// Order records by time of receipt, and by UUID for those received at the same time.
+func sortRecords(records []UploadRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Received.Equal(records[j].Received) {
+			return records[i].UUID < records[j].UUID
+		}
+		return records[i].Received.Before(records[j].Received)
+	})
+}
+
+// Rewrite the journal with only the current state of each record.
+func (s *UploadStore) compact() error {
+	records := s.Select(time.Time{}, time.Time{}, nil)
+	return s.journal.Rewrite(func(enc *json.Encoder) error {
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Generate a random (version 4) UUID, used to name uploaded files.
+func NewUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,203 @@
+/*! @file uploadsessions.go
+ * @brief The history of upload sessions, in which loggers upload files in stages
+ *
+ * An upload session is begun, has its data sent in parts, and is then committed (or aborted, or
+ * abandoned); each change is appended to a journal in the state directory, as for the upload history,
+ * so that the state of each session (and why it failed, if it did) survives a restart.  See
+ * uploadsessions.go in the main package for the API.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// The states of an upload session.
+const (
+	SessionOpen      = "open"
+	SessionCommitted = "committed"
+	SessionFailed    = "failed"
+	SessionAborted   = "aborted"
+	SessionExpired   = "expired"
+)
+
+// An UploadSessions holds the upload sessions, by ID.
+type UploadSessions struct {
+	mu       sync.RWMutex
+	journal  *Journal
+	sessions map[string]*api.UploadSession
+}
+
+// Generate a store of upload sessions from the journal given, which need not exist.
+func NewUploadSessions(filename string) (*UploadSessions, error) {
+	s := &UploadSessions{journal: NewJournal(filename), sessions: make(map[string]*api.UploadSession)}
+	err := s.journal.Scan(func(line []byte) error {
+		session := new(api.UploadSession)
+		if err := json.Unmarshal(line, session); err != nil {
+			return nil
+		}
+		s.sessions[session.ID] = session
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add a new session.
+func (s *UploadSessions) Begin(session api.UploadSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.journal.Append(session); err != nil {
+		return err
+	}
+	s.sessions[session.ID] = &session
+	return nil
+}
+
+// Provide the session with the ID given.
+func (s *UploadSessions) Get(id string) (api.UploadSession, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return api.UploadSession{}, false
+	}
+	return *session, true
+}
+
+// Apply a change to the session with the ID given, noting the time of the change.  If the function
+// returns an error, the session is left unchanged.  The updated session is returned.
+func (s *UploadSessions) Update(id string, fn func(session *api.UploadSession) error) (api.UploadSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.sessions[id]
+	if !ok {
+		return api.UploadSession{}, ErrNotFound
+	}
+	session := *existing
+	if err := fn(&session); err != nil {
+		return api.UploadSession{}, err
+	}
+	session.Updated = time.Now().UTC()
+	if err := s.journal.Append(session); err != nil {
+		return api.UploadSession{}, err
+	}
+	s.sessions[id] = &session
+	return session, nil
+}
+
+// Generate a list of the sessions for which the filter function returns true (a nil filter accepts
+// everything), ordered by the time they began.
+func (s *UploadSessions) List(filter func(session *api.UploadSession) bool) []api.UploadSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list(filter)
+}
+
+func (s *UploadSessions) list(filter func(session *api.UploadSession) bool) []api.UploadSession {
+	rtn := make([]api.UploadSession, 0)
+	for _, session := range s.sessions {
+		if filter == nil || filter(session) {
+			rtn = append(rtn, *session)
+		}
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		if rtn[i].Created.Equal(rtn[j].Created) {
+			return rtn[i].ID < rtn[j].ID
+		}
+		return rtn[i].Created.Before(rtn[j].Created)
+	})
+	return rtn
+}
+
+// Remove the sessions that were closed (committed, failed, aborted, or expired) before the time
+// given, returning the number removed.
+func (s *UploadSessions) Prune(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make(map[string]*api.UploadSession)
+	for id, session := range s.sessions {
+		if session.State != SessionOpen && session.Updated.Before(before) {
+			removed[id] = session
+			delete(s.sessions, id)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	if err := s.compact(); err != nil {
+		for id, session := range removed {
+			s.sessions[id] = session
+		}
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// Remove all of the sessions from the logger given, whatever their state (e.g., when the logger's data
+// is purged), returning the number removed.
+func (s *UploadSessions) Forget(logger string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make(map[string]*api.UploadSession)
+	for id, session := range s.sessions {
+		if session.Logger == logger {
+			removed[id] = session
+			delete(s.sessions, id)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	if err := s.compact(); err != nil {
+		for id, session := range removed {
+			s.sessions[id] = session
+		}
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// Rewrite the journal with only the current state of each session.
+func (s *UploadSessions) compact() error {
+	sessions := s.list(nil)
+	return s.journal.Rewrite(func(enc *json.Encoder) error {
+		for _, session := range sessions {
+			if err := enc.Encode(session); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,173 @@
+/*! @file usage.go
+ * @brief Accounting of the storage used by each logger
+ *
+ * Some loggers upload far more than others (e.g., those on ships that are at sea all year), so
+ * operators need to be able to see which dominate storage, and to limit them if necessary.  The
+ * upload store keeps a running total of the files and bytes stored for each logger, which is
+ * updated as records are added, changed, and removed, so that it's cheap to check on every upload.
+ * It keeps the same sort of running totals of the WIBL files sent down each processing route, so
+ * that the route metrics don't need a pass over the whole upload history on every scrape.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"maps"
+	"sort"
+	"time"
+)
+
+// A Usage summarises the uploads from a single logger.  Files and Bytes count only the files
+// currently held in storage; Uploads and Rejected count all attempts in the upload history.
+type Usage struct {
+	Logger   string `json:"logger"`
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	Uploads  int64  `json:"uploads"`
+	Rejected int64  `json:"rejected"`
+}
+
+// Add (sign = +1) or remove (sign = -1) the contribution of an upload record to the usage.
+func (u *Usage) account(record *UploadRecord, sign int64) {
+	u.Uploads += sign
+	if record.Status == UploadRejected {
+		u.Rejected += sign
+	}
+	if len(record.Key) > 0 && record.State != StateMissing {
+		u.Files += sign
+		u.Bytes += sign * record.Size
+	}
+}
+
+func (s *UploadStore) account(record *UploadRecord, sign int64) {
+	u, ok := s.usage[record.Logger]
+	if !ok {
+		u = &Usage{Logger: record.Logger}
+		s.usage[record.Logger] = u
+	}
+	u.account(record, sign)
+	if u.Uploads == 0 {
+		delete(s.usage, record.Logger)
+	}
+	if record.Status != UploadAccepted || len(record.Type) > 0 {
+		return
+	}
+	c, ok := s.routes[record.Route]
+	if !ok {
+		c = newRouteCount(record.Route)
+		s.routes[record.Route] = c
+	}
+	c.account(record, sign)
+	if c.Files == 0 {
+		delete(s.routes, record.Route)
+	}
+}
+
+// Provide the usage for the named logger.  Loggers with no uploads have zero usage.
+func (s *UploadStore) Usage(logger string) Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if u, ok := s.usage[logger]; ok {
+		return *u
+	}
+	return Usage{Logger: logger}
+}
+
+// Generate a list of the usage of all loggers with uploads, ordered by logger identifier.
+func (s *UploadStore) UsageList() []Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rtn := make([]Usage, 0, len(s.usage))
+	for _, u := range s.usage {
+		rtn = append(rtn, *u)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Logger < rtn[j].Logger })
+	return rtn
+}
+
+// A RouteCount summarises the accepted WIBL files sent down a processing route (with an empty name for
+// production): their number and size, and the number in each processing state and with each latest
+// outcome reported by the processing chain.
+type RouteCount struct {
+	Route    string
+	Files    int64
+	Bytes    int64
+	States   map[string]int64
+	Outcomes map[string]int64
+}
+
+func newRouteCount(route string) *RouteCount {
+	return &RouteCount{Route: route, States: make(map[string]int64), Outcomes: make(map[string]int64)}
+}
+
+// Add (sign = +1) or remove (sign = -1) the contribution of an upload record to the route's counts.
+func (c *RouteCount) account(record *UploadRecord, sign int64) {
+	c.Files += sign
+	c.Bytes += sign * record.Size
+	tally(c.States, record.State, sign)
+	if outcome, ok := record.LatestOutcome(); ok {
+		tally(c.Outcomes, outcome.Outcome, sign)
+	}
+}
+
+// Adjust a count in a map, removing it when it reaches zero.
+func tally(counts map[string]int64, key string, sign int64) {
+	if counts[key] += sign; counts[key] == 0 {
+		delete(counts, key)
+	}
+}
+
+// Generate the counts for each processing route of the files received since the time given, ordered
+// by route name.  With a zero time, the running totals are used rather than the upload history.
+func (s *UploadStore) RouteCounts(since time.Time) []RouteCount {
+	s.mu.RLock()
+	counts := s.routes
+	if !since.IsZero() {
+		counts = make(map[string]*RouteCount)
+		for _, record := range s.records {
+			if record.Status != UploadAccepted || len(record.Type) > 0 || !InRange(record.Received, since, time.Time{}) {
+				continue
+			}
+			c, ok := counts[record.Route]
+			if !ok {
+				c = newRouteCount(record.Route)
+				counts[record.Route] = c
+			}
+			c.account(record, 1)
+		}
+	}
+	rtn := make([]RouteCount, 0, len(counts))
+	for _, c := range counts {
+		rtn = append(rtn, RouteCount{Route: c.Route, Files: c.Files, Bytes: c.Bytes, States: maps.Clone(c.States),
+			Outcomes: maps.Clone(c.Outcomes)})
+	}
+	s.mu.RUnlock()
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Route < rtn[j].Route })
+	return rtn
+}
+
+// Determine the storage limit for the named logger, in bytes, with zero meaning no limit.
+func (q QuotaParam) Limit(logger string) int64 {
+	if limit, ok := q.Loggers[logger]; ok {
+		return limit
+	}
+	return q.DefaultBytes
+}
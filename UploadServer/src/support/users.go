@@ -0,0 +1,338 @@
+/*! @file users.go
+ * @brief Local accounts and login sessions for users of the administration API
+ *
+ * Operators using the administration API (or a dashboard built on it) need real accounts, rather
+ * than sharing the pre-shared keys from the configuration.  This module keeps a store of admin
+ * users (separate from the logger upload tokens), with passwords hashed using bcrypt, and issues
+ * short-lived session tokens on login.  Passwords can be marked for forced rotation (e.g., after
+ * an administrator resets one, or when it reaches the maximum age set in the configuration), in
+ * which case the session issued at login is only good for changing the password.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The minimum length of password that the user store will accept.
+const minPasswordLength = 12
+
+var (
+	ErrBadCredentials = errors.New("invalid user name or password")
+	ErrUserExists     = errors.New("user already exists")
+	ErrWeakPassword   = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+)
+
+// An AdminUser is an account for the administration API.
+type AdminUser struct {
+	Name            string    `json:"name"`
+	Role            Role      `json:"role"`
+	Tenant          string    `json:"tenant,omitempty"`
+	PasswordHash    string    `json:"password_hash"`
+	PasswordChanged time.Time `json:"password_changed"`
+	MustChange      bool      `json:"must_change"`
+	Created         time.Time `json:"created"`
+	LastLogin       time.Time `json:"last_login,omitempty"`
+}
+
+// A UserStore holds the admin accounts, backed by a JSON file in the server's state directory.
+type UserStore struct {
+	mu       sync.RWMutex
+	filename string
+	maxAge   time.Duration // Zero for passwords that don't expire
+	users    map[string]*AdminUser
+}
+
+// Generate a user store from the given file, which need not exist.  Passwords older than |maxAge|
+// have to be changed on next login (zero disables expiry).
+func NewUserStore(filename string, maxAge time.Duration) (*UserStore, error) {
+	s := &UserStore{filename: filename, maxAge: maxAge, users: make(map[string]*AdminUser)}
+	var users []*AdminUser
+	if err := LoadJSON(filename, &users); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, u := range users {
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+// Add a new user with the given role and initial password.  If |temporary| is set, the user
+// has to change the password on first login.
+func (s *UserStore) Add(name string, role Role, tenant, password string, temporary bool) (AdminUser, error) {
+	if len(name) == 0 {
+		return AdminUser{}, errors.New("user name must not be empty")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return AdminUser{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; ok {
+		return AdminUser{}, ErrUserExists
+	}
+	now := time.Now().UTC()
+	user := &AdminUser{
+		Name:            name,
+		Role:            role,
+		Tenant:          tenant,
+		PasswordHash:    hash,
+		PasswordChanged: now,
+		MustChange:      temporary,
+		Created:         now,
+	}
+	s.users[name] = user
+	if err := s.save(); err != nil {
+		delete(s.users, name)
+		return AdminUser{}, err
+	}
+	return *user, nil
+}
+
+// Remove a user from the store.
+func (s *UserStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, name)
+	return s.save()
+}
+
+// Generate a list of all users, ordered by name.
+func (s *UserStore) List() []AdminUser {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rtn := make([]AdminUser, 0, len(s.users))
+	for _, u := range s.users {
+		rtn = append(rtn, *u)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Name < rtn[j].Name })
+	return rtn
+}
+
+// Check the user name and password given, returning the principal for the user on success.  The
+// principal is marked if the password has to be changed before the user can do anything else.
+// The password is checked without holding the lock, since bcrypt is deliberately slow and would
+// otherwise hold up every other login and session check.
+func (s *UserStore) Login(name, password string) (Principal, error) {
+	s.mu.RLock()
+	var hash string
+	user, ok := s.users[name]
+	if ok {
+		hash = user.PasswordHash
+	}
+	s.mu.RUnlock()
+	if !ok {
+		// Compare against a dummy hash so that the time taken doesn't reveal whether the
+		// user exists or not.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return Principal{}, ErrBadCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return Principal{}, ErrBadCredentials
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The user might have been deleted, or the password changed, while the password was checked.
+	if user, ok = s.users[name]; !ok || user.PasswordHash != hash {
+		return Principal{}, ErrBadCredentials
+	}
+	user.LastLogin = time.Now().UTC()
+	if err := s.save(); err != nil {
+		Warnf("failed to record login time for %s: %s\n", name, err)
+	}
+	return s.principal(user), nil
+}
+
+// Change a user's password, given the current one.  The new password has to differ from the old.
+func (s *UserStore) ChangePassword(name, current, replacement string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[name]
+	if !ok || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(current)) != nil {
+		return ErrBadCredentials
+	}
+	if current == replacement {
+		return errors.New("new password must differ from the current password")
+	}
+	return s.setPassword(user, replacement, false)
+}
+
+// Set a new temporary password for a user (e.g., when the user has forgotten theirs).  The user
+// has to change the password on next login.
+func (s *UserStore) ResetPassword(name, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	return s.setPassword(user, password, true)
+}
+
+func (s *UserStore) setPassword(user *AdminUser, password string, temporary bool) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	old := *user
+	user.PasswordHash = hash
+	user.PasswordChanged = time.Now().UTC()
+	user.MustChange = temporary
+	if err := s.save(); err != nil {
+		*user = old
+		return err
+	}
+	return nil
+}
+
+func (s *UserStore) principal(user *AdminUser) Principal {
+	expired := user.MustChange
+	if s.maxAge > 0 && time.Since(user.PasswordChanged) > s.maxAge {
+		expired = true
+	}
+	return Principal{Name: user.Name, Role: user.Role, Tenant: user.Tenant, PasswordExpired: expired}
+}
+
+func (s *UserStore) save() error {
+	users := make([]*AdminUser, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return SaveJSON(s.filename, users)
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no-such-user-password"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// A Session is issued to a user on login, and is presented as a bearer token on subsequent
+// requests until it expires.
+type Session struct {
+	Principal Principal `json:"principal"`
+	Expires   time.Time `json:"expires"`
+	Epoch     int64     `json:"epoch"` // Generation of the user's sessions when issued
+}
+
+// A SessionStore holds the login sessions that are currently active.  Sessions are held in the
+// shared state (indexed by a hash of the token), so unless that's in Redis, users have to log in
+// again if the server restarts.  Ending all of a user's sessions moves the user on to a new
+// generation, which invalidates all sessions issued before it.
+type SessionStore struct {
+	ttl   time.Duration
+	state SharedState
+}
+
+func NewSessionStore(state SharedState, ttl time.Duration) *SessionStore {
+	return &SessionStore{ttl: ttl, state: state}
+}
+
+// Generate a new session for the principal given, returning the bearer token for it.
+func (s *SessionStore) Issue(p Principal) (string, Session, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", Session{}, err
+	}
+	epoch, err := s.epoch(p.Name)
+	if err != nil {
+		return "", Session{}, err
+	}
+	session := Session{Principal: p, Expires: time.Now().UTC().Add(s.ttl), Epoch: epoch}
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", Session{}, err
+	}
+	if err := s.state.Set(sessionKey(token), value, s.ttl); err != nil {
+		return "", Session{}, err
+	}
+	return token, session, nil
+}
+
+// End the session associated with the token given.
+func (s *SessionStore) Revoke(token string) {
+	if err := s.state.Delete(sessionKey(token)); err != nil {
+		Errorf("failed to end session: %s\n", err)
+	}
+}
+
+// End all sessions held by the named user (e.g., when the account is deleted).
+func (s *SessionStore) RevokeUser(name string) {
+	if _, err := s.state.Incr("session-epoch:"+name, 0); err != nil {
+		Errorf("failed to end sessions for %s: %s\n", name, err)
+	}
+}
+
+func (s *SessionStore) Authenticate(token string) (Principal, bool) {
+	value, err := s.state.Get(sessionKey(token))
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			Errorf("failed to look up session: %s\n", err)
+		}
+		return Principal{}, false
+	}
+	var session Session
+	if err := json.Unmarshal(value, &session); err != nil || time.Now().After(session.Expires) {
+		return Principal{}, false
+	}
+	if epoch, err := s.epoch(session.Principal.Name); err != nil || epoch != session.Epoch {
+		return Principal{}, false
+	}
+	return session.Principal, true
+}
+
+// Find the current generation of the named user's sessions.
+func (s *SessionStore) epoch(name string) (int64, error) {
+	value, err := s.state.Get("session-epoch:" + name)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+func sessionKey(token string) string {
+	return fmt.Sprintf("session:%x", sha256.Sum256([]byte(token)))
+}
@@ -0,0 +1,178 @@
+/*! @file vessels.go
+ * @brief Records of the vessels on which loggers are installed
+ *
+ * Submissions to a Trusted Node have to describe the platform that collected the data (name and
+ * identifiers, draft, sensor offsets), and can only be made with the owner's consent.  The firmware
+ * can be configured with some of this, but it's often wrong or missing, so the server keeps its own
+ * vessel records, which loggers are linked to through the registry (see registry.go).  The records
+ * are backed by a JSON file in the state directory.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// A Vessel is the server's record of a vessel.
+type Vessel struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	api.VesselInfo
+}
+
+// Check that the vessel information is plausible.
+func ValidateVessel(info *api.VesselInfo) error {
+	info.Name = strings.TrimSpace(info.Name)
+	if len(info.Name) == 0 || len(info.Name) > 128 {
+		return errors.New("vessel name must be between 1 and 128 characters")
+	}
+	if len(info.MMSI) > 0 && !allDigits(info.MMSI, 9) {
+		return errors.New("MMSI must be nine digits")
+	}
+	if len(info.IMO) > 0 && !allDigits(strings.TrimPrefix(info.IMO, "IMO"), 7) {
+		return errors.New("IMO number must be seven digits")
+	}
+	if info.Draft != nil && (*info.Draft < 0 || *info.Draft > 30) {
+		return fmt.Errorf("draft of %g m is implausible", *info.Draft)
+	}
+	return nil
+}
+
+func allDigits(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// A VesselStore holds the vessel records.
+type VesselStore struct {
+	mu       sync.RWMutex
+	filename string
+	vessels  map[string]*Vessel
+}
+
+// Generate a vessel store from the given file, which need not exist.
+func NewVesselStore(filename string) (*VesselStore, error) {
+	s := &VesselStore{filename: filename, vessels: make(map[string]*Vessel)}
+	var records []*Vessel
+	if err := LoadJSON(filename, &records); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, record := range records {
+		s.vessels[record.ID] = record
+	}
+	return s, nil
+}
+
+// Add a new vessel, which must already have been validated.
+func (s *VesselStore) Add(info api.VesselInfo) (Vessel, error) {
+	id, err := RandomToken(6)
+	if err != nil {
+		return Vessel{}, err
+	}
+	now := time.Now().UTC()
+	record := &Vessel{ID: id, Created: now, Updated: now, VesselInfo: info}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vessels[id] = record
+	if err := s.save(); err != nil {
+		delete(s.vessels, id)
+		return Vessel{}, err
+	}
+	return *record, nil
+}
+
+// Replace the information for an existing vessel, which must already have been validated.
+func (s *VesselStore) Replace(id string, info api.VesselInfo) (Vessel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.vessels[id]
+	if !ok {
+		return Vessel{}, ErrNotFound
+	}
+	record := *existing
+	record.VesselInfo = info
+	record.Updated = time.Now().UTC()
+	s.vessels[id] = &record
+	if err := s.save(); err != nil {
+		s.vessels[id] = existing
+		return Vessel{}, err
+	}
+	return record, nil
+}
+
+// Provide the record for the vessel given.
+func (s *VesselStore) Get(id string) (Vessel, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.vessels[id]
+	if !ok {
+		return Vessel{}, false
+	}
+	return *record, true
+}
+
+// Generate a list of all vessels, ordered by name.
+func (s *VesselStore) List() []Vessel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rtn := make([]Vessel, 0, len(s.vessels))
+	for _, record := range s.vessels {
+		rtn = append(rtn, *record)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Name < rtn[j].Name })
+	return rtn
+}
+
+// Remove the record for the vessel given.
+func (s *VesselStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.vessels[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.vessels, id)
+	return s.save()
+}
+
+func (s *VesselStore) save() error {
+	records := make([]*Vessel, 0, len(s.vessels))
+	for _, record := range s.vessels {
+		records = append(records, record)
+	}
+	return SaveJSON(s.filename, records)
+}
@@ -0,0 +1,218 @@
+/*! @file window.go
+ * @brief Upload windows, to spread the fleet's uploads over time
+ *
+ * Left to themselves, loggers upload as soon as they can, so a large fleet all finishing its quiet
+ * period at the same moment would arrive at the server together.  The operator can configure quiet
+ * hours (when the shore station's link is needed for other things) in the station's local time, and
+ * a spread over which loggers are staggered; each logger is given a fixed offset within the spread,
+ * derived from its identifier, so that the fleet's uploads are evenly distributed.  Loggers whose
+ * links are only usable at some times of day (e.g., marina Wi-Fi that's only idle overnight) can also
+ * be given their own upload hours, in their own time zone, in the registry (see registry.go).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package support
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+	_ "time/tzdata" // Time zones are needed even where the system has no database (e.g., on Lambda)
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+)
+
+// A QuietPeriod is a daily period during which loggers shouldn't upload, from Start to End as "HH:MM"
+// in the schedule's time zone.  If End is before Start, the period runs past midnight.
+type QuietPeriod struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// An UploadScheduleParam configures the upload windows given to loggers at checkin: quiet hours (in
+// TimeZone, an IANA name), the spread in minutes over which loggers are staggered, the number of files
+// each logger should upload at once, and the proportion of upload slots in use (see priority.go) at
+// which the server is busy enough to ask loggers to stagger their uploads.
+type UploadScheduleParam struct {
+	TimeZone      string        `json:"time_zone"`
+	QuietHours    []QuietPeriod `json:"quiet_hours"`
+	SpreadMinutes int           `json:"spread_minutes"`
+	MaxFiles      int           `json:"max_files"`
+	BusyPercent   int           `json:"busy_percent"`
+}
+
+type quietPeriod struct {
+	start, end int // Minutes after midnight
+}
+
+// An UploadSchedule determines when loggers may upload.
+type UploadSchedule struct {
+	loc    *time.Location
+	quiet  []quietPeriod
+	spread time.Duration
+}
+
+// Generate the upload schedule from the configuration, checking that the time zone and quiet hours
+// are valid.
+func NewUploadSchedule(param UploadScheduleParam) (*UploadSchedule, error) {
+	loc, err := time.LoadLocation(param.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("upload schedule time zone: %w", err)
+	}
+	s := &UploadSchedule{loc: loc, spread: time.Duration(max(param.SpreadMinutes, 0)) * time.Minute}
+	for _, p := range param.QuietHours {
+		period, err := parsePeriod("quiet", p.Start, p.End)
+		if err != nil {
+			return nil, err
+		}
+		s.quiet = append(s.quiet, period)
+	}
+	return s, nil
+}
+
+func parsePeriod(kind, start, end string) (quietPeriod, error) {
+	s, err := parseClock(start)
+	if err != nil {
+		return quietPeriod{}, err
+	}
+	e, err := parseClock(end)
+	if err != nil {
+		return quietPeriod{}, err
+	}
+	if e == s {
+		return quietPeriod{}, fmt.Errorf("%s period from %s to %s is empty", kind, start, end)
+	}
+	return quietPeriod{start: s, end: e}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("time of day %q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Generate the intervals covered by the quiet periods starting on the day before that of t, that day,
+// and the day after, in the schedule's time zone.
+func (s *UploadSchedule) intervals(t time.Time) [][2]time.Time {
+	return dailyIntervals(t, s.loc, s.quiet)
+}
+
+// Generate the intervals covered by daily periods starting on the day before that of t, that day, and
+// the day after, in the time zone given.
+func dailyIntervals(t time.Time, loc *time.Location, periods []quietPeriod) [][2]time.Time {
+	t = t.In(loc)
+	var rtn [][2]time.Time
+	for day := -1; day <= 1; day++ {
+		for _, p := range periods {
+			start := time.Date(t.Year(), t.Month(), t.Day()+day, p.start/60, p.start%60, 0, 0, loc)
+			endDay := t.Day() + day
+			if p.end < p.start {
+				endDay++
+			}
+			end := time.Date(t.Year(), t.Month(), endDay, p.end/60, p.end%60, 0, 0, loc)
+			rtn = append(rtn, [2]time.Time{start, end})
+		}
+	}
+	return rtn
+}
+
+// Provide the first time, at or after t, that isn't within quiet hours.
+func (s *UploadSchedule) NextOpen(t time.Time) time.Time {
+	for moved := true; moved; {
+		moved = false
+		for _, i := range s.intervals(t) {
+			if !t.Before(i[0]) && t.Before(i[1]) {
+				t, moved = i[1].UTC(), true
+			}
+		}
+	}
+	return t
+}
+
+// Provide the start of the next quiet period after t, or the zero time if there are no quiet hours.
+func (s *UploadSchedule) NextQuiet(t time.Time) time.Time {
+	var rtn time.Time
+	for _, i := range s.intervals(t) {
+		if i[0].After(t) && (rtn.IsZero() || i[0].Before(rtn)) {
+			rtn = i[0].UTC()
+		}
+	}
+	return rtn
+}
+
+// Provide the logger's offset within the spread, which is the same at every checkin.
+func (s *UploadSchedule) Stagger(logger string) time.Duration {
+	if s.spread <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(logger))
+	return time.Duration(h.Sum64()%uint64(s.spread/time.Second)) * time.Second
+}
+
+// Check that a logger's upload hours are valid: a known time zone (if given), and at least one
+// non-empty period.
+func ValidateUploadHours(hours *api.UploadHours) error {
+	if len(hours.TimeZone) > 0 {
+		if _, err := time.LoadLocation(hours.TimeZone); err != nil {
+			return fmt.Errorf("upload hours time zone: %w", err)
+		}
+	}
+	if len(hours.Periods) == 0 {
+		return errors.New("upload hours need at least one period")
+	}
+	for _, p := range hours.Periods {
+		if _, err := parsePeriod("upload", p.Start, p.End); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Provide the first time, at or after t, within a logger's upload hours, and the end of the period that
+// it's in.  Upload hours without a time zone are in the schedule's.  The hours are assumed to have been
+// validated; any that aren't valid are ignored.
+func (s *UploadSchedule) NextUploadHour(hours *api.UploadHours, t time.Time) (time.Time, time.Time) {
+	loc := s.loc
+	if len(hours.TimeZone) > 0 {
+		if l, err := time.LoadLocation(hours.TimeZone); err == nil {
+			loc = l
+		}
+	}
+	var periods []quietPeriod
+	for _, p := range hours.Periods {
+		if period, err := parsePeriod("upload", p.Start, p.End); err == nil {
+			periods = append(periods, period)
+		}
+	}
+	var open, end time.Time
+	for _, i := range dailyIntervals(t, loc, periods) {
+		if !t.Before(i[0]) && t.Before(i[1]) {
+			return t, i[1].UTC()
+		}
+		if i[0].After(t) && (open.IsZero() || i[0].Before(open)) {
+			open, end = i[0].UTC(), i[1].UTC()
+		}
+	}
+	return open, end
+}
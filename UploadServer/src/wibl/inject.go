@@ -0,0 +1,139 @@
+/*! @file inject.go
+ * @brief Rewriting of the identification and platform metadata in WIBL files
+ *
+ * The processing chain takes the platform's name from the Metadata packet, and merges the contents
+ * of the JSONMetadata packet (IHO B.12 style metadata) into the GeoJSON that it generates.  Both are
+ * configured into the firmware by hand, and so are often wrong or missing.  This rewrites them from
+ * information that the server holds, following the same rules as wibl-python's editwibl command:
+ * existing packets are replaced in place, and missing packets are appended at the end of the file.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package wibl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Rewrite the Metadata and JSONMetadata packets in a WIBL file.  The ship name in the Metadata
+// packet is replaced (the logger name from the file is kept, if there is one), and each of the
+// top-level sections given (e.g., "platform") is merged key-by-key into the JSON metadata, so that
+// anything else the firmware was configured with is retained.  A truncated final packet is
+// dropped, since the processing chain would ignore it anyway.
+func InjectMetadata(data []byte, logger, ship string, sections map[string]map[string]any) ([]byte, error) {
+	var out bytes.Buffer
+	out.Grow(len(data) + 1024)
+	metadataOut, jsonOut := false, false
+	offset := 0
+	for offset+8 <= len(data) {
+		id := binary.LittleEndian.Uint32(data[offset:])
+		length := binary.LittleEndian.Uint32(data[offset+4:])
+		if _, known := packetNames[id]; !known || length > maxPacketLength {
+			if offset == 0 {
+				return nil, errors.New("not a WIBL file")
+			}
+			return nil, fmt.Errorf("invalid packet (id %d, length %d) at offset %d", id, length, offset)
+		}
+		end := offset + 8 + int(length)
+		if end > len(data) {
+			break
+		}
+		payload := data[offset+8 : end]
+		switch id {
+		case PacketMetadata:
+			name := logger
+			if existing, _, ok := readString(payload); ok && len(existing) > 0 {
+				name = existing
+			}
+			writePacket(&out, PacketMetadata, metadataPayload(name, ship))
+			metadataOut = true
+		case PacketJSONMetadata:
+			existing, _, _ := readString(payload)
+			merged, err := mergeJSON(existing, sections)
+			if err != nil {
+				return nil, err
+			}
+			writePacket(&out, PacketJSONMetadata, stringPayload(merged))
+			jsonOut = true
+		default:
+			out.Write(data[offset:end])
+		}
+		offset = end
+	}
+	if offset == 0 {
+		return nil, errors.New("file too short to be a WIBL file")
+	}
+	if !metadataOut {
+		writePacket(&out, PacketMetadata, metadataPayload(logger, ship))
+	}
+	if !jsonOut {
+		merged, err := mergeJSON("", sections)
+		if err != nil {
+			return nil, err
+		}
+		writePacket(&out, PacketJSONMetadata, stringPayload(merged))
+	}
+	return out.Bytes(), nil
+}
+
+// Merge sections into a JSON object, which is replaced if it doesn't decode.  The result has no
+// line breaks, since the logger's serialiser (and perhaps readers of the packet) can't cope with them.
+func mergeJSON(existing string, sections map[string]map[string]any) (string, error) {
+	doc := make(map[string]any)
+	if len(existing) > 0 {
+		if err := json.Unmarshal([]byte(existing), &doc); err != nil {
+			doc = make(map[string]any)
+		}
+	}
+	for name, values := range sections {
+		section, ok := doc[name].(map[string]any)
+		if !ok {
+			section = make(map[string]any)
+			doc[name] = section
+		}
+		for k, v := range values {
+			section[k] = v
+		}
+	}
+	rtn, err := json.Marshal(doc)
+	return string(rtn), err
+}
+
+func writePacket(out *bytes.Buffer, id uint32, payload []byte) {
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[:], id)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+	out.Write(header[:])
+	out.Write(payload)
+}
+
+func stringPayload(s string) []byte {
+	payload := make([]byte, 4, 4+len(s))
+	binary.LittleEndian.PutUint32(payload, uint32(len(s)))
+	return append(payload, s...)
+}
+
+func metadataPayload(logger, ship string) []byte {
+	return append(stringPayload(logger), stringPayload(ship)...)
+}
@@ -0,0 +1,380 @@
+/*! @file wibl.go
+ * @brief Extraction of summary metadata from WIBL binary log files
+ *
+ * WIBL files are a sequence of packets, each with a header of a 32-bit packet ID and 32-bit payload
+ * length (both little-endian), followed by the payload.  The packet formats are defined in
+ * LogConvert/src/serialisation.h and wibl-python/wibl/core/logger_file.py; this code only decodes
+ * enough of them to summarise a file for search: the time and geographic coverage, the NMEA0183
+ * talkers and sentences present, and the logger/platform identification.  Full interpretation of
+ * the data is left to the processing chain.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package wibl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Packet identifiers, from the WIBL serialisation specification.
+const (
+	PacketSerialiserVersion = 0
+	PacketSystemTime        = 1
+	PacketAttitude          = 2
+	PacketDepth             = 3
+	PacketCOG               = 4
+	PacketGNSS              = 5
+	PacketEnvironment       = 6
+	PacketTemperature       = 7
+	PacketHumidity          = 8
+	PacketPressure          = 9
+	PacketSerialString      = 10
+	PacketMotion            = 11
+	PacketMetadata          = 12
+	PacketAlgorithmRequest  = 13
+	PacketJSONMetadata      = 14
+	PacketNMEA0183Filter    = 15
+	PacketSensorScales      = 16
+	PacketRawIMU            = 17
+	PacketSetup             = 18
+)
+
+var packetNames = map[uint32]string{
+	PacketSerialiserVersion: "SerialiserVersion",
+	PacketSystemTime:        "SystemTime",
+	PacketAttitude:          "Attitude",
+	PacketDepth:             "Depth",
+	PacketCOG:               "COG",
+	PacketGNSS:              "GNSS",
+	PacketEnvironment:       "Environment",
+	PacketTemperature:       "Temperature",
+	PacketHumidity:          "Humidity",
+	PacketPressure:          "Pressure",
+	PacketSerialString:      "SerialString",
+	PacketMotion:            "Motion",
+	PacketMetadata:          "Metadata",
+	PacketAlgorithmRequest:  "AlgorithmRequest",
+	PacketJSONMetadata:      "JSONMetadata",
+	PacketNMEA0183Filter:    "NMEA0183Filter",
+	PacketSensorScales:      "SensorScales",
+	PacketRawIMU:            "RawIMU",
+	PacketSetup:             "Setup",
+}
+
+// The largest packet payload that's considered plausible; anything larger means the file is
+// corrupt (or not a WIBL file at all).
+const maxPacketLength = 1 << 20
+
+// A BoundingBox is a geographic extent in decimal degrees.
+type BoundingBox struct {
+	West  float64 `json:"west"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	North float64 `json:"north"`
+}
+
+// Determine whether two bounding boxes overlap (boxes crossing the antimeridian aren't handled).
+func (b BoundingBox) Intersects(o BoundingBox) bool {
+	return b.West <= o.East && o.West <= b.East && b.South <= o.North && o.South <= b.North
+}
+
+// Metadata summarises the contents of a WIBL file.  The time range and bounds are only present
+// if the file contains time and position information.
+type Metadata struct {
+	Version   string         `json:"version,omitempty"`  // Serialiser version (major.minor)
+	Logger    string         `json:"logger,omitempty"`   // Logger unique ID, from the Metadata packet
+	Platform  string         `json:"platform,omitempty"` // Ship name, from the Metadata packet
+	Start     *time.Time     `json:"start,omitempty"`
+	End       *time.Time     `json:"end,omitempty"`
+	Bounds    *BoundingBox   `json:"bounds,omitempty"`
+	Talkers   []string       `json:"talkers,omitempty"`   // NMEA0183 talker IDs (e.g., GP, SD)
+	Sentences []string       `json:"sentences,omitempty"` // NMEA0183 sentence types (e.g., GGA, DBT)
+	Packets   map[string]int `json:"packets"`             // Count of packets by type
+}
+
+// HasTalker determines whether the file contains NMEA0183 data from the talker given.
+func (m *Metadata) HasTalker(talker string) bool {
+	for _, t := range m.Talkers {
+		if strings.EqualFold(t, talker) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSentence determines whether the file contains NMEA0183 sentences of the type given.
+func (m *Metadata) HasSentence(sentence string) bool {
+	for _, s := range m.Sentences {
+		if strings.EqualFold(s, sentence) {
+			return true
+		}
+	}
+	return false
+}
+
+// An extractor accumulates metadata while scanning the packets in a file.
+type extractor struct {
+	meta       Metadata
+	talkers    map[string]bool
+	sentences  map[string]bool
+	start, end time.Time
+}
+
+// Check that the data starts with a plausible serialiser version packet, as all WIBL files do.  This
+// is much quicker than Extract(), and catches things that aren't WIBL files at all (e.g., HTML error
+// pages), but not files that are corrupt further on.
+func CheckHeader(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("file too short to be a WIBL file")
+	}
+	id := binary.LittleEndian.Uint32(data)
+	length := binary.LittleEndian.Uint32(data[4:])
+	if id != PacketSerialiserVersion || length > maxPacketLength {
+		return errors.New("not a WIBL file")
+	}
+	return nil
+}
+
+// Scan a WIBL file and summarise its contents.  An error is returned if the data does not look
+// like a WIBL file; a file that is truncated part-way through a packet is summarised up to that
+// point, since loggers can lose the tail of a file on power failure.
+func Extract(data []byte) (*Metadata, error) {
+	x := &extractor{
+		meta:      Metadata{Packets: make(map[string]int)},
+		talkers:   make(map[string]bool),
+		sentences: make(map[string]bool),
+	}
+	offset := 0
+	for offset+8 <= len(data) {
+		id := binary.LittleEndian.Uint32(data[offset:])
+		length := binary.LittleEndian.Uint32(data[offset+4:])
+		offset += 8
+		name, known := packetNames[id]
+		if !known || length > maxPacketLength {
+			if offset == 8 {
+				return nil, errors.New("not a WIBL file")
+			}
+			return nil, fmt.Errorf("invalid packet (id %d, length %d) at offset %d", id, length, offset-8)
+		}
+		if offset+int(length) > len(data) {
+			break // Truncated final packet
+		}
+		if offset == 8 && id != PacketSerialiserVersion {
+			return nil, errors.New("WIBL file does not start with a serialiser version packet")
+		}
+		x.packet(id, data[offset:offset+int(length)])
+		x.meta.Packets[name]++
+		offset += int(length)
+	}
+	if offset == 0 {
+		return nil, errors.New("file too short to be a WIBL file")
+	}
+	if !x.start.IsZero() {
+		x.meta.Start, x.meta.End = &x.start, &x.end
+	}
+	x.meta.Talkers = sortedKeys(x.talkers)
+	x.meta.Sentences = sortedKeys(x.sentences)
+	return &x.meta, nil
+}
+
+func (x *extractor) packet(id uint32, payload []byte) {
+	switch id {
+	case PacketSerialiserVersion:
+		if len(payload) >= 4 {
+			x.meta.Version = fmt.Sprintf("%d.%d",
+				binary.LittleEndian.Uint16(payload), binary.LittleEndian.Uint16(payload[2:]))
+		}
+	case PacketSystemTime:
+		// u16 date (days since epoch), f64 timestamp (seconds since midnight), u32 elapsed, u8 source
+		if len(payload) >= 10 {
+			x.addTime(binary.LittleEndian.Uint16(payload), readFloat(payload[2:]))
+		}
+	case PacketGNSS:
+		// u16 date, f64 timestamp, u32 elapsed (reception), then u16 date, f64 timestamp, f64
+		// latitude, f64 longitude, f64 altitude, ... (in-message)
+		if len(payload) >= 14+2+8+16 {
+			x.addTime(binary.LittleEndian.Uint16(payload[14:]), readFloat(payload[16:]))
+			x.addPosition(readFloat(payload[24:]), readFloat(payload[32:]))
+		}
+	case PacketSerialString:
+		// u32 elapsed, then the sentence text
+		if len(payload) > 4 {
+			x.sentence(string(payload[4:]))
+		}
+	case PacketMetadata:
+		// u32 length, logger ID, u32 length, ship name
+		if logger, rest, ok := readString(payload); ok {
+			x.meta.Logger = logger
+			if platform, _, ok := readString(rest); ok {
+				x.meta.Platform = platform
+			}
+		}
+	}
+}
+
+// Decode an NMEA0183 sentence, recording the talker and sentence type, and extracting position
+// and time information from the common positioning sentences.
+func (x *extractor) sentence(text string) {
+	text = strings.TrimSpace(text)
+	if len(text) < 6 || (text[0] != '$' && text[0] != '!') {
+		return
+	}
+	if star := strings.IndexByte(text, '*'); star > 0 {
+		text = text[:star]
+	}
+	fields := strings.Split(text[1:], ",")
+	if len(fields[0]) < 5 {
+		return
+	}
+	talker, kind := fields[0][:2], fields[0][2:]
+	x.talkers[talker] = true
+	x.sentences[kind] = true
+	switch kind {
+	case "GGA":
+		// hhmmss.ss, lat, N/S, lon, E/W, quality, ...
+		if len(fields) > 6 && fields[6] != "0" {
+			if lat, lon, ok := nmeaPosition(fields[2:6]); ok {
+				x.addPosition(lat, lon)
+			}
+		}
+	case "RMC":
+		// hhmmss.ss, status, lat, N/S, lon, E/W, speed, course, ddmmyy, ...
+		if len(fields) > 9 && fields[2] == "A" {
+			if lat, lon, ok := nmeaPosition(fields[3:7]); ok {
+				x.addPosition(lat, lon)
+			}
+			if t, err := time.Parse("020106150405", fields[9]+truncateSeconds(fields[1])); err == nil {
+				x.updateRange(t)
+			}
+		}
+	case "ZDA":
+		// hhmmss.ss, day, month, year, ...
+		if len(fields) > 4 {
+			stamp := fmt.Sprintf("%s%s%s%s", fields[4], fields[3], fields[2], truncateSeconds(fields[1]))
+			if t, err := time.Parse("20060102150405", stamp); err == nil {
+				x.updateRange(t)
+			}
+		}
+	}
+}
+
+// Add a time expressed as days since the epoch and seconds since midnight to the time coverage.
+func (x *extractor) addTime(days uint16, seconds float64) {
+	if days == 0 || math.IsNaN(seconds) || seconds < 0 || seconds > 86401 {
+		return
+	}
+	t := time.Unix(int64(days)*86400, 0).UTC().Add(time.Duration(seconds * float64(time.Second)))
+	x.updateRange(t)
+}
+
+func (x *extractor) updateRange(t time.Time) {
+	if x.start.IsZero() || t.Before(x.start) {
+		x.start = t
+	}
+	if t.After(x.end) {
+		x.end = t
+	}
+}
+
+func (x *extractor) addPosition(lat, lon float64) {
+	if math.IsNaN(lat) || math.IsNaN(lon) || lat < -90 || lat > 90 || lon < -180 || lon > 180 ||
+		(lat == 0 && lon == 0) {
+		return
+	}
+	if x.meta.Bounds == nil {
+		x.meta.Bounds = &BoundingBox{West: lon, South: lat, East: lon, North: lat}
+		return
+	}
+	b := x.meta.Bounds
+	b.West, b.East = math.Min(b.West, lon), math.Max(b.East, lon)
+	b.South, b.North = math.Min(b.South, lat), math.Max(b.North, lat)
+}
+
+// Convert NMEA0183 ddmm.mmmm,N,dddmm.mmmm,W fields into decimal degrees.
+func nmeaPosition(fields []string) (lat, lon float64, ok bool) {
+	parse := func(value, hemisphere string, degreeDigits int) (float64, bool) {
+		if len(value) < degreeDigits+2 {
+			return 0, false
+		}
+		degrees, err1 := strconv.ParseFloat(value[:degreeDigits], 64)
+		minutes, err2 := strconv.ParseFloat(value[degreeDigits:], 64)
+		if err1 != nil || err2 != nil {
+			return 0, false
+		}
+		v := degrees + minutes/60
+		if hemisphere == "S" || hemisphere == "W" {
+			v = -v
+		}
+		return v, true
+	}
+	var ok1, ok2 bool
+	lat, ok1 = parse(fields[0], fields[1], 2)
+	lon, ok2 = parse(fields[2], fields[3], 3)
+	return lat, lon, ok1 && ok2
+}
+
+// Remove fractional seconds from an NMEA0183 hhmmss.ss time field.
+func truncateSeconds(hms string) string {
+	if dot := strings.IndexByte(hms, '.'); dot >= 0 {
+		return hms[:dot]
+	}
+	return hms
+}
+
+func readFloat(b []byte) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+// Read a u32 length-prefixed string, returning the string and the remaining data.
+func readString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		return "", nil, false
+	}
+	return string(b[4 : 4+n]), b[4+n:], true
+}
+
+func sortedKeys(m map[string]bool) []string {
+	rtn := make([]string, 0, len(m))
+	for k := range m {
+		rtn = append(rtn, k)
+	}
+	sort.Strings(rtn)
+	return rtn
+}
+
+// Determine whether the file's time coverage overlaps the range [from, to], where zero times
+// leave the corresponding end of the range open.  Files without time information never overlap.
+func (m *Metadata) Overlaps(from, to time.Time) bool {
+	if m.Start == nil {
+		return false
+	}
+	return (from.IsZero() || !m.End.Before(from)) && (to.IsZero() || !m.Start.After(to))
+}
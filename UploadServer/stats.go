@@ -0,0 +1,141 @@
+/*! @file stats.go
+ * @brief Aggregate statistics on the fleet and its uploads
+ *
+ * Dashboards and external reporting need a quick view of program health (how many loggers are
+ * active, how much data is arriving, and why uploads are failing) without pulling the full upload
+ * history.  This end-point computes the aggregates from the fleet status and upload history.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The default and maximum number of days reported by the statistics end-point.
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+type dailyStats struct {
+	Date     string `json:"date"`
+	Uploads  int    `json:"uploads"`
+	Accepted int    `json:"accepted"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type reasonCount struct {
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+type fleetStats struct {
+	Generated     time.Time     `json:"generated"`
+	Loggers       int           `json:"loggers"`    // Known to the server, by checkin, upload, or registry
+	Active24h     int           `json:"active_24h"` // Checked in or uploaded in the last 24 hours
+	Active7d      int           `json:"active_7d"`
+	Days          []dailyStats  `json:"days"`
+	TopRejections []reasonCount `json:"top_rejections"`
+}
+
+// Report aggregate statistics on the fleet.  The "days" query parameter sets the number of days of
+// upload statistics (and the window for rejection reasons) reported, ending today.
+func (app *application) fleetStats(w http.ResponseWriter, r *http.Request) {
+	days := defaultStatsDays
+	if value := r.URL.Query().Get("days"); len(value) > 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxStatsDays {
+			writeError(w, http.StatusBadRequest, "days must be between 1 and 366")
+			return
+		}
+		days = n
+	}
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, 1-days)
+
+	// Activity is taken from the most recent checkin or upload, since the fleet status is only
+	// held in memory, and so is lost when the server restarts.
+	active := make(map[string]time.Time)
+	for _, status := range app.fleet.List() {
+		active[status.LoggerID] = status.LastCheckin
+	}
+	for _, record := range app.registry.List() {
+		if _, ok := active[record.ID]; !ok {
+			active[record.ID] = time.Time{}
+		}
+	}
+	stats := fleetStats{Generated: now, Days: make([]dailyStats, days)}
+	for n := range stats.Days {
+		stats.Days[n].Date = from.AddDate(0, 0, n).Format(time.DateOnly)
+	}
+	reasons := make(map[string]int)
+	app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		if u.Received.After(active[u.Logger]) {
+			active[u.Logger] = u.Received
+		}
+		if u.Received.Before(from) {
+			return false
+		}
+		n := int(u.Received.Sub(from) / (24 * time.Hour))
+		if n >= days {
+			return false
+		}
+		day := &stats.Days[n]
+		day.Uploads++
+		if u.Status == support.UploadAccepted {
+			day.Accepted++
+			day.Bytes += u.Size
+		} else {
+			reasons[u.Reason]++
+		}
+		return false
+	})
+	stats.Loggers = len(active)
+	for _, last := range active {
+		if now.Sub(last) <= 24*time.Hour {
+			stats.Active24h++
+		}
+		if now.Sub(last) <= 7*24*time.Hour {
+			stats.Active7d++
+		}
+	}
+	stats.TopRejections = make([]reasonCount, 0, len(reasons))
+	for reason, count := range reasons {
+		stats.TopRejections = append(stats.TopRejections, reasonCount{Reason: reason, Count: count})
+	}
+	sort.Slice(stats.TopRejections, func(i, j int) bool {
+		if stats.TopRejections[i].Count != stats.TopRejections[j].Count {
+			return stats.TopRejections[i].Count > stats.TopRejections[j].Count
+		}
+		return stats.TopRejections[i].Reason < stats.TopRejections[j].Reason
+	})
+	if len(stats.TopRejections) > 10 {
+		stats.TopRejections = stats.TopRejections[:10]
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,88 @@
+/*! @file statuswarnings.go
+ * @brief Reporting the parts of loggers' status messages that the server doesn't understand
+ *
+ * Checkin status messages are decoded leniently (see support/lenient.go), so that a field added by new
+ * firmware, or a value of a different type, doesn't lose the rest of the status.  What the server
+ * didn't understand in each logger's most recent status is kept with the logger's record (and shown
+ * with it); this gathers the warnings across the fleet, with the loggers and firmware versions that
+ * gave each, so that firmware teams can see which of their changes the server doesn't know yet.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A statusWarning is one thing that the server didn't understand in loggers' most recent status, with
+// the loggers that sent it and the firmware they were running.
+type statusWarning struct {
+	Warning  string    `json:"warning"`
+	Loggers  []string  `json:"loggers"`
+	Firmware []string  `json:"firmware"`
+	Latest   time.Time `json:"last_seen"`
+}
+
+// List the warnings from the most recent status of each logger, most widespread first, optionally only
+// those for loggers running a given firmware version.
+func (app *application) statusWarnings(w http.ResponseWriter, r *http.Request) {
+	firmware := r.URL.Query().Get("firmware")
+	index := make(map[string]*statusWarning)
+	for _, status := range app.fleet.List() {
+		version := status.Status.Versions.Firmware
+		if len(firmware) > 0 && version != firmware {
+			continue
+		}
+		for _, warning := range status.Warnings {
+			entry, ok := index[warning]
+			if !ok {
+				entry = &statusWarning{Warning: warning}
+				index[warning] = entry
+			}
+			entry.Loggers = append(entry.Loggers, status.LoggerID)
+			if len(version) > 0 && !slices.Contains(entry.Firmware, version) {
+				entry.Firmware = append(entry.Firmware, version)
+			}
+			if status.LastCheckin.After(entry.Latest) {
+				entry.Latest = status.LastCheckin
+			}
+		}
+	}
+	rtn := make([]statusWarning, 0, len(index))
+	for _, entry := range index {
+		slices.Sort(entry.Loggers)
+		slices.SortFunc(entry.Firmware, compareVersions)
+		if entry.Firmware == nil {
+			entry.Firmware = make([]string, 0)
+		}
+		rtn = append(rtn, *entry)
+	}
+	slices.SortFunc(rtn, func(a, b statusWarning) int {
+		if n := len(b.Loggers) - len(a.Loggers); n != 0 {
+			return n
+		}
+		return strings.Compare(a.Warning, b.Warning)
+	})
+	writeJSON(w, http.StatusOK, rtn)
+}
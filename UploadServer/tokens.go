@@ -0,0 +1,85 @@
+/*! @file tokens.go
+ * @brief Expiry warnings and renewal of upload tokens, for the loggers
+ *
+ * Upload tokens expire (see support/tokens.go), so a logger needs to renew its token before then.
+ * When the token a logger checks in with is within the warning period of the configuration, the
+ * checkin response says when it expires and where to renew it; the logger then posts to that path,
+ * authenticating with its current token, and gets a new one.  The old token stays good for a grace
+ * period, so a logger that doesn't receive the new token can try again.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The path to which loggers post to renew their upload tokens.
+const renewPath = "/v1/token/renew"
+
+// Determine whether the token with the ID given is due for renewal, i.e., expires within the warning
+// period of the configuration, returning its record if so.
+func (app *application) renewalDue(id string) (support.LoggerToken, bool) {
+	token, ok := app.tokens.Get(id)
+	if !ok || token.Expires == nil {
+		return support.LoggerToken{}, false
+	}
+	warning := time.Duration(app.config.Tokens.WarnDays) * 24 * time.Hour
+	return token, token.Expired(time.Now().Add(warning))
+}
+
+// Generate the warning for a logger whose token is due for renewal, or nil if it isn't.
+func (app *application) tokenExpiry(r *http.Request) *api.TokenExpiry {
+	token, due := app.renewalDue(support.TokenID(r))
+	if !due {
+		return nil
+	}
+	return &api.TokenExpiry{Expires: *token.Expires, Renew: renewPath}
+}
+
+// Give a logger a new upload token in place of the one it authenticated with, if that's due for
+// renewal.
+func (app *application) renewToken(w http.ResponseWriter, r *http.Request) {
+	logger, id := support.LoggerID(r), support.TokenID(r)
+	if _, due := app.renewalDue(id); !due {
+		writeError(w, http.StatusConflict, "token is not due for renewal")
+		return
+	}
+	grace := time.Duration(app.config.Tokens.GraceHours) * time.Hour
+	token, record, err := app.tokens.Renew(id, grace)
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "token has been revoked")
+		return
+	case err != nil:
+		support.Errorf("API: failed to renew upload token %s for logger %s: %s\n", id, logger, err)
+		writeError(w, http.StatusInternalServerError, "failed to renew token")
+		return
+	}
+	support.Infof("API: renewed upload token %s for logger %s as %s.\n", id, logger, record.ID)
+	app.audit.Record(logger, r.RemoteAddr, "token.renew", record.ID, "replaces "+id)
+	writeJSON(w, http.StatusOK, api.TokenRenewal{ID: record.ID, Token: token, Expires: record.Expires})
+}
@@ -0,0 +1,95 @@
+/*! @file trace.go
+ * @brief Trace IDs that follow each upload from the logger to DCDB
+ *
+ * A data manager chasing one file has to match it up across the logger's log, this server, the
+ * processing chain, and DCDB, each of which names it differently.  Each upload is given a trace ID,
+ * a random 128-bit identifier (in hex, as for a W3C trace ID) generated by the server, so that the
+ * ID is unique whatever the logger sends.  An ID that the logger sends in the X-Trace-Id header is
+ * kept with the upload as its correlation ID, passed to the processing chain alongside the trace
+ * ID, and can be used in place of the trace ID to find the file.  The trace ID is recorded with the
+ * upload, stored in the object's metadata, sent to the processing chain with the notification that
+ * the file is ready, and returned to the logger with the result of the transfer; the processing
+ * chain gives it back when it reports what happened to the file (see outcomes.go), and it can be
+ * used to find the file in the listing under /v1/files.  Files forwarded to an upstream server (see
+ * federation.go) carry their trace IDs there as correlation IDs.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The header in which a logger (or downstream server) can give the trace ID for an upload.
+const traceHeader = "X-Trace-Id"
+
+// Trace IDs from loggers have to be safe to log and to pass on in message attributes.
+var traceID = regexp.MustCompile(`^[A-Za-z0-9._:-]{8,64}$`)
+
+// Generate a new random trace ID.
+func newTraceID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Find the ID that the logger (or downstream server) gave for an upload in a request, if it gave a
+// usable one.
+func requestCorrelation(r *http.Request) string {
+	header := strings.TrimSpace(r.Header.Get(traceHeader))
+	if len(header) > 0 && !traceID.MatchString(header) {
+		support.Warnf("TRANS: ignoring malformed trace ID %q from %s.\n", header, support.LoggerID(r))
+		return ""
+	}
+	return header
+}
+
+// Find the trace ID to report to the logger for an upload: that of its record, or, if the upload
+// repeated a file that was already accepted (and so wasn't recorded itself), that of the original.
+func (app *application) uploadTrace(record support.UploadRecord) string {
+	if u, ok := app.uploads.Get(record.UUID); ok {
+		return u.Trace
+	}
+	if u, ok := app.uploads.Get(app.acceptedUpload(record.Logger, record.MD5)); ok {
+		return u.Trace
+	}
+	return ""
+}
+
+// Find the upload with the trace ID given.
+func (app *application) tracedUpload(trace string) (support.UploadRecord, bool) {
+	matches := app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.Trace == trace
+	})
+	if len(matches) == 0 {
+		return support.UploadRecord{}, false
+	}
+	return matches[len(matches)-1], true
+}
@@ -0,0 +1,91 @@
+/*! @file transfer.go
+ * @brief Transfer profiles, which suit how loggers send files to their links
+ *
+ * The server's timeouts suit loggers with reasonable connectivity, but over a BGAN or Iridium Certus
+ * link a large upload can't finish within them, and a long dropped transfer wastes expensive airtime.
+ * Each logger is assigned a transfer profile in the registry (or the default in the configuration):
+ * the server extends its read and write deadlines for the logger's requests to suit, and tells the
+ * logger at checkin what size of chunk to send files in (see chunks.go), and how often and how many
+ * times to retry, so that a slow link sends files in tiny chunks, resuming after each drop.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Find the transfer profile for a logger, by name.  The name is empty if the profile named in the
+// registry (or configuration) isn't defined.
+func (app *application) transferProfile(logger string) (string, support.ProfileParam) {
+	name := app.config.Transfer.Default
+	if record, ok := app.registry.Get(logger); ok && len(record.Profile) > 0 {
+		name = record.Profile
+	}
+	profile, ok := app.config.Transfer.Profiles[name]
+	if !ok {
+		return "", support.ProfileParam{}
+	}
+	return name, profile
+}
+
+// Generate the transfer profile to tell the logger about at checkin.
+func (app *application) transferAdvice(logger string) *api.TransferProfile {
+	name, profile := app.transferProfile(logger)
+	if len(name) == 0 {
+		return nil
+	}
+	return &api.TransferProfile{
+		Name:         name,
+		ChunkBytes:   profile.ChunkKB * 1024,
+		ReadSeconds:  profile.ReadSeconds,
+		WriteSeconds: profile.WriteSeconds,
+		RetrySeconds: profile.RetrySeconds,
+		MaxRetries:   profile.MaxRetries,
+	}
+}
+
+// Set the deadlines for reading the request and writing the response according to the logger's
+// transfer profile, in place of the server's.
+func (app *application) transferDeadlines(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := support.LoggerID(r)
+		_, profile := app.transferProfile(logger)
+		control := http.NewResponseController(w)
+		now := time.Now()
+		if profile.ReadSeconds > 0 {
+			if err := control.SetReadDeadline(now.Add(time.Duration(profile.ReadSeconds) * time.Second)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				support.Warnf("API: failed to set read deadline for logger %s: %s\n", logger, err)
+			}
+		}
+		if profile.WriteSeconds > 0 {
+			if err := control.SetWriteDeadline(now.Add(time.Duration(profile.WriteSeconds) * time.Second)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				support.Warnf("API: failed to set write deadline for logger %s: %s\n", logger, err)
+			}
+		}
+		next(w, r)
+	}
+}
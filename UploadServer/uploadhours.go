@@ -0,0 +1,101 @@
+/*! @file uploadhours.go
+ * @brief Per-logger upload hours
+ *
+ * Some loggers can only upload at certain times of day without getting in the way (e.g., when the
+ * marina's Wi-Fi is idle overnight).  Operators can give a logger upload hours in the registry, in the
+ * logger's own time zone (see support/window.go); the logger is told about them in the upload window at
+ * checkin (see hints.go), and uploads that start outside them are refused with HTTP 503 (Service
+ * Unavailable) and a Retry-After header giving the time until they next open.  Upload sessions already
+ * under way (see uploadsessions.go) are allowed to finish, and the hours are lifted while an operator
+ * has asked the logger to upload everything (see uploadnow.go).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Provide the logger's upload hours, or nil if it may upload at any time.
+func (app *application) loggerHours(logger string) *api.UploadHours {
+	if record, ok := app.registry.Get(logger); ok {
+		return record.Hours
+	}
+	return nil
+}
+
+// Describe upload hours for the audit log, e.g., "01:00-05:00 America/New_York".
+func uploadHoursText(hours *api.UploadHours) string {
+	periods := make([]string, 0, len(hours.Periods))
+	for _, p := range hours.Periods {
+		periods = append(periods, p.Start+"-"+p.End)
+	}
+	text := strings.Join(periods, ",")
+	if len(hours.TimeZone) > 0 {
+		text += " " + hours.TimeZone
+	}
+	return text
+}
+
+// Find the first time, at or after t, that's both within the logger's upload hours and outside the
+// schedule's quiet hours, and the end of the upload period that it's in.  The end is zero if no such
+// time can be found within the next few periods.
+func (app *application) nextUploadHour(hours *api.UploadHours, t time.Time) (time.Time, time.Time) {
+	for range 8 {
+		open, end := app.schedule.NextUploadHour(hours, t)
+		if open.IsZero() {
+			break
+		}
+		if t = app.schedule.NextOpen(open); t.Equal(open) {
+			return open, end
+		}
+	}
+	return t, time.Time{}
+}
+
+// Refuse uploads from loggers outside their upload hours, telling them when to try again.
+func (app *application) requireUploadHours(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := support.LoggerID(r)
+		hours := app.loggerHours(logger)
+		if hours == nil || app.uploadNow(logger) {
+			next(w, r)
+			return
+		}
+		now := time.Now().UTC()
+		if open, _ := app.schedule.NextUploadHour(hours, now); open.After(now) {
+			support.Infof("TRANS: upload from logger %s outside its upload hours; asking it to retry at %s.\n",
+				logger, open.Format(time.RFC3339))
+			w.Header().Set("Retry-After", strconv.Itoa(int(open.Sub(now).Seconds())+1))
+			writeError(w, http.StatusServiceUnavailable,
+				fmt.Sprintf("outside the logger's upload hours; retry at %s", open.Format(time.RFC3339)))
+			return
+		}
+		next(w, r)
+	}
+}
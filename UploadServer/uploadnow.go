@@ -0,0 +1,97 @@
+/*! @file uploadnow.go
+ * @brief Asking a logger to upload everything now
+ *
+ * Before a logger is swapped out (or sent away for repair), operators want everything on it at the
+ * server.  They can queue an "upload" command for it, which asks it to send all of the files that it
+ * hasn't yet uploaded at once; the command is delivered at the logger's next checkin (see queue.go).
+ * From the checkin that collects it (and any checkin while it's waiting), the upload window tells the
+ * logger to start immediately, and for a day after delivery the logger's uploads aren't held to its
+ * upload hours (see uploadhours.go), so that it can drain even over a slow link.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// How long after an upload command is delivered that the logger can upload regardless of its hours.
+const uploadNowTTL = 24 * time.Hour
+
+// The uploadNowRequest gives the reason for asking a logger to upload everything, for the logger's
+// log and the audit log.
+type uploadNowRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Note that a logger has been asked to upload everything, so that its upload hours are lifted.
+func (app *application) openUploads(logger, command string) {
+	if err := app.state.Set("upload-now:"+logger, []byte(command), uploadNowTTL); err != nil {
+		support.Errorf("CHECKIN: failed to lift upload hours for logger %s: %s\n", logger, err)
+	}
+}
+
+// Determine whether a logger has been asked to upload everything: it has an upload command waiting,
+// or has collected one recently.
+func (app *application) uploadNow(logger string) bool {
+	if _, err := app.state.Get("upload-now:" + logger); err == nil {
+		return true
+	} else if !errors.Is(err, support.ErrNotFound) {
+		support.Errorf("failed to check for upload command for logger %s: %s\n", logger, err)
+	}
+	pending, err := app.commands.Pending(logger)
+	if err != nil {
+		support.Errorf("failed to read command queue for logger %s: %s\n", logger, err)
+		return false
+	}
+	return slices.ContainsFunc(pending, func(c api.Command) bool { return c.Action == support.CommandUpload })
+}
+
+// Ask a logger to upload all of the files that it hasn't yet uploaded, at its next checkin.
+func (app *application) requestUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var request uploadNowRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	reason := request.Reason
+	if len(reason) == 0 {
+		reason = "requested by operator"
+	}
+	command, queued, err := app.commands.Enqueue(id, api.Command{Action: support.CommandUpload, Reason: reason})
+	if err != nil {
+		support.Errorf("ADMIN: failed to request upload from %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to queue command")
+		return
+	}
+	if !queued {
+		writeJSON(w, http.StatusOK, commandResult{})
+		return
+	}
+	app.recordAction(r, "logger.upload", id, reason)
+	writeJSON(w, http.StatusAccepted, commandResult{Queued: true, Command: &command})
+}
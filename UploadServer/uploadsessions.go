@@ -0,0 +1,498 @@
+/*! @file uploadsessions.go
+ * @brief Uploads in stages: begin a session, send the data, then commit it
+ *
+ * A single POST to /update either works or doesn't, and when it doesn't the logger (and the operator)
+ * can't tell how far it got.  With the "upload-sessions" feature enabled, a logger can instead begin an
+ * upload session (POST /v1/uploads, with the payload type and other details in the headers as for a
+ * file transfer, and the size of the file if it knows it), send the data in one or more parts (PUT
+ * /v1/uploads/{id}, with the X-Upload-Offset header giving where each part starts), and then commit
+ * the session (POST /v1/uploads/{id}/commit) with the digest of the whole file in the Digest header.
+ * The committed file is then handled exactly as if it had been uploaded in one piece.  A part must
+ * start where the data received so far ends, which the logger can find from the session (GET
+ * /v1/uploads/{id}) after a dropped connection, and then carry on from there.  A session only fails
+ * if its data doesn't check; if the data can't be stored, or the logger is over its quota or awaiting
+ * approval, the session stays open so that the logger can commit it again later (with HTTP 503, and
+ * Retry-After, if storage failed).  Each logger can have a few sessions open at once (see
+ * sessionMaxOpen); more are refused with HTTP 429 (Too Many Requests).
+ *
+ * Each session is recorded in the state directory (see support/uploadsessions.go), with the bytes
+ * received, the upload record it became, or the reason that it failed, so that operators can see
+ * exactly where an upload went wrong.  Parts are held in the storage backend (under "sessions/")
+ * until the session is closed; the stage-cleanup job abandons sessions that have had no data for a
+ * day, and forgets closed sessions after a month.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/storage"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+const (
+	sessionPrefix    = "sessions/"
+	sessionIdle      = 24 * time.Hour      // How long an open session is kept without receiving data
+	sessionRetention = 30 * 24 * time.Hour // How long closed sessions are remembered
+	sessionLock      = 5 * time.Minute     // Longest that an instance can spend on one part
+	sessionMaxOpen   = 4                   // Most sessions that a logger can have open at once
+)
+
+// The header giving the offset in the file at which the data in a part starts.
+const offsetHeader = "X-Upload-Offset"
+
+var errSessionBusy = errors.New("another request for this session is in progress")
+
+// Generate the storage key for the part of a session's data starting at the offset given.  Offsets
+// are zero-padded so that the parts list in order.
+func sessionPartKey(id string, offset int64) string {
+	return fmt.Sprintf("%s%s/%015d", sessionPrefix, id, offset)
+}
+
+// Find the session named in the request path, writing an error response if it isn't one of the
+// logger's sessions.
+func (app *application) requestSession(w http.ResponseWriter, r *http.Request) (api.UploadSession, bool) {
+	session, ok := app.staged.Get(r.PathValue("id"))
+	if !ok || session.Logger != support.LoggerID(r) {
+		writeError(w, http.StatusNotFound, "no such upload session")
+		return api.UploadSession{}, false
+	}
+	return session, true
+}
+
+// Claim a session for the request, so that parts aren't stored, or the session committed, by two
+// requests at once.  The release function has to be called when the request is done.
+func (app *application) claimSession(session api.UploadSession) (func(), error) {
+	key := uploadKey("sending", session.Logger, session.ID)
+	claimed, err := app.state.SetNX(key, []byte(app.instance), sessionLock)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errSessionBusy
+	}
+	return func() {
+		if err := app.state.Delete(key); err != nil {
+			support.Errorf("TRANS: failed to release upload session %s: %s\n", session.ID, err)
+		}
+	}, nil
+}
+
+// Write an error response for a session that couldn't be claimed.
+func claimFailed(w http.ResponseWriter, session api.UploadSession, err error) {
+	if errors.Is(err, errSessionBusy) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	support.Errorf("TRANS: failed to claim upload session %s: %s\n", session.ID, err)
+	writeError(w, http.StatusServiceUnavailable, "upload sessions unavailable")
+}
+
+// Begin an upload session.  The response describes the session, including its ID.
+func (app *application) beginSession(w http.ResponseWriter, r *http.Request) {
+	payload, known := app.payloadType(r)
+	if !known {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unknown payload type %q", r.Header.Get(payloadHeader)))
+		return
+	}
+	key, known := app.encryptionKey(r)
+	if !known {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unknown encryption key %q", r.Header.Get(encryptionHeader)))
+		return
+	}
+	var request api.UploadBegin
+	if r.ContentLength != 0 && !readJSON(w, r, &request) {
+		return
+	}
+	if request.Size < 0 {
+		writeError(w, http.StatusBadRequest, "size must not be negative")
+		return
+	}
+	if limit := app.payloadLimit(payload); limit > 0 && request.Size > limit {
+		support.Warnf("TRANS: refusing upload session for %d bytes from %s (limit %d).\n", request.Size, support.LoggerID(r), limit)
+		app.refuseUpload(r, request.Size, "file too large")
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("file too large (%d bytes, limit %d)", request.Size, limit))
+		return
+	}
+	logger := support.LoggerID(r)
+	if open := app.staged.List(func(s *api.UploadSession) bool {
+		return s.Logger == logger && s.State == support.SessionOpen
+	}); len(open) >= sessionMaxOpen {
+		support.Warnf("TRANS: refusing upload session for logger %s, which has %d open already.\n", logger, len(open))
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("%d upload sessions open already; commit or abort one first", len(open)))
+		return
+	}
+	now := time.Now().UTC()
+	session := api.UploadSession{
+		ID:          support.NewUUID(),
+		Logger:      logger,
+		Remote:      r.RemoteAddr,
+		State:       support.SessionOpen,
+		Type:        payload,
+		KeyID:       key,
+		Trace:       newTraceID(),
+		Correlation: requestCorrelation(r),
+		Size:        request.Size,
+		Created:     now,
+		Updated:     now,
+		Expires:     now.Add(sessionIdle),
+	}
+	if header := r.Header.Get(fileIDHeader); len(header) > 0 {
+		if id, err := strconv.ParseUint(strings.TrimSpace(header), 10, 0); err == nil {
+			fileID := uint(id)
+			session.FileID = &fileID
+		} else {
+			support.Warnf("TRANS: ignoring malformed file ID %q from logger %s.\n", header, session.Logger)
+		}
+	}
+	if err := app.staged.Begin(session); err != nil {
+		support.Errorf("TRANS: failed to record upload session for logger %s: %s\n", session.Logger, err)
+		writeError(w, http.StatusInternalServerError, "failed to begin upload session")
+		return
+	}
+	support.Infof("TRANS: logger %s began upload session %s (%d bytes declared).\n", session.Logger, session.ID, session.Size)
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// Report the state of an upload session, so that the logger can find where to resume sending data.
+func (app *application) getSession(w http.ResponseWriter, r *http.Request) {
+	if session, ok := app.requestSession(w, r); ok {
+		writeJSON(w, http.StatusOK, session)
+	}
+}
+
+// Accept a part of the data for an upload session.  The part has to start where the data received
+// so far ends; if it doesn't, the response (HTTP 409) gives the session, so that the logger can
+// resume from the right place.  The Digest header, if given, is checked against the part.
+func (app *application) putSessionPart(w http.ResponseWriter, r *http.Request) {
+	session, ok := app.requestSession(w, r)
+	if !ok {
+		return
+	}
+	if session.State != support.SessionOpen {
+		writeError(w, http.StatusConflict, fmt.Sprintf("upload session is %s", session.State))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(offsetHeader), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s header must give the offset of the part", offsetHeader))
+		return
+	}
+	release, err := app.claimSession(session)
+	if err != nil {
+		claimFailed(w, session, err)
+		return
+	}
+	defer release()
+	if session, _ = app.staged.Get(session.ID); session.State != support.SessionOpen || offset != session.Received {
+		writeJSON(w, http.StatusConflict, session)
+		return
+	}
+	remaining := int64(-1)
+	if limit := app.payloadLimit(session.Type); limit > 0 {
+		remaining = limit - session.Received
+	}
+	if session.Size > 0 && (remaining < 0 || session.Size-session.Received < remaining) {
+		remaining = session.Size - session.Received
+	}
+	if remaining >= 0 {
+		if r.ContentLength > remaining {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("part too large (%d bytes, %d remaining)", r.ContentLength, remaining))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, remaining)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("part too large (%d bytes remaining)", remaining))
+			return
+		}
+		support.Errorf("API: failed to read part of upload session %s: %s.\n", session.ID, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 {
+		writeError(w, http.StatusBadRequest, "part has no data")
+		return
+	}
+	if len(r.Header.Get("Digest")) > 0 {
+		if _, err := support.CheckDigest(r.Header.Get("Digest"), body); err != nil {
+			support.Errorf("API: part at %d of upload session %s doesn't check against its digest (%s).\n", offset, session.ID, err)
+			writeError(w, http.StatusBadRequest, "part digest: "+err.Error())
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	key := sessionPartKey(session.ID, offset)
+	if err := app.putObject(ctx, key, body, map[string]string{"md5": fmt.Sprintf("%X", md5.Sum(body))}); err != nil {
+		support.Errorf("API: failed to store part %s: %s\n", key, err)
+		writeError(w, http.StatusInternalServerError, "failed to store part")
+		return
+	}
+	session, err = app.staged.Update(session.ID, func(s *api.UploadSession) error {
+		s.Received += int64(len(body))
+		s.Parts++
+		s.Expires = time.Now().UTC().Add(sessionIdle)
+		return nil
+	})
+	if err != nil {
+		support.Errorf("TRANS: failed to record part of upload session %s: %s\n", r.PathValue("id"), err)
+		writeError(w, http.StatusInternalServerError, "failed to record part")
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// Commit an upload session: assemble the data received, check it against the digest in the Digest
+// header, and handle it as for a file transfer.  The response is the same as for a file transfer; the
+// session records the upload that it became, or why it failed.
+func (app *application) commitSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := app.requestSession(w, r)
+	if !ok {
+		return
+	}
+	if session.State != support.SessionOpen {
+		writeError(w, http.StatusConflict, fmt.Sprintf("upload session is %s", session.State))
+		return
+	}
+	if len(r.Header.Get("Digest")) == 0 {
+		writeError(w, http.StatusBadRequest, "the digest of the file is required to commit")
+		return
+	}
+	release, err := app.claimSession(session)
+	if err != nil {
+		claimFailed(w, session, err)
+		return
+	}
+	defer release()
+	if session, _ = app.staged.Get(session.ID); session.State != support.SessionOpen {
+		writeError(w, http.StatusConflict, fmt.Sprintf("upload session is %s", session.State))
+		return
+	}
+	if session.Received == 0 || session.Size > 0 && session.Received != session.Size {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%d of %d bytes received", session.Received, session.Size))
+		return
+	}
+	result := api.TransferResult{Status: "failure"}
+	body, err := app.sessionData(r.Context(), session)
+	if err != nil {
+		support.Errorf("API: failed to assemble upload session %s: %s\n", session.ID, err)
+		if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, errPartsMissing) {
+			sessionUnavailable(w)
+			return
+		}
+		app.closeSession(session, support.SessionFailed, "", err.Error())
+		app.writeTransferResult(w, result)
+		return
+	}
+	record := support.UploadRecord{
+		UUID:        support.NewUUID(),
+		Logger:      session.Logger,
+		Received:    time.Now().UTC(),
+		Remote:      r.RemoteAddr,
+		Size:        int64(len(body)),
+		MD5:         fmt.Sprintf("%X", md5.Sum(body)),
+		Type:        session.Type,
+		KeyID:       session.KeyID,
+		FileID:      session.FileID,
+		Session:     session.ID,
+		Trace:       session.Trace,
+		Correlation: session.Correlation,
+	}
+	if record.FileID == nil {
+		record.FileID = app.reportedFileID(r, record.Logger, record.MD5)
+	}
+	algorithm, err := support.CheckDigest(r.Header.Get("Digest"), body)
+	if algorithm != "md5" {
+		record.Digest = algorithm
+	}
+	if err != nil {
+		support.Errorf("API: upload session %s doesn't check against its digest (%s).\n", session.ID, err)
+		app.recordUpload(record, support.UploadRejected, err.Error())
+		app.quarantineUpload(record, body, err.Error())
+		if errors.Is(err, support.ErrDigestMismatch) {
+			app.resendFailed(record.Logger, support.ClaimedMD5(r.Header.Get("Digest")), "upload did not match its digest")
+		}
+		app.closeSession(session, support.SessionFailed, record.UUID, err.Error())
+		result.Trace = record.Trace
+		app.writeTransferResult(w, result)
+		return
+	}
+	status, receipt, accepted := app.acceptUpload(r.Context(), record, body)
+	if status == http.StatusConflict {
+		w.WriteHeader(status)
+		return
+	}
+	upload, recorded := app.uploads.Get(record.UUID)
+	switch {
+	case !accepted && recorded && transientRefusals[upload.Reason]:
+		// Keep the session open, so that the logger can commit again without sending the data again.
+		support.Warnf("TRANS: keeping upload session %s open after failing to accept it (%s).\n", session.ID, upload.Reason)
+		if upload.Reason == "storage failure" || upload.Reason == "storage cancelled" {
+			sessionUnavailable(w)
+			return
+		}
+	case accepted && recorded:
+		app.closeSession(session, support.SessionCommitted, record.UUID, "")
+	case accepted:
+		app.closeSession(session, support.SessionCommitted, app.acceptedUpload(record.Logger, record.MD5), "")
+	case recorded:
+		app.closeSession(session, support.SessionFailed, record.UUID, upload.Reason)
+	default:
+		app.closeSession(session, support.SessionFailed, "", http.StatusText(status))
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	if accepted {
+		result.Status = "success"
+		result.Receipt = receipt
+	}
+	result.Trace = app.uploadTrace(record)
+	app.writeTransferResult(w, result)
+}
+
+// Tell the logger that its session couldn't be committed for now, but may be later (e.g., if the
+// storage backend failed), with HTTP 503 (Service Unavailable).  The session is left open.
+func sessionUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfter))
+	writeError(w, http.StatusServiceUnavailable, "failed to store the upload; commit again later")
+}
+
+// Abort an upload session, discarding the data received.
+func (app *application) abortSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := app.requestSession(w, r)
+	if !ok {
+		return
+	}
+	if session.State != support.SessionOpen {
+		writeError(w, http.StatusConflict, fmt.Sprintf("upload session is %s", session.State))
+		return
+	}
+	release, err := app.claimSession(session)
+	if err != nil {
+		claimFailed(w, session, err)
+		return
+	}
+	defer release()
+	app.closeSession(session, support.SessionAborted, "", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errPartsMissing = errors.New("parts of the data are missing")
+
+// Assemble the data received for a session from its parts, checking that they're contiguous.
+func (app *application) sessionData(ctx context.Context, session api.UploadSession) ([]byte, error) {
+	prefix := sessionPrefix + session.ID + "/"
+	var keys []string
+	err := app.storage.List(ctx, prefix, func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	body := make([]byte, 0, session.Received)
+	for _, key := range keys {
+		if offset, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64); err != nil || offset != int64(len(body)) {
+			return nil, fmt.Errorf("%w: expected a part at %d, found %s", errPartsMissing, len(body), key)
+		}
+		if body, err = app.appendChunk(ctx, body, key); err != nil {
+			return nil, err
+		}
+	}
+	if int64(len(body)) != session.Received {
+		return nil, fmt.Errorf("%w: %d of %d bytes stored", errPartsMissing, len(body), session.Received)
+	}
+	return body, nil
+}
+
+// Find the UUID of the accepted upload of the file with the digest given from a logger, when a
+// session repeated it.
+func (app *application) acceptedUpload(logger, digest string) string {
+	matches := app.uploads.Select(time.Time{}, time.Time{}, func(u *support.UploadRecord) bool {
+		return u.Logger == logger && u.MD5 == digest && u.Status == support.UploadAccepted
+	})
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[len(matches)-1].UUID
+}
+
+// Close a session in the state given, noting the upload it became or the reason it failed, and remove
+// its data.
+func (app *application) closeSession(session api.UploadSession, state, upload, reason string) {
+	_, err := app.staged.Update(session.ID, func(s *api.UploadSession) error {
+		s.State = state
+		s.Upload = upload
+		s.Error = reason
+		return nil
+	})
+	if err != nil {
+		support.Errorf("TRANS: failed to record upload session %s as %s: %s\n", session.ID, state, err)
+	}
+	support.Infof("TRANS: upload session %s from logger %s %s.\n", session.ID, session.Logger, state)
+	ctx, cancel := context.WithTimeout(app.ctx, storeTimeout)
+	defer cancel()
+	app.deleteChunks(ctx, sessionPrefix+session.ID+"/")
+}
+
+// Abandon open sessions that haven't received data for a day, and forget closed sessions after a month.
+func (app *application) sessionCleanupJob(ctx context.Context) (string, error) {
+	now := time.Now().UTC()
+	stale := app.staged.List(func(s *api.UploadSession) bool {
+		return s.State == support.SessionOpen && now.After(s.Expires)
+	})
+	for _, session := range stale {
+		if ctx.Err() != nil {
+			break
+		}
+		app.closeSession(session, support.SessionExpired, "", "no data received before the session expired")
+	}
+	pruned, err := app.staged.Prune(now.Add(-sessionRetention))
+	return fmt.Sprintf("abandoned %d upload sessions, and forgot %d closed sessions", len(stale), pruned), err
+}
+
+// List the upload sessions, optionally only those from one logger or in one state, for operators to
+// diagnose failed uploads.
+func (app *application) listUploadSessions(w http.ResponseWriter, r *http.Request) {
+	logger := r.URL.Query().Get("logger")
+	state := r.URL.Query().Get("state")
+	writeJSON(w, http.StatusOK, app.staged.List(func(s *api.UploadSession) bool {
+		return (len(logger) == 0 || s.Logger == logger) && (len(state) == 0 || s.State == state)
+	}))
+}
@@ -0,0 +1,202 @@
+/*! @file usage.go
+ * @brief Storage usage reporting, quota enforcement, and metrics
+ *
+ * The upload store keeps a running total of what each logger has stored (see support/usage.go).
+ * This is reported through the administration API and as Prometheus-style metrics, so that operators
+ * can see which vessels dominate storage, and is used to enforce the per-logger storage quota.  Loggers
+ * approaching their quota are warned in their checkin response (and the operator alerted), so that
+ * the firmware has a chance to throttle uploads before they start being rejected.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The quotaReservations are the bytes set aside against loggers' quotas for uploads that are in
+// progress, so that concurrent uploads from a logger can't each pass the quota check and together
+// take it over quota.
+type quotaReservations struct {
+	mu       sync.Mutex
+	reserved map[string]int64
+}
+
+// Reserve space for a file of the given size against the logger's quota, returning false if
+// storing it would take the logger over quota (counting the bytes given as held outside the upload
+// history, e.g., unassembled chunks).  Otherwise, the function returned has to be called once the
+// upload is recorded (or has failed) to release the reservation.
+func (app *application) reserveQuota(logger string, held, size int64) (func(), bool) {
+	limit := app.settings.Get().Quota.Limit(logger)
+	if limit <= 0 {
+		return func() {}, true
+	}
+	q := &app.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stored, reserved := app.uploads.Usage(logger).Bytes+held, q.reserved[logger]
+	if stored+reserved+size > limit {
+		support.Warnf("TRANS: logger %s is over quota (%d bytes stored, %d reserved, %d more offered, %d limit).\n",
+			logger, stored, reserved, size, limit)
+		return nil, false
+	}
+	if q.reserved == nil {
+		q.reserved = make(map[string]int64)
+	}
+	q.reserved[logger] += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if q.reserved[logger] -= size; q.reserved[logger] <= 0 {
+				delete(q.reserved, logger)
+			}
+		})
+	}, true
+}
+
+// Check whether the logger is approaching its quota, returning a warning for the logger if so.
+// Operators are alerted when a logger's warning level rises.
+func (app *application) checkQuota(logger string) *api.QuotaWarning {
+	quota := app.settings.Get().Quota
+	limit := quota.Limit(logger)
+	if limit <= 0 {
+		return nil
+	}
+	used := app.uploads.Usage(logger).Bytes
+	level := ""
+	switch {
+	case used >= limit:
+		level = "exceeded"
+	case used*100 >= limit*int64(quota.WarnPercent):
+		level = "warning"
+	}
+
+	// The level last reported is kept so that an alert is raised when the level changes, rather
+	// than on every checkin (to any instance of the server).
+	var previous []byte
+	var err error
+	if len(level) > 0 {
+		previous, err = app.state.Swap("quota-warning:"+logger, []byte(level), 0)
+	} else if previous, err = app.state.Take("quota-warning:" + logger); errors.Is(err, support.ErrNotFound) {
+		err = nil
+	}
+	if err != nil {
+		support.Errorf("failed to update quota warning level for %s: %s\n", logger, err)
+	}
+	if len(level) > 0 && level != string(previous) && string(previous) != "exceeded" {
+		app.alerts.Raise("quota", logger, fmt.Sprintf("storage quota %s (%d of %d bytes used)", level, used, limit))
+	}
+
+	if len(level) == 0 {
+		return nil
+	}
+	return &api.QuotaWarning{Level: level, Used: used, Limit: limit}
+}
+
+// A usageView is the usage of a logger, along with its quota.
+type usageView struct {
+	support.Usage
+	Quota int64 `json:"quota,omitempty"`
+}
+
+func (app *application) usageView(u support.Usage) usageView {
+	return usageView{Usage: u, Quota: app.settings.Get().Quota.Limit(u.Logger)}
+}
+
+// Report the storage used by all loggers with uploads.
+func (app *application) listUsage(w http.ResponseWriter, r *http.Request) {
+	usage := app.uploads.UsageList()
+	rtn := make([]usageView, 0, len(usage))
+	for _, u := range usage {
+		rtn = append(rtn, app.usageView(u))
+	}
+	writeJSON(w, http.StatusOK, rtn)
+}
+
+// Report the state of the server in the Prometheus text exposition format, so that it can be
+// scraped by standard monitoring tools.
+func (app *application) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	usage := app.uploads.UsageList()
+	metricFamily(w, "wibl_logger_stored_files", "Number of files held in storage for the logger.", "gauge")
+	for _, u := range usage {
+		metricSample(w, "wibl_logger_stored_files", u.Files, "logger", u.Logger)
+	}
+	metricFamily(w, "wibl_logger_stored_bytes", "Number of bytes held in storage for the logger.", "gauge")
+	for _, u := range usage {
+		metricSample(w, "wibl_logger_stored_bytes", u.Bytes, "logger", u.Logger)
+	}
+	metricFamily(w, "wibl_logger_quota_bytes", "Storage quota for the logger (zero for no limit).", "gauge")
+	quota := app.settings.Get().Quota
+	for _, u := range usage {
+		metricSample(w, "wibl_logger_quota_bytes", quota.Limit(u.Logger), "logger", u.Logger)
+	}
+	metricFamily(w, "wibl_logger_uploads", "Number of upload attempts in the upload history for the logger.", "gauge")
+	for _, u := range usage {
+		metricSample(w, "wibl_logger_uploads", u.Uploads-u.Rejected, "logger", u.Logger, "status", support.UploadAccepted)
+		metricSample(w, "wibl_logger_uploads", u.Rejected, "logger", u.Logger, "status", support.UploadRejected)
+	}
+	metricFamily(w, "wibl_backend_retries_total", "Number of times a backend operation has been retried.", "counter")
+	retries := app.retry.Counts()
+	for _, c := range retries {
+		metricSample(w, "wibl_backend_retries_total", c.Retries, "operation", c.Operation)
+	}
+	metricFamily(w, "wibl_backend_failures_total", "Number of backend operations that failed after all attempts.", "counter")
+	for _, c := range retries {
+		metricSample(w, "wibl_backend_failures_total", c.Failures, "operation", c.Operation)
+	}
+	metricFamily(w, "wibl_loggers_reporting", "Number of loggers that have checked in since the server started.", "gauge")
+	metricSample(w, "wibl_loggers_reporting", int64(len(app.fleet.List())))
+	app.replicationMetrics(w)
+	app.routeMetrics(w)
+}
+
+func metricFamily(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Write a single sample, with labels given as name, value pairs.
+func metricSample(w io.Writer, name string, value int64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i] + "=" + strconv.Quote(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(w, "%s %d\n", b.String(), value)
+}
@@ -0,0 +1,178 @@
+/*! @file users.go
+ * @brief Administration API end-points for admin user accounts and login sessions
+ *
+ * Admin users log in with a name and password to get a session token, which they then present as
+ * a bearer token to the rest of the administration API.  Admins can create and delete users, and
+ * reset their passwords; any user can change their own password (which is the only thing that they
+ * can do if their password has expired).
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Check an admin user's credentials, and issue a session token if they're valid.
+func (app *application) login(w http.ResponseWriter, r *http.Request) {
+	var request api.LoginRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	principal, err := app.users.Login(request.Name, request.Password)
+	if err != nil {
+		support.Warnf("ADMIN: failed login for user %q from %s.\n", request.Name, r.RemoteAddr)
+		app.audit.Record(request.Name, r.RemoteAddr, "user.login-failed", request.Name, "")
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	app.issueSession(w, principal)
+}
+
+// End the session associated with the bearer token on the request.
+func (app *application) logout(w http.ResponseWriter, r *http.Request) {
+	token, _ := support.BearerToken(r)
+	app.sessions.Revoke(token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Change the caller's password.  All of the user's existing sessions are ended, and a new session
+// is issued so that the caller can carry on.
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	var request api.PasswordChangeRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	principal := support.CurrentPrincipal(r)
+	if err := app.users.ChangePassword(principal.Name, request.Current, request.Replacement); err != nil {
+		if errors.Is(err, support.ErrBadCredentials) {
+			writeError(w, http.StatusForbidden, err.Error())
+		} else {
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	app.recordAction(r, "user.password", principal.Name, "")
+	app.sessions.RevokeUser(principal.Name)
+	principal.PasswordExpired = false
+	app.issueSession(w, principal)
+}
+
+func (app *application) issueSession(w http.ResponseWriter, principal support.Principal) {
+	token, session, err := app.sessions.Issue(principal)
+	if err != nil {
+		support.Errorf("ADMIN: failed to issue session token: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to issue session")
+		return
+	}
+	writeJSON(w, http.StatusOK, api.LoginResponse{
+		Token:           token,
+		Expires:         session.Expires,
+		PasswordExpired: principal.PasswordExpired,
+	})
+}
+
+// Report all of the admin users.
+func (app *application) listUsers(w http.ResponseWriter, r *http.Request) {
+	users := app.users.List()
+	rtn := make([]api.UserInfo, 0, len(users))
+	for _, u := range users {
+		rtn = append(rtn, userInfo(u))
+	}
+	writeJSON(w, http.StatusOK, rtn)
+}
+
+// Create a new admin user, with a temporary password.
+func (app *application) addUser(w http.ResponseWriter, r *http.Request) {
+	var request api.NewUserRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	role, err := support.ParseRole(request.Role)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	user, err := app.users.Add(request.Name, role, strings.TrimSpace(request.Tenant), request.Password, true)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, support.ErrUserExists) {
+			code = http.StatusConflict
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	app.recordAction(r, "user.add", user.Name, "role "+user.Role.String())
+	writeJSON(w, http.StatusCreated, userInfo(user))
+}
+
+// Delete an admin user, ending any sessions that they have.
+func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := app.users.Delete(name); err != nil {
+		if errors.Is(err, support.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "no such user")
+		} else {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	app.sessions.RevokeUser(name)
+	app.recordAction(r, "user.delete", name, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Set a temporary password for an admin user, which they have to change on next login.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var request api.PasswordResetRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	name := r.PathValue("name")
+	if err := app.users.ResetPassword(name, request.Password); err != nil {
+		if errors.Is(err, support.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "no such user")
+		} else {
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	app.sessions.RevokeUser(name)
+	app.recordAction(r, "user.reset", name, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func userInfo(u support.AdminUser) api.UserInfo {
+	return api.UserInfo{
+		Name:            u.Name,
+		Role:            u.Role.String(),
+		Tenant:          u.Tenant,
+		PasswordChanged: u.PasswordChanged,
+		MustChange:      u.MustChange,
+		Created:         u.Created,
+		LastLogin:       u.LastLogin,
+	}
+}
@@ -0,0 +1,154 @@
+/*! @file validate.go
+ * @brief Dry-run validation of uploads
+ *
+ * Firmware developers (and CI pipelines) need to check that a logger's uploads would be accepted by a
+ * production server without actually adding files to the archive or starting the processing chain.
+ * The validation end-point runs the same checks as a real upload (authentication, content type,
+ * encryption key, digest, WIBL format, quota, and repeats) on the payload, and reports the result
+ * of each along with the overall verdict, but stores nothing and notifies nobody.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/support"
+	"ccom.unh.edu/wibl-monitor/src/wibl"
+)
+
+// The path of the validation end-point.  Uploads refused here by the usual middleware aren't recorded.
+const validatePath = "/v1/update/validate"
+
+// The largest payload that's validated, whatever the configured upload limit, since the whole payload
+// is held in memory to check it.
+const maxValidateBytes = 64 << 20
+
+// The result of a single validation check: "pass", "warn" (the upload would still be accepted), or
+// "fail".
+type validationCheck struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// The verdict is what would happen to the upload: "accept", "reject", "repeat" (already accepted, so
+// acknowledged without being stored), or "conflict" (the same file is being uploaded already).
+type validationResult struct {
+	Verdict  string            `json:"verdict"`
+	Logger   string            `json:"logger"`
+	Size     int64             `json:"size"`
+	MD5      string            `json:"md5"`
+	Checks   []validationCheck `json:"checks"`
+	Metadata *wibl.Metadata    `json:"metadata,omitempty"`
+}
+
+func (v *validationResult) check(name, result, detail string) {
+	v.Checks = append(v.Checks, validationCheck{Name: name, Result: result, Detail: detail})
+	if result == "fail" {
+		v.Verdict = "reject"
+	}
+}
+
+// Validate an upload without storing it.  The request is made as for a real upload, and
+// authentication failures, unacceptable content types, and payloads that are too large are reported
+// in the same way; otherwise, the response is HTTP 200 with the result of each check and the verdict.
+func (app *application) validateUpload(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidateBytes))
+	if err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("payload larger than %d bytes", maxBytes.Limit))
+			return
+		}
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	result := validationResult{Verdict: "accept", Logger: support.LoggerID(r), Size: int64(len(body)),
+		MD5: fmt.Sprintf("%X", md5.Sum(body)), Checks: []validationCheck{}}
+	result.check("authentication", "pass", "upload token accepted")
+	key, known := app.encryptionKey(r)
+	if !known {
+		result.check("encryption", "fail", fmt.Sprintf("encryption key %q is not configured", key))
+	} else if len(key) > 0 {
+		result.check("encryption", "pass", fmt.Sprintf("encrypted with key %s", key))
+	}
+	if _, ok := app.payloadType(r); !ok {
+		result.check("content-type", "fail", fmt.Sprintf("payload type %q is not configured", r.Header.Get(payloadHeader)))
+	} else if app.acceptableType(r) {
+		result.check("content-type", "pass", r.Header.Get("Content-Type"))
+	} else {
+		result.check("content-type", "fail", fmt.Sprintf("content type %q is not accepted", r.Header.Get("Content-Type")))
+	}
+
+	if algorithm, err := support.CheckDigest(r.Header.Get("Digest"), body); err != nil {
+		result.check("digest", "fail", err.Error())
+	} else {
+		result.check("digest", "pass", algorithm)
+	}
+
+	payload, _ := app.payloadType(r)
+	if err := app.checkPayload(payload, key, body); err != nil {
+		result.check("format", "fail", err.Error())
+	} else if len(key) > 0 {
+		result.check("format", "pass", "encrypted, so the contents can't be checked")
+	} else if len(payload) > 0 {
+		result.check("format", "pass", fmt.Sprintf("payload type %s", payload))
+	} else if result.Metadata, err = wibl.Extract(body); err != nil {
+		result.check("format", "warn", fmt.Sprintf("not readable as a WIBL file (%s); it would be stored without metadata", err))
+	} else {
+		result.check("format", "pass", fmt.Sprintf("WIBL serialiser version %s", result.Metadata.Version))
+	}
+
+	limit := app.settings.Get().Quota.Limit(result.Logger)
+	used := app.uploads.Usage(result.Logger).Bytes
+	switch {
+	case limit <= 0:
+		result.check("quota", "pass", "no limit")
+	case used+result.Size > limit:
+		result.check("quota", "fail", fmt.Sprintf("quota exceeded (%d bytes stored, %d offered, %d limit)", used, result.Size, limit))
+	default:
+		result.check("quota", "pass", fmt.Sprintf("%d bytes stored of %d limit", used, limit))
+	}
+
+	if result.Verdict == "accept" {
+		previous, err := app.state.Get(uploadKey("uploaded", result.Logger, result.MD5))
+		switch {
+		case err == nil:
+			result.Verdict = "repeat"
+			result.check("repeat", "pass", fmt.Sprintf("already accepted as %s; would be acknowledged without storing", previous))
+		case !errors.Is(err, support.ErrNotFound):
+			result.check("repeat", "warn", fmt.Sprintf("couldn't check for repeats (%s)", err))
+		default:
+			if _, err := app.state.Get(uploadKey("uploading", result.Logger, result.MD5)); err == nil {
+				result.check("repeat", "fail", errUploadInProgress.Error())
+				result.Verdict = "conflict"
+			} else {
+				result.check("repeat", "pass", "")
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,85 @@
+/*! @file version.go
+ * @brief Version and build information for the server
+ *
+ * So that firmware and operators can tell what protocol the server speaks, it reports its semantic
+ * version, the commit it was built from, the build date, and the experimental features enabled, at
+ * /version and in each checkin response.  The version is set when building, with
+ *
+ *	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+ *
+ * and the commit and build date otherwise come from the version control information that the Go
+ * tools record, where available.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// The version of the logger protocol that the server speaks.  Version 2 adds challenge-response
+// authentication (see challenge.go), where the configuration allows it.
+const protocolVersion = 2
+
+// Build information, set with -ldflags at build time.
+var (
+	version   = "0.0.0-dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// Generate the server's build information, including the experimental features that are enabled.
+func (app *application) serverInfo() *api.ServerInfo {
+	info := &api.ServerInfo{Version: version, Commit: commit, BuildDate: buildDate, Features: []string{},
+		Digests: support.DigestAlgorithms, Protocol: protocolVersion, Auth: []string{authBasic},
+		Encodings: checkinEncodings}
+	if app.challengeAuth() {
+		info.Auth = append(info.Auth, authChallenge)
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && len(info.Commit) == 0:
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && len(info.BuildDate) == 0:
+				info.BuildDate = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && len(commit) == 0:
+				info.Modified = true
+			}
+		}
+	}
+	for _, f := range app.config.FeatureList() {
+		if app.config.FeatureEnabled(f.Name) {
+			info.Features = append(info.Features, f.Name)
+		}
+	}
+	return info
+}
+
+// Report the server's version and build information.  This doesn't need authentication, so that
+// loggers can check compatibility before they are configured with an upload token.
+func (app *application) versionInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.serverInfo())
+}
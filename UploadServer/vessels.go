@@ -0,0 +1,131 @@
+/*! @file vessels.go
+ * @brief Administration end-points for vessel records
+ *
+ * Vessel records (see support/vessels.go) describe the platforms on which loggers are installed.
+ * Loggers are linked to a vessel through the registry (PATCH /admin/v1/loggers/{id}), and each
+ * upload carries a copy of the vessel record as it was when the file arrived, so that later edits
+ * don't change the description of data that's already been collected.
+ *
+ * Copyright (c) 2024, University of New Hampshire, Center for Coastal and Ocean Mapping.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software
+ * and associated documentation files (the "Software"), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or
+ * substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS
+ * OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+ * WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF
+ * OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/support"
+)
+
+// Report all of the vessel records.
+func (app *application) listVessels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.vessels.List())
+}
+
+// Report a single vessel record.
+func (app *application) getVessel(w http.ResponseWriter, r *http.Request) {
+	vessel, ok := app.vessels.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such vessel")
+		return
+	}
+	writeJSON(w, http.StatusOK, vessel)
+}
+
+// Add a new vessel record.
+func (app *application) addVessel(w http.ResponseWriter, r *http.Request) {
+	var request api.VesselInfo
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if err := support.ValidateVessel(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	vessel, err := app.vessels.Add(request)
+	if err != nil {
+		support.Errorf("ADMIN: failed to add vessel: %s\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to add vessel")
+		return
+	}
+	app.recordAction(r, "vessel.add", vessel.ID, vessel.Name)
+	writeJSON(w, http.StatusCreated, vessel)
+}
+
+// Replace the information in a vessel record.
+func (app *application) replaceVessel(w http.ResponseWriter, r *http.Request) {
+	var request api.VesselInfo
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if err := support.ValidateVessel(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id := r.PathValue("id")
+	vessel, err := app.vessels.Replace(id, request)
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such vessel")
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to update vessel %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to update vessel")
+		return
+	}
+	app.recordAction(r, "vessel.update", id, vessel.Name)
+	writeJSON(w, http.StatusOK, vessel)
+}
+
+// Remove a vessel record.  Vessels that still have loggers linked to them can't be removed.
+func (app *application) deleteVessel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	for _, logger := range app.registry.List() {
+		if logger.Vessel == id {
+			writeError(w, http.StatusConflict, "vessel has logger "+logger.ID+" linked to it")
+			return
+		}
+	}
+	switch err := app.vessels.Delete(id); {
+	case errors.Is(err, support.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such vessel")
+		return
+	case err != nil:
+		support.Errorf("ADMIN: failed to delete vessel %s: %s\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed to delete vessel")
+		return
+	}
+	app.recordAction(r, "vessel.delete", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Provide the vessel record for the logger given, if it is linked to one.
+func (app *application) vesselFor(logger string) *support.Vessel {
+	record, ok := app.registry.Get(logger)
+	if !ok || len(record.Vessel) == 0 {
+		return nil
+	}
+	vessel, ok := app.vessels.Get(record.Vessel)
+	if !ok {
+		return nil
+	}
+	return &vessel
+}
@@ -39,95 +39,678 @@ The code generates an HTTP server with two end-points:
   - checkin, which is used by loggers to report status information (and check the server is accessible)
   - update, which is used by loggers to transfer files for processing
 
+and an administration API under /admin/v1 (see admin.go) for operators to manage the fleet, along
+with access to the files received under /v1/files (see files.go), metrics for monitoring
+tools under /metrics (see usage.go), the server's version and build information at /version
+(see version.go), and health checks for load balancers at /healthz and /readyz (see drain.go).
+Uploads can be checked without being stored at /v1/update/validate (see validate.go), and large
+files can be uploaded in chunks under /v1/chunks if enabled (see chunks.go).  Sending the server SIGUSR1 drains it before a restart; SIGTERM stops it once
+requests in progress have completed.
+
 Usage:
 
 	wibl-monitor [flags]
+	wibl-monitor <command> [flags]
 
 The flags are:
 
 	-config
-		Specify a JSON format file to configure the server
+		Specify a JSON format file to configure the server; if repeated, each file overrides
+		the ones before it (default $WIBL_MONITOR_CONFIG)
 
 Without flags, the code generates a default configuration for the server, typically
 bringing it up on a non-constrained port (see support/config.go for details).
+
+For firmware development, setting "mock" in the configuration keeps files in memory and records
+the notifications to the processing chain rather than sending them (see mock.go).
+
+When started by the AWS Lambda runtime, the same handlers serve requests from API Gateway instead
+of running a TLS server (see lambda.go).
+
+The commands, which carry out maintenance tasks rather than running the server, are:
+
+	adduser
+		Add an account for the administration API (see commands.go)
+	config init
+		Write out the default configuration, with every parameter described (see commands.go)
+	replay
+		Send requests recorded from loggers to another server (see replay.go)
 */
 package main
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
+
 	"ccom.unh.edu/wibl-monitor/src/api"
+	"ccom.unh.edu/wibl-monitor/src/metrics"
+	"ccom.unh.edu/wibl-monitor/src/notify"
+	"ccom.unh.edu/wibl-monitor/src/storage"
 	"ccom.unh.edu/wibl-monitor/src/support"
+	"ccom.unh.edu/wibl-monitor/src/wibl"
 )
 
 func main() {
 	log.SetFlags(log.Lmicroseconds | log.Ldate)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				support.Errorf("%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	fs := flag.NewFlagSet("monitor", flag.ExitOnError)
-	configFile := fs.String("config", "", "Filename to load JSON configuration")
+	var configFiles configFiles
+	fs.Var(&configFiles, "config", "Filename to load JSON configuration (may be repeated)")
 
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		support.Errorf("failed to parse command line parameters (%v)\n", err)
 		os.Exit(1)
 	}
 
-	var config *support.Config
-	if len(*configFile) > 0 {
-		var err error
-		config, err = support.NewConfig(*configFile)
-		if err != nil {
-			support.Errorf("failed to generate configuration from %q (%v)\n", *configFile, err)
-			os.Exit(1)
-		}
-	} else {
-		config = support.NewDefaultConfig()
+	config, err := loadConfig(configFiles)
+	if err != nil {
+		support.Errorf("failed to generate configuration from %q (%v)\n", configFiles.String(), err)
+		os.Exit(1)
 	}
 
-	address := fmt.Sprintf(":%d", config.API.Port)
+	if err := support.StartErrorTracking(config.Tracking); err != nil {
+		support.Errorf("failed to start error tracking (%v)\n", err)
+		os.Exit(1)
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", syntax)
-	mux.HandleFunc("/checkin", support.BasicAuth(status_updates))
-	mux.HandleFunc("/update", support.BasicAuth(file_transfer))
+	app, err := newApplication(config)
+	if err != nil {
+		support.Errorf("failed to initialise server (%v)\n", err)
+		os.Exit(1)
+	}
+
+	if inLambda() {
+		serveLambda(app.routes())
+		return
+	}
+
+	app.registerJobs()
+	go app.leader.Run(app.ctx)
+	app.jobs.Start(app.ctx)
+	app.publishMetrics()
+
+	address := fmt.Sprintf(":%d", config.API.Port)
 
 	srv := &http.Server{
 		Addr:         address,
-		Handler:      mux,
+		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return app.ctx },
+	}
+	srv.RegisterOnShutdown(app.live.Close)
+	// The certificate is loaded once, so that the pins advertised are those of the certificate that
+	// the listeners present.
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		support.Errorf("failed to load server certificate (%v)\n", err)
+		os.Exit(1)
+	}
+	if err := app.pins.Serving(cert); err != nil {
+		support.Errorf("failed to pin server certificate (%v)\n", err)
+		os.Exit(1)
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if app.ca != nil {
+		srv.TLSConfig.ClientAuth, srv.TLSConfig.ClientCAs = tls.VerifyClientCertIfGiven, app.ca.Pool()
+	}
+	quic, err := app.startHTTP3(address, srv.Handler, srv.TLSConfig)
+	if err != nil {
+		support.Errorf("failed to start HTTP/3 listener (%v)\n", err)
+		os.Exit(1)
+	}
+	srv.Handler = advertiseHTTP3(quic, srv.Handler)
+	if err := app.startCoAP(); err != nil {
+		support.Errorf("failed to start CoAP listener (%v)\n", err)
+		os.Exit(1)
 	}
 
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+	go func() {
+		for range drain {
+			if app.drain.start() {
+				log.Printf("received SIGUSR1, draining")
+				app.audit.Record("signal", "", "server.drain", app.instance, "")
+			}
+		}
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("received %s, shutting down", <-signals)
+		app.shutdown(srv, quic)
+	}()
+
 	log.Printf("starting server on %s", srv.Addr)
-	err := srv.ListenAndServeTLS("./certs/server.crt", "./certs/server.key")
-	log.Fatal(err)
+	err = srv.ListenAndServeTLS("", "")
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// Stop the server, giving requests in progress the grace period to complete before they (and any
+// background work) are cancelled.
+func (app *application) shutdown(srv *http.Server, quic *http3.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	go stopHTTP3(ctx, quic)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("cancelling requests still in progress after %s: %v", shutdownGrace, err)
+	}
+	app.stop()
+	srv.Close()
+	app.jobs.Wait()
+	app.background.Wait()
+	support.FlushErrorTracking()
+}
+
+// The configFiles collect the -config flags, which are applied in order (see support/config.go).
+type configFiles []string
+
+func (c *configFiles) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *configFiles) Set(filename string) error {
+	*c = append(*c, filename)
+	return nil
+}
+
+// Generate the server configuration from the named files, or from those listed in the
+// WIBL_MONITOR_CONFIG environment variable (separated as for PATH) if there are none.  If no files
+// are specified, the default configuration is used.
+func loadConfig(filenames configFiles) (*support.Config, error) {
+	if len(filenames) == 0 {
+		filenames = filepath.SplitList(os.Getenv("WIBL_MONITOR_CONFIG"))
+	}
+	return support.NewConfig(filenames...)
+}
+
+// Provide the name of the file in which run-time changes to the settings are kept.
+func settingsFile(config *support.Config) string {
+	return filepath.Join(config.State.Directory, "settings.json")
+}
+
+// Limits on how long the server waits for storage, and for requests to complete on shutdown.
+const (
+	storeTimeout  = 20 * time.Second
+	shutdownGrace = 30 * time.Second
+)
+
+// The server's TLS certificate and key.
+const (
+	serverCert = "./certs/server.crt"
+	serverKey  = "./certs/server.key"
+)
+
+// The application holds the state that the server's handlers need to share.  Background work is
+// done under the application's context, which is cancelled when the server shuts down.
+type application struct {
+	config   *support.Config
+	settings *support.SettingsStore
+	tokens   *support.TokenStore
+	fleet    *support.FleetStatus
+	capture  *support.RequestCapture
+	record   *support.RequestRecorder
+	limit    *support.Bandwidth
+	slots    chan struct{} // Uploads in progress, if limited (see priority.go)
+	schedule *support.UploadSchedule
+	users    *support.UserStore
+	instance string
+	state    support.SharedState
+	sessions *support.SessionStore
+	admin    support.Authenticator
+	audit    *support.AuditLog
+	alerts   *support.AlertLog
+	jobs     *support.Scheduler
+	leader   *support.Leader
+	uploads  *support.UploadStore
+	staged   *support.UploadSessions // Uploads sent in stages (see uploadsessions.go)
+	storage  storage.Backend
+	replica  storage.Backend // Second site for copies of uploads; nil if not replicating
+	replicas replicationCounts
+	upstream *upstream            // Server to forward uploads and checkins to; nil if not federated
+	outbox   *support.Journal     // Checkins waiting to be forwarded upstream; nil if not federated
+	cursors  *support.SyncCursors // How far each downstream server has forwarded its records
+	confirm  *support.Confirmations
+	registry *support.Registry
+	vessels  *support.VesselStore
+	ingest   *metrics.Ingest
+	retry    *support.Retrier
+	dead     *support.DeadLetterStore
+	suspect  *support.Quarantine // Refused checkins and uploads (see quarantine.go)
+	holds    *support.HoldStore
+	commands *support.CommandQueue
+	receipts *support.ReceiptSigner        // Nil if receipts aren't given
+	grants   *support.SessionIssuer        // Logger session tokens; nil if sessions aren't issued
+	ca       *support.CertificateAuthority // Signs logger client certificates; nil if not enrolling
+	pins     *support.PinSet
+	live     *support.LiveFeed
+	codes    *support.EnrolmentCodes // One-time codes for loggers to enrol themselves
+	publish  []metrics.Publisher
+	notifier notify.Multi
+	payloads map[string]notify.Multi // Notifiers for the other payload types, by name
+	routed   map[string]notify.Multi // Notifiers for the processing routes under test, by name
+	mock     *notify.Recorder        // Notifications that would have been sent, in mock mode only
+
+	ctx        context.Context    // Cancelled when the server shuts down
+	stop       context.CancelFunc // Cancels ctx
+	background sync.WaitGroup     // Background work started by handlers (e.g., notifications)
+	drain      drainState
+	ready      readiness
+	quota      quotaReservations // Space set aside for uploads in progress (see usage.go)
+}
+
+// Generate the application state from the configuration, loading any persistent state from
+// the state directory.
+func newApplication(config *support.Config) (*application, error) {
+	if err := os.MkdirAll(config.State.Directory, 0700); err != nil {
+		return nil, err
+	}
+	if config.State.Migrate {
+		if err := migrateState(config.State.Directory); err != nil {
+			return nil, err
+		}
+	} else if pending, err := support.PendingMigrations(config.State.Directory); err != nil {
+		return nil, err
+	} else if len(pending) > 0 {
+		return nil, fmt.Errorf("state directory needs %d migrations; apply them with the migrate command", len(pending))
+	}
+	if err := support.CheckFeatures(config.Features); err != nil {
+		return nil, err
+	}
+	tokens, err := openTokenStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("loading upload tokens: %w", err)
+	}
+	keyring, err := support.NewAdminKeyring(config.Admin.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("loading admin keys: %w", err)
+	}
+	users, err := openUserStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("loading admin users: %w", err)
+	}
+	state, err := support.NewSharedState(config.Shared)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to shared state: %w", err)
+	}
+	settings, err := support.NewSettingsStore(settingsFile(config), support.ConfigSettings(config))
+	if err != nil {
+		return nil, fmt.Errorf("loading run-time settings: %w", err)
+	}
+	sessions := support.NewSessionStore(state, time.Duration(config.Admin.SessionMinutes)*time.Minute)
+	uploads, err := support.NewUploadStore(filepath.Join(config.State.Directory, "uploads.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("loading upload history: %w", err)
+	}
+	staged, err := support.NewUploadSessions(filepath.Join(config.State.Directory, "upload-sessions.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("loading upload sessions: %w", err)
+	}
+	registry, err := support.NewRegistry(filepath.Join(config.State.Directory, "registry.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading logger registry: %w", err)
+	}
+	switch config.Processing.InjectMetadata {
+	case injectNone, injectFile, injectSidecar:
+	default:
+		return nil, fmt.Errorf("unknown platform metadata injection mode %q", config.Processing.InjectMetadata)
+	}
+	if len(config.Storage.Archive.Class) > 0 && config.Storage.Backend != "s3" && !config.Mock {
+		return nil, errors.New("files can only be archived with the s3 storage backend")
+	}
+	switch config.Upload.Naming {
+	case namingUUID, namingLogger:
+	default:
+		return nil, fmt.Errorf("unknown file naming scheme %q", config.Upload.Naming)
+	}
+	switch config.Storage.Layout {
+	case layoutFlat, layoutDate:
+	default:
+		return nil, fmt.Errorf("unknown storage layout %q", config.Storage.Layout)
+	}
+	if _, ok := config.Transfer.Profiles[config.Transfer.Default]; !ok {
+		return nil, fmt.Errorf("unknown default transfer profile %q", config.Transfer.Default)
+	}
+	if c := config.Storage.Compress; len(c) > 0 && c != storage.CompressZstd {
+		return nil, fmt.Errorf("unknown storage compression %q", c)
+	}
+	vessels, err := support.NewVesselStore(filepath.Join(config.State.Directory, "vessels.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading vessel records: %w", err)
+	}
+	audit, err := support.NewAuditLog(filepath.Join(config.State.Directory, "audit.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("loading audit trail: %w", err)
+	}
+	dead, err := support.NewDeadLetterStore(filepath.Join(config.State.Directory, "deadletters.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading dead letters: %w", err)
+	}
+	holds, err := support.NewHoldStore(filepath.Join(config.State.Directory, "holds.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading legal holds: %w", err)
+	}
+	codes, err := support.NewEnrolmentCodes(filepath.Join(config.State.Directory, "enrolcodes.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading enrolment codes: %w", err)
+	}
+	suspect, err := support.NewQuarantine(filepath.Join(config.State.Directory, "quarantine"))
+	if err != nil {
+		return nil, fmt.Errorf("loading quarantine: %w", err)
+	}
+	cursors, err := support.NewSyncCursors(filepath.Join(config.State.Directory, "federation.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading federation cursors: %w", err)
+	}
+	var receipts *support.ReceiptSigner
+	if config.Receipts.Enabled {
+		keyFile := config.Receipts.KeyFile
+		if len(keyFile) == 0 {
+			keyFile = filepath.Join(config.State.Directory, "receipt-key.pem")
+		}
+		if receipts, err = support.NewReceiptSigner(keyFile); err != nil {
+			return nil, fmt.Errorf("loading receipt signing key: %w", err)
+		}
+	}
+	var grants *support.SessionIssuer
+	if config.Sessions.Enabled {
+		keyFile := config.Sessions.KeyFile
+		if len(keyFile) == 0 {
+			keyFile = filepath.Join(config.State.Directory, "session-key")
+		}
+		lifetime := time.Duration(config.Sessions.LifetimeMinutes) * time.Minute
+		if grants, err = support.NewSessionIssuer(keyFile, lifetime); err != nil {
+			return nil, fmt.Errorf("loading session signing key: %w", err)
+		}
+	}
+	var ca *support.CertificateAuthority
+	if config.Enrollment.Enabled {
+		certFile, keyFile := config.Enrollment.CACert, config.Enrollment.CAKey
+		if len(certFile) == 0 {
+			certFile = "./certs/ca.crt"
+		}
+		if len(keyFile) == 0 {
+			keyFile = "./certs/ca.key"
+		}
+		if ca, err = support.LoadCertificateAuthority(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("loading logger CA: %w", err)
+		}
+	}
+	var notifier notify.Multi
+	var store storage.Backend
+	var recorder *notify.Recorder
+	if config.Mock {
+		support.Warnf("running in mock mode: files are kept in memory, and the processing chain is not notified.\n")
+		recorder = notify.NewRecorder(mockEvents)
+		notifier, store = notify.Multi{recorder}, storage.NewMemory()
+	} else {
+		if notifier, err = notify.New(config.Notify, config.AWS); err != nil {
+			return nil, fmt.Errorf("configuring notifications: %w", err)
+		}
+		if store, err = storage.New(config.Storage, config.AWS); err != nil {
+			return nil, fmt.Errorf("opening storage backend: %w", err)
+		}
+	}
+	store = storage.NewDecompressing(store)
+	replica, err := openReplica(config)
+	if err != nil {
+		return nil, fmt.Errorf("opening replication target: %w", err)
+	}
+	upstream, err := newUpstream(config.Federation)
+	if err != nil {
+		return nil, fmt.Errorf("configuring upstream server: %w", err)
+	}
+	var outbox *support.Journal
+	if upstream != nil {
+		outbox = support.NewJournal(filepath.Join(config.State.Directory, "federation-checkins.jsonl"))
+	}
+	payloads, err := payloadNotifiers(config, recorder)
+	if err != nil {
+		return nil, fmt.Errorf("configuring payload types: %w", err)
+	}
+	routes, err := routeNotifiers(config, recorder)
+	if err != nil {
+		return nil, fmt.Errorf("configuring processing routes: %w", err)
+	}
+	retry := support.NewRetrier(config.Retry)
+	notifier = notify.WithRetry(notifier, retry)
+	for name, n := range payloads {
+		payloads[name] = notify.WithRetry(n, retry)
+	}
+	for name, n := range routes {
+		routes[name] = notify.WithRetry(n, retry)
+	}
+	publishers, err := newPublishers(config)
+	if err != nil {
+		return nil, fmt.Errorf("configuring metrics: %w", err)
+	}
+	schedule, err := support.NewUploadSchedule(config.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	instance := instanceID()
+	leader := support.NewLeader(state, "jobs", instance, leaderLease)
+	jobs := support.NewScheduler(config.Jobs)
+	jobs.SetLeader(leader)
+	ctx, stop := context.WithCancel(context.Background())
+	app := &application{
+		ctx:      ctx,
+		stop:     stop,
+		config:   config,
+		settings: settings,
+		tokens:   tokens,
+		fleet:    support.NewFleetStatus(),
+		capture:  support.NewRequestCapture(config.Debug.CaptureRequests, config.Debug.CaptureBodyBytes),
+		record:   support.NewRequestRecorder(config.Debug.RecordFile, int64(config.Debug.RecordMaxMB)*1024*1024),
+		limit:    support.NewBandwidth(int64(config.Bandwidth.UploadKBps)*1024, int64(config.Bandwidth.TotalKBps)*1024),
+		slots:    newUploadSlots(config.API.MaxUploads),
+		schedule: schedule,
+		users:    users,
+		instance: instance,
+		state:    state,
+		sessions: sessions,
+		admin:    support.Authenticators{keyring, sessions},
+		audit:    audit,
+		alerts:   support.NewAlertLog(filepath.Join(config.State.Directory, "alerts.jsonl")),
+		jobs:     jobs,
+		leader:   leader,
+		uploads:  uploads,
+		staged:   staged,
+		storage:  store,
+		replica:  replica,
+		upstream: upstream,
+		outbox:   outbox,
+		cursors:  cursors,
+		confirm:  support.NewConfirmations(state, 5*time.Minute),
+		registry: registry,
+		vessels:  vessels,
+		notifier: notifier,
+		payloads: payloads,
+		routed:   routes,
+		ingest:   metrics.NewIngest(),
+		retry:    retry,
+		dead:     dead,
+		suspect:  suspect,
+		holds:    holds,
+		commands: support.NewCommandQueue(state),
+		receipts: receipts,
+		grants:   grants,
+		ca:       ca,
+		pins:     support.NewPinSet(config.API.NextCert),
+		live:     support.NewLiveFeed(config.Live),
+		codes:    codes,
+		publish:  publishers,
+		mock:     recorder,
+	}
+	return app, nil
+}
+
+// Generate the routing for all of the end-points that the server provides.
+func (app *application) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", syntax)
+	mux.HandleFunc("/checkin", support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.record.Middleware(app.capture.Middleware(
+		support.RateLimit(app.state, "checkin", app.checkinLimit, support.LoggerID, app.status_updates))))))
+	mux.HandleFunc("POST /beacon", support.LoggerAuth(app.tokens, app.grants, app.requireApproved(
+		support.RateLimit(app.state, "checkin", app.checkinLimit, support.LoggerID, app.beaconUpdate))))
+	mux.HandleFunc("/update", support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.requireUploadHours(app.requireType(app.limitSize(app.limitUploads(app.limit.Middleware(app.record.Middleware(
+		app.capture.Middleware(support.RateLimit(app.state, "upload", app.uploadLimit, support.LoggerID,
+			app.countUploads(app.file_transfer))))))))))))
+	mux.HandleFunc("PUT /v1/chunks/{id}/{index}", support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.requireFeature("resumable-uploads",
+		app.requireApproved(app.requireUploadHours(app.requireType(app.limitSize(app.limitUploads(app.limit.Middleware(support.RateLimit(app.state, "upload", app.uploadLimit, support.LoggerID,
+			app.countUploads(app.putChunk))))))))))))
+	mux.HandleFunc("GET /v1/chunks/{id}", support.LoggerAuth(app.tokens, app.grants, app.requireFeature("resumable-uploads", app.listChunks)))
+	mux.HandleFunc("POST /v1/chunks/{id}/assemble", support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.requireFeature("resumable-uploads",
+		app.requireApproved(app.limitUploads(app.countUploads(app.assembleChunks)))))))
+	mux.HandleFunc("POST /v1/uploads", support.LoggerAuth(app.tokens, app.grants, app.requireFeature("upload-sessions",
+		app.requireApproved(app.requireUploadHours(support.RateLimit(app.state, "upload", app.uploadLimit, support.LoggerID, app.beginSession))))))
+	mux.HandleFunc("GET /v1/uploads/{id}", support.LoggerAuth(app.tokens, app.grants, app.requireFeature("upload-sessions", app.getSession)))
+	mux.HandleFunc("PUT /v1/uploads/{id}", support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.requireFeature("upload-sessions",
+		app.requireApproved(app.limitUploads(app.limit.Middleware(app.countUploads(app.putSessionPart))))))))
+	mux.HandleFunc("POST /v1/uploads/{id}/commit", support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.requireFeature("upload-sessions",
+		app.requireApproved(app.limitUploads(app.countUploads(app.commitSession)))))))
+	mux.HandleFunc("DELETE /v1/uploads/{id}", support.LoggerAuth(app.tokens, app.grants, app.requireFeature("upload-sessions", app.abortSession)))
+	mux.HandleFunc("GET /v1/update/{md5}", support.LoggerAuth(app.tokens, app.grants,
+		support.RateLimit(app.state, "probe", app.uploadLimit, support.LoggerID, app.probeFile)))
+	mux.HandleFunc("POST "+validatePath, support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.requireType(app.limitSize(
+		app.limitUploads(app.limit.Middleware(support.RateLimit(app.state, "validate", app.uploadLimit, support.LoggerID, app.validateUpload))))))))
+	mux.HandleFunc("GET /v1/delta/files/{id}", support.LoggerAuth(app.tokens, app.grants, app.requireFeature("delta-transfer", app.limitUploads(app.deltaSignature))))
+	mux.HandleFunc("POST /v1/delta/{basis}", support.LoggerAuth(app.tokens, app.grants, app.transferDeadlines(app.requireFeature("delta-transfer",
+		app.requireApproved(app.requireUploadHours(app.requireType(app.limitSize(app.limitUploads(app.limit.Middleware(support.RateLimit(app.state, "upload", app.uploadLimit, support.LoggerID,
+			app.countUploads(app.deltaTransfer))))))))))))
+	mux.HandleFunc("POST /v1/live", support.LoggerAuth(app.tokens, app.grants, app.requireFeature("live-streaming", app.requireApproved(app.liveStream))))
+	mux.HandleFunc("POST "+renewPath, support.LoggerAuth(app.tokens, app.grants, app.renewToken))
+	mux.HandleFunc("POST /v1/enroll", support.LoggerAuth(app.tokens, app.grants, app.enroll))
+	mux.HandleFunc("GET /v1/enroll/ca", app.enrollCA)
+	mux.HandleFunc("POST /v1/register",
+		support.RateLimit(app.state, "register", app.loginLimit, support.RemoteHost, app.registerLogger))
+	mux.HandleFunc("POST /v1/auth/challenge",
+		support.RateLimit(app.state, "challenge", app.loginLimit, support.RemoteHost, app.issueChallenge))
+	mux.HandleFunc("POST /v1/auth/response",
+		support.RateLimit(app.state, "challenge", app.loginLimit, support.RemoteHost, app.checkChallenge))
+	mux.HandleFunc("POST /v1/gateway/sbd", app.sbdDelivery)
+	mux.HandleFunc("POST /v1/gateway/email", app.emailDelivery)
+	mux.HandleFunc("PUT /replica/v1/objects/{key...}", app.acceptReplica)
+	mux.HandleFunc("DELETE /replica/v1/objects/{key...}", app.deleteReplica)
+	mux.HandleFunc("POST /v1/federation/update", app.downstreamAuth(app.transferDeadlines(app.requireType(app.limitSize(app.limitUploads(
+		app.limit.Middleware(app.countUploads(app.file_transfer))))))))
+	mux.HandleFunc("POST /v1/federation/checkins", app.federatedCheckins)
+	mux.HandleFunc("GET /v1/federation/cursor", app.getSyncCursor)
+	mux.HandleFunc("PUT /v1/federation/cursor", app.setSyncCursor)
+	mux.HandleFunc("POST /v1/processing", app.reportOutcome)
+	mux.HandleFunc("POST /v1/processing/{uuid}", app.reportOutcome)
+	mux.HandleFunc("GET /v1/files", app.fileAuth(app.listFiles))
+	mux.HandleFunc("GET /v1/files/search", app.fileAuth(app.searchFiles))
+	mux.HandleFunc("GET /v1/files/{uuid}", app.fileAuth(app.downloadFile))
+	mux.HandleFunc("GET /v1/receipts/key", app.receiptKey)
+	mux.HandleFunc("POST /v1/receipts/verify", app.verifyReceipt)
+	mux.HandleFunc("GET /metrics", app.authorize(support.RoleViewer, app.metrics))
+	mux.HandleFunc("GET /version", app.versionInfo)
+	mux.HandleFunc("GET /healthz", healthz)
+	mux.HandleFunc("GET /readyz", app.readyz)
+	app.adminRoutes(mux)
+	return support.TrackErrors(app.closeWhenDraining(mux))
+}
+
+// The lease on leadership of the scheduled jobs, which is how long it takes another instance to take
+// over if the leader goes away without giving it up.
+const leaderLease = 30 * time.Second
+
+// Generate an identifier for this instance of the server, unique among those sharing state.
+func instanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "wibl-monitor"
+	}
+	return host + "-" + support.NewUUID()[:8]
+}
+
+// Open the admin user store in the state directory given in the configuration.
+func openUserStore(config *support.Config) (*support.UserStore, error) {
+	maxAge := time.Duration(config.Admin.PasswordMaxAgeDays) * 24 * time.Hour
+	return support.NewUserStore(filepath.Join(config.State.Directory, "users.json"), maxAge)
+}
+
+// Open the store of upload tokens in the state directory.
+func openTokenStore(config *support.Config) (*support.TokenStore, error) {
+	return support.NewTokenStore(filepath.Join(config.State.Directory, "tokens.json"),
+		time.Duration(config.Tokens.LifetimeDays)*24*time.Hour)
 }
 
 // Generate a list of the end-points that the server provides.
 func syntax(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "checkin\n")
+	fmt.Fprintf(w, "beacon\n")
 	fmt.Fprintf(w, "update\n")
+	fmt.Fprintf(w, "version\n")
+	fmt.Fprintf(w, "v1/update/validate\n")
 }
 
 // Accept a status message from the logger client (which should list all of the files on the logger,
-// along with other status information like the uptime, firmware version, etc.).  The server responds
-// with HTTP 200 (OK) if the status message parses according to the definition in support/config.go,
-// and HTTP 400 (Bad Request) if the body of the message fails to read or convert.  Any response should
-// be used by the client to indicate that the server exists.  More sophisticated implementations might
-// use the status information to update a local dB of logger status, health, etc.
-func status_updates(w http.ResponseWriter, r *http.Request) {
+// along with other status information like the uptime, firmware version, etc.).  The server
+// responds with HTTP 200 (OK) if the status message is an object, and HTTP 400 (Bad Request) if the
+// body of the message fails to read or isn't an object.  The status, and the response, may be CBOR
+// rather than JSON (see encoding.go).  Fields that the server doesn't know, or whose values don't
+// match the definition in api/api.go, are ignored, but recorded as warnings against the logger (see
+// statuswarnings.go) so that firmware can add to the status before the server catches up.  Any
+// response should be used by the client to indicate that the server exists.  The status is recorded
+// against the logger's identifier so that the fleet's state is available through the administration
+// API.  The body of a successful response is an object with "status" of "success", the "server"
+// version information (see version.go), a "quota" warning if the logger is approaching its storage
+// limit, and the "changes" since the logger's previous checkin (see changelog.go), if there were
+// any.  If the logger reports its time, the offset of its clock from the server's is also given
+// (see clock.go).  The "upload" window tells the logger when it should upload its files (see
+// hints.go).  A logger checking in far more often than it should is refused with HTTP 429 (Too Many
+// Requests) for a while (see flood.go).
+func (app *application) status_updates(w http.ResponseWriter, r *http.Request) {
+	received := time.Now().UTC()
 	var body []byte
 	var err error
 	var status api.Status
 
+	if wait, flooding := app.checkinFlood(support.LoggerID(r), received); flooding {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "checking in too often")
+		return
+	}
+
 	if body, err = io.ReadAll(r.Body); err != nil {
 		support.Errorf("API: failed to read POST body component: %s\n", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -135,74 +718,320 @@ func status_updates(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body.Close()
 
-	if err = json.Unmarshal(body, &status); err != nil {
+	warnings, err := decodeStatus(r, body, &status)
+	if err != nil {
 		support.Errorf("API: failed to unmarshall request: %s\n", err)
 		support.Errorf("API: body was |%s|\n", body)
+		app.quarantineCheckin(r, body, err.Error())
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	support.Infof("CHECKIN: status update from logger on IP %s with firmware %s, command processor %s, total %d files.\n",
-		status.Server.IPAddress, status.Versions.Firmware, status.Versions.CommandProcessor, status.Files.Count)
+	logger := support.LoggerID(r)
+	if len(status.Logger) > 0 && status.Logger != logger {
+		app.impersonation(logger, status.Logger, "status")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var since time.Time
+	var known []string
+	if previous, ok := app.fleet.Get(logger); ok {
+		since, known = previous.LastCheckin, previous.Warnings
+	}
+	var offset *float64
+	if status.Timestamp != nil {
+		drift := app.checkClock(logger, *status.Timestamp, received)
+		offset = &drift
+	}
+	app.fleet.Update(logger, r.RemoteAddr, status, offset)
+	app.fleet.SetWarnings(logger, warnings)
+	if len(warnings) > 0 && !slices.Equal(warnings, known) {
+		support.Warnf("CHECKIN: status from logger %s (firmware %s) has parts the server doesn't understand: %s.\n",
+			logger, status.Versions.Firmware, strings.Join(warnings, "; "))
+	}
+	app.checkFirmware(logger, status.Versions.Firmware)
+	app.queueCheckin(logger, r.RemoteAddr, received, status)
+
+	support.Infof("CHECKIN: status update from logger %s on IP %s with firmware %s, command processor %s, total %d files.\n",
+		logger, status.Server.IPAddress, status.Versions.Firmware, status.Versions.CommandProcessor, status.Files.Count)
+
+	response := api.CheckinResponse{Status: "success", Server: app.serverInfo(), Quota: app.checkQuota(logger),
+		Changes: app.uploadChangelog(logger, since), Clock: offset, Upload: app.uploadWindow(logger),
+		Commands: app.deliverCommands(logger), Token: app.tokenExpiry(r), Session: app.issueLoggerSession(r),
+		Pins: app.pins.Pins(), Transfer: app.transferAdvice(logger), Outcomes: app.outcomeNotices(logger, since)}
+	contentType, marshal := responseEncoding(r)
+	w.Header().Set("Content-Type", contentType)
+	if body, err = marshal(response); err != nil {
+		support.Errorf("API: failed to marshal response as %s for checkin: %s\n", contentType, err)
+		return
+	}
+	w.Write(body)
 }
 
-// Accept a file transfer from the logger client (which should contain a binary-encoded body
-// with the WIBL raw file).  The client must specify the Content-Length header, the Digest header
-// (with the MD5 hash of the contents of the body of the request), and the Authentication header
-// with type "Basic" and the upload token specified by the server's operator when the logger was
-// configured as a (very simple, and not terribly secure, identification mechanism).  The server
-// responds with a JSON body containing only a "status" tag with either "success" or "failure" as
-// appropriate.  Typical verification models would include checking the upload token from the
-// Authentication header is one of those that was pre-shared, recomputing the MD5 hash for the
-// payload and comparing it against that specified in the Digest header, etc.  A full implementation
-// of the server would take the payload body, then transfer it to the appropriate S3 bucket for
-// processing (using a UUID4 for the name), and finally trigger the SNS topic indicating that the
-// file was ready for processing.
-func file_transfer(w http.ResponseWriter, r *http.Request) {
+// Headers that carry credentials, and so aren't logged with the rest of a request.
+var redactedHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true}
+
+// Accept a file transfer from the logger client (which should contain a binary-encoded body with
+// the WIBL raw file).  The client must specify the Content-Length header, the Digest header (with
+// the MD5 hash of the contents of the body of the request, or one of the alternatives in
+// support/digest.go), and the Authentication header with type "Basic" and the upload token
+// specified by the server's operator when the logger was configured as a (very simple, and not
+// terribly secure, identification mechanism).  The server responds with a JSON body containing only
+// a "status" tag with either "success" or "failure" as appropriate.  Typical verification models
+// would include checking the upload token from the Authentication header is one of those that was
+// pre-shared, recomputing the MD5 hash for the payload and comparing it against that specified in
+// the Digest header, etc.  Accepted files are written to the configured storage backend (using a
+// UUID4 for the name), and recorded in the upload history.  The processing chain is then notified
+// (see processing.go) that the file is ready for processing.  Repeats of a file that has already
+// been accepted are acknowledged without being stored again (see idempotency.go).
+
+func (app *application) file_transfer(w http.ResponseWriter, r *http.Request) {
 	var body []byte
 	var err error
 	var result api.TransferResult
 
 	support.Infof("TRANS: File transfer request with headers:\n")
 	for k, v := range r.Header {
+		if redactedHeaders[k] {
+			v = []string{"(redacted)"}
+		}
 		support.Infof("TRANS:    %s = %s\n", k, v)
 	}
 	if body, err = io.ReadAll(r.Body); err != nil {
+		if app.tooLarge(w, r, err) {
+			return
+		}
 		support.Errorf("API: failed to read file body from POST: %s.\n", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	r.Body.Close()
 	support.Infof("TRANS: File from logger with %d bytes in body.\n", len(body))
-	md5digest := r.Header.Get("Digest")
-	if len(md5digest) == 0 {
+	record := support.UploadRecord{
+		UUID:     support.NewUUID(),
+		Logger:   support.LoggerID(r),
+		Received: time.Now().UTC(),
+		Remote:   r.RemoteAddr,
+		Size:     int64(len(body)),
+	}
+	record.Type, _ = app.payloadType(r)
+	record.KeyID, _ = app.encryptionKey(r)
+	record.Trace, record.Correlation = newTraceID(), requestCorrelation(r)
+	record.MD5 = fmt.Sprintf("%X", md5.Sum(body))
+	record.FileID = app.reportedFileID(r, record.Logger, record.MD5)
+	algorithm, err := support.CheckDigest(r.Header.Get("Digest"), body)
+	if algorithm != "md5" {
+		record.Digest = algorithm
+	}
+	if errors.Is(err, support.ErrNoDigest) {
 		support.Errorf("API: no digest in headers for file transfer.\n")
+		app.recordUpload(record, support.UploadRejected, err.Error())
+		app.quarantineUpload(record, body, err.Error())
 		w.WriteHeader(http.StatusBadRequest)
 		return
+	} else if err != nil {
+		support.Errorf("API: digest %q sent from logger doesn't check (%s).\n", r.Header.Get("Digest"), err)
+		app.recordUpload(record, support.UploadRejected, err.Error())
+		app.quarantineUpload(record, body, err.Error())
+		if errors.Is(err, support.ErrDigestMismatch) {
+			app.resendFailed(record.Logger, support.ClaimedMD5(r.Header.Get("Digest")), "upload did not match its digest")
+		}
+		result.Status = "failure"
 	} else {
-		md5digest = strings.Split(md5digest, "=")[1]
-		support.Infof("TRANS: MD5 Digest |%s|\n", md5digest)
-	}
-	md5hash := fmt.Sprintf("%X", md5.Sum(body))
-	if md5hash != md5digest {
-		support.Errorf("API: recomputed MD5 digest doesn't match that sent from logger (%s != %s).\n",
-			md5digest, md5hash)
+		support.Infof("TRANS: successful recomputation of %s digest for transmitted contents.\n", algorithm)
+		status, receipt, ok := app.acceptUpload(r.Context(), record, body)
+		if !ok {
+			if refused, found := app.uploads.Get(record.UUID); found {
+				result.Reason = refused.Reason
+			}
+		}
+		if status != http.StatusOK {
+			if len(result.Reason) > 0 {
+				http.Error(w, result.Reason, status)
+			} else {
+				w.WriteHeader(status)
+			}
+			return
+		}
 		result.Status = "failure"
+		if ok {
+			result.Status = "success"
+			result.Receipt = receipt
+		}
+	}
+	result.Trace = app.uploadTrace(record)
+	app.writeTransferResult(w, result)
+}
+
+// Accept a file whose digest has been checked (record.MD5), storing it if it isn't a repeat of a file
+// already accepted and the logger has quota for it, and then notifying the processing chain.  The
+// result is true if the file was accepted (or was a repeat), in which case the receipt for it is
+// given, if receipts are signed; the HTTP status is StatusOK unless the logger has to be told something
+// other than the result (i.e., that the same file is being uploaded already, or that the file claims
+// to come from another logger).
+func (app *application) acceptUpload(ctx context.Context, record support.UploadRecord, body []byte) (int, *api.Receipt, bool) {
+	if len(record.Trace) == 0 {
+		record.Trace = newTraceID()
+	}
+	if entry, ok := app.registry.Get(record.Logger); ok && entry.Pending {
+		support.Warnf("TRANS: refusing file from logger %s, which is awaiting approval.\n", record.Logger)
+		app.recordUpload(record, support.UploadRejected, "logger awaiting approval")
+		return http.StatusForbidden, nil, false
+	}
+	if err := app.checkPayload(record.Type, record.KeyID, body); err != nil {
+		support.Warnf("TRANS: refusing file from logger %s (%s).\n", record.Logger, err)
+		app.recordUpload(record, support.UploadRejected, err.Error())
+		app.quarantineUpload(record, body, err.Error())
+		return http.StatusOK, nil, false
+	}
+	previous, err := app.startUpload(record.Logger, record.MD5)
+	if err != nil {
+		support.Warnf("TRANS: %s for file from logger %s with digest %s.\n", err, record.Logger, record.MD5)
+		return http.StatusConflict, nil, false
+	}
+	if len(previous) > 0 {
+		support.Infof("TRANS: file repeats upload %s, which was accepted; not storing again.\n", previous)
+		original, _ := app.uploads.Get(previous)
+		return http.StatusOK, original.Receipt, true
+	}
+	defer app.finishUpload(record.Logger, record.MD5, &record)
+	if len(record.Type) == 0 && len(record.KeyID) == 0 {
+		if record.Metadata, err = wibl.Extract(body); err != nil {
+			support.Warnf("TRANS: failed to extract metadata from file: %s\n", err)
+		} else if claimed := record.Metadata.Logger; len(claimed) > 0 && claimed != record.Logger {
+			app.impersonation(record.Logger, claimed, "file "+record.UUID)
+			app.recordUpload(record, support.UploadRejected, "logger identity mismatch")
+			return http.StatusForbidden, nil, false
+		}
+	}
+	release, ok := app.reserveQuota(record.Logger, 0, record.Size)
+	if !ok {
+		app.recordUpload(record, support.UploadRejected, "quota exceeded")
+		return http.StatusOK, nil, false
+	}
+	defer release()
+	if route, ok := app.chooseRoute(record); ok && len(record.Type) == 0 {
+		record.Route = route.Name
+	}
+	record.Key = app.payloadKey(record)
+	metadata := map[string]string{"uuid": record.UUID, "logger": record.Logger, "md5": record.MD5, "trace": record.Trace}
+	if len(record.Correlation) > 0 {
+		metadata["correlation"] = record.Correlation
+	}
+	if len(record.Route) > 0 {
+		metadata["route"] = record.Route
+	}
+	if record.Vessel = app.vesselFor(record.Logger); record.Vessel != nil {
+		metadata["vessel"] = record.Vessel.ID
+	}
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	data := body
+	if len(record.Type) == 0 {
+		data = app.injectPlatform(ctx, &record, body)
 	} else {
-		support.Infof("TRANS: successful recomputation of MD5 hash for transmitted contents.\n")
-		result.Status = "success"
-		// TODO: Further transfer of the file:
-		//    1. Make a UUID for the transferred data.
-		//    2. Store the received data into the appropriate S3 bucket for the current instance
-		//       with the UUID.wibl extension.
-		//    3. Trigger SNS topic for new file arrival.
+		metadata["type"] = record.Type
+	}
+	if len(record.KeyID) > 0 {
+		metadata["key_id"] = record.KeyID
 	}
+	if record.FileID != nil {
+		metadata["file_id"] = strconv.FormatUint(uint64(*record.FileID), 10)
+	}
+	if algorithm := app.config.Storage.Compress; len(algorithm) > 0 {
+		if data, metadata, err = storage.Compress(algorithm, data, metadata); err != nil {
+			support.Errorf("API: failed to compress %s: %s\n", record.Key, err)
+			app.discardStored(&record)
+			app.recordUpload(record, support.UploadRejected, "storage failure")
+			return http.StatusOK, nil, false
+		}
+		record.Compress = algorithm
+	}
+	if err = app.putObject(ctx, record.Key, data, metadata); err != nil {
+		support.Errorf("API: failed to store %s: %s\n", record.Key, err)
+		app.ingest.Failure()
+		app.discardStored(&record)
+		reason := "storage failure"
+		if ctx.Err() != nil {
+			reason = "storage cancelled"
+		}
+		app.recordUpload(record, support.UploadRejected, reason)
+		app.resendFailed(record.Logger, record.MD5, reason)
+		return http.StatusOK, nil, false
+	}
+	support.Infof("TRANS: stored file as %s.\n", record.Key)
+	record.State = support.StateStored
+	if app.receipts != nil {
+		receipt := app.receipts.Sign(record)
+		record.Receipt = &receipt
+	}
+	app.recordUpload(record, support.UploadAccepted, "")
+	app.checkQuota(record.Logger)
+	app.background.Add(1)
+	go func() {
+		defer app.background.Done()
+		app.notifyStored(record)
+	}()
+	return http.StatusOK, record.Receipt, true
+}
+
+// Store an object, retrying if the backend fails (see support/retry.go).
+func (app *application) putObject(ctx context.Context, key string, data []byte, metadata map[string]string) error {
+	return app.retry.Do(ctx, "storage.put", func(ctx context.Context) error {
+		return app.storage.Put(ctx, key, data, metadata)
+	})
+}
+
+// Report a logger that has sent something claiming to come from another logger.
+func (app *application) impersonation(logger, claimed, what string) {
+	support.Warnf("API: logger %s sent %s claiming to be from logger %s; refusing it.\n", logger, what, claimed)
+	app.alerts.Raise("identity", logger, fmt.Sprintf("sent %s claiming to be from logger %s", what, claimed))
+}
+
+// Send the result of a file transfer to the logger.
+func (app *application) writeTransferResult(w http.ResponseWriter, result api.TransferResult) {
 	w.Header().Set("Content-Type", "application/json")
-	var result_string []byte
-	if result_string, err = json.Marshal(result); err != nil {
+	result_string, err := json.Marshal(result)
+	if err != nil {
 		support.Errorf("API: failed to marshal response as JSON for file upload: %s\n", err)
 		return
 	}
 	support.Infof("TRANS: sending |%s| to logger as response.\n", result_string)
 	w.Write(result_string)
 }
+
+// Remove anything stored for an upload that couldn't be completed (e.g., the platform metadata
+// sidecar, or an object that was written just as the request was cancelled), so that partial
+// uploads don't leak into storage.  This has to happen even if the request was cancelled, so it
+// doesn't use the request's context.
+func (app *application) discardStored(record *support.UploadRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	for _, key := range []string{record.Key, record.Sidecar} {
+		if len(key) == 0 {
+			continue
+		}
+		if err := app.storage.Delete(ctx, key); err != nil {
+			support.Errorf("API: failed to remove %s after failed upload: %s\n", key, err)
+		}
+	}
+	record.Key = ""
+	record.Sidecar = ""
+	record.Stored = ""
+}
+
+// Add an upload attempt to the upload history, with the outcome given.
+func (app *application) recordUpload(record support.UploadRecord, status, reason string) {
+	if len(record.Trace) == 0 {
+		record.Trace = newTraceID()
+	}
+	record.Status = status
+	record.Reason = reason
+	app.ingest.Upload(status == support.UploadAccepted, record.Size)
+	if err := app.uploads.Put(record); err != nil {
+		support.Errorf("API: failed to record upload %s in history: %s\n", record.UUID, err)
+	}
+	if status == support.UploadAccepted {
+		app.audit.Record(record.Logger, record.Remote, "upload.accept", record.UUID, fmt.Sprintf("%s, %d bytes", record.MD5, record.Size))
+	}
+}